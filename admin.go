@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoshuaDoes/json"
+)
+
+const (
+	adminMaxBodyBytes = 64 << 10 //The largest admin request body to accept
+)
+
+//AdminLobby describes any lobby, public or not, to operators
+type AdminLobby struct {
+	RoomCode     string         `json:"roomCode"`
+	Public       bool           `json:"public"`
+	OwnerSteamID uint64         `json:"ownerSteamID,string"`
+	MaxPlayers   int            `json:"maxPlayers"`
+	MaxHealth    float32        `json:"maxHealth"`
+	Level        string         `json:"level"`
+	Levels       int            `json:"levels"` //The amount of maps in the rotation, which a map is picked from by index
+	GameMode     string         `json:"gameMode"`
+	NextGameMode string         `json:"nextGameMode"`
+	Created      time.Time      `json:"created"`
+	InFight      bool           `json:"inFight"`
+	Clients      []*AdminClient `json:"clients"`
+}
+
+//AdminClient describes a client or spectator in a lobby to operators
+type AdminClient struct {
+	SteamID       uint64  `json:"steamID,string"`
+	Username      string  `json:"username"`
+	Addr          string  `json:"addr"`
+	PlayerIndexes []int   `json:"playerIndexes"`
+	Spectator     bool    `json:"spectator"`
+	Disconnected  bool    `json:"disconnected"` //If its slot is being held for it to reconnect
+	PingInMs      float64 `json:"ping"`
+}
+
+//AdminLobbies is the answer to GET /admin/lobbies
+type AdminLobbies struct {
+	Lobbies []*AdminLobby `json:"lobbies"`
+}
+
+//AdminResult is the answer to an admin action that has nothing else to say
+type AdminResult struct {
+	Result string `json:"result"`
+}
+
+//Admin returns the lobby as operators see it, or nil if it closed, and must only be called from the event loop
+func (lobby *Lobby) Admin() *AdminLobby {
+	if !lobby.IsRunning() {
+		return nil
+	}
+
+	view := &AdminLobby{
+		RoomCode:     lobby.LobbyRoomCode,
+		Public:       lobby.Public,
+		OwnerSteamID: lobby.LobbyOwner.ID,
+		MaxPlayers:   lobby.MaxPlayers,
+		MaxHealth:    lobby.GetMaxHealth(),
+		Levels:       len(lobby.Levels),
+		GameMode:     GameModeName(lobby.GameMode),
+		NextGameMode: GameModeName(lobby.NextGameMode),
+		Created:      lobby.LobbyCreationTime,
+		InFight:      lobby.MatchInProgress(),
+		Clients:      make([]*AdminClient, 0, len(lobby.Clients)+len(lobby.Spectators)),
+	}
+	if lobby.CurrentLevel != nil {
+		view.Level = lobby.CurrentLevel.String()
+	}
+	for _, clients := range [][]*Client{lobby.Clients, lobby.Spectators} {
+		for _, client := range clients {
+			adminClient := &AdminClient{
+				SteamID:       client.SteamID.ID,
+				Addr:          client.Addr.String(),
+				PlayerIndexes: make([]int, 0, len(client.Players)),
+				Spectator:     lobby.IsSpectator(client),
+				Disconnected:  client.Disconnected,
+				PingInMs:      client.PingInMs,
+			}
+			for _, player := range client.Players {
+				adminClient.PlayerIndexes = append(adminClient.PlayerIndexes, player.Index)
+			}
+			view.Clients = append(view.Clients, adminClient)
+		}
+	}
+	return view
+}
+
+//adminView returns a lobby as operators see it with every username filled in, or nil if it closed
+func adminView(lobby *Lobby) *AdminLobby {
+	var view *AdminLobby
+	lobby.Invoke(func() {
+		view = lobby.Admin()
+	})
+	if view == nil {
+		return nil
+	}
+
+	for _, client := range view.Clients {
+		client.Username = NewCSteamID(client.SteamID).GetUsername() //Outside of the event loop, as it may have to ask Steam
+	}
+	return view
+}
+
+//AuditEntry records an admin request and how it was answered
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Query  string    `json:"query,omitempty"`
+	Body   string    `json:"body,omitempty"` //Only kept once the request is authorized
+	Status int       `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+//AuditLog records every admin request to the log, and as JSON lines to a file if it's given one
+type AuditLog struct {
+	sync.Mutex
+	file io.WriteCloser
+}
+
+//Open appends every admin request recorded from now on to the file at the path
+func (audit *AuditLog) Open(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	audit.Lock()
+	defer audit.Unlock()
+	audit.file = file
+	return nil
+}
+
+//Record records an admin request
+func (audit *AuditLog) Record(entry *AuditEntry) {
+	target := entry.Path
+	if entry.Query != "" {
+		target += "?" + entry.Query
+	}
+	if entry.Error != "" {
+		log.Warn("Admin ", entry.Remote, " ", entry.Method, " ", target, " ", entry.Body, ": ", entry.Status, " ", entry.Error)
+	} else {
+		log.Info("Admin ", entry.Remote, " ", entry.Method, " ", target, " ", entry.Body, ": ", entry.Status)
+	}
+
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.file == nil {
+		return
+	}
+	data, err := json.Marshal(entry, false)
+	if err == nil {
+		_, err = audit.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		log.Error("Unable to write audit log: ", err)
+	}
+}
+
+//Close stops recording admin requests to the file
+func (audit *AuditLog) Close() error {
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.file == nil {
+		return nil
+	}
+	err := audit.file.Close()
+	audit.file = nil
+	return err
+}
+
+//handleAdmin routes the admin API, which only answers requests that carry the token as a bearer token
+func (api *API) handleAdmin(token string) {
+	api.Handle(http.MethodGet, "/admin/lobbies", api.admin(token, api.adminLobbies))
+	api.Handle(http.MethodPost, "/admin/lobbies", api.admin(token, api.adminCreateLobby))
+	api.Handle(http.MethodPatch, "/admin/lobbies", api.admin(token, api.adminUpdateLobby))
+	api.Handle(http.MethodDelete, "/admin/lobbies", api.admin(token, api.adminCloseLobby))
+	api.Handle(http.MethodPost, "/admin/kick", api.admin(token, api.adminKick))
+	api.Handle(http.MethodPost, "/admin/move", api.admin(token, api.adminMove))
+	api.Handle(http.MethodPost, "/admin/announce", api.admin(token, api.adminAnnounce))
+}
+
+//admin wraps an admin handler so that it only answers requests that carry the token, and audits every request however it's answered
+func (api *API) admin(token string, handler apiHandler) apiHandler {
+	return func(r *http.Request) (value interface{}, err error) {
+		entry := &AuditEntry{
+			Time:   time.Now(),
+			Remote: r.RemoteAddr,
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+			Status: http.StatusOK,
+		}
+		defer func() {
+			p := recover()
+			switch {
+			case p != nil:
+				entry.Status, entry.Error = http.StatusInternalServerError, "internal error"
+			case err != nil:
+				entry.Status, entry.Error = http.StatusInternalServerError, err.Error()
+				if apiErr, ok := err.(*apiError); ok {
+					entry.Status = apiErr.Status
+				}
+			}
+			api.Audit.Record(entry)
+			if p != nil {
+				panic(p) //For ServeHTTP to recover from
+			}
+		}()
+
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) != 1 {
+			return nil, apiErrorf(http.StatusUnauthorized, "unauthorized")
+		}
+
+		//Read up front, so that the audit has it no matter how the handler answers
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, adminMaxBodyBytes+1))
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "unable to read request: %v", err)
+		}
+		if len(body) > adminMaxBodyBytes {
+			return nil, apiErrorf(http.StatusRequestEntityTooLarge, "request is over %d bytes", adminMaxBodyBytes)
+		}
+		entry.Body = string(body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		return handler(r)
+	}
+}
+
+//decodeAdminRequest decodes the JSON body of an admin request into the value
+func decodeAdminRequest(r *http.Request, value interface{}) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, value)
+	}
+	if err != nil {
+		return apiErrorf(http.StatusBadRequest, "malformed request: %v", err)
+	}
+	return nil
+}
+
+//adminLobby returns the running lobby with the room code in the request's code query parameter
+func (api *API) adminLobby(r *http.Request) (*Lobby, error) {
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		return nil, apiErrorf(http.StatusBadRequest, "code is required")
+	}
+	lobby := api.Server.GetLobbyByCode(code)
+	if lobby == nil {
+		return nil, apiErrorf(http.StatusNotFound, "lobby %s not found", code)
+	}
+	return lobby, nil
+}
+
+//adminLobbies answers with every lobby, public or not, sorted by room code
+func (api *API) adminLobbies(r *http.Request) (interface{}, error) {
+	views := make([]*AdminLobby, 0)
+	for _, lobby := range api.Server.GetLobbies() {
+		if view := adminView(lobby); view != nil {
+			views = append(views, view)
+		}
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].RoomCode < views[j].RoomCode
+	})
+	return &AdminLobbies{Lobbies: views}, nil
+}
+
+//adminCreateLobby creates an empty lobby, with a random room code unless it's given one, which stays open until it's closed
+func (api *API) adminCreateLobby(r *http.Request) (interface{}, error) {
+	request := &struct {
+		RoomCode string `json:"roomCode"`
+		Public   bool   `json:"public"`
+	}{}
+	if err := decodeAdminRequest(r, request); err != nil {
+		return nil, err
+	}
+
+	lobby, err := NewLobby(api.Server, request.RoomCode)
+	if err != nil {
+		return nil, apiErrorf(http.StatusServiceUnavailable, "unable to create lobby: %v", err)
+	}
+	lobby.Invoke(func() {
+		lobby.Public = request.Public
+	})
+	if !api.Server.LobbyAddIfAbsent(lobby) { //Checked as it's added, so two requests for one room code can't both get it
+		lobby.Invoke(lobby.Close)
+		return nil, apiErrorf(http.StatusConflict, "lobby %s exists", lobby.LobbyRoomCode)
+	}
+
+	return adminView(lobby), nil
+}
+
+//adminLobbyUpdate changes a lobby's settings, leaving alone any that aren't given
+type adminLobbyUpdate struct {
+	Map        *int     `json:"map"` //The index of a map in the rotation to change to right away, or -1 for a random one
+	GameMode   *string  `json:"gameMode"`
+	MaxHealth  *float32 `json:"health"`
+	MaxPlayers *int     `json:"maxPlayers"`
+	Public     *bool    `json:"public"`
+}
+
+//Apply changes the lobby's settings, or none of them if any is invalid, and must only be called from the event loop
+func (update *adminLobbyUpdate) Apply(lobby *Lobby) error {
+	var gameMode GameMode
+	if update.GameMode != nil {
+		if gameMode = ParseGameMode(*update.GameMode, lobby.GetPlayerCount(false)); gameMode == nil {
+			return apiErrorf(http.StatusBadRequest, "unknown gamemode %s", *update.GameMode)
+		}
+	}
+	if update.MaxHealth != nil {
+		valid := false
+		for _, health := range lobbyHealths {
+			valid = valid || health == *update.MaxHealth
+		}
+		if !valid {
+			return apiErrorf(http.StatusBadRequest, "health must be one of %v", lobbyHealths)
+		}
+	}
+	if update.MaxPlayers != nil {
+		if err := lobby.CheckMaxPlayers(*update.MaxPlayers); err != nil {
+			return apiErrorf(http.StatusBadRequest, "maxPlayers: %s", err)
+		}
+	}
+	if update.Map != nil && (*update.Map < -1 || *update.Map >= len(lobby.Levels)) {
+		return apiErrorf(http.StatusBadRequest, "map must be from 0 to %d, or -1 for random", len(lobby.Levels)-1)
+	}
+
+	if gameMode != nil {
+		lobby.NextGameMode = gameMode
+	}
+	if update.MaxHealth != nil {
+		lobby.SetMaxHealth(*update.MaxHealth)
+	}
+	if update.MaxPlayers != nil {
+		lobby.MaxPlayers = *update.MaxPlayers
+	}
+	if update.Public != nil {
+		lobby.Public = *update.Public
+	}
+	if update.Map != nil {
+		lobby.ChangeMap(*update.Map, 255)
+	}
+	return nil
+}
+
+//adminUpdateLobby changes a lobby's settings, where the gamemode and health take effect from the next match
+func (api *API) adminUpdateLobby(r *http.Request) (interface{}, error) {
+	lobby, err := api.adminLobby(r)
+	if err != nil {
+		return nil, err
+	}
+	update := &adminLobbyUpdate{}
+	if err := decodeAdminRequest(r, update); err != nil {
+		return nil, err
+	}
+
+	err = apiErrorf(http.StatusNotFound, "lobby %s closed", lobby.LobbyRoomCode) //Unless it's still running to say otherwise
+	lobby.Invoke(func() {
+		err = update.Apply(lobby)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return adminView(lobby), nil
+}
+
+//adminCloseLobby closes a lobby, telling everyone in it the reason query parameter if there is one
+func (api *API) adminCloseLobby(r *http.Request) (interface{}, error) {
+	lobby, err := api.adminLobby(r)
+	if err != nil {
+		return nil, err
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "closed by an admin"
+	}
+
+	lobby.Invoke(func() {
+		lobby.CloseWithReason(reason)
+	})
+	return &AdminResult{Result: fmt.Sprintf("closed lobby %s", lobby.LobbyRoomCode)}, nil
+}
+
+//adminKick kicks a client or spectator from whichever lobby it's in
+func (api *API) adminKick(r *http.Request) (interface{}, error) {
+	request := &struct {
+		SteamID uint64 `json:"steamID,string"`
+		Reason  string `json:"reason"`
+	}{}
+	if err := decodeAdminRequest(r, request); err != nil {
+		return nil, err
+	}
+	if request.Reason == "" {
+		request.Reason = "kicked by an admin"
+	}
+
+	lobby, _ := api.Server.Registry.GetBySteamID(request.SteamID)
+	if lobby == nil || !lobby.IsRunning() {
+		return nil, apiErrorf(http.StatusNotFound, "client %d not found", request.SteamID)
+	}
+	lobby.Invoke(func() {
+		lobby.KickClientBySteamID(request.SteamID, request.Reason)
+	})
+	return &AdminResult{Result: fmt.Sprintf("kicked client %d from lobby %s", request.SteamID, lobby.LobbyRoomCode)}, nil
+}
+
+//adminMove moves a client or spectator into another lobby, inviting it there if it has to be
+func (api *API) adminMove(r *http.Request) (interface{}, error) {
+	request := &struct {
+		SteamID  uint64 `json:"steamID,string"`
+		RoomCode string `json:"roomCode"`
+	}{}
+	if err := decodeAdminRequest(r, request); err != nil {
+		return nil, err
+	}
+
+	lobby, client := api.Server.Registry.GetBySteamID(request.SteamID)
+	if lobby == nil || !lobby.IsRunning() {
+		return nil, apiErrorf(http.StatusNotFound, "client %d not found", request.SteamID)
+	}
+	dstLobby := api.Server.GetLobbyByCode(request.RoomCode)
+	if dstLobby == nil {
+		return nil, apiErrorf(http.StatusNotFound, "lobby %s not found", request.RoomCode)
+	}
+	if dstLobby == lobby {
+		return nil, apiErrorf(http.StatusConflict, "client %d is already in lobby %s", request.SteamID, request.RoomCode)
+	}
+
+	dstLobby.Invoke(func() {
+		dstLobby.Invited = append(dstLobby.Invited, client.SteamID)
+	})
+	if err := lobby.MoveClient(client, dstLobby); err != nil {
+		return nil, apiErrorf(http.StatusConflict, "unable to move client %d: %v", request.SteamID, err)
+	}
+	return &AdminResult{Result: fmt.Sprintf("moved client %d from lobby %s to lobby %s", request.SteamID, lobby.LobbyRoomCode, dstLobby.LobbyRoomCode)}, nil
+}
+
+//adminAnnounce says something to a lobby, or to every lobby if it's not given a room code
+//The game has no server messages, so it's spoken by the first connected player in each lobby, and lobbies without one don't hear it
+func (api *API) adminAnnounce(r *http.Request) (interface{}, error) {
+	request := &struct {
+		RoomCode string `json:"roomCode"`
+		Message  string `json:"message"`
+	}{}
+	if err := decodeAdminRequest(r, request); err != nil {
+		return nil, err
+	}
+	if request.Message == "" {
+		return nil, apiErrorf(http.StatusBadRequest, "message is required")
+	}
+
+	lobbies := api.Server.GetLobbies()
+	if request.RoomCode != "" {
+		lobby := api.Server.GetLobbyByCode(request.RoomCode)
+		if lobby == nil {
+			return nil, apiErrorf(http.StatusNotFound, "lobby %s not found", request.RoomCode)
+		}
+		lobbies = []*Lobby{lobby}
+	}
+
+	announced := 0
+	for _, lobby := range lobbies {
+		lobby.Invoke(func() {
+			if lobby.IsRunning() {
+				if lobby.Announce("%s", request.Message) {
+					announced++
+				}
+			}
+		})
+	}
+	return &AdminResult{Result: fmt.Sprintf("announced to %d lobbies", announced)}, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoshuaDoes/json"
+)
+
+const testAdminToken = "hunter2"
+
+//newAdminTestServer returns a test server whose API serves the admin routes
+func newAdminTestServer(t *testing.T) *testServer {
+	defaultToken := adminToken
+	adminToken = testAdminToken
+	t.Cleanup(func() { adminToken = defaultToken })
+
+	return newTestServer(t)
+}
+
+//adminRequest answers an admin request with the test server's API, and decodes the JSON response into the value if it's given one
+func adminRequest(t *testing.T, ts *testServer, method, target string, body string, value interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return apiServe(t, ts, r, value)
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	if w := apiRequest(t, newTestServer(t), http.MethodGet, "/admin/lobbies", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("/admin/lobbies answered with %d without an admin token configured", w.Code)
+	}
+
+	ts := newAdminTestServer(t)
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "audit.log")
+	if err := ts.API.Audit.Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong", testAdminToken} {
+		r := httptest.NewRequest(http.MethodPost, "/admin/lobbies", strings.NewReader(`{"roomCode":"SNEAKY"}`))
+		r.Header.Set("Authorization", authorization)
+		if w := apiServe(t, ts, r, nil); w.Code != http.StatusUnauthorized {
+			t.Fatalf("/admin/lobbies answered with %d to authorization %q", w.Code, authorization)
+		}
+	}
+	if ts.GetLobbyByCode("SNEAKY") != nil {
+		t.Fatal("unauthorized request created a lobby")
+	}
+	adminRequest(t, ts, http.MethodPost, "/admin/lobbies", `{"roomCode":"ADMIN1"}`, nil)
+
+	//Every request is audited, but only the authorized one's body
+	ts.API.Audit.Close()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("audited %d requests, expected 4:\n%s", len(lines), data)
+	}
+	for i, line := range lines {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal([]byte(line), entry); err != nil {
+			t.Fatalf("malformed audit entry %q: %v", line, err)
+		}
+		if i < 3 && (entry.Status != http.StatusUnauthorized || entry.Body != "") {
+			t.Errorf("audited unauthorized request as %+v", entry)
+		}
+		if i == 3 && (entry.Status != http.StatusOK || entry.Path != "/admin/lobbies" || !strings.Contains(entry.Body, "ADMIN1")) {
+			t.Errorf("audited authorized request as %+v", entry)
+		}
+	}
+}
+
+func TestAdminLobbies(t *testing.T) {
+	ts := newAdminTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	ts.Join(76561190000000003) //Alone in a lobby that isn't public, which admins still see
+	code := ts.Lobby(host).LobbyRoomCode
+
+	lobbies := &AdminLobbies{}
+	if w := adminRequest(t, ts, http.MethodGet, "/admin/lobbies", "", lobbies); w.Code != http.StatusOK {
+		t.Fatalf("/admin/lobbies answered with %d", w.Code)
+	}
+	if len(lobbies.Lobbies) != 2 {
+		t.Fatalf("/admin/lobbies listed %d lobbies, expected every lobby", len(lobbies.Lobbies))
+	}
+
+	view := &AdminLobby{}
+	w := adminRequest(t, ts, http.MethodPatch, "/admin/lobbies?code="+code, `{"gameMode":"duel","health":25,"maxPlayers":8}`, view)
+	if w.Code != http.StatusOK || view.NextGameMode != "Duel" || view.MaxHealth != 25 || view.MaxPlayers != 8 || len(view.Clients) != 2 {
+		t.Fatalf("PATCH /admin/lobbies answered with %d %+v", w.Code, view)
+	}
+	for _, update := range []string{`{"health":42}`, `{"gameMode":"chess"}`, `{"maxPlayers":0}`, `{"maxPlayers":256}`, `{"maxPlayers":1}`, `{"maxPlayers":2,"map":9999}`} {
+		if w := adminRequest(t, ts, http.MethodPatch, "/admin/lobbies?code="+code, update, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("PATCH /admin/lobbies %s answered with %d", update, w.Code)
+		}
+	}
+	if adminRequest(t, ts, http.MethodGet, "/admin/lobbies", "", lobbies); lobbies.Lobbies[0].MaxPlayers != 8 && lobbies.Lobbies[1].MaxPlayers != 8 {
+		t.Fatal("invalid update changed the lobby's settings")
+	}
+
+	adminRequest(t, ts, http.MethodPost, "/admin/announce", fmt.Sprintf(`{"roomCode":%q,"message":"Server restarting soon"}`, code), nil)
+	guest.ExpectChat(host.PlayerIndex, "Server restarting soon")
+
+	//Moving the guest into a new private lobby invites it there
+	if w := adminRequest(t, ts, http.MethodPost, "/admin/lobbies", `{"roomCode":"ADMIN1"}`, view); w.Code != http.StatusOK || view.RoomCode != "ADMIN1" || view.Public {
+		t.Fatalf("POST /admin/lobbies answered with %d %+v", w.Code, view)
+	}
+	if w := adminRequest(t, ts, http.MethodPost, "/admin/lobbies", `{"roomCode":"ADMIN1"}`, nil); w.Code != http.StatusConflict {
+		t.Fatalf("creating a lobby that exists answered with %d", w.Code)
+	}
+	result := &AdminResult{}
+	if adminRequest(t, ts, http.MethodPost, "/admin/announce", `{"message":"Server restarting soon"}`, result); result.Result != "announced to 2 lobbies" {
+		t.Fatalf("announcing to every lobby, one of them empty, %s", result.Result)
+	}
+	if w := adminRequest(t, ts, http.MethodPost, "/admin/move", fmt.Sprintf(`{"steamID":"%d","roomCode":"ADMIN1"}`, guest.SteamID), nil); w.Code != http.StatusOK {
+		t.Fatalf("/admin/move answered with %d: %s", w.Code, w.Body)
+	}
+	guest.ExpectInit()
+	if lobby := ts.Lobby(guest); lobby.LobbyRoomCode != "ADMIN1" {
+		t.Fatalf("guest was moved to lobby %s", lobby.LobbyRoomCode)
+	}
+
+	if w := adminRequest(t, ts, http.MethodPost, "/admin/kick", fmt.Sprintf(`{"steamID":"%d"}`, host.SteamID), nil); w.Code != http.StatusOK {
+		t.Fatalf("/admin/kick answered with %d", w.Code)
+	}
+	host.Expect(packetTypeKickPlayer)
+	if w := adminRequest(t, ts, http.MethodPost, "/admin/kick", fmt.Sprintf(`{"steamID":"%d"}`, host.SteamID), nil); w.Code != http.StatusNotFound {
+		t.Fatalf("kicking a client that's gone answered with %d", w.Code)
+	}
+
+	if w := adminRequest(t, ts, http.MethodDelete, "/admin/lobbies?code=ADMIN1&reason=maintenance", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("DELETE /admin/lobbies answered with %d", w.Code)
+	}
+	guest.Expect(packetTypeKickPlayer)
+	if ts.GetLobbyByCode("ADMIN1") != nil {
+		t.Fatal("closed lobby is still running")
+	}
+}
+
+func TestAdminCreateLobbyOnce(t *testing.T) {
+	ts := newAdminTestServer(t)
+
+	//Every request for the same room code at once, where only one may get it
+	codes := make(chan int)
+	for i := 0; i < 8; i++ {
+		go func() {
+			r := httptest.NewRequest(http.MethodPost, "/admin/lobbies", strings.NewReader(`{"roomCode":"RACE01"}`))
+			r.Header.Set("Authorization", "Bearer "+testAdminToken)
+			w := httptest.NewRecorder()
+			ts.API.ServeHTTP(w, r)
+			codes <- w.Code
+		}()
+	}
+	created := 0
+	for i := 0; i < 8; i++ {
+		switch code := <-codes; code {
+		case http.StatusOK:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("creating a lobby answered with %d", code)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d requests created lobby RACE01", created)
+	}
+}
+
+func TestAdminLobbyInFight(t *testing.T) {
+	ts := newAdminTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	ts.Join(76561190000000003) //Alone in a lobby with no match
+	code := ts.Lobby(host).LobbyRoomCode
+
+	startMatch(host, guest)
+	lobbies := &AdminLobbies{}
+	adminRequest(t, ts, http.MethodGet, "/admin/lobbies", "", lobbies)
+	for _, view := range lobbies.Lobbies {
+		if view.InFight != (view.RoomCode == code) {
+			t.Fatalf("/admin/lobbies reported lobby %s in a fight=%t once the host's match started", view.RoomCode, view.InFight)
+		}
+	}
+}
+
+func TestAdminMoveCrossesJoin(t *testing.T) {
+	ts := newAdminTestServer(t)
+
+	//Each lobby moving a client into the other at once must never leave both waiting on each other
+	for i := uint64(0); i < 10; i++ {
+		steamID := 76561190000000001 + i*4
+		host, mover := ts.Join(steamID), ts.Join(steamID+1)
+		otherHost, joiner := ts.Join(steamID+2), ts.Join(steamID+3)
+		joinLobby(t, host, mover)
+		joinLobby(t, otherHost, joiner)
+		lobby, otherLobby := ts.Lobby(host), ts.Lobby(otherHost)
+
+		//Hold up both lobbies so that the move and the join are both waiting when they start
+		release := make(chan struct{})
+		lobby.Do(func() { <-release })
+		otherLobby.Do(func() { <-release })
+		moved := make(chan int, 1)
+		go func() {
+			moved <- adminRequest(t, ts, http.MethodPost, "/admin/move", fmt.Sprintf(`{"steamID":"%d","roomCode":%q}`, mover.SteamID, otherLobby.LobbyRoomCode), nil).Code
+		}()
+		joiner.Say("/join " + lobby.LobbyRoomCode)
+		close(release)
+
+		select {
+		case code := <-moved:
+			if code != http.StatusOK {
+				t.Fatalf("/admin/move answered with %d", code)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("/admin/move deadlocked against a player joining the other way")
+		}
+		mover.ExpectInit()
+		joiner.ExpectInit()
+		if ts.Lobby(mover) != otherLobby || ts.Lobby(joiner) != lobby {
+			t.Fatal("clients moving past each other ended up in the wrong lobbies")
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoshuaDoes/json"
+)
+
+const (
+	apiReadHeaderTimeout = 5 * time.Second  //How long a client may take to send a request's headers
+	apiReadTimeout       = 10 * time.Second //How long a client may take to send a whole request
+	apiIdleTimeout       = 60 * time.Second //How long a kept-alive connection may sit between requests
+	apiHandlerTimeout    = 10 * time.Second //How long a request may take to be answered before it's given up on
+	apiMaxHeaderBytes    = 16 << 10         //The largest request headers to accept
+)
+
+//API serves the server's HTTP API, answering every request with JSON
+type API struct {
+	Server *Server
+	Audit  *AuditLog //Every admin request
+
+	routes    map[string]map[string]http.Handler //Handlers by path, then by method
+	http      *http.Server
+	listeners []net.Listener
+	lock      sync.Mutex //Guards listeners
+}
+
+//apiHandler answers a request with a value to respond with as JSON, or an error
+type apiHandler func(r *http.Request) (interface{}, error)
+
+//apiError is an error to respond to a request with, along with its HTTP status
+type apiError struct {
+	Status  int    `json:"-"`
+	Message string `json:"error"`
+}
+
+func (err *apiError) Error() string {
+	return err.Message
+}
+
+//apiErrorf returns an error to respond to a request with, along with its HTTP status
+func apiErrorf(status int, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+//NewAPI returns the HTTP API of a server, which serves nothing until it's told to listen
+func NewAPI(srv *Server) *API {
+	api := &API{
+		Server: srv,
+		Audit:  &AuditLog{},
+		routes: make(map[string]map[string]http.Handler),
+	}
+	api.http = &http.Server{
+		Handler:           api,
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		ReadTimeout:       apiReadTimeout,
+		IdleTimeout:       apiIdleTimeout,
+		MaxHeaderBytes:    apiMaxHeaderBytes,
+	}
+
+	api.Handle(http.MethodGet, "/status", api.status)
+	api.Handle(http.MethodGet, "/lobbies", api.lobbies)
+	api.HandleRaw(http.MethodGet, "/metrics", http.HandlerFunc(api.metrics))
+	api.HandleRaw(http.MethodGet, "/events", http.HandlerFunc(api.events))
+	if adminToken != "" {
+		api.handleAdmin(adminToken)
+	}
+	return api
+}
+
+//Handle routes requests with a method to a path to a handler that answers with JSON
+func (api *API) Handle(method, path string, handler apiHandler) {
+	api.HandleRaw(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.serveJSON(w, r, handler)
+	}))
+}
+
+//HandleRaw routes requests with a method to a path to a handler that writes its own response, for anything that isn't JSON
+//It's given none of the JSON handlers' timeouts or panic recovery, so it has to look after itself
+func (api *API) HandleRaw(method, path string, handler http.Handler) {
+	if api.routes[path] == nil {
+		api.routes[path] = make(map[string]http.Handler)
+	}
+	api.routes[path][method] = handler
+}
+
+//ServeHTTP answers a request with the handler of its route, or a JSON error if it has none
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	methods, ok := api.routes[r.URL.Path]
+	if !ok {
+		api.respond(w, r, nil, apiErrorf(http.StatusNotFound, "%s not found", r.URL.Path))
+		return
+	}
+	handler, ok := methods[r.Method]
+	if !ok {
+		allowed := make([]string, 0, len(methods))
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		api.respond(w, r, nil, apiErrorf(http.StatusMethodNotAllowed, "%s doesn't allow %s", r.URL.Path, r.Method))
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+//serveJSON answers a request with a JSON handler, or a JSON error if it fails or takes too long
+func (api *API) serveJSON(w http.ResponseWriter, r *http.Request, handler apiHandler) {
+	//The handler answers with a value rather than writing it, so it can be given up on without racing a late response
+	ctx, cancel := context.WithTimeout(r.Context(), apiHandlerTimeout)
+	defer cancel()
+	type answer struct {
+		value interface{}
+		err   error
+	}
+	answered := make(chan answer, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Error("Recovered from a panic answering ", r.Method, " ", r.URL.Path, ": ", p)
+				answered <- answer{err: apiErrorf(http.StatusInternalServerError, "internal error")}
+			}
+		}()
+		value, err := handler(r.WithContext(ctx))
+		answered <- answer{value, err}
+	}()
+
+	select {
+	case a := <-answered:
+		api.respond(w, r, a.value, a.err)
+	case <-ctx.Done():
+		api.respond(w, r, nil, apiErrorf(http.StatusServiceUnavailable, "timed out"))
+	}
+}
+
+//respond writes a value as JSON, or an error as {"error": message} with its status, pretty printed if the request asks with ?pretty
+func (api *API) respond(w http.ResponseWriter, r *http.Request, value interface{}, err error) {
+	status := http.StatusOK
+	if err != nil {
+		apiErr, ok := err.(*apiError)
+		if !ok {
+			apiErr = apiErrorf(http.StatusInternalServerError, "%v", err)
+		}
+		status, value = apiErr.Status, apiErr
+	}
+
+	_, pretty := r.URL.Query()["pretty"]
+	data, err := json.Marshal(value, pretty)
+	if err != nil {
+		log.Error("unable to respond to ", r.Method, " ", r.URL.Path, ": ", err)
+		status = http.StatusInternalServerError
+		data = []byte(`{"error":"internal error"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+//Listen opens a TCP listener for every address, which may be IPv4, IPv6 or dual-stack
+func (api *API) Listen(addrs []string) error {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		log.Trace("Listening for HTTP on ", listener.Addr())
+		api.listeners = append(api.listeners, listener)
+	}
+	return nil
+}
+
+//Serve serves the API on every listener in the background, until it's closed
+func (api *API) Serve() {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	for _, listener := range api.listeners {
+		listener := listener
+		go func() {
+			if err := api.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Error("HTTP API on ", listener.Addr(), ": ", err)
+			}
+		}()
+	}
+}
+
+//Addrs returns every address the API is listening on
+func (api *API) Addrs() []string {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	addrs := make([]string, 0, len(api.listeners))
+	for _, listener := range api.listeners {
+		addrs = append(addrs, listener.Addr().String())
+	}
+	return addrs
+}
+
+//Close stops serving the API, cutting off any request still being answered
+func (api *API) Close() {
+	api.http.Close()
+
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	for _, listener := range api.listeners {
+		listener.Close() //In case it was never served
+	}
+	api.listeners = nil
+
+	if err := api.Audit.Close(); err != nil {
+		log.Error("Unable to finish audit log: ", err)
+	}
+}
+
+//status answers with the server's statistics, in the same shape as before the API had any other routes
+func (api *API) status(r *http.Request) (interface{}, error) {
+	return api.Server.Status(), nil
+}
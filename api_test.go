@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JoshuaDoes/json"
+)
+
+//apiRequest answers a request with the test server's API, and decodes the JSON response into the value if it's given one
+func apiRequest(t *testing.T, ts *testServer, method, target string, body string, value interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	return apiServe(t, ts, httptest.NewRequest(method, target, strings.NewReader(body)), value)
+}
+
+//apiServe answers a request with the test server's API, and decodes the JSON response into the value if it's given one
+func apiServe(t *testing.T, ts *testServer, r *http.Request, value interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	ts.API.ServeHTTP(w, r)
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("%s %s answered with %s", r.Method, r.URL, contentType)
+	}
+	if value != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), value); err != nil {
+			t.Fatalf("%s %s answered with malformed JSON %q: %v", r.Method, r.URL, w.Body, err)
+		}
+	}
+	return w
+}
+
+func TestAPIStatus(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Join(76561190000000001)
+
+	status := &Status{}
+	if w := apiRequest(t, ts, http.MethodGet, "/status", "", status); w.Code != http.StatusOK {
+		t.Fatalf("/status answered with %d", w.Code)
+	}
+	if !status.Online || status.Lobbies != 1 || status.Players != 1 {
+		t.Fatalf("/status answered with %+v", status)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	ts := newTestServer(t)
+
+	apiErr := &apiError{}
+	if w := apiRequest(t, ts, http.MethodGet, "/nowhere", "", apiErr); w.Code != http.StatusNotFound || apiErr.Message == "" {
+		t.Fatalf("unknown path answered with %d %+v", w.Code, apiErr)
+	}
+	w := apiRequest(t, ts, http.MethodPost, "/status", "", apiErr)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodGet {
+		t.Fatalf("wrong method answered with %d, allowing %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestAPISlowClient(t *testing.T) {
+	ts := newTestServer(t)
+	if err := ts.API.Listen([]string{"127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	ts.API.Serve()
+	addr := ts.API.Addrs()[0]
+
+	//A client that connects and never sends its request mustn't hold up anyone else
+	slow, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	resp, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/status answered with %d", resp.StatusCode)
+	}
+}
+
+func TestAPILobbies(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	ts.Join(76561190000000003) //Alone in a lobby that isn't public
+
+	listings := &LobbyListings{}
+	if w := apiRequest(t, ts, http.MethodGet, "/lobbies?open=true&sort=-players", "", listings); w.Code != http.StatusOK {
+		t.Fatalf("/lobbies answered with %d", w.Code)
+	}
+	if len(listings.Lobbies) != 1 {
+		t.Fatalf("/lobbies listed %d lobbies, expected only the public one", len(listings.Lobbies))
+	}
+	listing := listings.Lobbies[0]
+	if listing.RoomCode != ts.Lobby(host).LobbyRoomCode || listing.OwnerSteamID != host.SteamID || listing.Players != 2 || listing.GameMode != "Stock" {
+		t.Fatalf("/lobbies listed %+v", listing)
+	}
+
+	if apiRequest(t, ts, http.MethodGet, "/lobbies?inFight=true", "", listings); len(listings.Lobbies) != 0 {
+		t.Fatalf("/lobbies listed %d lobbies in a fight before any match started", len(listings.Lobbies))
+	}
+	startMatch(host, guest)
+	if apiRequest(t, ts, http.MethodGet, "/lobbies?inFight=true", "", listings); len(listings.Lobbies) != 1 || !listings.Lobbies[0].InFight {
+		t.Fatalf("/lobbies listed %d lobbies in a fight once the match started", len(listings.Lobbies))
+	}
+	if apiRequest(t, ts, http.MethodGet, "/lobbies?inFight=false", "", listings); len(listings.Lobbies) != 0 {
+		t.Fatalf("/lobbies listed %d lobbies out of a fight once the match started", len(listings.Lobbies))
+	}
+
+	for _, query := range []string{"sort=favourite", "open=maybe"} {
+		if w := apiRequest(t, ts, http.MethodGet, "/lobbies?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("/lobbies?%s answered with %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//LobbyListing describes a public lobby to server browsers
+type LobbyListing struct {
+	RoomCode     string    `json:"roomCode"`
+	Owner        string    `json:"owner"`               //The owner's Steam username
+	OwnerSteamID uint64    `json:"ownerSteamID,string"` //A string, as JavaScript can't hold a Steam ID as a number
+	Players      int       `json:"players"`
+	MaxPlayers   int       `json:"maxPlayers"`
+	Spectators   int       `json:"spectators"`
+	Level        string    `json:"level"`
+	GameMode     string    `json:"gameMode"`
+	TeamType     string    `json:"teamType"`
+	TourneyRules bool      `json:"tourneyRules"`
+	Created      time.Time `json:"created"`
+	Uptime       int64     `json:"uptime"` //Seconds since the lobby was created
+	InFight      bool      `json:"inFight"`
+}
+
+//LobbyListings is the answer to GET /lobbies
+type LobbyListings struct {
+	Lobbies []*LobbyListing `json:"lobbies"`
+}
+
+//lobbyListingSorts are the ways to sort lobby listings, by the name of the sort query parameter
+var lobbyListingSorts = map[string]func(a, b *LobbyListing) bool{
+	"code":       func(a, b *LobbyListing) bool { return a.RoomCode < b.RoomCode },
+	"owner":      func(a, b *LobbyListing) bool { return strings.ToLower(a.Owner) < strings.ToLower(b.Owner) },
+	"players":    func(a, b *LobbyListing) bool { return a.Players < b.Players },
+	"maxPlayers": func(a, b *LobbyListing) bool { return a.MaxPlayers < b.MaxPlayers },
+	"spectators": func(a, b *LobbyListing) bool { return a.Spectators < b.Spectators },
+	"uptime":     func(a, b *LobbyListing) bool { return a.Uptime < b.Uptime },
+	"gameMode":   func(a, b *LobbyListing) bool { return a.GameMode < b.GameMode },
+}
+
+//Listing returns the lobby's listing for server browsers, or nil if it isn't public, and must only be called from the event loop
+func (lobby *Lobby) Listing() *LobbyListing {
+	if !lobby.IsRunning() || !lobby.Public {
+		return nil
+	}
+
+	listing := &LobbyListing{
+		RoomCode:     lobby.LobbyRoomCode,
+		OwnerSteamID: lobby.LobbyOwner.ID,
+		Players:      lobby.GetPlayerCount(false),
+		MaxPlayers:   lobby.MaxPlayers,
+		Spectators:   len(lobby.Spectators),
+		GameMode:     GameModeName(lobby.GameMode),
+		TeamType:     lobby.TeamType,
+		TourneyRules: lobby.TourneyRules,
+		Created:      lobby.LobbyCreationTime,
+		Uptime:       int64(time.Since(lobby.LobbyCreationTime).Seconds()),
+		InFight:      lobby.MatchInProgress(),
+	}
+	if lobby.CurrentLevel != nil {
+		listing.Level = lobby.CurrentLevel.String()
+	}
+	return listing
+}
+
+//lobbyListingQuery is how GET /lobbies filters and sorts its listings
+type lobbyListingQuery struct {
+	Code, Owner, GameMode, TeamType string
+	TourneyRules, InFight, Open     *bool                        //Nil to not filter by them
+	Less                            func(a, b *LobbyListing) bool //How to sort the listings
+}
+
+//parseLobbyListingQuery parses the filters and sort of GET /lobbies, like ?gameMode=stock&open=true&sort=-players
+func parseLobbyListingQuery(values url.Values) (*lobbyListingQuery, error) {
+	query := &lobbyListingQuery{
+		Code:     values.Get("code"),
+		Owner:    strings.ToLower(values.Get("owner")),
+		GameMode: values.Get("gameMode"),
+		TeamType: values.Get("teamType"),
+	}
+
+	for name, filter := range map[string]**bool{"tourneyRules": &query.TourneyRules, "inFight": &query.InFight, "open": &query.Open} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%s must be true or false", name)
+		}
+		*filter = &b
+	}
+
+	sortBy := values.Get("sort")
+	if sortBy == "" {
+		sortBy = "code"
+	}
+	descending := strings.HasPrefix(sortBy, "-")
+	less, ok := lobbyListingSorts[strings.TrimPrefix(sortBy, "-")]
+	if !ok {
+		return nil, apiErrorf(http.StatusBadRequest, "can't sort by %s", sortBy)
+	}
+	query.Less = less
+	if descending {
+		query.Less = func(a, b *LobbyListing) bool { return less(b, a) }
+	}
+
+	return query, nil
+}
+
+//Matches returns true if a listing makes it through the query's filters
+func (query *lobbyListingQuery) Matches(listing *LobbyListing) bool {
+	switch {
+	case query.Code != "" && !strings.EqualFold(listing.RoomCode, query.Code):
+		return false
+	case query.Owner != "" && !strings.Contains(strings.ToLower(listing.Owner), query.Owner):
+		return false
+	case query.GameMode != "" && !strings.EqualFold(listing.GameMode, query.GameMode):
+		return false
+	case query.TeamType != "" && !strings.EqualFold(listing.TeamType, query.TeamType):
+		return false
+	case query.TourneyRules != nil && listing.TourneyRules != *query.TourneyRules:
+		return false
+	case query.InFight != nil && listing.InFight != *query.InFight:
+		return false
+	case query.Open != nil && (listing.Players < listing.MaxPlayers) != *query.Open:
+		return false
+	}
+	return true
+}
+
+//LobbyListings returns the listings of every public lobby
+func (srv *Server) LobbyListings() []*LobbyListing {
+	listings := make([]*LobbyListing, 0)
+	for _, lobby := range srv.GetLobbies() {
+		var listing *LobbyListing
+		lobby.Invoke(func() {
+			listing = lobby.Listing()
+		})
+		if listing == nil {
+			continue
+		}
+
+		listing.Owner = NewCSteamID(listing.OwnerSteamID).GetUsername() //Outside of the event loop, as it may have to ask Steam
+		listings = append(listings, listing)
+	}
+	return listings
+}
+
+//lobbies answers with the listings of every public lobby that makes it through the request's filters, sorted by its sort
+func (api *API) lobbies(r *http.Request) (interface{}, error) {
+	query, err := parseLobbyListingQuery(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	listings := make([]*LobbyListing, 0)
+	for _, listing := range api.Server.LobbyListings() {
+		if query.Matches(listing) {
+			listings = append(listings, listing)
+		}
+	}
+	sort.SliceStable(listings, func(i, j int) bool {
+		return query.Less(listings[i], listings[j])
+	})
+	return &LobbyListings{Lobbies: listings}, nil
+}
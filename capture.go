@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+const (
+	captureMagic   = "SFCAP" //Starts every capture file
+	captureVersion = 1       //The version of the capture format, bumped whenever it changes
+	captureExt     = ".sfcap"
+)
+
+//CaptureDirection is what a captured record is
+type CaptureDirection byte
+
+const (
+	CaptureInbound  CaptureDirection = iota //A packet the server received from the address
+	CaptureOutbound                         //A packet the server sent to the address
+	CaptureJoined                           //The address was initialized into the lobby with the clientRequestingIndex packet and session token in the record
+)
+
+func (direction CaptureDirection) String() string {
+	switch direction {
+	case CaptureInbound:
+		return "in"
+	case CaptureOutbound:
+		return "out"
+	case CaptureJoined:
+		return "joined"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(direction))
+}
+
+//CaptureHeader describes the lobby a capture was recorded from, which is everything needed to start an identical lobby
+type CaptureHeader struct {
+	Start    time.Time    //When the capture started
+	RoomCode string       //The lobby's room code
+	Seed     int64        //The seed of the lobby's random numbers
+	Map      protocol.Map //The lobby map the lobby started on
+}
+
+//CaptureRecord is a single captured packet
+type CaptureRecord struct {
+	Time      time.Duration    //How long after the capture started the packet was sent or received
+	Direction CaptureDirection //Whether the packet was sent or received
+	Addr      *net.UDPAddr     //The client the packet was sent to or received from
+	Channel   int              //The channel the packet travelled through
+	Data      []byte           //The packet as it was on the wire
+	Session   []byte           //The session token the client was initialized with, only for CaptureJoined
+}
+
+//Capture records every packet a lobby sends and receives to a file, for replaying later
+type Capture struct {
+	sync.Mutex
+
+	Path   string
+	file   *os.File
+	w      *bufio.Writer
+	start  time.Time
+	last   time.Duration //The time of the last record, which every record is written relative to
+	closed bool
+}
+
+//NewCapture creates a capture file for a lobby in the specified directory and writes its header
+func NewCapture(dir string, header *CaptureHeader) (*Capture, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	//Only for the server's own eyes, as it holds every session token, and never written over another lobby's capture
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s%s", header.RoomCode, header.Start.Format("20060102-150405"), captureExt))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	capture := &Capture{
+		Path:  path,
+		file:  file,
+		w:     bufio.NewWriter(file),
+		start: header.Start,
+	}
+
+	//Header: magic, version, start time, room code, seed, map type and map data
+	capture.w.WriteString(captureMagic)
+	capture.w.WriteByte(captureVersion)
+	capture.writeUvarint(uint64(header.Start.UnixNano()))
+	capture.writeBytes([]byte(header.RoomCode))
+	capture.writeUvarint(uint64(header.Seed))
+	capture.w.WriteByte(byte(header.Map.Type))
+	capture.writeBytes(header.Map.Data)
+	if err := capture.w.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return capture, nil
+}
+
+func (capture *Capture) writeUvarint(x uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	capture.w.Write(buf[:binary.PutUvarint(buf, x)])
+}
+
+func (capture *Capture) writeBytes(data []byte) {
+	capture.writeUvarint(uint64(len(data)))
+	capture.w.Write(data)
+}
+
+//Record records a packet sent to or received from an address, or a client joining with a session token
+func (capture *Capture) Record(direction CaptureDirection, addr *net.UDPAddr, data, session []byte) {
+	if capture == nil {
+		return
+	}
+
+	capture.Lock()
+	defer capture.Unlock()
+	if capture.closed {
+		return
+	}
+
+	//Record: direction, microseconds since the last record, IP, port, channel, data, then the session token if joined
+	now := time.Since(capture.start)
+	capture.w.WriteByte(byte(direction))
+	capture.writeUvarint(uint64((now - capture.last) / time.Microsecond))
+	capture.last = now.Truncate(time.Microsecond)
+
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	capture.writeBytes(ip)
+	capture.writeUvarint(uint64(addr.Port))
+	capture.w.WriteByte(byte(protocol.PeekChannel(data)))
+	capture.writeBytes(data)
+	if direction == CaptureJoined {
+		capture.writeBytes(session)
+	}
+}
+
+//Flush writes every buffered record to the file
+func (capture *Capture) Flush() error {
+	if capture == nil {
+		return nil
+	}
+
+	capture.Lock()
+	defer capture.Unlock()
+	if capture.closed {
+		return nil
+	}
+	return capture.w.Flush()
+}
+
+//Close flushes the capture and closes its file
+func (capture *Capture) Close() error {
+	if capture == nil {
+		return nil
+	}
+
+	capture.Lock()
+	defer capture.Unlock()
+	if capture.closed {
+		return nil
+	}
+	capture.closed = true
+
+	if err := capture.w.Flush(); err != nil {
+		capture.file.Close()
+		return err
+	}
+	return capture.file.Close()
+}
+
+//CaptureReader reads the records of a capture file in order
+type CaptureReader struct {
+	Header *CaptureHeader
+
+	file *os.File
+	r    *bufio.Reader
+	last time.Duration
+}
+
+//OpenCapture opens a capture file and reads its header
+func OpenCapture(path string) (*CaptureReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &CaptureReader{file: file, r: bufio.NewReader(file)}
+	if err := reader.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return reader, nil
+}
+
+func (reader *CaptureReader) readHeader() error {
+	magic := make([]byte, len(captureMagic)+1)
+	if _, err := io.ReadFull(reader.r, magic); err != nil {
+		return err
+	}
+	if string(magic[:len(captureMagic)]) != captureMagic {
+		return errors.New("not a capture file")
+	}
+	if magic[len(captureMagic)] != captureVersion {
+		return fmt.Errorf("unsupported capture version %d", magic[len(captureMagic)])
+	}
+
+	header := &CaptureHeader{}
+	start, err := binary.ReadUvarint(reader.r)
+	if err != nil {
+		return err
+	}
+	header.Start = time.Unix(0, int64(start))
+	roomCode, err := reader.readBytes()
+	if err != nil {
+		return err
+	}
+	header.RoomCode = string(roomCode)
+	seed, err := binary.ReadUvarint(reader.r)
+	if err != nil {
+		return err
+	}
+	header.Seed = int64(seed)
+	mapType, err := reader.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	header.Map.Type = protocol.MapType(mapType)
+	if header.Map.Data, err = reader.readBytes(); err != nil {
+		return err
+	}
+
+	reader.Header = header
+	return nil
+}
+
+func (reader *CaptureReader) readBytes() ([]byte, error) {
+	size, err := binary.ReadUvarint(reader.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(maxBufferSize)*8 {
+		return nil, fmt.Errorf("record of %d bytes is too large", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//Next returns the next record, or io.EOF once there are no more
+func (reader *CaptureReader) Next() (*CaptureRecord, error) {
+	direction, err := reader.r.ReadByte()
+	if err != nil {
+		return nil, err //A clean io.EOF between records is the end of the capture
+	}
+
+	record := &CaptureRecord{Direction: CaptureDirection(direction)}
+	if record.Direction > CaptureJoined {
+		return nil, fmt.Errorf("unknown record direction %d", direction)
+	}
+
+	delta, err := binary.ReadUvarint(reader.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	reader.last += time.Duration(delta) * time.Microsecond
+	record.Time = reader.last
+
+	ip, err := reader.readBytes()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	port, err := binary.ReadUvarint(reader.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	record.Addr = &net.UDPAddr{IP: net.IP(ip), Port: int(port)}
+
+	channel, err := reader.r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	record.Channel = int(channel)
+
+	if record.Data, err = reader.readBytes(); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if record.Direction == CaptureJoined {
+		if record.Session, err = reader.readBytes(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+
+	return record, nil
+}
+
+//ReadAll returns every remaining record
+func (reader *CaptureReader) ReadAll() ([]*CaptureRecord, error) {
+	records := make([]*CaptureRecord, 0)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+//Close closes the capture file
+func (reader *CaptureReader) Close() error {
+	return reader.file.Close()
+}
+
+//unexpectedEOF turns running out of capture in the middle of a record into an error, as only the end of a record is a clean end
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//CaptureOf returns the capture of the lobby an address is in, or nil if it isn't being captured
+func (srv *Server) CaptureOf(addr *net.UDPAddr) *Capture {
+	lobby, _ := srv.Registry.GetByAddr(addr)
+	if lobby == nil {
+		return nil
+	}
+	return lobby.Capture
+}
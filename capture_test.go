@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureReplaysIdentically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	captureDir = dir
+	defer func() { captureDir = "" }()
+
+	//Play a match with a map change and a winner, then close the server so the capture is finished
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	host.Say("/map 3")
+	host.ExpectMapChange(255)
+	startMatch(host, guest)
+	guest.Die(host.PlayerIndex)
+	host.ExpectMapChange(host.PlayerIndex)
+	guest.ExpectMapChange(host.PlayerIndex)
+	roomCode := ts.Lobby(host).LobbyRoomCode
+	ts.Close()
+
+	paths, err := filepath.Glob(filepath.Join(dir, roomCode+"-*"+captureExt))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("expected one capture of the host's lobby, found %v", paths)
+	}
+
+	captureDir = ""
+	report := &bytes.Buffer{}
+	diverged, err := Replay(paths[0], 4, false, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diverged {
+		t.Fatalf("replay diverged from the capture:\n%s", report)
+	}
+	if !bytes.Contains(report.Bytes(), []byte("(76561190000000002)")) {
+		t.Fatalf("replay didn't include the guest that joined the lobby:\n%s", report)
+	}
+}
+
+func TestStockDrawsFromLobbySeed(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	lobby := ts.Lobby(host)
+
+	//A replay only makes the same choices if they all come from the lobby's seed, so the next number drawn follows the weapon spawn wait
+	var got int64
+	lobby.Invoke(func() {
+		lobby.Random = rand.New(rand.NewSource(1))
+		Stock{}.StartMatch(lobby)
+		got = lobby.Random.Int63()
+	})
+
+	rate := Stock{}.GetWeaponSpawnRates()[0]
+	random := rand.New(rand.NewSource(1))
+	random.Intn(rate.MaximumSeconds - rate.MinimumSeconds + 1)
+	if want := random.Int63(); got != want {
+		t.Fatalf("lobby seeded with 1 drew %d after starting a stock match, expected %d", got, want)
+	}
+}
+
+func TestCaptureIsPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header := &CaptureHeader{Start: time.Now(), RoomCode: "SECRET"}
+	capture, err := NewCapture(dir, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Close()
+
+	info, err := os.Stat(capture.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("capture was created with mode %o, readable by more than the server", mode)
+	}
+	if _, err := NewCapture(dir, header); !os.IsExist(err) {
+		t.Fatalf("second capture of the same lobby at the same time returned %v instead of leaving the first alone", err)
+	}
+}
@@ -0,0 +1,392 @@
+//Package client connects to a Stick Fight server as a player, for bots, load generators and monitoring probes
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+const (
+	eventsSize     = 256                    //The amount of events that can wait to be received before new ones are dropped
+	handshakeRetry = time.Millisecond * 500 //How long to wait for a handshake response before asking again
+	maxPacketSize  = 65535                  //The largest packet that can be received
+)
+
+var (
+	ErrClosed   = errors.New("client is closed")          //Returned when sending on a closed client
+	ErrTimedOut = errors.New("timed out joining a lobby") //Returned when the handshake doesn't finish in time
+)
+
+//Event is a packet received from the server after joining a lobby
+type Event struct {
+	Packet  *protocol.Packet //The packet as it was received
+	Message protocol.Message //The packet's typed data, nil if it couldn't be decoded
+	Err     error            //Why the packet's data couldn't be decoded, if it couldn't
+}
+
+//Stats holds how much traffic a client has sent and received
+type Stats struct {
+	PacketsSent     uint64 //The amount of packets sent, including acks and ping responses
+	PacketsReceived uint64 //The amount of packets received, including resent duplicates
+	BytesSent       uint64 //The amount of bytes sent
+	BytesReceived   uint64 //The amount of bytes received
+	Dropped         uint64 //The amount of events dropped because Events was full
+}
+
+//Client is a connection to a Stick Fight server, playing as the local players of a single Steam ID
+type Client struct {
+	stats Stats //Accessed atomically, first so it's aligned for atomic access
+
+	SteamID     uint64 //The Steam ID the client joined as
+	PlayerCount int    //How many local players the client joined with
+
+	Events <-chan *Event   //Every packet received after joining, in order on each channel
+	Done   <-chan struct{} //Closed when the client is closed or the server removes it
+
+	conn        *net.UDPConn
+	session     []byte
+	reliability *protocol.Reliability //Only used by the goroutine reading from conn
+	lastInit    []byte                //The last reliable clientInit as it was received, to tell a resend of it from a new one
+	init        *protocol.ClientInit
+	initLock    sync.RWMutex
+	events      chan *Event
+	done        chan struct{}
+	closeOnce   sync.Once
+	err         error
+}
+
+//Dial connects to a server and joins a lobby as the specified Steam ID with one local player
+func Dial(address string, steamID uint64) (*Client, error) {
+	return DialTimeout(address, steamID, 1, time.Second*10)
+}
+
+//DialTimeout connects to a server and joins a lobby as the specified Steam ID with the specified amount of local players, giving up if the handshake doesn't finish in time
+func DialTimeout(address string, steamID uint64, playerCount int, timeout time.Duration) (*Client, error) {
+	if playerCount < 1 || playerCount > 255 {
+		return nil, fmt.Errorf("invalid player count %d", playerCount)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan *Event, eventsSize)
+	done := make(chan struct{})
+	client := &Client{
+		SteamID:     steamID,
+		PlayerCount: playerCount,
+		Events:      events,
+		Done:        done,
+		conn:        conn,
+		reliability: protocol.NewReliability(),
+		events:      events,
+		done:        done,
+	}
+
+	if err := client.handshake(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go client.read()
+	return client, nil
+}
+
+//handshake asks to be accepted, then asks for a player index with the session token it was accepted with
+func (client *Client) handshake(deadline time.Time) error {
+	buffer := make([]byte, maxPacketSize)
+	for client.init == nil {
+		if time.Now().After(deadline) {
+			return ErrTimedOut
+		}
+
+		//Until we're accepted we don't have a session to sign with, and after that every request has to be signed
+		var err error
+		if client.session == nil {
+			err = client.Send(&protocol.Empty{PacketType: protocol.PacketTypeClientRequestingAccepting}, 0, 0)
+		} else {
+			err = client.requestIndex()
+		}
+		if err != nil {
+			return err
+		}
+
+		retryAt := time.Now().Add(handshakeRetry)
+		if retryAt.After(deadline) {
+			retryAt = deadline
+		}
+		client.conn.SetReadDeadline(retryAt)
+		for client.init == nil {
+			n, err := client.conn.Read(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break //Ask again
+				}
+				return err
+			}
+
+			client.received(n)
+			packet, err := protocol.NewPacketFromBytes(buffer[:n])
+			if err != nil {
+				continue
+			}
+
+			//Anything else that's reliable is left unacknowledged, so it's resent once we're reading events
+			switch packet.Type {
+			case protocol.PacketTypeClientAccepted:
+				accepted := &protocol.ClientAccepted{}
+				if err := packet.Decode(accepted); err != nil {
+					return err
+				}
+				if client.session == nil {
+					client.session = accepted.Token
+					if err := client.requestIndex(); err != nil {
+						return err
+					}
+				}
+
+			case protocol.PacketTypeClientInit:
+				init := &protocol.ClientInit{LocalSteamID: client.SteamID}
+				if err := packet.Decode(init); err != nil {
+					return err
+				}
+				if !init.Accepted {
+					return fmt.Errorf("rejected: %s", init.Reason)
+				}
+				if packet.Sequence != 0 {
+					client.ack(packet)
+					client.reliability.Receive(packet) //So the rest of its channel follows it in order
+					client.lastInit = append([]byte{}, buffer[:n]...)
+				}
+				client.init = init
+			}
+		}
+	}
+
+	client.conn.SetReadDeadline(time.Time{})
+	return nil
+}
+
+func (client *Client) requestIndex() error {
+	return client.Send(&protocol.ClientRequestingIndex{
+		SteamID:         client.SteamID,
+		PlayerCount:     byte(client.PlayerCount),
+		ProtocolVersion: protocol.Version,
+		Extensions:      protocol.Extensions,
+	}, 0, client.SteamID)
+}
+
+//read reads packets from the server until the client is closed, answering acks and pings and handing the rest to Events
+func (client *Client) read() {
+	buffer := make([]byte, maxPacketSize)
+	for {
+		n, err := client.conn.Read(buffer)
+		if err != nil {
+			client.close(err)
+			return
+		}
+
+		client.received(n)
+		packet, err := protocol.NewPacketFromBytes(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		if packet.Sequence == 0 {
+			client.handle(packet)
+			continue
+		}
+
+		if packet.Type == protocol.PacketTypeClientInit && packet.Sequence == 1 && !bytes.Equal(buffer[:n], client.lastInit) {
+			//Moving to another lobby or being reinitialized starts every channel over, unlike a resend of the clientInit we already have
+			client.reliability = protocol.NewReliability()
+			client.lastInit = append([]byte{}, buffer[:n]...)
+		}
+		ready, accepted := client.reliability.Receive(packet)
+		if !accepted {
+			continue //Too far ahead to hold, so leave it unacknowledged for the server to send again
+		}
+		client.ack(packet) //Always acknowledge, even duplicates, in case the last ack was lost
+		for _, ready := range ready {
+			client.handle(ready)
+		}
+	}
+}
+
+func (client *Client) handle(packet *protocol.Packet) {
+	switch packet.Type {
+	case protocol.PacketTypePing:
+		if packet.SteamID.ID == 0 { //The server is measuring our round trip, so echo it back the same way
+			ping := &protocol.Ping{}
+			if packet.Decode(ping) == nil {
+				client.Send(&protocol.PingResponse{Data: ping.Data}, packet.Channel, 0)
+			}
+			return
+		}
+
+	case protocol.PacketTypeClientInit:
+		init := &protocol.ClientInit{LocalSteamID: client.SteamID}
+		if packet.Decode(init) != nil {
+			break
+		}
+		if !init.Accepted { //The server follows a kickPlayer with a rejected clientInit telling us why
+			client.emit(packet)
+			client.close(fmt.Errorf("removed: %s", init.Reason))
+			return
+		}
+		client.initLock.Lock()
+		client.init = init
+		client.initLock.Unlock()
+	}
+
+	client.emit(packet)
+}
+
+//emit decodes a packet and hands it to Events, dropping it if nobody's keeping up
+func (client *Client) emit(packet *protocol.Packet) {
+	event := &Event{Packet: packet}
+	if msg := protocol.NewMessage(packet.Type); msg != nil {
+		if clientInit, ok := msg.(*protocol.ClientInit); ok {
+			clientInit.LocalSteamID = client.SteamID
+		}
+		if err := packet.Decode(msg); err != nil {
+			event.Err = err
+		} else {
+			event.Message = msg
+		}
+	}
+
+	select {
+	case client.events <- event:
+	default:
+		atomic.AddUint64(&client.stats.Dropped, 1)
+	}
+}
+
+func (client *Client) received(n int) {
+	atomic.AddUint64(&client.stats.PacketsReceived, 1)
+	atomic.AddUint64(&client.stats.BytesReceived, uint64(n))
+}
+
+func (client *Client) ack(packet *protocol.Packet) {
+	client.Send(&protocol.Ack{Sequence: packet.Sequence}, packet.Channel, 0)
+}
+
+//Send sends a message on the specified channel, signed with the client's session
+func (client *Client) Send(msg protocol.Message, channel int, steamID uint64) error {
+	select {
+	case <-client.done:
+		return ErrClosed
+	default:
+	}
+
+	packet, err := protocol.NewPacketFromMessage(msg, channel, steamID)
+	if err != nil {
+		return err
+	}
+
+	data := packet.AsBytes()
+	if client.session != nil {
+		data = packet.AsSignedBytes(0, client.session)
+	}
+	if _, err = client.conn.Write(data); err != nil {
+		return err
+	}
+	atomic.AddUint64(&client.stats.PacketsSent, 1)
+	atomic.AddUint64(&client.stats.BytesSent, uint64(len(data)))
+	return nil
+}
+
+//SendPlayerUpdate sends a local player's position and weapon
+func (client *Client) SendPlayerUpdate(playerIndex int, update *protocol.PlayerUpdate) error {
+	return client.Send(update, protocol.ChannelUpdate(playerIndex), client.SteamID)
+}
+
+//SendPlayerTookDamage tells the lobby that a local player took damage
+func (client *Client) SendPlayerTookDamage(playerIndex int, tookDamage *protocol.PlayerTookDamage) error {
+	return client.Send(tookDamage, protocol.ChannelUpdate(playerIndex), client.SteamID)
+}
+
+//Ping asks the lobby to echo the data back in a pingResponse event, having passed through its event loop
+func (client *Client) Ping(data []byte) error {
+	return client.Send(&protocol.Ping{Data: data}, 0, 0)
+}
+
+//Say sends a chat message as a local player
+func (client *Client) Say(playerIndex int, message string) error {
+	return client.Send(&protocol.PlayerTalked{Message: message}, protocol.ChannelEvent(playerIndex), client.SteamID)
+}
+
+//ReadyUp marks the specified local players as ready
+func (client *Client) ReadyUp(playerIndexes ...int) error {
+	readyUp := &protocol.ClientReadyUp{PlayerIndexes: make([]byte, len(playerIndexes))}
+	for i, playerIndex := range playerIndexes {
+		readyUp.PlayerIndexes[i] = byte(playerIndex)
+	}
+	return client.Send(readyUp, 0, client.SteamID)
+}
+
+//Init returns the latest accepted clientInit, which describes the lobby as it stood when the client joined it
+func (client *Client) Init() *protocol.ClientInit {
+	client.initLock.RLock()
+	defer client.initLock.RUnlock()
+	return client.init
+}
+
+//PlayerIndexes returns the player indexes of the client's local players
+func (client *Client) PlayerIndexes() []int {
+	init := client.Init()
+	playerIndexes := make([]int, client.PlayerCount)
+	for i := range playerIndexes {
+		playerIndexes[i] = int(init.PlayerIndex) + i
+	}
+	return playerIndexes
+}
+
+//Stats returns how much traffic the client has sent and received so far
+func (client *Client) Stats() Stats {
+	return Stats{
+		PacketsSent:     atomic.LoadUint64(&client.stats.PacketsSent),
+		PacketsReceived: atomic.LoadUint64(&client.stats.PacketsReceived),
+		BytesSent:       atomic.LoadUint64(&client.stats.BytesSent),
+		BytesReceived:   atomic.LoadUint64(&client.stats.BytesReceived),
+		Dropped:         atomic.LoadUint64(&client.stats.Dropped),
+	}
+}
+
+//Err returns why the client was closed, or nil if it's still open or was closed with Close
+func (client *Client) Err() error {
+	select {
+	case <-client.done:
+		return client.err
+	default:
+		return nil
+	}
+}
+
+//Close leaves the lobby and closes the connection
+func (client *Client) Close() error {
+	client.Send(&protocol.Empty{PacketType: protocol.PacketTypeClientLeft}, 0, client.SteamID)
+	client.close(nil)
+	return nil
+}
+
+func (client *Client) close(err error) {
+	client.closeOnce.Do(func() {
+		client.err = err
+		close(client.done)
+		client.conn.Close()
+	})
+}
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/client/clienttest"
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+const testTimeout = 5 * time.Second //How long to wait for the server before failing the test
+
+//newTestServer starts a scripted server, which is closed when the test ends
+func newTestServer(t *testing.T) *clienttest.Server {
+	srv, err := clienttest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+//dial joins a scripted server, failing the test unless it's accepted into a lobby
+func dial(t *testing.T, srv *clienttest.Server, steamID uint64) *Client {
+	t.Helper()
+
+	client, err := DialTimeout(srv.Addr, steamID, 1, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+//expect skips a client's events until one matches, failing the test if none does in time
+func expect(t *testing.T, client *Client, what string, match func(event *Event) bool) *Event {
+	t.Helper()
+
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case event := <-client.Events:
+			if event.Err != nil {
+				t.Fatalf("client %d received a malformed %s: %v", client.SteamID, event.Packet.Type, event.Err)
+			}
+			if match(event) {
+				return event
+			}
+		case <-client.Done:
+			t.Fatalf("client %d was closed waiting for %s: %v", client.SteamID, what, client.Err())
+		case <-deadline:
+			t.Fatalf("client %d didn't receive %s", client.SteamID, what)
+		}
+	}
+}
+
+func TestDialJoinsLobby(t *testing.T) {
+	srv := newTestServer(t)
+	client := dial(t, srv, 1)
+
+	init := client.Init()
+	if init == nil || !init.Accepted {
+		t.Fatalf("dialing returned without an accepted clientInit: %+v", init)
+	}
+	if len(init.Players) != 4 || init.Players[0].SteamID != 1 || init.Players[0].Stats != nil {
+		t.Fatalf("clientInit doesn't hold the client in its first slot: %+v", init.Players)
+	}
+	if playerIndexes := client.PlayerIndexes(); !reflect.DeepEqual(playerIndexes, []int{0}) {
+		t.Fatalf("client has players %v, expected [0]", playerIndexes)
+	}
+	if stats := client.Stats(); stats.PacketsSent < 3 || stats.PacketsReceived < 2 {
+		t.Fatalf("handshake wasn't counted: %+v", stats)
+	}
+}
+
+func TestDialRejected(t *testing.T) {
+	srv := newTestServer(t)
+
+	_, err := DialTimeout(srv.Addr, 1, 5, testTimeout)
+	if err == nil || !strings.HasPrefix(err.Error(), "rejected: ") {
+		t.Fatalf("dialing with more players than fit in a lobby returned %v", err)
+	}
+}
+
+func TestDialTimesOut(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	start := time.Now()
+	if _, err := DialTimeout(silent.LocalAddr().String(), 1, 1, handshakeRetry*2); err != ErrTimedOut {
+		t.Fatalf("dialing a server that never answers returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > testTimeout {
+		t.Fatalf("dialing gave up after %s", elapsed)
+	}
+
+	if _, err := DialTimeout(silent.LocalAddr().String(), 1, 0, testTimeout); err == nil {
+		t.Fatal("dialing without any players succeeded")
+	}
+}
+
+func TestSendAndReceive(t *testing.T) {
+	srv := newTestServer(t)
+	host := dial(t, srv, 1)
+	guest := dial(t, srv, 2)
+
+	host.Say(0, "/code")
+	code := ""
+	expect(t, host, "its room code", func(event *Event) bool {
+		talked, ok := event.Message.(*protocol.PlayerTalked)
+		if ok && event.Packet.SteamID.ID == host.SteamID && strings.HasPrefix(talked.Message, "Room code: ") {
+			code = strings.TrimPrefix(talked.Message, "Room code: ")
+			return true
+		}
+		return false
+	})
+
+	guest.Say(0, "/join "+code)
+	expect(t, guest, "a clientInit for the host's lobby", func(event *Event) bool {
+		init, ok := event.Message.(*protocol.ClientInit)
+		return ok && init.Accepted && init.PlayerIndex == 1
+	})
+	if playerIndexes := guest.PlayerIndexes(); !reflect.DeepEqual(playerIndexes, []int{1}) {
+		t.Fatalf("guest has players %v after moving lobbies, expected [1]", playerIndexes)
+	}
+	expect(t, host, "the guest joining", func(event *Event) bool {
+		joined, ok := event.Message.(*protocol.ClientJoined)
+		return ok && joined.PlayerIndex == 1 && joined.SteamID == guest.SteamID
+	})
+
+	//Reliable chat arrives in order on the host's event channel
+	for _, message := range []string{"one", "two", "three"} {
+		if err := host.Say(0, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, message := range []string{"one", "two", "three"} {
+		event := expect(t, guest, "the host's chat", func(event *Event) bool {
+			_, ok := event.Message.(*protocol.PlayerTalked)
+			return ok
+		})
+		if talked := event.Message.(*protocol.PlayerTalked); talked.Message != message || event.Packet.SteamID.ID != host.SteamID || event.Packet.Channel != protocol.ChannelEvent(0) {
+			t.Fatalf("guest heard %q from %d on channel %d, expected %q from the host on channel %d",
+				talked.Message, event.Packet.SteamID.ID, event.Packet.Channel, message, protocol.ChannelEvent(0))
+		}
+	}
+
+	update := &protocol.PlayerUpdate{PositionY: 150, PositionZ: -20, Projectiles: []protocol.ProjectileUpdate{{ShootX: 1, SyncIndex: 7}}, Weapon: 2}
+	if err := guest.SendPlayerUpdate(1, update); err != nil {
+		t.Fatal(err)
+	}
+	event := expect(t, host, "the guest's playerUpdate", func(event *Event) bool {
+		_, ok := event.Message.(*protocol.PlayerUpdate)
+		return ok
+	})
+	if !reflect.DeepEqual(event.Message, update) || event.Packet.Channel != protocol.ChannelUpdate(1) {
+		t.Fatalf("host received %+v on channel %d, expected %+v on channel %d", event.Message, event.Packet.Channel, update, protocol.ChannelUpdate(1))
+	}
+
+	if err := host.Ping([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, host, "a pingResponse", func(event *Event) bool {
+		response, ok := event.Message.(*protocol.PingResponse)
+		return ok && bytes.Equal(response.Data, []byte{1, 2, 3})
+	})
+}
+
+func TestKicked(t *testing.T) {
+	srv := newTestServer(t)
+	client := dial(t, srv, 1)
+
+	if !srv.Kick(client.SteamID, "testing") {
+		t.Fatal("server couldn't find the client to kick")
+	}
+	select {
+	case <-client.Done:
+	case <-time.After(testTimeout):
+		t.Fatal("client wasn't closed after being kicked")
+	}
+	if err := client.Err(); err == nil || err.Error() != "removed: testing" {
+		t.Fatalf("kicked client was closed with %v", err)
+	}
+	if err := client.Say(0, "hello?"); err != ErrClosed {
+		t.Fatalf("sending on a kicked client returned %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	srv := newTestServer(t)
+	client := dial(t, srv, 1)
+
+	client.Close()
+	<-client.Done
+	if err := client.Err(); err != nil {
+		t.Fatalf("closed client has error %v", err)
+	}
+	if err := client.Ping(nil); err != ErrClosed {
+		t.Fatalf("sending on a closed client returned %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+//Package clienttest runs a scripted Stick Fight server on localhost, with just enough of a real server's lobbies to test clients against
+package clienttest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+const (
+	defaultMaxPlayers = 4     //The amount of player slots in a new lobby
+	maxPacketSize     = 65535 //The largest packet that can be received
+)
+
+//Server is a scripted server on a loopback UDP port
+//Every client joins a lobby of its own, and can then answer to /code, /maxplayers and /join like a real server's lobbies do
+//Chat, playerUpdates and damage are passed along to the rest of the lobby, and pings are echoed back
+type Server struct {
+	Addr string //The address to dial the server on
+
+	conn     *net.UDPConn
+	lock     sync.Mutex
+	clients  map[string]*serverClient //Every accepted client, by address
+	lobbies  map[string]*serverLobby  //Every lobby, by room code
+	lastCode int
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+//serverClient is a client the server accepted
+type serverClient struct {
+	addr        *net.UDPAddr
+	session     []byte
+	steamID     uint64
+	playerCount int
+	playerIndex int          //The client's first player, if it's in a lobby
+	lobby       *serverLobby //The lobby the client is in, nil until it asks for a player index
+	reliable    bool         //Whether the client negotiated ExtensionsReliable
+	reliability *protocol.Reliability
+}
+
+//serverLobby is a lobby on the server
+type serverLobby struct {
+	code  string
+	slots []*serverClient //One per player slot, holding the client whose player it is, nil if open
+}
+
+//NewServer starts a scripted server on a free loopback port
+func NewServer() (*Server, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{
+		Addr:    conn.LocalAddr().String(),
+		conn:    conn,
+		clients: make(map[string]*serverClient),
+		lobbies: make(map[string]*serverLobby),
+		done:    make(chan struct{}),
+	}
+	srv.wg.Add(2)
+	go srv.read()
+	go srv.resend()
+	return srv, nil
+}
+
+//Close stops the server and waits for it to finish
+func (srv *Server) Close() {
+	close(srv.done)
+	srv.conn.Close()
+	srv.wg.Wait()
+}
+
+//Kick removes a client from the server, telling it why with a rejected clientInit, and returns false if there's no such client
+func (srv *Server) Kick(steamID uint64, reason string) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	for _, client := range srv.clients {
+		if client.steamID == steamID && client.lobby != nil {
+			srv.send(client, &protocol.Empty{PacketType: protocol.PacketTypeKickPlayer}, 0, 0)
+			srv.send(client, &protocol.ClientInit{Reason: reason}, 0, 0)
+			srv.remove(client)
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) read() {
+	defer srv.wg.Done()
+
+	buffer := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := srv.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		packet, err := protocol.NewPacketFromBytes(buffer[:n])
+		if err != nil {
+			continue
+		}
+		packet.Src = addr
+
+		srv.lock.Lock()
+		srv.handle(packet)
+		srv.lock.Unlock()
+	}
+}
+
+//resend retransmits reliable packets that weren't acknowledged in time, like a real server's lobbies do
+func (srv *Server) resend() {
+	defer srv.wg.Done()
+
+	ticker := time.NewTicker(protocol.ReliableTickRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.done:
+			return
+		case now := <-ticker.C:
+			srv.lock.Lock()
+			for _, client := range srv.clients {
+				resend, _ := client.reliability.Resend(now)
+				for _, data := range resend {
+					srv.conn.WriteToUDP(data, client.addr)
+				}
+			}
+			srv.lock.Unlock()
+		}
+	}
+}
+
+func (srv *Server) handle(packet *protocol.Packet) {
+	client := srv.clients[packet.Src.String()]
+	if packet.Type == protocol.PacketTypeClientRequestingAccepting {
+		if client == nil {
+			client = &serverClient{addr: packet.Src, session: make([]byte, protocol.SessionTokenSize), reliability: protocol.NewReliability()}
+			if _, err := rand.Read(client.session); err != nil {
+				return
+			}
+			srv.clients[packet.Src.String()] = client
+		}
+		srv.send(client, &protocol.ClientAccepted{Token: client.session}, 0, 0)
+		return
+	}
+	if client == nil || !packet.Verify(client.session) {
+		return //Only accepted clients get this far, and only with their session
+	}
+
+	switch packet.Type {
+	case protocol.PacketTypeClientRequestingIndex:
+		request := &protocol.ClientRequestingIndex{}
+		if packet.Decode(request) != nil || client.lobby != nil {
+			return //The clientInit it's asking again for is already being resent
+		}
+		if request.PlayerCount < 1 || int(request.PlayerCount) > defaultMaxPlayers {
+			srv.send(client, &protocol.ClientInit{Reason: fmt.Sprintf("%d players won't fit in a lobby", request.PlayerCount)}, 0, 0)
+			srv.remove(client)
+			return
+		}
+		client.steamID = request.SteamID
+		client.playerCount = int(request.PlayerCount)
+		client.reliable = protocol.NegotiateExtensions(request.Extensions) >= protocol.ExtensionsReliable
+
+		srv.lastCode++
+		lobby := &serverLobby{code: "TEST" + strconv.Itoa(srv.lastCode), slots: make([]*serverClient, defaultMaxPlayers)}
+		srv.lobbies[lobby.code] = lobby
+		srv.join(client, lobby, 0)
+
+	case protocol.PacketTypeClientLeft:
+		srv.remove(client)
+
+	case protocol.PacketTypeAck:
+		ack := &protocol.Ack{}
+		if packet.Decode(ack) == nil {
+			client.reliability.Ack(packet.Channel, ack.Sequence)
+		}
+
+	case protocol.PacketTypePing:
+		ping := &protocol.Ping{}
+		if packet.SteamID.ID == 0 && packet.Decode(ping) == nil {
+			srv.send(client, &protocol.PingResponse{Data: ping.Data}, packet.Channel, 0)
+		}
+
+	case protocol.PacketTypePlayerTalked:
+		talked := &protocol.PlayerTalked{}
+		if client.lobby == nil || packet.Decode(talked) != nil {
+			return
+		}
+		if strings.HasPrefix(talked.Message, "/") {
+			srv.command(client, strings.Fields(talked.Message))
+			return
+		}
+		srv.relay(client, talked, packet.Channel)
+
+	case protocol.PacketTypePlayerUpdate, protocol.PacketTypePlayerTookDamage:
+		msg := protocol.NewMessage(packet.Type)
+		if client.lobby != nil && packet.Decode(msg) == nil {
+			srv.relay(client, msg, packet.Channel)
+		}
+	}
+}
+
+//command runs a chat command, ignoring the ones the server doesn't know
+func (srv *Server) command(client *serverClient, args []string) {
+	lobby := client.lobby
+	switch args[0] {
+	case "/code":
+		srv.say(client, "Room code: %s", lobby.code)
+
+	case "/maxplayers":
+		if len(args) != 2 {
+			return
+		}
+		maxPlayers, err := strconv.Atoi(args[1])
+		if err != nil || maxPlayers < 1 || maxPlayers > 255 {
+			srv.say(client, "Invalid player count %s", args[1])
+			return
+		}
+		for i := maxPlayers; i < len(lobby.slots); i++ {
+			if lobby.slots[i] != nil {
+				srv.say(client, "Player %d is still in the lobby", i)
+				return
+			}
+		}
+		if maxPlayers < len(lobby.slots) {
+			lobby.slots = lobby.slots[:maxPlayers]
+		}
+		for len(lobby.slots) < maxPlayers {
+			lobby.slots = append(lobby.slots, nil)
+		}
+
+	case "/join":
+		if len(args) != 2 {
+			return
+		}
+		dstLobby := srv.lobbies[args[1]]
+		if dstLobby == nil || dstLobby == lobby {
+			srv.say(client, "No other lobby has the room code %s", args[1])
+			return
+		}
+		playerIndex := dstLobby.open(client.playerCount)
+		if playerIndex < 0 {
+			srv.say(client, "Lobby %s is full", dstLobby.code)
+			return
+		}
+		srv.leave(client)
+		srv.join(client, dstLobby, playerIndex)
+	}
+}
+
+//join puts a client's players in a lobby starting at the player index, and sends it a clientInit as the lobby stands
+func (srv *Server) join(client *serverClient, lobby *serverLobby, playerIndex int) {
+	client.lobby = lobby
+	client.playerIndex = playerIndex
+	client.reliability = protocol.NewReliability() //Every channel starts over in a new lobby
+	for i := 0; i < client.playerCount; i++ {
+		lobby.slots[playerIndex+i] = client
+	}
+
+	init := &protocol.ClientInit{
+		Accepted:     true,
+		PlayerIndex:  byte(playerIndex),
+		Players:      make([]protocol.ClientInitPlayer, len(lobby.slots)),
+		LocalSteamID: client.steamID,
+	}
+	for i, other := range lobby.slots {
+		if other != nil {
+			init.Players[i] = protocol.ClientInitPlayer{SteamID: other.steamID, Stats: &protocol.PlayerStats{}}
+		}
+	}
+	srv.send(client, init, 0, 0)
+
+	for _, other := range lobby.clients() {
+		if other != client {
+			for i := 0; i < client.playerCount; i++ {
+				srv.send(other, &protocol.ClientJoined{PlayerIndex: byte(playerIndex + i), SteamID: client.steamID}, 0, 0)
+			}
+		}
+	}
+}
+
+//leave takes a client's players out of its lobby, closing the lobby once it's empty
+func (srv *Server) leave(client *serverClient) {
+	lobby := client.lobby
+	if lobby == nil {
+		return
+	}
+
+	client.lobby = nil
+	for i, slot := range lobby.slots {
+		if slot == client {
+			lobby.slots[i] = nil
+		}
+	}
+	if len(lobby.clients()) == 0 {
+		delete(srv.lobbies, lobby.code)
+	}
+}
+
+//remove forgets a client
+func (srv *Server) remove(client *serverClient) {
+	srv.leave(client)
+	delete(srv.clients, client.addr.String())
+}
+
+//relay passes a client's message along to the rest of its lobby
+func (srv *Server) relay(client *serverClient, msg protocol.Message, channel int) {
+	for _, other := range client.lobby.clients() {
+		if other != client {
+			srv.send(other, msg, channel, client.steamID)
+		}
+	}
+}
+
+//say sends a chat message as a client's first player to its whole lobby
+func (srv *Server) say(client *serverClient, msg string, data ...interface{}) {
+	talked := &protocol.PlayerTalked{Message: fmt.Sprintf(msg, data...)}
+	for _, other := range client.lobby.clients() {
+		srv.send(other, talked, protocol.ChannelEvent(client.playerIndex), client.steamID)
+	}
+}
+
+//send sends a message to a client, reliably if it's reliable and the client negotiated it
+func (srv *Server) send(client *serverClient, msg protocol.Message, channel int, steamID uint64) {
+	packet, err := protocol.NewPacketFromMessage(msg, channel, steamID)
+	if err != nil {
+		return
+	}
+
+	data := packet.AsBytes()
+	if client.reliable && packet.ShouldSendReliably() {
+		data = client.reliability.Send(packet)
+	}
+	srv.conn.WriteToUDP(data, client.addr)
+}
+
+//clients returns every client with a player in the lobby
+func (lobby *serverLobby) clients() []*serverClient {
+	clients := make([]*serverClient, 0, len(lobby.slots))
+	for _, client := range lobby.slots {
+		if client != nil && (len(clients) == 0 || clients[len(clients)-1] != client) {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+//open returns the first player index with enough open slots after it for the amount of players, or -1 if there's no room
+func (lobby *serverLobby) open(playerCount int) int {
+	for playerIndex := 0; playerIndex+playerCount <= len(lobby.slots); playerIndex++ {
+		room := true
+		for i := playerIndex; i < playerIndex+playerCount; i++ {
+			if lobby.slots[i] != nil {
+				room = false
+				break
+			}
+		}
+		if room {
+			return playerIndex
+		}
+	}
+	return -1
+}
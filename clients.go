@@ -2,6 +2,9 @@ package main
 
 import (
 	"net"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
 )
 
 //Client holds a session with a lobby
@@ -10,9 +13,13 @@ type Client struct {
 
 	//The actual client details
 	Addr *net.UDPAddr
-	//LastTick time.Time
+	LastTick time.Time //The last time a packet was received from this client
+	LastPing time.Time //The last time the server pinged this client
 	PingInMs float64
 	Closed   bool
+	Disconnected   bool      //If the client timed out and its slot is being held for it to reconnect
+	DisconnectedAt time.Time //When the client timed out
+	Session  []byte //The session token that every packet from this client must be signed with
 
 	//The players on this client
 	SteamID CSteamID
@@ -21,17 +28,22 @@ type Client struct {
 	//Client session tracking
 	Paused bool //If the player is marked as paused, will make the lobby ignore the player's automatic ready-up
 	ClientInit *Packet //Cached ClientInit packet for lobby migration
+	Reliability *protocol.Reliability //The reliable delivery state for each channel sent to and received from this client
+	Dialect *protocol.Dialect //The protocol version this client speaks, which every packet is translated to and from
+	Extensions byte //The version of the server's protocol extensions agreed on with this client, which decides if it's sent packets reliably
 }
 
 //NewClient returns a new client
-func NewClient(lobby *Lobby, addr *net.UDPAddr, steamID uint64, playerCount int, clientInit *Packet) *Client {
+func NewClient(lobby *Lobby, addr *net.UDPAddr, steamID uint64, playerCount int, clientInit *Packet, session []byte) *Client {
 	newClient := &Client{
 		Lobby: lobby,
 		Addr:  addr,
-		//LastTick: time.Now(),
+		LastTick: time.Now(),
+		Session: session,
 		SteamID: NewCSteamID(steamID),
 		Players: make([]*Player, playerCount),
 		ClientInit: clientInit,
+		Reliability: protocol.NewReliability(),
 	}
 
 	for i := 0; i < playerCount; i++ {
@@ -45,12 +57,11 @@ func NewClient(lobby *Lobby, addr *net.UDPAddr, steamID uint64, playerCount int,
 	return newClient
 }
 
-//Close closes a client
+//Close closes a client, after Lobby.Disconnect or Lobby.CloseWithReason has told it why
 func (client *Client) Close() {
 	if client.Closed {
 		return
 	}
-	//TODO: Send a kick packet to tell the player they were kicked
 	client.Addr = nil
 	client.PingInMs = 0
 	client.SteamID = NewCSteamID(0)
@@ -58,6 +69,16 @@ func (client *Client) Close() {
 	client.Closed = true
 }
 
+//IsTimedOut returns true if the client hasn't sent a packet within the client timeout
+func (client *Client) IsTimedOut(now time.Time) bool {
+	return now.Sub(client.LastTick) > time.Duration(clientTimeout)*time.Second
+}
+
+//IsGraceExpired returns true if the client has been disconnected for longer than the reconnect grace period
+func (client *Client) IsGraceExpired(now time.Time) bool {
+	return client.Disconnected && now.Sub(client.DisconnectedAt) > time.Duration(reconnectGrace)*time.Second
+}
+
 //IsClosed returns if the client is closed
 func (client *Client) IsClosed() bool {
 	return client.Closed
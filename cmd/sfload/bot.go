@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/client"
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+const (
+	chatPrefix   = "sfload " //Starts every chat message a bot sends, followed by when it was sent
+	pingDataSize = 16        //The size of a bot's ping data, an 8 byte ID and the 8 byte UnixNano time it was sent
+	pingMagic    = 0x5346    //Marks the ID of a bot's ping, to tell its responses from anything else
+	drainTime    = time.Second
+)
+
+//bot plays a simulated client in a lobby
+type bot struct {
+	Client      *client.Client //The client's connection
+	Lobby       *lobby         //The lobby the client is in
+	PlayerIndex int            //The client's only player
+
+	stats  *loadStats
+	random *rand.Rand
+
+	//The player's position, which wanders around like a real player's would
+	positionY, positionZ float32
+	velocityY, velocityZ float32
+}
+
+func newBot(sfClient *client.Client, lobby *lobby, stats *loadStats) *bot {
+	return &bot{
+		Client:      sfClient,
+		Lobby:       lobby,
+		PlayerIndex: sfClient.PlayerIndexes()[0],
+		stats:       stats,
+		random:      rand.New(rand.NewSource(int64(sfClient.SteamID))),
+	}
+}
+
+//Run readies up and sends traffic until stopped, then waits for stragglers and leaves
+func (bot *bot) Run(stop chan struct{}) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bot.readEvents()
+	}()
+
+	bot.Client.ReadyUp(bot.PlayerIndex)
+
+	updateTicker := time.NewTicker(time.Second / time.Duration(updateRate))
+	chatTicker := time.NewTicker(time.Duration(chatInterval) * time.Second)
+	damageTicker := time.NewTicker(time.Duration(damageInterval) * time.Second)
+	pingTicker := time.NewTicker(time.Duration(pingInterval) * time.Millisecond)
+	defer updateTicker.Stop()
+	defer chatTicker.Stop()
+	defer damageTicker.Stop()
+	defer pingTicker.Stop()
+
+	var pingID uint32
+	running := true
+	for running {
+		select {
+		case <-stop:
+			running = false
+		case <-bot.Client.Done:
+			log.Error("Client ", bot.Client.SteamID, " was removed from lobby ", bot.Lobby.Code, ": ", bot.Client.Err())
+			return
+		case <-updateTicker.C:
+			bot.sendPlayerUpdate()
+		case <-chatTicker.C:
+			bot.sendChat()
+		case <-damageTicker.C:
+			bot.sendDamage()
+		case <-pingTicker.C:
+			pingID++
+			bot.sendPing(pingID)
+		}
+	}
+
+	//Give the last responses a chance to arrive before counting them as lost
+	time.Sleep(drainTime)
+	bot.Client.Close()
+	<-done
+}
+
+func (bot *bot) sendPlayerUpdate() {
+	//Drift around the middle of the map, bouncing off its edges
+	bot.velocityY += (bot.random.Float32() - 0.5) * 0.2
+	bot.velocityZ += (bot.random.Float32() - 0.5) * 0.2
+	bot.positionY += bot.velocityY
+	bot.positionZ += bot.velocityZ
+	if bot.positionY < -10 || bot.positionY > 10 {
+		bot.velocityY = -bot.velocityY
+	}
+	if bot.positionZ < -5 || bot.positionZ > 10 {
+		bot.velocityZ = -bot.velocityZ
+	}
+
+	update := &protocol.PlayerUpdate{
+		PositionY:    int16(bot.positionY * 100),
+		PositionZ:    int16(bot.positionZ * 100),
+		RotationX:    byte(bot.random.Intn(100)),
+		RotationY:    byte(bot.random.Intn(100)),
+		YValue:       byte(bot.random.Intn(100)),
+		MovementType: byte(bot.random.Intn(3)),
+		Weapon:       byte(bot.random.Intn(4)),
+	}
+	if bot.random.Intn(20) == 0 { //Fire now and then
+		update.FightState = 1
+		update.Projectiles = []protocol.ProjectileUpdate{{
+			ShootPositionX: update.PositionY,
+			ShootPositionY: update.PositionZ,
+			ShootX:         byte(bot.random.Intn(256)),
+			ShootY:         byte(bot.random.Intn(256)),
+			SyncIndex:      uint16(bot.random.Intn(65536)),
+		}}
+	}
+
+	if bot.Client.SendPlayerUpdate(bot.PlayerIndex, update) == nil {
+		atomic.AddUint64(&bot.stats.UpdatesSent, 1)
+	}
+}
+
+func (bot *bot) sendChat() {
+	if bot.Client.Say(bot.PlayerIndex, chatPrefix+strconv.FormatInt(time.Now().UnixNano(), 10)) != nil {
+		return
+	}
+	atomic.AddUint64(&bot.stats.ChatsSent, 1)
+	atomic.AddUint64(&bot.stats.ChatsExpected, uint64(len(bot.Lobby.Bots)-1)) //Everyone else in the lobby should hear it
+}
+
+func (bot *bot) sendDamage() {
+	playerIndexes := bot.Lobby.PlayerIndexes()
+	if len(playerIndexes) < 2 {
+		return //Nobody to be hurt by
+	}
+
+	attackerIndex := playerIndexes[bot.random.Intn(len(playerIndexes))]
+	for attackerIndex == bot.PlayerIndex {
+		attackerIndex = playerIndexes[bot.random.Intn(len(playerIndexes))]
+	}
+
+	tookDamage := &protocol.PlayerTookDamage{
+		AttackerIndex:      byte(attackerIndex),
+		Damage:             5 + bot.random.Float32()*10,
+		PlayParticles:      true,
+		ParticleDirectionX: bot.random.Float32()*2 - 1,
+		ParticleDirectionY: bot.random.Float32()*2 - 1,
+	}
+	if bot.Client.SendPlayerTookDamage(bot.PlayerIndex, tookDamage) == nil {
+		atomic.AddUint64(&bot.stats.DamageSent, 1)
+	}
+}
+
+func (bot *bot) sendPing(pingID uint32) {
+	data := make([]byte, pingDataSize)
+	binary.LittleEndian.PutUint32(data, pingMagic)
+	binary.LittleEndian.PutUint32(data[4:], pingID)
+	binary.LittleEndian.PutUint64(data[8:], uint64(time.Now().UnixNano()))
+	if bot.Client.Ping(data) == nil {
+		atomic.AddUint64(&bot.stats.PingsSent, 1)
+	}
+}
+
+//readEvents measures the responses to the bot's pings and the chat messages of the rest of the lobby
+func (bot *bot) readEvents() {
+	for {
+		var event *client.Event
+		select {
+		case event = <-bot.Client.Events:
+		case <-bot.Client.Done:
+			return
+		}
+
+		now := time.Now()
+		switch msg := event.Message.(type) {
+		case *protocol.PingResponse:
+			if event.Packet.SteamID.ID != 0 || len(msg.Data) != pingDataSize || binary.LittleEndian.Uint32(msg.Data) != pingMagic {
+				continue
+			}
+			sentAt := time.Unix(0, int64(binary.LittleEndian.Uint64(msg.Data[8:])))
+			atomic.AddUint64(&bot.stats.PingsReceived, 1)
+			bot.stats.PingRTT.Add(now.Sub(sentAt))
+
+		case *protocol.PlayerTalked:
+			if event.Packet.SteamID.ID == bot.Client.SteamID || !strings.HasPrefix(msg.Message, chatPrefix) {
+				continue
+			}
+			sentAt, err := strconv.ParseInt(strings.TrimPrefix(msg.Message, chatPrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			atomic.AddUint64(&bot.stats.ChatsReceived, 1)
+			bot.stats.ChatLatency.Add(now.Sub(time.Unix(0, sentAt)))
+
+		case *protocol.PlayerUpdate:
+			atomic.AddUint64(&bot.stats.UpdatesReceived, 1)
+		}
+	}
+}
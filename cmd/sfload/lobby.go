@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/client"
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+const (
+	roomCodePrefix = "Room code: " //How the server answers /code
+)
+
+//lobby is a server lobby filled with simulated clients
+type lobby struct {
+	Code string //The lobby's room code
+	Bots []*bot //The clients that made it into the lobby
+}
+
+//Fill joins a lobby with the first client, opens it up to the rest, and joins them into it one at a time
+func (lobby *lobby) Fill(serverAddr string, firstSteamID uint64, size int, stats *loadStats) {
+	timeout := time.Duration(joinTimeout) * time.Second
+
+	host, err := client.DialTimeout(serverAddr, firstSteamID, 1, timeout)
+	if err != nil {
+		log.Error("Client ", firstSteamID, " couldn't join: ", err)
+		return
+	}
+	hostIndex := host.PlayerIndexes()[0]
+
+	//Every client joining the server gets its own lobby, so the host opens its up for the others to /join
+	host.Say(hostIndex, "/public")
+	if size > len(host.Init().Players) {
+		host.Say(hostIndex, fmt.Sprintf("/maxplayers %d", size))
+	}
+	host.Say(hostIndex, "/code")
+	awaitEvent(host, timeout, func(event *client.Event) bool {
+		talked, ok := event.Message.(*protocol.PlayerTalked)
+		if ok && event.Packet.SteamID.ID == host.SteamID && strings.HasPrefix(talked.Message, roomCodePrefix) {
+			lobby.Code = strings.TrimPrefix(talked.Message, roomCodePrefix)
+			return true
+		}
+		return false
+	})
+	if lobby.Code == "" {
+		log.Error("Client ", firstSteamID, " couldn't find out its room code")
+		host.Close()
+		return
+	}
+	log.Debug("Opened lobby ", lobby.Code, " for ", size, " clients")
+	lobby.Bots = append(lobby.Bots, newBot(host, lobby, stats))
+
+	for i := 1; i < size; i++ {
+		steamID := firstSteamID + uint64(i)
+		guest, err := client.DialTimeout(serverAddr, steamID, 1, timeout)
+		if err != nil {
+			log.Error("Client ", steamID, " couldn't join: ", err)
+			continue
+		}
+
+		guest.Say(guest.PlayerIndexes()[0], "/join "+lobby.Code)
+		joined := awaitEvent(guest, timeout, func(event *client.Event) bool {
+			clientInit, ok := event.Message.(*protocol.ClientInit)
+			return ok && clientInit.Accepted
+		})
+		if !joined {
+			log.Error("Client ", steamID, " couldn't join lobby ", lobby.Code)
+			guest.Close()
+			continue
+		}
+		lobby.Bots = append(lobby.Bots, newBot(guest, lobby, stats))
+	}
+}
+
+//PlayerIndexes returns the player index of every client in the lobby
+func (lobby *lobby) PlayerIndexes() []int {
+	playerIndexes := make([]int, 0, len(lobby.Bots))
+	for _, bot := range lobby.Bots {
+		playerIndexes = append(playerIndexes, bot.PlayerIndex)
+	}
+	return playerIndexes
+}
+
+//awaitEvent reads a client's events until one matches, returning false if none did in time
+func awaitEvent(sfClient *client.Client, timeout time.Duration, match func(event *client.Event) bool) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event := <-sfClient.Events:
+			if match(event) {
+				return true
+			}
+		case <-sfClient.Done:
+			return false
+		case <-deadline:
+			return false
+		}
+	}
+}
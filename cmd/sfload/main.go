@@ -0,0 +1,162 @@
+//sfload simulates many Stick Fight clients against a local server, and reports how well it keeps up
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/JoshuaDoes/logger"
+)
+
+//Command-line flags and their defaults
+var (
+	address        = "127.0.0.1:1337"          //The server to load test, which must be on localhost
+	clientCount    = 100                       //The amount of simulated clients
+	lobbyCount     = 10                        //The amount of lobbies to spread them across
+	duration       = 30                        //The amount of seconds to send traffic for
+	updateRate     = 30                        //The amount of playerUpdates per second per client
+	chatInterval   = 5                         //The amount of seconds between chat messages per client
+	damageInterval = 2                         //The amount of seconds between taking damage per client
+	pingInterval   = 250                       //The amount of milliseconds between pings per client
+	joinTimeout    = 10                        //The amount of seconds to wait for a client to join its lobby
+	steamIDBase    = uint64(76561190000000000) //The Steam ID of the first client, the rest count up from it
+	verbosityLevel = 0                         //The verbosity level of debug log output
+)
+
+var (
+	log *logger.Logger //Console logger
+)
+
+func init() {
+	flag.StringVar(&address, "address", address, "The IP and port of the server to load test, which must be on localhost")
+	flag.IntVar(&clientCount, "clients", clientCount, "The amount of simulated clients")
+	flag.IntVar(&lobbyCount, "lobbies", lobbyCount, "The amount of lobbies to spread the clients across")
+	flag.IntVar(&duration, "duration", duration, "The amount of seconds to send traffic for")
+	flag.IntVar(&updateRate, "updateRate", updateRate, "The amount of playerUpdates per second per client")
+	flag.IntVar(&chatInterval, "chatInterval", chatInterval, "The amount of seconds between chat messages per client")
+	flag.IntVar(&damageInterval, "damageInterval", damageInterval, "The amount of seconds between taking damage per client")
+	flag.IntVar(&pingInterval, "pingInterval", pingInterval, "The amount of milliseconds between pings per client")
+	flag.IntVar(&joinTimeout, "joinTimeout", joinTimeout, "The amount of seconds to wait for a client to join its lobby")
+	flag.Uint64Var(&steamIDBase, "steamIDBase", steamIDBase, "The Steam ID of the first client, the rest count up from it")
+	flag.IntVar(&verbosityLevel, "verbosity", verbosityLevel, "The verbosity level of debug log output")
+}
+
+func main() {
+	flag.Parse()
+	log = logger.NewLogger("sf:load", verbosityLevel)
+
+	if err := checkFlags(); err != nil {
+		log.Fatal(err)
+	}
+	serverAddr, err := localhost(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := run(serverAddr, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//checkFlags refuses flags that can't make a load test
+func checkFlags() error {
+	if clientCount < 1 || lobbyCount < 1 || clientCount < lobbyCount {
+		return errors.New("clients and lobbies must be above 0, with at least one client per lobby")
+	}
+	if duration <= 0 || updateRate <= 0 || chatInterval <= 0 || damageInterval <= 0 || pingInterval <= 0 || joinTimeout <= 0 {
+		return errors.New("duration, updateRate, chatInterval, damageInterval, pingInterval and joinTimeout must be above 0")
+	}
+	return nil
+}
+
+//run joins every client to the server and sends traffic for the duration, then writes the report
+func run(serverAddr string, report io.Writer) error {
+	stats := newLoadStats()
+
+	//Fill every lobby at once, but each lobby one client at a time so they all land in it
+	log.Info("Joining ", clientCount, " clients across ", lobbyCount, " lobbies on ", serverAddr, "...")
+	lobbies := make([]*lobby, lobbyCount)
+	var wg sync.WaitGroup
+	for i := range lobbies {
+		size := clientCount / lobbyCount
+		if i < clientCount%lobbyCount {
+			size++
+		}
+		firstSteamID := steamIDBase + uint64(i*(clientCount/lobbyCount)) + uint64(minInt(i, clientCount%lobbyCount))
+
+		lobbies[i] = &lobby{}
+		wg.Add(1)
+		go func(lobby *lobby) {
+			defer wg.Done()
+			lobby.Fill(serverAddr, firstSteamID, size, stats)
+		}(lobbies[i])
+	}
+	wg.Wait()
+
+	bots := make([]*bot, 0, clientCount)
+	for _, lobby := range lobbies {
+		bots = append(bots, lobby.Bots...)
+	}
+	if len(bots) == 0 {
+		return errors.New("no clients were able to join")
+	}
+	log.Info("Joined ", len(bots), " clients, ", clientCount-len(bots), " failed to join")
+
+	//Send traffic until the duration is up, reporting throughput every second
+	stop := make(chan struct{})
+	for _, simulated := range bots {
+		wg.Add(1)
+		go func(simulated *bot) {
+			defer wg.Done()
+			simulated.Run(stop)
+		}(simulated)
+	}
+
+	start := time.Now()
+	last := trafficOf(bots)
+	ticker := time.NewTicker(time.Second)
+	for time.Since(start) < time.Duration(duration)*time.Second {
+		<-ticker.C
+		now := trafficOf(bots)
+		log.Info(fmt.Sprintf("Sent %d packets/s (%s/s), received %d packets/s (%s/s)",
+			now.PacketsSent-last.PacketsSent, formatBytes(now.BytesSent-last.BytesSent),
+			now.PacketsReceived-last.PacketsReceived, formatBytes(now.BytesReceived-last.BytesReceived)))
+		last = now
+	}
+	ticker.Stop()
+	elapsed := time.Since(start)
+
+	close(stop)
+	wg.Wait()
+
+	stats.Report(report, len(bots), clientCount-len(bots), lobbyCount, trafficOf(bots), elapsed)
+	return nil
+}
+
+//localhost returns the address to load test, refusing anything that isn't on this machine
+func localhost(address string) (string, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return "", err
+	}
+	if udpAddr.IP == nil || udpAddr.IP.IsUnspecified() {
+		udpAddr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	if !udpAddr.IP.IsLoopback() {
+		return "", fmt.Errorf("refusing to load test %s, only localhost is allowed", udpAddr.IP)
+	}
+	return udpAddr.String(), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/JoshuaDoes/logger"
+	"github.com/StickFightDev/StickFightDedicatedSrv/client/clienttest"
+)
+
+func TestMain(m *testing.M) {
+	log = logger.NewLogger("sf:load:test", verbosityLevel)
+	os.Exit(m.Run())
+}
+
+//parseFlags parses the arguments into sfload's flags from their defaults, which they go back to when the test ends
+func parseFlags(t *testing.T, args ...string) {
+	t.Helper()
+
+	reset := func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "test.") {
+				f.Value.Set(f.DefValue)
+			}
+		})
+	}
+	reset()
+	t.Cleanup(reset)
+
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	parseFlags(t)
+	if err := checkFlags(); err != nil {
+		t.Fatalf("default flags were refused: %v", err)
+	}
+
+	parseFlags(t, "-address", "127.0.0.1:4000", "-clients", "6", "-lobbies", "2", "-duration", "3", "-updateRate", "10",
+		"-chatInterval", "4", "-damageInterval", "5", "-pingInterval", "100", "-joinTimeout", "2", "-steamIDBase", "5")
+	if err := checkFlags(); err != nil {
+		t.Fatalf("valid flags were refused: %v", err)
+	}
+	if address != "127.0.0.1:4000" || clientCount != 6 || lobbyCount != 2 || duration != 3 || updateRate != 10 ||
+		chatInterval != 4 || damageInterval != 5 || pingInterval != 100 || joinTimeout != 2 || steamIDBase != 5 {
+		t.Fatal("flags weren't parsed into their variables")
+	}
+
+	for _, args := range [][]string{
+		{"-clients", "0"},
+		{"-lobbies", "0"},
+		{"-clients", "2", "-lobbies", "3"},
+		{"-duration", "0"},
+		{"-updateRate", "0"},
+		{"-chatInterval", "-1"},
+		{"-damageInterval", "0"},
+		{"-pingInterval", "0"},
+		{"-joinTimeout", "0"},
+	} {
+		parseFlags(t, args...)
+		if checkFlags() == nil {
+			t.Errorf("flags %v were accepted", args)
+		}
+	}
+}
+
+func TestLocalhost(t *testing.T) {
+	for address, expected := range map[string]string{
+		"127.0.0.1:1337": "127.0.0.1:1337",
+		":1337":          "127.0.0.1:1337",
+		"0.0.0.0:1337":   "127.0.0.1:1337",
+		"[::1]:1337":     "[::1]:1337",
+	} {
+		if serverAddr, err := localhost(address); err != nil || serverAddr != expected {
+			t.Errorf("address %s was taken as %s (%v), expected %s", address, serverAddr, err, expected)
+		}
+	}
+
+	for _, address := range []string{"8.8.8.8:1337", "192.168.1.1:1337", "127.0.0.1:port"} {
+		if _, err := localhost(address); err == nil {
+			t.Errorf("address %s was accepted", address)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	srv, err := clienttest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	//The first lobby is too big for a new lobby's player slots, so its host has to raise them
+	parseFlags(t, "-clients", "9", "-lobbies", "2", "-duration", "1", "-chatInterval", "1", "-damageInterval", "1", "-pingInterval", "50", "-joinTimeout", "5")
+	report := &bytes.Buffer{}
+	if err := run(srv.Addr, report); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(report.String(), "Load test of 9 clients (0 failed to join) across 2 lobbies") {
+		t.Fatalf("not every client joined:\n%s", report)
+	}
+	if !strings.Contains(report.String(), "Server latency, ping round trip: n=") {
+		t.Fatalf("no pings came back:\n%s", report)
+	}
+	received := regexp.MustCompile(`Received: (\d+) playerUpdates`).FindStringSubmatch(report.String())
+	if received == nil {
+		t.Fatalf("report doesn't say how many playerUpdates were received:\n%s", report)
+	}
+	if updates, _ := strconv.Atoi(received[1]); updates == 0 {
+		t.Fatalf("no playerUpdates reached the rest of their lobbies:\n%s", report)
+	}
+}
+
+func TestRunWithoutServer(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	parseFlags(t, "-clients", "2", "-lobbies", "2", "-joinTimeout", "1")
+	if err := run(silent.LocalAddr().String(), &bytes.Buffer{}); err == nil {
+		t.Fatal("run succeeded without a server to join")
+	}
+}
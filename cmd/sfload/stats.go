@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/client"
+)
+
+//loadStats holds what every bot measured, safe to use from any goroutine
+type loadStats struct {
+	//Accessed atomically, first so they're aligned for atomic access
+	UpdatesSent, UpdatesReceived uint64
+	ChatsSent, ChatsExpected     uint64
+	ChatsReceived                uint64
+	DamageSent                   uint64
+	PingsSent, PingsReceived     uint64
+
+	PingRTT     *latencies //How long pings take to come back through their lobby's event loop
+	ChatLatency *latencies //How long chat messages take to reach the rest of the lobby
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{
+		PingRTT:     &latencies{},
+		ChatLatency: &latencies{},
+	}
+}
+
+//latencies collects latency samples to take percentiles of
+type latencies struct {
+	sync.Mutex
+
+	samples []time.Duration
+}
+
+//Add records a latency sample
+func (lat *latencies) Add(sample time.Duration) {
+	lat.Lock()
+	defer lat.Unlock()
+	lat.samples = append(lat.samples, sample)
+}
+
+//String returns the sample count and the p50, p90, p99 and max latencies
+func (lat *latencies) String() string {
+	lat.Lock()
+	samples := make([]time.Duration, len(lat.samples))
+	copy(samples, lat.samples)
+	lat.Unlock()
+
+	if len(samples) == 0 {
+		return "no samples"
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	percentile := func(p float64) time.Duration {
+		return samples[int(p*float64(len(samples)-1))]
+	}
+	return fmt.Sprintf("n=%d p50=%s p90=%s p99=%s max=%s",
+		len(samples), percentile(0.5), percentile(0.9), percentile(0.99), samples[len(samples)-1])
+}
+
+//Report writes the summary of a load test
+func (stats *loadStats) Report(w io.Writer, joined, failed, lobbies int, traffic client.Stats, elapsed time.Duration) {
+	pingsSent := atomic.LoadUint64(&stats.PingsSent)
+	pingsReceived := atomic.LoadUint64(&stats.PingsReceived)
+	chatsExpected := atomic.LoadUint64(&stats.ChatsExpected)
+	chatsReceived := atomic.LoadUint64(&stats.ChatsReceived)
+	seconds := elapsed.Seconds()
+
+	fmt.Fprintf(w, "\nLoad test of %d clients (%d failed to join) across %d lobbies for %s\n", joined, failed, lobbies, elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Server latency, ping round trip: %s\n", stats.PingRTT)
+	fmt.Fprintf(w, "Server latency, chat delivery:   %s\n", stats.ChatLatency)
+	fmt.Fprintf(w, "Packet loss, pings:              %s (%d/%d lost)\n", lossOf(pingsSent, pingsReceived), lost(pingsSent, pingsReceived), pingsSent)
+	fmt.Fprintf(w, "Packet loss, chat deliveries:    %s (%d/%d lost)\n", lossOf(chatsExpected, chatsReceived), lost(chatsExpected, chatsReceived), chatsExpected)
+	fmt.Fprintf(w, "Sent:     %d playerUpdates, %d chat messages, %d damage\n",
+		atomic.LoadUint64(&stats.UpdatesSent), atomic.LoadUint64(&stats.ChatsSent), atomic.LoadUint64(&stats.DamageSent))
+	fmt.Fprintf(w, "Received: %d playerUpdates\n", atomic.LoadUint64(&stats.UpdatesReceived))
+	fmt.Fprintf(w, "Throughput, sent:     %.0f packets/s (%s/s)\n", float64(traffic.PacketsSent)/seconds, formatBytes(uint64(float64(traffic.BytesSent)/seconds)))
+	fmt.Fprintf(w, "Throughput, received: %.0f packets/s (%s/s)\n", float64(traffic.PacketsReceived)/seconds, formatBytes(uint64(float64(traffic.BytesReceived)/seconds)))
+	if traffic.Dropped > 0 {
+		fmt.Fprintf(w, "Events dropped by the load tester falling behind: %d\n", traffic.Dropped)
+	}
+}
+
+//trafficOf totals the traffic of every bot's client
+func trafficOf(bots []*bot) client.Stats {
+	total := client.Stats{}
+	for _, bot := range bots {
+		stats := bot.Client.Stats()
+		total.PacketsSent += stats.PacketsSent
+		total.PacketsReceived += stats.PacketsReceived
+		total.BytesSent += stats.BytesSent
+		total.BytesReceived += stats.BytesReceived
+		total.Dropped += stats.Dropped
+	}
+	return total
+}
+
+func lost(expected, received uint64) uint64 {
+	if received > expected {
+		return 0
+	}
+	return expected - received
+}
+
+func lossOf(expected, received uint64) string {
+	if expected == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2f%%", float64(lost(expected, received))*100/float64(expected))
+}
+
+func formatBytes(bytes uint64) string {
+	switch {
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", float64(bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", bytes)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+//dumpCommand decodes every packet in the captures and hex dumps named in its arguments, or in a hex dump on stdin, and returns the exit code: 2 if any couldn't be read
+func dumpCommand(args []string) int {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	types := flags.String("type", "", "The comma-separated packet types to show, by name or number")
+	channels := flags.String("channel", "", "The comma-separated channels to show")
+	steamID := flags.Uint64("steamID", 0, "Only show packets carrying this Steam ID, or sent to or received from its client in a capture")
+	raw := flags.Bool("raw", false, "Also show the raw data of every packet")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: dump [-type playerUpdate,mapChange] [-channel 2,3] [-steamID id] [-raw] [capture.sfcap|packets.hex|-]...")
+		fmt.Fprintln(flags.Output(), "Decodes every packet in captures, or in hex dumps holding one packet per line, field by field. Without any files, reads a hex dump from stdin.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	filter, err := newDumpFilter(*types, *channels, *steamID)
+	if err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		return 2
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	dump := &dumper{w: os.Stdout, filter: filter, raw: *raw}
+	code := 0
+	for _, path := range paths {
+		if err := dump.Path(path); err != nil {
+			log.Error("Unable to dump ", path, ": ", err)
+			code = 2
+		}
+	}
+	return code
+}
+
+//dumpFilter picks the packets to dump, and picks every packet when empty
+type dumpFilter struct {
+	Types    map[PacketType]bool
+	Channels map[int]bool
+	SteamID  uint64
+}
+
+//newDumpFilter returns a filter for comma-separated lists of packet types and channels, and a Steam ID, where each is left out if empty or 0
+func newDumpFilter(types, channels string, steamID uint64) (*dumpFilter, error) {
+	filter := &dumpFilter{
+		Types:    make(map[PacketType]bool),
+		Channels: make(map[int]bool),
+		SteamID:  steamID,
+	}
+
+	for _, name := range splitList(types) {
+		packetType, ok := protocol.ParsePacketType(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown packet type %q", name)
+		}
+		filter.Types[packetType] = true
+	}
+	for _, number := range splitList(channels) {
+		channel, err := strconv.Atoi(number)
+		if err != nil || channel < 0 || channel > 0x3F {
+			return nil, fmt.Errorf("invalid channel %q", number)
+		}
+		filter.Channels[channel] = true
+	}
+
+	return filter, nil
+}
+
+//splitList splits a list separated by commas or spaces
+func splitList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+//Empty returns true if the filter picks every packet
+func (filter *dumpFilter) Empty() bool {
+	return len(filter.Types) == 0 && len(filter.Channels) == 0 && filter.SteamID == 0
+}
+
+//Match returns true if the filter picks a packet, which was sent to or received from the client with the specified Steam ID, or 0 if unknown
+func (filter *dumpFilter) Match(packet *Packet, clientSteamID uint64) bool {
+	if len(filter.Types) > 0 && !filter.Types[packet.Type] {
+		return false
+	}
+	if len(filter.Channels) > 0 && !filter.Channels[packet.Channel] {
+		return false
+	}
+	if filter.SteamID != 0 && packet.SteamID.ID != filter.SteamID && clientSteamID != filter.SteamID {
+		return false
+	}
+	return true
+}
+
+//dumper writes the packets its filter picks, decoded field by field
+type dumper struct {
+	w      io.Writer
+	filter *dumpFilter
+	raw    bool //If the raw data of every packet is written too
+}
+
+//Path dumps a capture or hex dump file, telling them apart by the capture magic, or a hex dump on stdin if the path is "-"
+func (dump *dumper) Path(path string) error {
+	if path == "-" {
+		return dump.Hex(os.Stdin, "stdin")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	if magic, _ := r.Peek(len(captureMagic)); string(magic) == captureMagic {
+		return dump.Capture(path)
+	}
+	return dump.Hex(r, path)
+}
+
+//Capture dumps every record of a capture file
+func (dump *dumper) Capture(path string) error {
+	reader, err := OpenCapture(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	header := reader.Header
+
+	fmt.Fprintf(dump.w, "%s: lobby %s captured at %s with seed %d, starting on %s\n",
+		path, header.RoomCode, header.Start.Format(time.RFC3339), header.Seed, header.Map)
+
+	steamIDs := make(map[addrKey]uint64) //The Steam ID each captured address joined with
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		prefix := fmt.Sprintf("%9.3fs %-6s %-21s", record.Time.Seconds(), record.Direction, record.Addr)
+		packet, err := protocol.NewPacketFromBytes(record.Data)
+		if err != nil {
+			dump.Malformed(prefix, record.Data, err)
+			continue
+		}
+
+		key := newAddrKey(record.Addr)
+		if record.Direction == CaptureJoined {
+			request := &protocol.ClientRequestingIndex{}
+			if packet.Decode(request) == nil {
+				steamIDs[key] = request.SteamID
+			}
+		}
+		dump.Packet(prefix, packet, steamIDs[key])
+	}
+}
+
+//Hex dumps a hex dump holding one packet per line, skipping blank lines and lines starting with #
+func (dump *dumper) Hex(r io.Reader, name string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, maxBufferSize), maxBufferSize*4) //Every hex digit pair is one byte, and there may be a separator between them
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		prefix := fmt.Sprintf("%s:%d", name, line)
+		data, err := parseHexDump(text)
+		if err != nil {
+			dump.Malformed(prefix, nil, err)
+			continue
+		}
+		packet, err := protocol.NewPacketFromBytes(data)
+		if err != nil {
+			dump.Malformed(prefix, data, err)
+			continue
+		}
+		dump.Packet(prefix, packet, 0)
+	}
+	return scanner.Err()
+}
+
+//parseHexDump returns the bytes in a line of hex, which may be separated by spaces, colons, dashes or commas and prefixed with 0x
+func parseHexDump(text string) ([]byte, error) {
+	text = strings.NewReplacer("0x", "", "0X", "", " ", "", "\t", "", ":", "", "-", "", ",", "").Replace(text)
+	return hex.DecodeString(text)
+}
+
+//Malformed writes something that isn't a packet, unless the filter could have left it out
+func (dump *dumper) Malformed(prefix string, data []byte, err error) {
+	if !dump.filter.Empty() {
+		return
+	}
+
+	fmt.Fprintf(dump.w, "%s malformed: %v\n", prefix, err)
+	if len(data) > 0 {
+		fmt.Fprintf(dump.w, "    Raw: %s\n", dumpBytes(data))
+	}
+}
+
+//Packet writes a packet's header and its decoded fields if the filter picks it, and returns true if it did
+func (dump *dumper) Packet(prefix string, packet *Packet, clientSteamID uint64) bool {
+	if !dump.filter.Match(packet, clientSteamID) {
+		return false
+	}
+
+	line := fmt.Sprintf("%s %s ch %d", prefix, packet.Type, packet.Channel)
+	if channel := dumpChannel(packet.Channel); channel != "" {
+		line += " (" + channel + ")"
+	}
+	if packet.Sequence != 0 {
+		line += fmt.Sprintf(" #%d", packet.Sequence)
+	}
+	if packet.MAC != nil {
+		line += " signed"
+	}
+	if packet.SteamID.ID != 0 {
+		line += fmt.Sprintf(" steamID %d", packet.SteamID.ID)
+	}
+	fmt.Fprintf(dump.w, "%s, %d bytes\n", line, packet.ByteCapacity())
+
+	dumpMessage(dump.w, packet)
+	if dump.raw && packet.ByteCapacity() > 0 {
+		fmt.Fprintf(dump.w, "    Raw: %s\n", dumpBytes(packet.Bytes()))
+	}
+	return true
+}
+
+//dumpChannel describes what travels through a channel, or returns an empty string if nothing in particular does
+func dumpChannel(channel int) string {
+	switch {
+	case channel < protocol.ChannelUpdate(0):
+		return ""
+	case channel%2 == 0:
+		return fmt.Sprintf("player %d updates", (channel-protocol.ChannelUpdate(0))/2)
+	}
+	return fmt.Sprintf("player %d events", (channel-protocol.ChannelEvent(0))/2)
+}
+
+//dumpBytes returns bytes as spaced out hex
+func dumpBytes(data []byte) string {
+	if len(data) == 0 {
+		return "(none)"
+	}
+
+	str := hex.EncodeToString(data)
+	spaced := make([]string, 0, len(data))
+	for i := 0; i < len(str); i += 2 {
+		spaced = append(spaced, str[i:i+2])
+	}
+	return strings.Join(spaced, " ")
+}
+
+//dumpMessage writes the fields of a packet's data, decoded with the server's own packet definitions
+func dumpMessage(w io.Writer, packet *Packet) {
+	msg := protocol.NewMessage(packet.Type)
+	if err := packet.Decode(msg); err != nil {
+		fmt.Fprintf(w, "    Malformed: %v\n", err)
+		fmt.Fprintf(w, "    Raw: %s\n", dumpBytes(packet.Bytes()))
+		return
+	}
+
+	switch msg := msg.(type) {
+	case *protocol.PlayerUpdate:
+		dumpPlayerUpdate(w, msg)
+	case *protocol.PlayerTookDamage:
+		dumpPlayerTookDamage(w, msg)
+	case *protocol.MapChange:
+		dumpPlayerIndex(w, "Winner", msg.WinnerIndex)
+		fmt.Fprintf(w, "    Map: %s\n", msg.Map())
+	case *protocol.ClientInit:
+		dumpClientInit(w, msg)
+	default:
+		dumpFields(w, "    ", reflect.ValueOf(msg).Elem())
+	}
+}
+
+//dumpPlayerIndex writes a player index, where 255 is nobody
+func dumpPlayerIndex(w io.Writer, name string, playerIndex byte) {
+	if playerIndex == 255 {
+		fmt.Fprintf(w, "    %s: nobody\n", name)
+		return
+	}
+	fmt.Fprintf(w, "    %s: player %d\n", name, playerIndex)
+}
+
+func dumpPlayerUpdate(w io.Writer, update *protocol.PlayerUpdate) {
+	yValue := ""
+	switch update.YValue {
+	case 100:
+		yValue = " (holding up)"
+	case 156:
+		yValue = " (holding down)"
+	}
+
+	fmt.Fprintf(w, "    Position: Y %g, Z %g\n", float32(update.PositionY)/100.0, float32(update.PositionZ)/100.0)
+	fmt.Fprintf(w, "    Rotation: X %g, Y %g\n", float32(update.RotationX)/100.0, float32(update.RotationY)/100.0)
+	fmt.Fprintf(w, "    YValue: %g%s\n", float32(update.YValue)/100.0, yValue)
+	fmt.Fprintf(w, "    MovementType: %d\n", update.MovementType)
+	fmt.Fprintf(w, "    FightState: %d\n", update.FightState)
+	fmt.Fprintf(w, "    Weapon: %s (%d)\n", Weapon(update.Weapon), update.Weapon)
+	fmt.Fprintf(w, "    Projectiles: %d\n", len(update.Projectiles))
+	for i, projectile := range update.Projectiles {
+		fmt.Fprintf(w, "      [%d] shot from (%d, %d) towards (%d, %d), sync index %d\n", i,
+			projectile.ShootPositionX, projectile.ShootPositionY, projectile.ShootX, projectile.ShootY, projectile.SyncIndex)
+	}
+}
+
+func dumpPlayerTookDamage(w io.Writer, damage *protocol.PlayerTookDamage) {
+	dumpPlayerIndex(w, "Attacker", damage.AttackerIndex)
+	if damage.Damage == 666.666 {
+		fmt.Fprintf(w, "    Damage: %g (killing blow)\n", damage.Damage)
+	} else {
+		fmt.Fprintf(w, "    Damage: %g\n", damage.Damage)
+	}
+	if damage.PlayParticles {
+		fmt.Fprintf(w, "    Particles: X %g, Y %g\n", damage.ParticleDirectionX, damage.ParticleDirectionY)
+	}
+	if damage.HasDamageType {
+		fmt.Fprintf(w, "    DamageType: %s (%d)\n", DamageType(damage.DamageType), damage.DamageType)
+	}
+}
+
+func dumpClientInit(w io.Writer, init *protocol.ClientInit) {
+	fmt.Fprintf(w, "    Accepted: %t\n", init.Accepted)
+	if !init.Accepted {
+		fmt.Fprintf(w, "    Reason: %q\n", init.Reason)
+		return
+	}
+
+	fmt.Fprintf(w, "    PlayerIndex: %d\n", init.PlayerIndex)
+	fmt.Fprintf(w, "    Map: %s\n", init.Map())
+	fmt.Fprintf(w, "    Options: maps %d, health %d, regen %d, weapon spawn rate %d\n", init.Maps, init.Health, init.Regen, init.WeaponSpawnRate)
+	fmt.Fprintf(w, "    Players: %d slots\n", len(init.Players))
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "      Slot\tSteamID\tWins\tKills\tDeaths\tSuicides\tFalls\tCrownSteals\tBulletsHit\tBulletsMissed\tBulletsShot\tBlocks\tPunchesLanded\tWeaponsPickedUp\tWeaponsThrown")
+	for slot, player := range init.Players {
+		switch {
+		case player.SteamID == 0:
+			fmt.Fprintf(table, "      %d\topen\n", slot)
+		case player.Stats == nil:
+			fmt.Fprintf(table, "      %d\t%d\t(receiving client)\n", slot, player.SteamID)
+		default:
+			stats := player.Stats
+			fmt.Fprintf(table, "      %d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", slot, player.SteamID,
+				stats.Wins, stats.Kills, stats.Deaths, stats.Suicides, stats.Falls, stats.CrownSteals,
+				stats.BulletsHit, stats.BulletsMissed, stats.BulletsShot, stats.Blocks, stats.PunchesLanded,
+				stats.WeaponsPickedUp, stats.WeaponsThrown)
+		}
+	}
+	table.Flush()
+}
+
+//dumpFields writes each field of a decoded message struct on its own line, with nested structs and slices indented under them
+func dumpFields(w io.Writer, indent string, v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if name == "PacketType" {
+			continue //Already in the packet's header
+		}
+		dumpField(w, indent, name, v.Field(i))
+	}
+}
+
+func dumpField(w io.Writer, indent, name string, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			fmt.Fprintf(w, "%s%s: (none)\n", indent, name)
+			return
+		}
+		dumpField(w, indent, name, v.Elem())
+	case reflect.Struct:
+		fmt.Fprintf(w, "%s%s:\n", indent, name)
+		dumpFields(w, indent+"  ", v)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			fmt.Fprintf(w, "%s%s: %s\n", indent, name, dumpBytes(v.Bytes()))
+			return
+		}
+		fmt.Fprintf(w, "%s%s: %d\n", indent, name, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			dumpField(w, indent+"  ", fmt.Sprintf("[%d]", i), v.Index(i))
+		}
+	case reflect.String:
+		fmt.Fprintf(w, "%s%s: %q\n", indent, name, v.String())
+	default:
+		fmt.Fprintf(w, "%s%s: %v\n", indent, name, v.Interface())
+	}
+}
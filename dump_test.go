@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+func TestDumpHex(t *testing.T) {
+	hexDump := &bytes.Buffer{}
+	hexDump.WriteString("# A scripted exchange\n")
+	for _, message := range []struct {
+		msg     protocol.Message
+		channel int
+		steamID uint64
+	}{
+		{&protocol.PlayerUpdate{PositionY: 125, Weapon: byte(weaponPistol), Projectiles: []protocol.ProjectileUpdate{{SyncIndex: 7}}}, protocol.ChannelUpdate(1), 76561190000000002},
+		{&protocol.MapChange{WinnerIndex: 255, MapType: byte(protocol.MapTypeLandfall), MapData: []byte{4, 0, 0, 0}}, 0, 0},
+		{&protocol.ClientInit{
+			Accepted:    true,
+			PlayerIndex: 1,
+			MapType:     byte(protocol.MapTypeLandfall),
+			MapData:     []byte{0, 0, 0, 0},
+			Players: []protocol.ClientInitPlayer{
+				{SteamID: 76561190000000001, Stats: &protocol.PlayerStats{Wins: 3, Kills: 5}},
+				{SteamID: 76561190000000002},
+				{},
+			},
+			LocalSteamID: 76561190000000002,
+		}, 0, 0},
+		{&protocol.PlayerTalked{Message: "gg"}, protocol.ChannelEvent(0), 76561190000000001},
+	} {
+		packet, err := NewPacketFromMessage(message.msg, message.channel, message.steamID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hexDump.WriteString(hex.EncodeToString(packet.AsBytes()) + "\n")
+	}
+	hexDump.WriteString("not hex\n")
+
+	dump := func(types, channels string, steamID uint64) string {
+		filter, err := newDumpFilter(types, channels, steamID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		if err := (&dumper{w: out, filter: filter}).Hex(bytes.NewReader(hexDump.Bytes()), "test"); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	all := dump("", "", 0)
+	for _, expected := range []string{
+		"test:2 playerUpdate ch 4 (player 1 updates) steamID 76561190000000002",
+		"    Position: Y 1.25, Z 0\n",
+		"    Weapon: Pistol (1)\n",
+		"      [0] shot from (0, 0) towards (0, 0), sync index 7\n",
+		"    Winner: nobody\n    Map: Landfall map: 4\n",
+		"76561190000000001  3     5",
+		"76561190000000002  (receiving client)",
+		"    Message: \"gg\"\n",
+		"test:6 malformed: ",
+	} {
+		if !strings.Contains(all, expected) {
+			t.Errorf("dump is missing %q:\n%s", expected, all)
+		}
+	}
+
+	if filtered := dump("mapChange,8", "", 0); strings.Contains(filtered, "playerUpdate") || !strings.Contains(filtered, "mapChange") {
+		t.Errorf("dump of mapChange and clientInit packets shows others:\n%s", filtered)
+	}
+	if filtered := dump("", "3", 0); strings.Count(filtered, "\ntest:") != 0 || !strings.HasPrefix(filtered, "test:5 playerTalked") {
+		t.Errorf("dump of channel 3 shows other channels:\n%s", filtered)
+	}
+	if filtered := dump("", "", 76561190000000001); !strings.Contains(filtered, "playerTalked") || strings.Contains(filtered, "playerUpdate") {
+		t.Errorf("dump of a Steam ID shows other Steam IDs:\n%s", filtered)
+	}
+	if _, err := newDumpFilter("notAPacket", "", 0); err == nil {
+		t.Error("filter accepted an unknown packet type")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoshuaDoes/json"
+)
+
+const (
+	eventBufferSize = 256              //The events a subscriber may fall behind by before it's cut off
+	eventKeepAlive  = 15 * time.Second //How often to tell a quiet stream's subscriber that it's still open
+)
+
+//The types of event a lobby publishes
+const (
+	eventClientJoined    = "clientJoined"
+	eventClientLeft      = "clientLeft"
+	eventMatchStarted    = "matchStarted"
+	eventMapChanged      = "mapChanged"
+	eventPlayerDamaged   = "playerDamaged"
+	eventPlayerKilled    = "playerKilled"
+	eventPlayerFellOut   = "playerFellOut"
+	eventChat            = "chat"
+	eventGameModeChanged = "gameModeChanged"
+	eventLobbyClosed     = "lobbyClosed"
+)
+
+//Event is something that happened in a lobby, as streamed to anyone watching it
+type Event struct {
+	Type     string      `json:"type"`
+	RoomCode string      `json:"roomCode"`
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data,omitempty"`
+
+	public bool //If the lobby was public, as only then is it streamed to subscribers that didn't ask for it by room code
+}
+
+//ClientEvent is the data of a client joining or leaving
+type ClientEvent struct {
+	SteamID     uint64 `json:"steamID,string"`
+	PlayerIndex *int   `json:"playerIndex,omitempty"` //Only known when joining
+}
+
+//MatchEvent is the data of a match starting
+type MatchEvent struct {
+	Level    string `json:"level"`
+	GameMode string `json:"gameMode"`
+}
+
+//MapEvent is the data of a map change
+type MapEvent struct {
+	Level       string `json:"level"`
+	WinnerIndex int    `json:"winnerIndex"` //255 if no one won
+}
+
+//DamageEvent is the data of a player being damaged or killed
+type DamageEvent struct {
+	PlayerIndex   int     `json:"playerIndex"`
+	AttackerIndex int     `json:"attackerIndex"`
+	Damage        float32 `json:"damage,omitempty"` //Only for damage that didn't kill
+	DamageType    string  `json:"damageType"`
+}
+
+//PlayerEvent is the data of something happening to a player
+type PlayerEvent struct {
+	PlayerIndex int `json:"playerIndex"`
+}
+
+//ChatEvent is the data of a player saying something
+type ChatEvent struct {
+	PlayerIndex int    `json:"playerIndex"`
+	SteamID     uint64 `json:"steamID,string"`
+	Message     string `json:"message"`
+}
+
+//GameModeEvent is the data of a lobby changing game modes
+type GameModeEvent struct {
+	GameMode         string `json:"gameMode"`
+	PreviousGameMode string `json:"previousGameMode"`
+}
+
+//LobbyClosedEvent is the data of a lobby closing
+type LobbyClosedEvent struct {
+	Reason string `json:"reason"`
+}
+
+//EventSubscription receives the events of the lobbies it's subscribed to, until its channel is closed
+type EventSubscription struct {
+	Events chan *Event
+	codes  map[string]bool //The room codes to receive events from, or nil for every public lobby
+}
+
+//Events publishes events from every lobby to every subscription, safe to use from any goroutine
+type Events struct {
+	sync.RWMutex
+	subscriptions map[*EventSubscription]bool
+}
+
+//NewEvents returns events with no subscriptions
+func NewEvents() *Events {
+	return &Events{subscriptions: make(map[*EventSubscription]bool)}
+}
+
+//Subscribe returns a subscription to the events of the lobbies with the room codes, or of every public lobby if there are none
+func (events *Events) Subscribe(codes []string) *EventSubscription {
+	sub := &EventSubscription{Events: make(chan *Event, eventBufferSize)}
+	if len(codes) > 0 {
+		sub.codes = make(map[string]bool)
+		for _, code := range codes {
+			sub.codes[code] = true
+		}
+	}
+
+	events.Lock()
+	defer events.Unlock()
+	events.subscriptions[sub] = true
+	return sub
+}
+
+//Unsubscribe stops a subscription, closing its channel if it's still open
+func (events *Events) Unsubscribe(sub *EventSubscription) {
+	events.Lock()
+	defer events.Unlock()
+	if events.subscriptions[sub] {
+		delete(events.subscriptions, sub)
+		close(sub.Events)
+	}
+}
+
+//Watched returns true if anyone is subscribed, so that events no one would receive aren't built
+func (events *Events) Watched() bool {
+	events.RLock()
+	defer events.RUnlock()
+	return len(events.subscriptions) > 0
+}
+
+//Publish sends an event to every subscription to its lobby, without ever waiting, as it's called from the event loops
+//A subscription that's too far behind to take it is cut off, so that it knows it missed something and can start over
+func (events *Events) Publish(event *Event) {
+	events.Lock()
+	defer events.Unlock()
+
+	for sub := range events.subscriptions {
+		if (sub.codes == nil && !event.public) || (sub.codes != nil && !sub.codes[event.RoomCode]) {
+			continue
+		}
+		select {
+		case sub.Events <- event:
+		default:
+			log.Warn("Cut off an event subscription that fell ", eventBufferSize, " events behind")
+			delete(events.subscriptions, sub)
+			close(sub.Events)
+		}
+	}
+}
+
+//Close stops every subscription
+func (events *Events) Close() {
+	events.Lock()
+	defer events.Unlock()
+	for sub := range events.subscriptions {
+		delete(events.subscriptions, sub)
+		close(sub.Events)
+	}
+}
+
+//Publish publishes an event that happened in the lobby, and must only be called from the event loop
+func (lobby *Lobby) Publish(eventType string, data interface{}) {
+	if !lobby.Server.Events.Watched() {
+		return
+	}
+	lobby.Server.Events.Publish(&Event{
+		Type:     eventType,
+		RoomCode: lobby.LobbyRoomCode,
+		Time:     time.Now(),
+		Data:     data,
+		public:   lobby.Public,
+	})
+}
+
+//events streams events as they happen with Server-Sent Events, from the lobbies in the comma-separated code query parameter or from every public lobby
+func (api *API) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		api.respond(w, r, nil, apiErrorf(http.StatusInternalServerError, "streaming is unsupported"))
+		return
+	}
+
+	var codes []string
+	if code := r.URL.Query().Get("code"); code != "" {
+		codes = strings.Split(code, ",")
+	}
+	sub := api.Server.Events.Subscribe(codes)
+	defer api.Server.Events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event, ok := <-sub.Events:
+			if !ok {
+				return //Cut off for falling behind, or the server closed
+			}
+			data, err := json.Marshal(event, false)
+			if err != nil {
+				log.Error("Unable to stream ", event.Type, " event: ", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoshuaDoes/json"
+)
+
+//streamedEvent is an event as read back from a stream, with its data left generic
+type streamedEvent struct {
+	Type     string                 `json:"type"`
+	RoomCode string                 `json:"roomCode"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+//subscribeEvents streams the test server's events from the lobbies in the comma-separated codes, or from every public lobby if there are none
+func subscribeEvents(t *testing.T, ts *testServer, codes string) <-chan *streamedEvent {
+	t.Helper()
+
+	if err := ts.API.Listen([]string{"127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	ts.API.Serve()
+	resp, err := http.Get("http://" + ts.API.Addrs()[0] + "/events?code=" + codes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("/events answered with %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan *streamedEvent, eventBufferSize)
+	go func() {
+		defer close(events)
+		lines := bufio.NewScanner(resp.Body)
+		eventType := ""
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event := &streamedEvent{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event); err != nil || event.Type != eventType {
+					t.Errorf("streamed malformed %s event %q: %v", eventType, line, err)
+					return
+				}
+				events <- event
+			}
+		}
+	}()
+	return events
+}
+
+//expectEvent skips streamed events until one of the specified type arrives, failing the test if it comes from another lobby or none does in time
+func expectEvent(t *testing.T, events <-chan *streamedEvent, roomCode, eventType string) *streamedEvent {
+	t.Helper()
+
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("stream ended before a %s event", eventType)
+			}
+			if event.RoomCode != roomCode {
+				t.Fatalf("streamed a %s event from lobby %s, expected only lobby %s", event.Type, event.RoomCode, roomCode)
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-deadline:
+			t.Fatalf("didn't stream a %s event", eventType)
+			return nil
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	code := ts.Lobby(host).LobbyRoomCode
+	events := subscribeEvents(t, ts, code)
+
+	ts.Join(76561190000000003) //In another lobby, which mustn't be streamed
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	if joined := expectEvent(t, events, code, eventClientJoined); joined.Data["steamID"] != "76561190000000002" || joined.Data["playerIndex"] != float64(guest.PlayerIndex) {
+		t.Fatalf("streamed %+v for the guest joining", joined.Data)
+	}
+
+	host.Say("gg")
+	if chat := expectEvent(t, events, code, eventChat); chat.Data["message"] != "gg" || chat.Data["playerIndex"] != float64(host.PlayerIndex) {
+		t.Fatalf("streamed %+v for the host's chat", chat.Data)
+	}
+
+	host.Say("/gamemode duel")
+	startMatch(host, guest)
+	if changed := expectEvent(t, events, code, eventGameModeChanged); changed.Data["gameMode"] != "Duel" || changed.Data["previousGameMode"] != "Stock" {
+		t.Fatalf("streamed %+v for the gamemode change", changed.Data)
+	}
+	expectEvent(t, events, code, eventMatchStarted)
+
+	guest.TakeDamage(host.PlayerIndex, 10)
+	if damaged := expectEvent(t, events, code, eventPlayerDamaged); damaged.Data["playerIndex"] != float64(guest.PlayerIndex) || damaged.Data["damage"] != float64(10) {
+		t.Fatalf("streamed %+v for the guest taking damage", damaged.Data)
+	}
+	guest.Die(host.PlayerIndex)
+	if killed := expectEvent(t, events, code, eventPlayerKilled); killed.Data["attackerIndex"] != float64(host.PlayerIndex) {
+		t.Fatalf("streamed %+v for the guest dying", killed.Data)
+	}
+	if changed := expectEvent(t, events, code, eventMapChanged); changed.Data["winnerIndex"] != float64(host.PlayerIndex) {
+		t.Fatalf("streamed %+v for the map change", changed.Data)
+	}
+}
+
+func TestEventsKeepPrivateLobbiesPrivate(t *testing.T) {
+	ts := newTestServer(t)
+	events := subscribeEvents(t, ts, "")
+
+	//The private lobby's chat is handled before its room code is told, and so is published before anything that follows
+	private := ts.Join(76561190000000001)
+	private.Say("meet me in the other lobby")
+	private.Say("/code")
+	private.ExpectChat(private.PlayerIndex, "Room code: ")
+
+	public := ts.Join(76561190000000002)
+	public.Say("/public")
+	public.Say("gg")
+	if chat := expectEvent(t, events, ts.Lobby(public).LobbyRoomCode, eventChat); chat.Data["message"] != "gg" {
+		t.Fatalf("streamed %+v for the public lobby's chat", chat.Data)
+	}
+
+	//Asking for a private lobby by its room code still streams it
+	code := ts.Lobby(private).LobbyRoomCode
+	watched := ts.Events.Subscribe([]string{code})
+	defer ts.Events.Unsubscribe(watched)
+	private.Say("gg")
+	select {
+	case event := <-watched.Events:
+		if event.RoomCode != code || event.Type != eventChat {
+			t.Fatalf("streamed a %s event from lobby %s to a subscriber of lobby %s", event.Type, event.RoomCode, code)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("private lobby wasn't streamed to a subscriber that asked for it by room code")
+	}
+}
+
+func TestEventsCutOffSlowSubscriber(t *testing.T) {
+	events := NewEvents()
+	slow := events.Subscribe(nil)
+	other := events.Subscribe([]string{"OTHER"})
+
+	for i := 0; i <= eventBufferSize; i++ {
+		events.Publish(&Event{Type: eventChat, RoomCode: "LOBBY", public: true})
+	}
+	received := 0
+	for range slow.Events {
+		received++
+	}
+	if received != eventBufferSize {
+		t.Fatalf("slow subscriber received %d events before being cut off, expected %d", received, eventBufferSize)
+	}
+
+	if !events.Watched() {
+		t.Fatal("cutting off one subscriber cut off another that wasn't subscribed to the lobby")
+	}
+	events.Unsubscribe(other)
+	events.Unsubscribe(slow) //Already cut off
+	if events.Watched() {
+		t.Fatal("events are still watched after every subscriber left")
+	}
+}
@@ -0,0 +1,65 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+//FuzzHandleInbound makes sure no packet a lobby member signs can crash the lobby's handlers, which otherwise only Recover would catch
+func FuzzHandleInbound(f *testing.F) {
+	for _, msg := range []protocol.Message{
+		&protocol.PlayerTalked{Message: ""},
+		&protocol.PlayerTalked{Message: "/map 3"},
+		&protocol.PlayerTalked{Message: "/index 9"},
+		&protocol.ClientReadyUp{PlayerIndexes: []byte{0, 200}},
+		&protocol.PlayerUpdate{Weapon: 255},
+		&protocol.PlayerTookDamage{AttackerIndex: 200, Damage: 666.666},
+		&protocol.ClientRequestingWeaponPickUp{PacketType: packetTypeClientRequestingWeaponPickUp, PlayerIndex: 200, WeaponSpawnID: 9999},
+		&protocol.ClientRequestingToSpawn{PlayerIndex: 200},
+	} {
+		data, err := msg.Marshal()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(byte(msg.Type()), byte(protocol.ChannelEvent(0)), data)
+		f.Add(byte(msg.Type()), byte(protocol.ChannelUpdate(0)), data)
+	}
+
+	f.Fuzz(func(t *testing.T, packetType, channel byte, data []byte) {
+		ts := newTestServer(t)
+		host := ts.Join(76561190000000001)
+		lobby := ts.Lobby(host)
+
+		packet := NewPacket(PacketType(packetType), int(channel), host.SteamID)
+		if len(data) > 0 {
+			packet.Grow(int64(len(data)))
+			packet.WriteBytesNext(data)
+		}
+		signed, err := protocol.NewPacketFromBytes(packet.AsSignedBytes(0, host.session))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed.Src = host.sock.addr
+
+		//Handled straight on the event loop, so a panic fails the fuzz target instead of being recovered
+		handled := make(chan struct{})
+		go func() {
+			defer close(handled)
+			lobby.Invoke(func() {
+				lobby.HandleInbound(signed)
+			})
+		}()
+		select {
+		case <-handled:
+		case <-time.After(testTimeout):
+			stack := make([]byte, 1<<20)
+			t.Fatalf("lobby hung handling %s\n%s", signed, stack[:runtime.Stack(stack, true)])
+		}
+	})
+}
@@ -1,16 +1,67 @@
-package main
-
-//WeaponSpawnRate holds a spawn rate for weapons
-type WeaponSpawnRate struct {
-	MinimumSeconds int
-	MaximumSeconds int
-}
-
-//GameMode holds a Stick Fight game mode
-type GameMode interface {
-	IsDone() bool                           //Called to check if match processing is finished, if variable must be set to true when GameMode.StartMatch() finishes
-	GetLevels() []*Level                    //Returns the allowed levels for this game mode, or nothing if any levels are allowed
-	GetWeapons() []Weapon                  //Returns the weapon list that will be in use for this game mode
-	GetWeaponSpawnRates() []WeaponSpawnRate //Returns the weapon spawn rates that match the four in-game options (normal, fast, none, slow), with 0/0 for no spawns
-	StartMatch(lobby *Lobby)                //Gets called in a goroutine at the start of each match, must allow GameMode.IsDone() to return true if checking lobby.MatchInProgress() to finish running
-}
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+//WeaponSpawnRate holds a spawn rate for weapons
+type WeaponSpawnRate struct {
+	MinimumSeconds int
+	MaximumSeconds int
+}
+
+//GameMode holds a Stick Fight game mode
+type GameMode interface {
+	IsDone() bool                           //Called to check if match processing is finished, if variable must be set to true once the match ends
+	GetLevels() []*Level                    //Returns the allowed levels for this game mode, or nothing if any levels are allowed
+	GetWeapons() []Weapon                  //Returns the weapon list that will be in use for this game mode
+	GetWeaponSpawnRates() []WeaponSpawnRate //Returns the weapon spawn rates that match the four in-game options (normal, fast, none, slow), with 0/0 for no spawns
+	StartMatch(lobby *Lobby)                //Gets called on the event loop at the start of each match, and must schedule anything it does during the match with lobby.After or lobby.AfterInMatch
+}
+
+//SpawnWeapons spawns random weapons at random intervals within the spawn rate on the event loop, until the match ends
+func SpawnWeapons(lobby *Lobby, rate WeaponSpawnRate) {
+	if rate.MaximumSeconds <= 0 {
+		return //Weapon spawning is disabled
+	}
+
+	weaponSpawnWait := lobby.Random.Intn(rate.MaximumSeconds-rate.MinimumSeconds+1) + rate.MinimumSeconds
+	log.Trace("Weapon next spawn wait: ", weaponSpawnWait)
+	lobby.AfterInMatch(time.Duration(weaponSpawnWait)*time.Second, func() {
+		lobby.SpawnWeaponRandom()
+		SpawnWeapons(lobby, rate)
+	})
+}
+
+//GameModeName returns the name of a game mode, or nothing if it's unknown
+func GameModeName(gameMode GameMode) string {
+	switch gameMode.(type) {
+	case Stock:
+		return "Stock"
+	case Tournament:
+		return "Tournament"
+	case Duel:
+		return "Duel"
+	case GunGame:
+		return "GunGame"
+	}
+	return ""
+}
+
+//ParseGameMode returns a new game mode for a lobby with the player count by any of its names, or nil if there's no such game mode
+func ParseGameMode(name string, playerCount int) GameMode {
+	switch strings.ToLower(name) {
+	case "stock", "default", "original", "og", "regular", "vanilla", "sf", "stick", "fight", "stickfight", "landfall", "official":
+		return Stock{}
+	case "tourney", "tournament", "challenge", "hard", "hardcore", "hardmode":
+		return Tournament{}
+	case "duel", "competitive", "compete", "competition":
+		return Duel{}
+	case "gun", "roulette", "gungame":
+		return GunGame{
+			PlayerData: make([]GunGamePlayerData, playerCount),
+		}
+	}
+	return nil
+}
@@ -1,7 +1,5 @@
 package main
 
-import "time"
-
 //Duel is a competitive duel-style game mode
 type Duel struct{}
 
@@ -54,21 +52,5 @@ func (gm Duel) GetWeaponSpawnRates() []WeaponSpawnRate {
 func (gm Duel) StartMatch(lobby *Lobby) {
 	log.Info("Starting match with gamemode: Duel")
 
-	lastWeaponSpawn := time.Now()
-	weaponSpawnWait := randomizer.Intn(gm.GetWeaponSpawnRates()[0].MaximumSeconds-gm.GetWeaponSpawnRates()[0].MinimumSeconds+1) + gm.GetWeaponSpawnRates()[0].MinimumSeconds
-	log.Trace("Weapon initial spawn wait: ", weaponSpawnWait)
-
-	for lobby.MatchInProgress() {
-		if !lobby.MatchInProgress() {
-			break
-		}
-
-		if int(time.Now().Sub(lastWeaponSpawn)/time.Second) >= weaponSpawnWait {
-			lobby.SpawnWeaponRandom()
-
-			weaponSpawnWait = randomizer.Intn(gm.GetWeaponSpawnRates()[0].MaximumSeconds-gm.GetWeaponSpawnRates()[0].MinimumSeconds+1) + gm.GetWeaponSpawnRates()[0].MinimumSeconds
-			log.Trace("Weapon next spawn wait: ", weaponSpawnWait)
-			lastWeaponSpawn = time.Now()
-		}
-	}
+	SpawnWeapons(lobby, gm.GetWeaponSpawnRates()[0])
 }
@@ -63,69 +63,87 @@ func (gm GunGame) StartMatch(lobby *Lobby) {
 		log.Trace("-- [Gun Game] Player ", playerIndex, " is no longer processed!")
 	}
 
-	//Loop until the match is over
-	for lobby.MatchInProgress() {
-		if lobby == nil || !lobby.IsRunning() || !lobby.MatchInProgress() {
-			break
+	//Process the players every tick on the event loop until the match is over
+	match := lobby.FightStartTime
+	var process func()
+	process = func() {
+		if !lobby.IsRunning() {
+			return
 		}
-		time.Sleep(time.Millisecond * 10)
-
-		players := lobby.GetPlayers()
-		if len(players) > 0 {
-			if len(players) > len(gm.PlayerData) {
-				newPlayers := len(players) - len(gm.PlayerData)
-				for i := 0; i < newPlayers; i++ {
-					gm.PlayerData = append(gm.PlayerData, GunGamePlayerData{})
-				}
-				log.Trace("-- [Gun Game] Added ", newPlayers, " players")
+		if !lobby.FightStartTime.Equal(match) {
+			gm.EndMatch(lobby)
+			return
+		}
+
+		gm.ProcessPlayers(lobby)
+		lobby.After(time.Second/time.Duration(tickRate), process)
+	}
+	lobby.After(time.Second/time.Duration(tickRate), process)
+}
+
+//ProcessPlayers moves each player that died since the last tick up or down the weapon list
+func (gm *GunGame) ProcessPlayers(lobby *Lobby) {
+	players := lobby.GetPlayers()
+	if len(players) > 0 {
+		if len(players) > len(gm.PlayerData) {
+			newPlayers := len(players) - len(gm.PlayerData)
+			for i := 0; i < newPlayers; i++ {
+				gm.PlayerData = append(gm.PlayerData, GunGamePlayerData{})
 			}
+			log.Trace("-- [Gun Game] Added ", newPlayers, " players")
+		}
 
-			for playerIndex := 0; playerIndex < len(players); playerIndex++ {
-				if players[playerIndex] != nil {
-					lastAttackerIndex := players[playerIndex].LastAttackerIndex
-					lastAttackerWeapon := players[lastAttackerIndex].Weapon.Weapon
-					lastAttackerWeaponIndex := gm.PlayerData[lastAttackerIndex].WeaponIndex
-					playerWeapon := players[playerIndex].Weapon.Weapon
-					playerWeaponIndex := gm.PlayerData[playerIndex].WeaponIndex
+		for playerIndex := 0; playerIndex < len(players); playerIndex++ {
+			if players[playerIndex] != nil {
+				lastAttackerIndex := players[playerIndex].LastAttackerIndex
+				if lastAttackerIndex < 0 || lastAttackerIndex >= len(players) || players[lastAttackerIndex] == nil {
+					lastAttackerIndex = playerIndex //Nobody in the lobby killed them, like falling out, so nobody moves up
+				}
+				lastAttackerWeapon := players[lastAttackerIndex].Weapon.Weapon
+				lastAttackerWeaponIndex := gm.PlayerData[lastAttackerIndex].WeaponIndex
+				playerWeapon := players[playerIndex].Weapon.Weapon
+				playerWeaponIndex := gm.PlayerData[playerIndex].WeaponIndex
 
-					if playerWeapon != weaponEmpty && playerWeapon != gm.GetWeapons()[playerWeaponIndex] {
-						lobby.UpdateWeapon(playerIndex, weaponEmpty)
-					}
+				if playerWeapon != weaponEmpty && playerWeapon != gm.GetWeapons()[playerWeaponIndex] {
+					lobby.UpdateWeapon(playerIndex, weaponEmpty)
+				}
 
-					if !gm.PlayerData[playerIndex].Dead && players[playerIndex].Health <= 0 {
-						log.Trace("-- [Gun Game] Player ", playerIndex, " died from player ", lastAttackerIndex, " and needs to be processed!")
-						gm.PlayerData[playerIndex].Dead = true
-
-						if lastAttackerIndex != playerIndex {
-							if lastAttackerWeapon == gm.GetWeapons()[lastAttackerWeaponIndex] {
-								if lastAttackerWeaponIndex != len(gm.GetWeapons()) {
-									gm.PlayerData[lastAttackerIndex].WeaponIndex++
-									log.Trace("-- [Gun Game] Increased player ", lastAttackerIndex, " to ", lastAttackerWeaponIndex+1)
-									lobby.UpdateWeapon(lastAttackerIndex, gm.GetWeapons()[lastAttackerWeaponIndex+1])
-								} else {
-									log.Trace("-- [Gun Game] Player ", lastAttackerIndex, " is the gun game winner!")
-
-									for playerIndex := 0; playerIndex < len(gm.PlayerData); playerIndex++ {
-										gm.PlayerData[playerIndex].Dead = false
-										gm.PlayerData[playerIndex].WeaponIndex = 0
-									}
-
-									lobby.PlayerSaid(lastAttackerIndex, "I'm the Gun Game winner!")
-								}
+				if !gm.PlayerData[playerIndex].Dead && players[playerIndex].Health <= 0 {
+					log.Trace("-- [Gun Game] Player ", playerIndex, " died from player ", lastAttackerIndex, " and needs to be processed!")
+					gm.PlayerData[playerIndex].Dead = true
+
+					if lastAttackerIndex != playerIndex {
+						if lastAttackerWeapon == gm.GetWeapons()[lastAttackerWeaponIndex] {
+							if lastAttackerWeaponIndex != len(gm.GetWeapons()) {
+								gm.PlayerData[lastAttackerIndex].WeaponIndex++
+								log.Trace("-- [Gun Game] Increased player ", lastAttackerIndex, " to ", lastAttackerWeaponIndex+1)
+								lobby.UpdateWeapon(lastAttackerIndex, gm.GetWeapons()[lastAttackerWeaponIndex+1])
 							} else {
-								if playerWeaponIndex != 0 {
-									gm.PlayerData[playerIndex].WeaponIndex--
-									log.Trace("-- [Gun Game] Decreased player ", playerIndex, " to ", gm.GetWeapons()[playerWeaponIndex-1])
+								log.Trace("-- [Gun Game] Player ", lastAttackerIndex, " is the gun game winner!")
+
+								for playerIndex := 0; playerIndex < len(gm.PlayerData); playerIndex++ {
+									gm.PlayerData[playerIndex].Dead = false
+									gm.PlayerData[playerIndex].WeaponIndex = 0
 								}
+
+								lobby.PlayerSaid(lastAttackerIndex, "I'm the Gun Game winner!")
+							}
+						} else {
+							if playerWeaponIndex != 0 {
+								gm.PlayerData[playerIndex].WeaponIndex--
+								log.Trace("-- [Gun Game] Decreased player ", playerIndex, " to ", gm.GetWeapons()[playerWeaponIndex-1])
 							}
 						}
 					}
-
 				}
+
 			}
 		}
 	}
+}
 
+//EndMatch resets gun game for the next match if the player count changed during this one
+func (gm *GunGame) EndMatch(lobby *Lobby) {
 	if len(lobby.GetPlayers()) != len(gm.PlayerData) {
 		log.Trace("-- [Gun Game] Player count changed, resetting!")
 		gm.PlayerData = make([]GunGamePlayerData, lobby.GetPlayerCount(false))
@@ -1,7 +1,5 @@
 package main
 
-import "time"
-
 //Tournament is a competitive tournament-style game mode
 type Tournament struct{}
 
@@ -48,21 +46,5 @@ func (gm Tournament) GetWeaponSpawnRates() []WeaponSpawnRate {
 func (gm Tournament) StartMatch(lobby *Lobby) {
 	log.Info("Starting match with gamemode: Tournament")
 
-	lastWeaponSpawn := time.Now()
-	weaponSpawnWait := randomizer.Intn(gm.GetWeaponSpawnRates()[0].MaximumSeconds-gm.GetWeaponSpawnRates()[0].MinimumSeconds+1) + gm.GetWeaponSpawnRates()[0].MinimumSeconds
-	log.Trace("Weapon initial spawn wait: ", weaponSpawnWait)
-
-	for lobby.MatchInProgress() {
-		if !lobby.MatchInProgress() {
-			break
-		}
-
-		if int(time.Now().Sub(lastWeaponSpawn)/time.Second) >= weaponSpawnWait {
-			lobby.SpawnWeaponRandom()
-
-			weaponSpawnWait = randomizer.Intn(gm.GetWeaponSpawnRates()[0].MaximumSeconds-gm.GetWeaponSpawnRates()[0].MinimumSeconds+1) + gm.GetWeaponSpawnRates()[0].MinimumSeconds
-			log.Trace("Weapon next spawn wait: ", weaponSpawnWait)
-			lastWeaponSpawn = time.Now()
-		}
-	}
+	SpawnWeapons(lobby, gm.GetWeaponSpawnRates()[0])
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JoshuaDoes/logger"
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+const (
+	testTimeout      = 5 * time.Second //How long a scripted client waits for a packet before failing the test
+	testReceivedSize = 4096            //The amount of packets a scripted client holds before it stops reading
+)
+
+func TestMain(m *testing.M) {
+	log = logger.NewLogger("sf:test", verbosityLevel)
+	randomizer = NewRandomizer(1)
+	lobbyLevels = []*Level{newLevelLandfall(0), newLevelLandfall(0)}
+	defaultLevels = newLevelsLandfall()
+
+	os.Exit(m.Run())
+}
+
+//testServer is a server running on an in-memory network, for scripted clients to play against
+type testServer struct {
+	*Server
+
+	t       testing.TB
+	network *MemoryNetwork
+	addr    *net.UDPAddr
+}
+
+//newTestServer starts a server on a new in-memory network, which is closed when the test ends
+func newTestServer(t testing.TB) *testServer {
+	return newTestServerOn(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1337})
+}
+
+//newTestServerOn starts a server like newTestServer with a transport bound to each address, where scripted clients talk to the first
+func newTestServerOn(t testing.TB, addrs ...*net.UDPAddr) *testServer {
+	network := NewMemoryNetwork()
+	srv := NewServer(nil)
+	for _, addr := range addrs {
+		sock, err := network.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Transports = append(srv.Transports, sock)
+	}
+
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	return &testServer{Server: srv, t: t, network: network, addr: addrs[0]}
+}
+
+//Connect opens a new scripted client that hasn't said anything to the server yet
+func (ts *testServer) Connect(steamID uint64) *testClient {
+	ts.t.Helper()
+	return ts.ConnectVersion(steamID, nil)
+}
+
+//ConnectVersion opens a new scripted client that speaks a protocol version, where nil is protocol.Version
+func (ts *testServer) ConnectVersion(steamID uint64, dialect *protocol.Dialect) *testClient {
+	ts.t.Helper()
+	return ts.connect(steamID, dialect, nil, ts.addr)
+}
+
+//connect opens a new scripted client on an address, or the next free localhost port if it's nil, that talks to the server on another
+func (ts *testServer) connect(steamID uint64, dialect *protocol.Dialect, addr, server *net.UDPAddr) *testClient {
+	ts.t.Helper()
+
+	sock, err := ts.network.Listen(addr)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	client := &testClient{
+		t:           ts.t,
+		SteamID:     steamID,
+		dialect:     dialect,
+		sock:        sock,
+		server:      server,
+		reliability: protocol.NewReliability(),
+		received:    make(chan *Packet, testReceivedSize),
+		readerDone:  make(chan struct{}),
+	}
+	go client.read(sock, client.readerDone)
+	ts.t.Cleanup(func() { client.Socket().Close() })
+
+	return client
+}
+
+//Rebind moves a scripted client to a new source port, like a NAT rebinding its address, keeping its session and channels
+func (ts *testServer) Rebind(client *testClient) {
+	ts.t.Helper()
+
+	sock, err := ts.network.Listen(nil)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	client.Socket().Close()
+	<-client.readerDone //Only one reader may touch the client's channels
+	client.sessionLock.Lock()
+	client.sock = sock
+	client.readerDone = make(chan struct{})
+	go client.read(sock, client.readerDone)
+	client.sessionLock.Unlock()
+}
+
+//Join connects a new scripted client with one player, failing the test unless it's accepted into a lobby
+func (ts *testServer) Join(steamID uint64) *testClient {
+	ts.t.Helper()
+	return ts.JoinVersion(steamID, nil)
+}
+
+//JoinVersion joins like Join with a client that speaks a protocol version, where nil is protocol.Version
+func (ts *testServer) JoinVersion(steamID uint64, dialect *protocol.Dialect) *testClient {
+	ts.t.Helper()
+
+	version := byte(protocol.Version)
+	if dialect != nil {
+		version = dialect.Version
+	}
+	return ts.join(ts.ConnectVersion(steamID, dialect), version)
+}
+
+//JoinFrom joins like Join with a client on an address, talking to the server on another of its addresses
+func (ts *testServer) JoinFrom(steamID uint64, addr, server *net.UDPAddr) *testClient {
+	ts.t.Helper()
+	return ts.join(ts.connect(steamID, nil, addr, server), protocol.Version)
+}
+
+//join runs a connected scripted client through the handshake that gets it into a lobby
+func (ts *testServer) join(client *testClient, version byte) *testClient {
+	ts.t.Helper()
+
+	steamID := client.SteamID
+	client.Send(&protocol.Empty{PacketType: packetTypeClientRequestingAccepting}, 0, 0)
+	accepted := &protocol.ClientAccepted{}
+	client.ExpectMessage(accepted)
+	client.setSession(accepted.Token)
+
+	client.Send(&protocol.ClientRequestingIndex{
+		SteamID:         steamID,
+		PlayerCount:     1,
+		ProtocolVersion: version,
+		Extensions:      protocol.Extensions,
+	}, 0, steamID)
+	client.ExpectInit()
+
+	return client
+}
+
+//JoinStock joins like Join with a client that asks for none of the server's extensions, so like the stock game it never signs a packet
+func (ts *testServer) JoinStock(steamID uint64) *testClient {
+	ts.t.Helper()
+
+	client := ts.Connect(steamID)
+	client.Send(&protocol.Empty{PacketType: packetTypeClientRequestingAccepting}, 0, 0)
+	client.Expect(packetTypeClientAccepted) //The stock game has no use for the session token
+
+	client.Send(&protocol.ClientRequestingIndex{
+		SteamID:         steamID,
+		PlayerCount:     1,
+		ProtocolVersion: protocol.Version,
+	}, 0, steamID)
+	client.ExpectInit()
+
+	return client
+}
+
+//Lobby returns the lobby a scripted client is in, failing the test if it isn't in one
+func (ts *testServer) Lobby(client *testClient) *Lobby {
+	ts.t.Helper()
+
+	lobby := ts.GetLobbyByAddr(client.Socket().addr)
+	if lobby == nil {
+		ts.t.Fatalf("client %d isn't in a lobby", client.SteamID)
+	}
+	return lobby
+}
+
+//testClient is a scripted Stick Fight client on a test server's network, which keeps every packet it receives for the test to expect
+type testClient struct {
+	t           testing.TB
+	SteamID     uint64
+	PlayerIndex int //The client's only player, as of the last clientInit
+
+	dialect     *protocol.Dialect     //Every packet is translated to and from it like the server does
+	server      *net.UDPAddr
+	reliability *protocol.Reliability //Only touched by the reader
+	lastInit    []byte                //The last clientInit, to tell a resend from a new one
+	received    chan *Packet
+	readerDone  chan struct{} //Closed once the reader of the current socket stops
+
+	sessionLock sync.Mutex //Guards the session and the socket, which the reader sends from
+	session     []byte
+	sock        *MemoryTransport
+}
+
+//Socket returns the socket the client currently sends from
+func (client *testClient) Socket() *MemoryTransport {
+	client.sessionLock.Lock()
+	defer client.sessionLock.Unlock()
+	return client.sock
+}
+
+//read reads packets from the socket until it's closed, answering acks and pings like the game does and keeping the rest
+func (client *testClient) read(sock *MemoryTransport, done chan struct{}) {
+	defer close(done)
+
+	buffer := make([]byte, maxBufferSize)
+	for {
+		n, _, err := sock.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		packet, err := protocol.NewPacketFromBytes(buffer[:n])
+		if err != nil {
+			client.t.Errorf("client %d received a malformed packet: %v", client.SteamID, err)
+			continue
+		}
+
+		if packet.Sequence == 0 {
+			client.handle(packet)
+			continue
+		}
+
+		if packet.Type == packetTypeClientInit && packet.Sequence == 1 && string(buffer[:n]) != string(client.lastInit) {
+			client.reliability = protocol.NewReliability() //Moving lobbies starts every channel over
+			client.lastInit = append([]byte{}, buffer[:n]...)
+		}
+		ready, accepted := client.reliability.Receive(packet)
+		if !accepted {
+			continue
+		}
+		client.Send(&protocol.Ack{Sequence: packet.Sequence}, packet.Channel, 0)
+		for _, ready := range ready {
+			client.handle(ready)
+		}
+	}
+}
+
+func (client *testClient) handle(packet *Packet) {
+	if err := client.dialect.FromWire(packet); err != nil {
+		client.t.Errorf("client %d received a malformed packet: %v", client.SteamID, err)
+		return
+	}
+
+	if packet.Type == packetTypePing && packet.SteamID.ID == 0 {
+		ping := &protocol.Ping{}
+		if packet.Decode(ping) == nil {
+			client.Send(&protocol.PingResponse{Data: ping.Data}, packet.Channel, 0)
+		}
+		return
+	}
+
+	select {
+	case client.received <- packet:
+	default:
+		client.t.Errorf("client %d fell too far behind to keep a %s", client.SteamID, packet.Type)
+	}
+}
+
+func (client *testClient) setSession(session []byte) {
+	client.sessionLock.Lock()
+	defer client.sessionLock.Unlock()
+	client.session = session
+}
+
+//Send sends a message to the server, signed with the client's session once it has one
+func (client *testClient) Send(msg protocol.Message, channel int, steamID uint64) {
+	packet, err := NewPacketFromMessage(msg, channel, steamID)
+	if err == nil {
+		packet, err = client.dialect.ToWire(packet)
+	}
+	if err != nil {
+		client.t.Fatal(err)
+	}
+
+	client.sessionLock.Lock()
+	defer client.sessionLock.Unlock()
+	data := packet.AsBytes()
+	if client.session != nil {
+		data = packet.AsSignedBytes(0, client.session)
+	}
+	client.sock.WriteToUDP(data, client.server)
+}
+
+//Say sends a chat message from the client's player
+func (client *testClient) Say(message string) {
+	client.Send(&protocol.PlayerTalked{Message: message}, protocol.ChannelEvent(client.PlayerIndex), client.SteamID)
+}
+
+//ReadyUp readies up the client's player
+func (client *testClient) ReadyUp() {
+	client.Send(&protocol.ClientReadyUp{PlayerIndexes: []byte{byte(client.PlayerIndex)}}, 0, client.SteamID)
+}
+
+//TakeDamage tells the server the client's player was hurt by another player
+func (client *testClient) TakeDamage(attackerIndex int, damage float32) {
+	client.Send(&protocol.PlayerTookDamage{AttackerIndex: byte(attackerIndex), Damage: damage}, protocol.ChannelUpdate(client.PlayerIndex), client.SteamID)
+}
+
+//Die tells the server the client's player took a killing blow from another player
+func (client *testClient) Die(attackerIndex int) {
+	client.TakeDamage(attackerIndex, 666.666)
+}
+
+//Expect skips received packets until one of the specified type arrives, failing the test if none does in time
+func (client *testClient) Expect(packetType PacketType) *Packet {
+	client.t.Helper()
+
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case packet := <-client.received:
+			if packet.Type == packetType {
+				return packet
+			}
+		case <-deadline:
+			client.t.Fatalf("client %d didn't receive a %s", client.SteamID, packetType)
+			return nil
+		}
+	}
+}
+
+//ExpectMessage expects a packet of the message's type and decodes it into the message
+func (client *testClient) ExpectMessage(msg protocol.Message) *Packet {
+	client.t.Helper()
+
+	packet := client.Expect(msg.Type())
+	if err := packet.Decode(msg); err != nil {
+		client.t.Fatalf("client %d received a malformed %s: %v", client.SteamID, msg.Type(), err)
+	}
+	return packet
+}
+
+//ExpectInit expects the client to be accepted into a lobby, and takes on the player index it was given
+func (client *testClient) ExpectInit() *protocol.ClientInit {
+	client.t.Helper()
+
+	init := &protocol.ClientInit{LocalSteamID: client.SteamID}
+	client.ExpectMessage(init)
+	if !init.Accepted {
+		client.t.Fatalf("client %d was rejected: %s", client.SteamID, init.Reason)
+	}
+	client.PlayerIndex = int(init.PlayerIndex)
+	return init
+}
+
+//ExpectChat skips received packets until the specified player says something starting with the prefix, and returns what they said
+func (client *testClient) ExpectChat(playerIndex int, prefix string) string {
+	client.t.Helper()
+
+	deadline := time.After(testTimeout)
+	for {
+		talked := &protocol.PlayerTalked{}
+		select {
+		case packet := <-client.received:
+			if packet.Type != packetTypePlayerTalked || packet.Channel != protocol.ChannelEvent(playerIndex) || packet.Decode(talked) != nil {
+				continue
+			}
+			if strings.HasPrefix(talked.Message, prefix) {
+				return talked.Message
+			}
+		case <-deadline:
+			client.t.Fatalf("client %d didn't hear player %d say %q", client.SteamID, playerIndex, prefix)
+			return ""
+		}
+	}
+}
+
+//ExpectMapChange expects the lobby to change maps, failing the test unless the specified player won the last one
+func (client *testClient) ExpectMapChange(winnerIndex int) protocol.Map {
+	client.t.Helper()
+
+	mapChange := &protocol.MapChange{}
+	client.ExpectMessage(mapChange)
+	if int(mapChange.WinnerIndex) != winnerIndex {
+		client.t.Fatalf("client %d saw player %d win instead of player %d", client.SteamID, mapChange.WinnerIndex, winnerIndex)
+	}
+	return mapChange.Map()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	impairReorderDelay = 50 * time.Millisecond //How much longer a reordered packet is held back than the packets after it
+)
+
+//Impairment is a simulated bad network link, applied each way between the server and a client
+type Impairment struct {
+	Latency   time.Duration //How long every packet is held back
+	Jitter    time.Duration //How much longer or shorter than the latency a packet may be held back, at random
+	Loss      float64       //The chance of a packet being lost, from 0 to 1
+	Duplicate float64       //The chance of a packet arriving twice, from 0 to 1
+	Reorder   float64       //The chance of a packet being held back behind the packets after it, from 0 to 1
+}
+
+//ParseImpairment parses an impairment written as settings like "latency=100ms jitter=20ms loss=5% dup=1% reorder=10%", or returns nil for "off"
+func ParseImpairment(settings []string) (*Impairment, error) {
+	if len(settings) == 0 || (len(settings) == 1 && (settings[0] == "off" || settings[0] == "none")) {
+		return nil, nil
+	}
+
+	impairment := &Impairment{}
+	for _, setting := range settings {
+		if setting == "" {
+			continue //Chat commands are split on every space
+		}
+		keyValue := strings.SplitN(setting, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("%q isn't setting=value", setting)
+		}
+
+		var err error
+		switch key, value := strings.ToLower(keyValue[0]), keyValue[1]; key {
+		case "latency", "delay":
+			impairment.Latency, err = parseImpairDuration(value)
+		case "jitter":
+			impairment.Jitter, err = parseImpairDuration(value)
+		case "loss":
+			impairment.Loss, err = parseImpairChance(value)
+		case "dup", "duplicate":
+			impairment.Duplicate, err = parseImpairChance(value)
+		case "reorder":
+			impairment.Reorder, err = parseImpairChance(value)
+		default:
+			return nil, fmt.Errorf("unknown setting %q", keyValue[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", keyValue[0], err)
+		}
+	}
+
+	return impairment, nil
+}
+
+func parseImpairDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err == nil && duration < 0 {
+		return 0, fmt.Errorf("%s is negative", value)
+	}
+	return duration, err
+}
+
+//parseImpairChance parses a chance written as a percentage like "5%", or a fraction like "0.05"
+func parseImpairChance(value string) (float64, error) {
+	divisor := 1.0
+	if strings.HasSuffix(value, "%") {
+		value, divisor = strings.TrimSuffix(value, "%"), 100.0
+	}
+
+	chance, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	chance /= divisor
+	if chance < 0 || chance > 1 {
+		return 0, fmt.Errorf("%s isn't between 0%% and 100%%", value)
+	}
+	return chance, nil
+}
+
+func (impairment *Impairment) String() string {
+	if impairment == nil {
+		return "unimpaired"
+	}
+
+	str := fmt.Sprintf("%s latency", impairment.Latency)
+	if impairment.Jitter > 0 {
+		str += fmt.Sprintf(" ±%s", impairment.Jitter)
+	}
+	if impairment.Loss > 0 {
+		str += fmt.Sprintf(", %g%% lost", impairment.Loss*100)
+	}
+	if impairment.Duplicate > 0 {
+		str += fmt.Sprintf(", %g%% duplicated", impairment.Duplicate*100)
+	}
+	if impairment.Reorder > 0 {
+		str += fmt.Sprintf(", %g%% reordered", impairment.Reorder*100)
+	}
+	return str
+}
+
+//Impairer simulates bad network links on the server's send and receive paths, for every client, the clients of a lobby or a single client
+type Impairer struct {
+	sync.Mutex
+
+	Default *Impairment            //Applies to every client without a lobby or client impairment
+	lobbies map[*Lobby]*Impairment //Applies to every client in a lobby without a client impairment
+	clients map[uint64]*Impairment //Applies to a single client by Steam ID, so it follows the client between lobbies and reconnects
+	random  *rand.Rand             //Only used under the lock
+	held    map[*time.Timer]bool   //The timer of every packet being held back, to be stopped on close
+	closed  bool                   //If true, packets are dropped rather than held back
+}
+
+//NewImpairer returns an impairer that leaves every packet alone until it's given an impairment
+func NewImpairer() *Impairer {
+	return &Impairer{
+		lobbies: make(map[*Lobby]*Impairment),
+		clients: make(map[uint64]*Impairment),
+		held:    make(map[*time.Timer]bool),
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+//SetDefault impairs every client without a lobby or client impairment, or stops impairing them if nil
+func (imp *Impairer) SetDefault(impairment *Impairment) {
+	imp.Lock()
+	defer imp.Unlock()
+	imp.Default = impairment
+}
+
+//SetLobby impairs every client in a lobby without a client impairment, or stops impairing them if nil
+func (imp *Impairer) SetLobby(lobby *Lobby, impairment *Impairment) {
+	imp.Lock()
+	defer imp.Unlock()
+	if impairment == nil {
+		delete(imp.lobbies, lobby)
+		return
+	}
+	imp.lobbies[lobby] = impairment
+}
+
+//SetClient impairs the client with a Steam ID, or stops impairing it if nil
+func (imp *Impairer) SetClient(steamID uint64, impairment *Impairment) {
+	imp.Lock()
+	defer imp.Unlock()
+	if impairment == nil {
+		delete(imp.clients, steamID)
+		return
+	}
+	imp.clients[steamID] = impairment
+}
+
+//Lobby returns the impairment of a lobby, or nil if it has none
+func (imp *Impairer) Lobby(lobby *Lobby) *Impairment {
+	imp.Lock()
+	defer imp.Unlock()
+	return imp.lobbies[lobby]
+}
+
+//Client returns the impairment of the client with a Steam ID, or nil if it has none
+func (imp *Impairer) Client(steamID uint64) *Impairment {
+	imp.Lock()
+	defer imp.Unlock()
+	return imp.clients[steamID]
+}
+
+//For returns the impairment of the packets to and from an address, or nil if they're left alone
+func (imp *Impairer) For(addr *net.UDPAddr, registry *Registry) *Impairment {
+	imp.Lock()
+	defer imp.Unlock()
+	if len(imp.clients) == 0 && len(imp.lobbies) == 0 {
+		return imp.Default //Nothing to look up
+	}
+
+	lobby, client := registry.GetByAddr(addr)
+	if client != nil {
+		if impairment, ok := imp.clients[client.SteamID.ID]; ok {
+			return impairment
+		}
+	}
+	if lobby != nil {
+		if impairment, ok := imp.lobbies[lobby]; ok {
+			return impairment
+		}
+	}
+	return imp.Default
+}
+
+//Apply passes a packet on to deliver as the impaired link would: late, more than once, out of order, or not at all
+//Once the impairer is closed every packet is dropped
+func (imp *Impairer) Apply(impairment *Impairment, data []byte, deliver func([]byte)) {
+	imp.Lock()
+	if imp.closed {
+		imp.Unlock()
+		return
+	}
+	lost := imp.random.Float64() < impairment.Loss
+	delays := []time.Duration{imp.delay(impairment)}
+	if imp.random.Float64() < impairment.Duplicate {
+		delays = append(delays, imp.delay(impairment))
+	}
+	imp.Unlock()
+
+	if lost {
+		return
+	}
+	for _, delay := range delays {
+		if delay <= 0 {
+			deliver(data)
+			continue
+		}
+
+		delayed := append([]byte{}, data...) //The sender may reuse its buffer before the delay is up
+		imp.Lock()
+		if imp.closed {
+			imp.Unlock()
+			return
+		}
+		var timer *time.Timer
+		timer = time.AfterFunc(delay, func() {
+			imp.Lock()
+			closed := imp.closed
+			delete(imp.held, timer)
+			imp.Unlock()
+			if !closed {
+				deliver(delayed)
+			}
+		})
+		imp.held[timer] = true
+		imp.Unlock()
+	}
+}
+
+//Close drops every packet that's being held back, and every packet it's given from then on
+func (imp *Impairer) Close() {
+	imp.Lock()
+	defer imp.Unlock()
+
+	imp.closed = true
+	for timer := range imp.held {
+		timer.Stop()
+	}
+	imp.held = make(map[*time.Timer]bool)
+}
+
+//delay returns how long to hold back a packet on an impaired link
+func (imp *Impairer) delay(impairment *Impairment) time.Duration {
+	delay := impairment.Latency
+	if impairment.Jitter > 0 {
+		delay += time.Duration(imp.random.Int63n(int64(impairment.Jitter)*2+1)) - impairment.Jitter
+	}
+	if imp.random.Float64() < impairment.Reorder {
+		delay += impairReorderDelay
+	}
+	return delay
+}
+
+//Impair passes a packet sent to or received from an address on to deliver, through the address's impairment if it has one
+func (srv *Server) Impair(addr *net.UDPAddr, data []byte, deliver func([]byte)) {
+	impairment := srv.Impairer.For(addr, srv.Registry)
+	if impairment == nil {
+		deliver(data)
+		return
+	}
+	srv.Impairer.Apply(impairment, data, func(data []byte) {
+		if srv.IsRunning() { //It may have been held back past the server closing
+			deliver(data)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+func TestParseImpairment(t *testing.T) {
+	impairment, err := ParseImpairment([]string{"latency=100ms", "jitter=20ms", "loss=5%", "dup=0.01", "", "reorder=10%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Impairment{Latency: 100 * time.Millisecond, Jitter: 20 * time.Millisecond, Loss: 0.05, Duplicate: 0.01, Reorder: 0.1}
+	if *impairment != expected {
+		t.Fatalf("parsed %+v, expected %+v", *impairment, expected)
+	}
+
+	if impairment, err := ParseImpairment([]string{"off"}); impairment != nil || err != nil {
+		t.Fatalf("off parsed as %v, %v", impairment, err)
+	}
+	for _, setting := range []string{"latency=-1s", "loss=101%", "dup=2", "speed=fast", "latency"} {
+		if _, err := ParseImpairment([]string{setting}); err == nil {
+			t.Errorf("%q parsed", setting)
+		}
+	}
+}
+
+func TestImpairerLossAndDuplication(t *testing.T) {
+	imp := NewImpairer()
+	delivered := 0
+	deliver := func([]byte) { delivered++ }
+
+	imp.Apply(&Impairment{Loss: 1}, []byte{1}, deliver)
+	if delivered != 0 {
+		t.Fatalf("lost packet was delivered %d times", delivered)
+	}
+	imp.Apply(&Impairment{Duplicate: 1}, []byte{1}, deliver)
+	if delivered != 2 {
+		t.Fatalf("duplicated packet was delivered %d times", delivered)
+	}
+}
+
+func TestImpairerClose(t *testing.T) {
+	imp := NewImpairer()
+	delivered := make(chan []byte, 2)
+	deliver := func(data []byte) { delivered <- data }
+
+	imp.Apply(&Impairment{Latency: 50 * time.Millisecond}, []byte{1}, deliver)
+	imp.Close() //Without waiting for the held back packet
+	imp.Apply(&Impairment{}, []byte{2}, deliver)
+	select {
+	case data := <-delivered:
+		t.Fatalf("packet %v was delivered after the impairer closed", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestImpairCommand(t *testing.T) {
+	allowImpair = true
+	t.Cleanup(func() { allowImpair = false }) //After the server closes, as cleanups run last first
+
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+
+	//Every packet is held back each way, so a chat command takes at least two latencies to be answered
+	host.Say("/impair latency=150ms")
+	host.ExpectChat(host.PlayerIndex, "Network: 150ms latency")
+	start := time.Now()
+	host.Say("/code")
+	host.ExpectChat(host.PlayerIndex, "Room code: ")
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("impaired chat command was answered in %s", elapsed)
+	}
+
+	host.Say("/impair off")
+	host.ExpectChat(host.PlayerIndex, "Network: unimpaired")
+	if impairment := ts.Impairer.For(host.sock.addr, ts.Registry); impairment != nil {
+		t.Fatalf("lobby is still impaired with %s", impairment)
+	}
+}
+
+func TestImpairerForgetsClosedLobbies(t *testing.T) {
+	allowImpair = true
+	t.Cleanup(func() { allowImpair = false })
+
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	lobby := ts.Lobby(host)
+	host.Say("/impair latency=10ms")
+	host.ExpectChat(host.PlayerIndex, "Network: 10ms latency")
+
+	host.Send(&protocol.Empty{PacketType: packetTypeClientLeft}, 0, host.SteamID)
+	select {
+	case <-lobby.closed:
+	case <-time.After(testTimeout):
+		t.Fatal("lobby didn't close when its last client left")
+	}
+	ts.Impairer.Lock()
+	impaired := len(ts.Impairer.lobbies)
+	ts.Impairer.Unlock()
+	if impaired != 0 {
+		t.Fatalf("impairer still holds %d lobbies after the only one closed", impaired)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	crunch "github.com/superwhiskers/crunch/v3"
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
 )
 
 var (
@@ -61,6 +62,17 @@ func newLevelLandfall(sceneIndex int32) *Level {
 
 	return level
 }
+//newLevelsLandfall returns every Landfall level that can be fought on, which skips the lobby and the stats screen
+func newLevelsLandfall() []*Level {
+	levels := make([]*Level, 0)
+	for i := int32(1); i <= 124; i++ {
+		if i == 102 {
+			continue
+		}
+		levels = append(levels, newLevelLandfall(i))
+	}
+	return levels
+}
 func newLevelLocal(path string) *Level {
 	level := &Level{
 		levelType: 1,
@@ -102,6 +114,23 @@ func newLevelCustomStream(path string, data []byte) *Level {
 	return level
 }
 
+//newLevelFromMap returns the level a map identifier sent to clients refers to
+func newLevelFromMap(m protocol.Map) *Level {
+	if sceneIndex, ok := m.SceneIndex(); ok {
+		return newLevelLandfall(sceneIndex)
+	}
+	if workshopID, ok := m.WorkshopID(); ok {
+		return newLevelCustomOnline(workshopID)
+	}
+	switch m.Type {
+	case protocol.MapTypeLocal:
+		return newLevelLocal(string(m.Data))
+	case protocol.MapTypeStreamed:
+		return newLevelCustomStream("", m.Data)
+	}
+	return newLevel(byte(m.Type), m.Data)
+}
+
 //Load loads the Stick Fight map into memory
 func (m *Level) Load() error {
 	switch m.levelType {
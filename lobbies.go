@@ -1,13 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+const (
+	lobbyInboundSize = 1024 //The amount of packets a lobby can have waiting to be handled before new ones are dropped
+	lobbyEventsSize  = 256  //The amount of events a lobby can have waiting to be run before new ones wait for room
+	maxLobbyPlayers  = 255  //The most players a lobby can allow, as player indexes are sent as a byte
 )
 
 //Lobby holds a Stick Fight lobby
@@ -34,34 +45,59 @@ type Lobby struct {
 	TeamType           string     //The format of teams represented with letters beginning at A
 
 	//Session tracker
-	Running                       bool      //If the lobby is currently running
-	LobbyOwner                    CSteamID  //The current owner of the lobby
-	LobbyCreationTime             time.Time //The time of the lobby's creation
-	LobbyRoomCode                 string    //The room code for other players to join this lobby directly
-	LastTimestamp                 uint32    //The timestamp of the last packet that was accepted by the lobby as present time
-	CurrentLevel                  *Level    //The currently-loaded level
-	InFight                       bool      //If the match is in progress
-	FightStartTime                time.Time //The match's start time
-	CompletedLevelsSinceLastStats int       //The amount of matches played so far since the last time the stats map was used
-	LastAppliedScale              float32   //The scale to use when managing coordinates on the map
-	LastSpawnedWeaponOnLeftSide   bool      //If the last weapon was spawned on the left side or not
-	LastSpawnedWeaponTime         time.Time //The last time a weapon was spawned
-	CheckingWinner                bool      //Stops multiple CheckWinner calls from happening concurrently
+	Running                       bool              //If the lobby is currently running
+	LobbyOwner                    CSteamID          //The current owner of the lobby
+	LobbyCreationTime             time.Time         //The time of the lobby's creation
+	LobbyRoomCode                 string            //The room code for other players to join this lobby directly
+	LastTimestamp                 uint32            //The timestamp of the last packet that was accepted by the lobby as present time
+	CurrentLevel                  *Level            //The currently-loaded level
+	InFight                       bool              //If the match is in progress
+	FightStartTime                time.Time         //The match's start time
+	CompletedLevelsSinceLastStats int               //The amount of matches played so far since the last time the stats map was used
+	LastAppliedScale              float32           //The scale to use when managing coordinates on the map
+	LastSpawnedWeaponOnLeftSide   bool              //If the last weapon was spawned on the left side or not
+	LastSpawnedWeaponTime         time.Time         //The last time a weapon was spawned
+	CheckingWinner                bool              //Stops multiple CheckWinner calls from happening concurrently
+	Seed                          int64             //The seed of the lobby's random numbers, so a capture can replay the same choices
+	Random                        *rand.Rand        //The lobby's random numbers, only to be used from the event loop
+	Capture                       *Capture          //The capture of every packet the lobby sends and receives, nil if not capturing
+	Dialect                       *protocol.Dialect //The protocol version of the lobby's clients, taken on from the first client to join
 
 	Clients    []*Client //The Stick Fight clients currently playing in this lobby
 	Spectators []*Client //The Stick Fight clients currently spectating this lobby
 	Levels     []*Level  //The Stick Fight maps to rotate through each match
+
+	//Event loop
+	Inbound chan *Packet  //Packets waiting to be handled by the event loop
+	Events  chan func()   //Packet handling, timers and game mode callbacks waiting to be run by the event loop
+	closed  chan struct{} //Closed once the lobby closes, to stop the event loop
+	strikes int           //How many events and timers have crashed on the event loop
+	members atomic.Value  //A *lobbyMembers snapshot of the clients and spectators, for lookups from outside of the event loop
+
+	//Tick state
+	playerUpdates    map[int]*Packet //The latest playerUpdate for each player index since the last tick
+	spectatorUpdates map[int]*Packet //The latest playerUpdate for each player index since the last spectator tick
+}
+
+//lobbyMembers is a snapshot of the players in a lobby, as clients and spectators are looked up through the server's registry
+type lobbyMembers struct {
+	players    []*Player //Every player
+	spectators int       //How many spectators are watching
 }
 
 //NewLobby retuns a new lobby
 func NewLobby(srv *Server, roomCode string) (*Lobby, error) {
-	if len(srv.Lobbies) >= maxLobbies {
+	if srv.IsShuttingDown() {
+		return nil, errors.New("server is shutting down")
+	}
+	if len(srv.GetLobbies()) >= maxLobbies {
 		return nil, errors.New("too many lobbies")
 	}
 
 	if roomCode == "" {
 		roomCode = LobbyRoomCode(6)
 	}
+	seed := time.Now().UnixNano()
 
 	lobby := &Lobby{
 		Running:            true,                                             //Mark this lobby as running
@@ -72,13 +108,38 @@ func NewLobby(srv *Server, roomCode string) (*Lobby, error) {
 		WeaponSpawnRateMin: 5,                                                //Default to one weapon at least for every 5 seconds
 		WeaponSpawnRateMax: 8,                                                //Default to one weapon at max for every 8 seconds
 		Weapons:            validWeapons,                                     //Default to the full valid weapon list
-		CurrentLevel:       lobbyLevels[randomizer.Intn(len(lobbyLevels)-1)], //Default to a random lobby map
+		CurrentLevel:       lobbyLevels[randomizer.Intn(len(lobbyLevels))],   //Default to a random lobby map, which a capture records rather than replays
 		LastAppliedScale:   1.0,                                              //The last applied map scaling, used to scale objects and other positions on the map
 		Clients:            make([]*Client, 0),                               //Initialize the clients slice
 		Levels:             defaultLevels,                                    //Default to the default levels list
 		GameMode:           Stock{},                                          //Default to the Stock game mode
+		Seed:               seed,                                             //Seed the lobby's random numbers
+		Random:             rand.New(rand.NewSource(seed)),                   //Initialize the lobby's random numbers
+		Inbound:            make(chan *Packet, lobbyInboundSize),             //Initialize the inbound packet queue
+		Events:             make(chan func(), lobbyEventsSize),               //Initialize the event queue
+		closed:             make(chan struct{}),                              //Initialize the close signal
+		playerUpdates:      make(map[int]*Packet),                            //Initialize the playerUpdates waiting for the next tick
+		spectatorUpdates:   make(map[int]*Packet),                            //Initialize the playerUpdates waiting for the next spectator tick
+	}
+	lobby.updateMembers()
+
+	if captureDir != "" {
+		capture, err := NewCapture(captureDir, &CaptureHeader{
+			Start:    lobby.LobbyCreationTime,
+			RoomCode: roomCode,
+			Seed:     seed,
+			Map:      protocol.Map{Type: protocol.MapType(lobby.CurrentLevel.Type()), Data: lobby.CurrentLevel.Data()},
+		})
+		if err != nil {
+			log.Error("Unable to capture lobby ", roomCode, ": ", err)
+		} else {
+			lobby.Capture = capture
+			log.Debug("Capturing lobby ", roomCode, " to ", capture.Path)
+		}
 	}
 
+	go lobby.Run() //Start the event loop
+
 	return lobby, nil
 }
 
@@ -89,28 +150,341 @@ func (lobby *Lobby) IsRunning() bool {
 	return lobby.Running
 }
 
-//Close closes the lobby
+//Close closes the lobby, telling everyone still in it that it closed
 func (lobby *Lobby) Close() {
+	lobby.CloseWithReason("lobby closed")
+}
+
+//CloseWithReason closes the lobby, telling everyone still in it why
+func (lobby *Lobby) CloseWithReason(reason string) {
 	if !lobby.IsRunning() {
 		return
 	}
 
-	log.Info("Closing lobby!")
+	log.Info("Closing lobby: ", reason)
+	lobby.Publish(eventLobbyClosed, &LobbyClosedEvent{Reason: reason})
 
 	for _, client := range lobby.Spectators {
+		lobby.Server.ClientKick(client, reason)
+		lobby.Server.Registry.Remove(client)
 		client.Close()
 	}
 	for _, client := range lobby.Clients {
+		lobby.Server.ClientKick(client, reason)
+		lobby.Server.Registry.Remove(client)
 		client.Close()
 	}
 	lobby.MaxPlayers = 0
 	lobby.CurrentLevel = nil
-	lobby.FightStartTime = time.Time{}
 	lobby.CompletedLevelsSinceLastStats = 0
 	lobby.Clients = nil
 	lobby.Spectators = nil
 	lobby.Levels = nil
+	lobby.updateMembers()
+
+	if err := lobby.Capture.Close(); err != nil {
+		log.Error("Unable to finish capture of lobby ", lobby.LobbyRoomCode, ": ", err)
+	}
+	lobby.Server.Impairer.SetLobby(lobby, nil)
+
+	lobby.Lock()
+	lobby.FightStartTime = time.Time{}
 	lobby.Running = false
+	lobby.Unlock()
+	close(lobby.closed) //Stop the event loop
+}
+
+//Run runs the lobby's event loop until the lobby closes, so that packet handling, timers and game mode callbacks never race
+func (lobby *Lobby) Run() {
+	resendTicker := time.NewTicker(protocol.ReliableTickRate)
+	defer resendTicker.Stop()
+	heartbeatTicker := time.NewTicker(time.Duration(heartbeatInterval) * time.Second)
+	defer heartbeatTicker.Stop()
+	tickTicker := time.NewTicker(time.Second / time.Duration(tickRate))
+	defer tickTicker.Stop()
+	spectatorTicker := time.NewTicker(time.Second / time.Duration(spectatorTickRate))
+	defer spectatorTicker.Stop()
+	defer lobby.Server.LobbyRemove(lobby)
+
+	for {
+		select {
+		case <-lobby.closed:
+			return
+		case packet := <-lobby.Inbound:
+			handleStart := time.Now()
+			lobby.Server.Recover(packet.Src, func() {
+				lobby.HandleInbound(packet)
+			})
+			lobby.Server.Metrics.HandlerLatency.Observe(time.Since(handleStart).Seconds())
+		case event := <-lobby.Events:
+			lobby.Recover("an event", event)
+		case now := <-resendTicker.C:
+			lobby.Recover("resends", func() { lobby.ResendPackets(now) })
+		case now := <-heartbeatTicker.C:
+			lobby.Recover("the heartbeat", func() { lobby.Heartbeat(now) })
+		case <-tickTicker.C:
+			lobby.Recover("the tick", lobby.Tick)
+		case <-spectatorTicker.C:
+			lobby.Recover("the spectator tick", lobby.SpectatorTick)
+		}
+	}
+}
+
+//Enqueue queues a packet to be handled by the event loop, or drops it if the lobby is too far behind
+func (lobby *Lobby) Enqueue(packet *Packet) {
+	select {
+	case <-lobby.closed:
+	case lobby.Inbound <- packet:
+	default:
+		log.Warn("Dropped packet from ", packet.Src, " as lobby ", lobby.LobbyRoomCode, " is too far behind: ", packet)
+	}
+}
+
+//Do queues an event to be run by the event loop, and never runs it if the lobby closes first
+func (lobby *Lobby) Do(event func()) {
+	select {
+	case <-lobby.closed:
+	case lobby.Events <- event:
+	}
+}
+
+//Invoke runs an event on the event loop and waits for it to finish, and must never be called from the event loop itself
+func (lobby *Lobby) Invoke(event func()) {
+	done := make(chan struct{})
+	lobby.Do(func() {
+		defer close(done)
+		event()
+	})
+
+	select {
+	case <-lobby.closed:
+	case <-done:
+	}
+}
+
+//After runs an event on the event loop once the specified duration has passed
+func (lobby *Lobby) After(wait time.Duration, event func()) {
+	time.AfterFunc(wait, func() {
+		lobby.Do(event)
+	})
+}
+
+//AfterInMatch runs an event on the event loop once the specified duration has passed, unless the match it was scheduled during has ended by then
+//It must be called from the event loop, like every game mode callback is
+func (lobby *Lobby) AfterInMatch(wait time.Duration, event func()) {
+	match := lobby.FightStartTime
+	lobby.After(wait, func() {
+		if lobby.IsRunning() && !match.IsZero() && lobby.FightStartTime.Equal(match) {
+			event()
+		}
+	})
+}
+
+//Members returns the latest snapshot of the clients and spectators in the lobby, which is safe to use outside of the event loop
+func (lobby *Lobby) Members() *lobbyMembers {
+	return lobby.members.Load().(*lobbyMembers)
+}
+
+//updateMembers takes a new snapshot of the clients and spectators in the lobby, and must be called whenever they change
+func (lobby *Lobby) updateMembers() {
+	members := &lobbyMembers{
+		players:    make([]*Player, 0),
+		spectators: len(lobby.Spectators),
+	}
+
+	for _, client := range lobby.Clients {
+		if client != nil && !client.IsClosed() {
+			members.players = append(members.players, client.Players...)
+		}
+	}
+
+	lobby.members.Store(members)
+}
+
+//HandleInbound checks a packet from one of the lobby's clients or spectators and handles it in order on its channel
+func (lobby *Lobby) HandleInbound(packet *Packet) {
+	if !lobby.IsRunning() {
+		return
+	}
+
+	clientLobby, client := lobby.Server.Registry.GetByAddr(packet.Src)
+	if clientLobby == nil {
+		if client = lobby.ClientRebind(packet); client == nil {
+			return
+		}
+	} else if clientLobby != lobby {
+		return //The client left while this packet was waiting
+	}
+
+	//Every packet from a client that signs must be signed with its session token, otherwise anyone could spoof its address
+	if client.Extensions >= protocol.ExtensionsSigned && !packet.Verify(client.Session) {
+		log.Warn("Dropped packet from ", packet.Src, " with an invalid session signature: ", packet)
+		return
+	}
+
+	client.LastTick = time.Now()
+	if client.Disconnected {
+		//It's back from the same address before the grace period ran out
+		lobby.ClientReattach(client, packet)
+		if packet.Type == packetTypeClientRequestingIndex {
+			return
+		}
+	}
+
+	//Only what's handled on the spot is acknowledged here, as an acknowledged packet is never sent again
+	if packet.Sequence != 0 && (packet.Type == packetTypeAck || (packet.Type == packetTypePingResponse && packet.SteamID.ID == 0) || lobby.IsSpectator(client)) {
+		lobby.Server.SendAck(packet, packet.Src)
+	}
+
+	switch packet.Type {
+	case packetTypeAck:
+		ack := &protocol.Ack{}
+		if err := packet.Decode(ack); err != nil {
+			log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+			return
+		}
+		client.Reliability.Ack(packet.Channel, ack.Sequence)
+		return
+
+	case packetTypePingResponse:
+		if packet.SteamID.ID == 0 { //Only the server pings without a target SteamID
+			lobby.Server.ClientPingResponse(client, packet)
+			return
+		}
+	}
+
+	if lobby.IsSpectator(client) {
+		switch packet.Type {
+		case packetTypePing:
+			lobby.Server.ClientPong(packet.Src, packet.Bytes())
+		case packetTypeKickPlayer, packetTypeClientLeft:
+			lobby.Depart(client, "left the lobby")
+		}
+		return
+	}
+
+	if packet.Sequence == 0 {
+		lobby.Handle(packet)
+		return
+	}
+
+	ready, accepted := client.Reliability.Receive(packet)
+	if !accepted {
+		log.Warn("Dropped packet from ", packet.Src, " as too many are waiting on an earlier one: ", packet)
+		return
+	}
+	lobby.Server.SendAck(packet, packet.Src) //Always acknowledge, even duplicates, in case the last ack was lost
+
+	//Handle every packet that's now in order on this channel
+	for _, ready := range ready {
+		lobby.Handle(ready)
+	}
+}
+
+//ResendPackets retransmits reliable packets that haven't been acknowledged in time, and disconnects clients that never acknowledge one
+func (lobby *Lobby) ResendPackets(now time.Time) {
+	failed := make([]*Client, 0)
+	for _, clients := range [][]*Client{lobby.Clients, lobby.Spectators} {
+		for _, client := range clients {
+			if client == nil || client.IsClosed() || client.Disconnected {
+				continue
+			}
+
+			resend, gaveUp := client.Reliability.Resend(now)
+			for _, data := range resend {
+				lobby.Server.WriteTo(data, client.Addr)
+			}
+			if gaveUp {
+				failed = append(failed, client)
+			}
+		}
+	}
+
+	//Remove them after looping, as removing a client shifts the client list
+	for _, client := range failed {
+		log.Warn("Gave up on reliable packets to ", client.Addr)
+		lobby.Disconnect(client, "stopped acknowledging packets")
+	}
+}
+
+//Tick sends every client the latest playerUpdate for each player since the last tick, except for its own players
+func (lobby *Lobby) Tick() {
+	if len(lobby.playerUpdates) == 0 {
+		return
+	}
+
+	//The client protocol has one message per datagram, so a player's latest update is the most it can be coalesced into
+	for playerIndex, packet := range lobby.playerUpdates {
+		delete(lobby.playerUpdates, playerIndex)
+		player := lobby.GetPlayerByIndex(playerIndex) //By its player, as the client may have moved to a new address since sending it
+		if player == nil || player.Client == nil {
+			continue //The player left since sending it
+		}
+
+		for _, client := range lobby.Clients {
+			if client == nil || client == player.Client {
+				continue
+			}
+			lobby.Server.SendPacketToClient(packet, client)
+		}
+	}
+}
+
+//SpectatorTick sends every spectator the latest playerUpdate for each player since the last spectator tick
+func (lobby *Lobby) SpectatorTick() {
+	if len(lobby.spectatorUpdates) == 0 {
+		return
+	}
+
+	for playerIndex, packet := range lobby.spectatorUpdates {
+		delete(lobby.spectatorUpdates, playerIndex)
+		if player := lobby.GetPlayerByIndex(playerIndex); player == nil || player.Client == nil {
+			continue //The player left since sending it
+		}
+
+		for _, spectator := range lobby.Spectators {
+			lobby.Server.SendPacketToClient(packet, spectator)
+		}
+	}
+}
+
+//Heartbeat pings every client and handles the ones that have gone silent for too long
+func (lobby *Lobby) Heartbeat(now time.Time) {
+	if err := lobby.Capture.Flush(); err != nil { //Write out the capture so far, so a crash loses at most a heartbeat of it
+		log.Error("Unable to write capture of lobby ", lobby.LobbyRoomCode, ": ", err)
+	}
+
+	timedOut := make([]*Client, 0)
+	expired := make([]*Client, 0)
+	for _, clients := range [][]*Client{lobby.Clients, lobby.Spectators} {
+		for _, client := range clients {
+			if client == nil || client.IsClosed() {
+				continue
+			}
+
+			if client.Disconnected {
+				if client.IsGraceExpired(now) {
+					expired = append(expired, client)
+				}
+				continue
+			}
+
+			if client.IsTimedOut(now) {
+				timedOut = append(timedOut, client)
+				continue
+			}
+
+			lobby.Server.ClientPing(client)
+		}
+	}
+
+	//Remove them after looping, as removing a client shifts the client list
+	for _, client := range timedOut {
+		lobby.ClientTimedOut(client)
+	}
+	for _, client := range expired {
+		lobby.Depart(client, "didn't reconnect in time")
+	}
 }
 
 //BroadcastPacket broadcasts a packet to every client in the lobby, except ignoreAddr if specified
@@ -121,20 +495,20 @@ func (lobby *Lobby) BroadcastPacket(packet *Packet, ignoreAddr *net.UDPAddr) {
 
 	for clientIndex := 0; clientIndex < len(lobby.Clients); clientIndex++ {
 		if lobby.Clients[clientIndex] != nil {
-			if ignoreAddr != nil && ignoreAddr.String() == lobby.Clients[clientIndex].Addr.String() {
+			if ignoreAddr != nil && newAddrKey(ignoreAddr) == newAddrKey(lobby.Clients[clientIndex].Addr) {
 				continue //Ignore this address
 			}
-			lobby.Server.SendPacket(packet, lobby.Clients[clientIndex].Addr)
+			lobby.Server.SendPacketToClient(packet, lobby.Clients[clientIndex])
 		}
 	}
 
 	for clientIndex := 0; clientIndex < len(lobby.Spectators); clientIndex++ {
 		if lobby.Spectators[clientIndex] != nil {
-			lobby.Server.SendPacket(packet, lobby.Spectators[clientIndex].Addr)
+			lobby.Server.SendPacketToClient(packet, lobby.Spectators[clientIndex])
 		}
 	}
 
-	if packet.ShouldLog() {
+	if shouldLog(packet) {
 		log.Trace("Broadcasted packet: ", packet)
 	}
 }
@@ -203,7 +577,13 @@ func (lobby *Lobby) Handle(packet *Packet) {
 		}
 
 	case packetTypeClientRequestingToSpawn:
-		playerIndex := int(packet.ReadByteNext())
+		request := &protocol.ClientRequestingToSpawn{}
+		if err := packet.Decode(request); err != nil {
+			log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+			return
+		}
+
+		playerIndex := int(request.PlayerIndex)
 		player := lobby.GetPlayerByIndex(playerIndex)
 		if player == nil {
 			log.Error("Unable to spawn invalid player ", playerIndex)
@@ -214,14 +594,23 @@ func (lobby *Lobby) Handle(packet *Packet) {
 			return
 		}
 
-		lobby.SpawnPlayer(playerIndex, packet.ReadF32LENext(1)[0], packet.ReadF32LENext(1)[0], packet.ReadF32LENext(1)[0], packet.ReadF32LENext(1)[0])
+		lobby.SpawnPlayer(playerIndex, request.PositionX, request.PositionY, request.RotationX, request.RotationY)
 
 	case packetTypeLobbyType:
+		lobbyType := &protocol.LobbyType{}
+		if err := packet.Decode(lobbyType); err != nil {
+			log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+			return
+		}
+
 		_, client := lobby.GetClientByAddr(packet.Src)
+		if client == nil {
+			return
+		}
 		playerIndex := client.Players[0].Index
 
 		if lobby.IsOwner(client.SteamID) {
-			flag := int(packet.ReadByteNext())
+			flag := int(lobbyType.LobbyType)
 			switch flag {
 			case 1: //Friends only
 				lobby.Public = false
@@ -236,6 +625,12 @@ func (lobby *Lobby) Handle(packet *Packet) {
 			lobby.PlayerSaid(playerIndex, "No permissions!")
 		}
 
+	case packetTypeClientRequestingIndex:
+		_, client := lobby.GetClientByAddr(packet.Src)
+		if client != nil {
+			lobby.ClientReattach(client, packet) //Already here, so just initialize it again
+		}
+
 	case packetTypeClientReadyUp:
 		lobby.ReadyUp(packet)
 
@@ -245,7 +640,7 @@ func (lobby *Lobby) Handle(packet *Packet) {
 	case packetTypeKickPlayer, packetTypeClientLeft:
 		_, client := lobby.GetClientByAddr(packet.Src)
 		if client != nil {
-			lobby.KickClientBySteamID(client.SteamID.ID)
+			lobby.Depart(client, "left the lobby")
 		}
 
 	case packetTypePlayerTalked:
@@ -269,20 +664,46 @@ func (lobby *Lobby) Handle(packet *Packet) {
 	case packetTypePlayerLavaForceAdded:
 		lobby.BroadcastPacket(packet, packet.Src)
 
-	case packetTypeClientRequestingWeaponDrop:
-		nextWeaponSpawnID := lobby.GetNextWeaponSpawnID(false)
-		nextObjectSpawnID := lobby.GetNextObjectSpawnID(false)
+	case packetTypeClientRequestingWeaponDrop, packetTypeClientRequestingWeaponThrow:
+		request := &protocol.ClientRequestingWeaponDrop{PacketType: packet.Type}
+		if err := packet.Decode(request); err != nil {
+			log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+			return
+		}
 
-		packet.Type = packetTypeWeaponDropped
-		packet.Grow(4)
-		packet.WriteU16LENext([]uint16{nextWeaponSpawnID, nextObjectSpawnID})
+		//Answer with the request as-is, plus the spawn IDs for the weapon's new object
+		answer := &protocol.WeaponDropped{
+			PacketType:    packetTypeWeaponDropped,
+			Request:       *request,
+			WeaponSpawnID: lobby.GetNextWeaponSpawnID(false),
+			ObjectSpawnID: lobby.GetNextObjectSpawnID(false),
+		}
+		if packet.Type == packetTypeClientRequestingWeaponThrow {
+			answer.PacketType = packetTypeWeaponThrown
+		}
+		packetAnswer, err := NewPacketFromMessage(answer, packet.Channel, packet.SteamID.ID)
+		if err != nil {
+			log.Error("Unable to answer ", packet.Type, ": ", err)
+			return
+		}
+		packetAnswer.Timestamp = packet.Timestamp
 
-		log.Info("Weapon ", int(packet.ReadByte(0x0)), " was dropped!")
-		lobby.BroadcastPacket(packet, nil)
+		if answer.PacketType == packetTypeWeaponThrown {
+			log.Info("Weapon ", int(request.Weapon), " was thrown!")
+		} else {
+			log.Info("Weapon ", int(request.Weapon), " was dropped!")
+		}
+		lobby.BroadcastPacket(packetAnswer, nil)
 
 	case packetTypeClientRequestingWeaponPickUp:
-		playerIndex := int(packet.ReadByteNext())
-		weaponSpawnID := packet.ReadU16LENext(1)[0]
+		request := &protocol.ClientRequestingWeaponPickUp{PacketType: packet.Type}
+		if err := packet.Decode(request); err != nil {
+			log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+			return
+		}
+
+		playerIndex := int(request.PlayerIndex)
+		weaponSpawnID := request.WeaponSpawnID
 
 		if weapon, ok := lobby.CurrentLevel.SpawnedWeapons[weaponSpawnID]; ok && weapon != nil {
 			packet.Type = packetTypeWeaponWasPickedUp
@@ -293,44 +714,34 @@ func (lobby *Lobby) Handle(packet *Packet) {
 			log.Error("Player ", playerIndex, " tried to pick up invalid weapon ", weaponSpawnID, "!")
 		}
 
-	case packetTypeClientRequestingWeaponThrow:
-		nextWeaponSpawnID := lobby.GetNextWeaponSpawnID(false)
-		nextObjectSpawnID := lobby.GetNextObjectSpawnID(false)
-
-		packet.Type = packetTypeWeaponThrown
-		packet.Grow(4)
-		packet.WriteU16LE(packet.ByteCapacity()-4, []uint16{nextWeaponSpawnID, nextObjectSpawnID})
-
-		log.Info("Weapon ", int(packet.ReadByte(0x0)), " was thrown!")
-		lobby.BroadcastPacket(packet, nil)
-
 	default:
 		log.Error(fmt.Sprintf("Unhandled packet from %s: %s", packet.Src, packet))
 	}
 }
 
+//lobbyHealths are the maximum and starting health of a player for each of the game's health settings, in its order
+var lobbyHealths = []float32{100, 200, 300, 1, 25, 50, 75}
+
 //GetMaxHealth returns the maximum and starting health of a player
 func (lobby *Lobby) GetMaxHealth() float32 {
-	switch lobby.Health {
-	case 0:
-		return 100
-	case 1:
-		return 200
-	case 2:
-		return 300
-	case 3:
-		return 1
-	case 4:
-		return 25
-	case 5:
-		return 50
-	case 6:
-		return 75
+	if int(lobby.Health) < len(lobbyHealths) {
+		return lobbyHealths[lobby.Health]
 	}
 
 	return 0
 }
 
+//SetMaxHealth sets the maximum and starting health of a player for the next match, returning false if the game has no such setting
+func (lobby *Lobby) SetMaxHealth(maxHealth float32) bool {
+	for setting, health := range lobbyHealths {
+		if health == maxHealth {
+			lobby.Health = byte(setting)
+			return true
+		}
+	}
+	return false
+}
+
 //GetNextWeaponSpawnID returns the next available weaponSpawnID
 func (lobby *Lobby) GetNextWeaponSpawnID(beginFromEnd bool) uint16 {
 	if !lobby.IsRunning() {
@@ -409,6 +820,17 @@ func (lobby *Lobby) GetPlayerCount(excludeSelf bool) int {
 	return playerCount
 }
 
+//CheckMaxPlayers returns an error if the lobby can't allow the specified maximum amount of players
+func (lobby *Lobby) CheckMaxPlayers(maxPlayers int) error {
+	if maxPlayers < 1 || maxPlayers > maxLobbyPlayers {
+		return fmt.Errorf("max players must be from 1 to %d", maxLobbyPlayers)
+	}
+	if playerCount := lobby.GetPlayerCount(false); maxPlayers < playerCount {
+		return fmt.Errorf("max players can't be below the %d players in the lobby", playerCount)
+	}
+	return nil
+}
+
 //GetPlayersTooMany returns true if the current player count plus the playersToAdd count exceeds the lobby's maximum player setting
 func (lobby *Lobby) GetPlayersTooMany(playersToAdd int, excludeSelf bool) bool {
 	if !lobby.IsRunning() {
@@ -508,16 +930,17 @@ func (lobby *Lobby) GetNextPlayerIndex() int {
 
 //GetClientByAddr returns the client with a matching address
 func (lobby *Lobby) GetClientByAddr(addr *net.UDPAddr) (int, *Client) {
-	if lobby.Clients == nil || len(lobby.Clients) == 0 {
+	clientLobby, found := lobby.Server.Registry.GetByAddr(addr)
+	if clientLobby != lobby {
 		return -1, nil
 	}
 
 	for clientIndex, client := range lobby.Clients {
-		if client.Addr.String() == addr.String() {
+		if client == found {
 			return clientIndex, client
 		}
 	}
-	return -1, nil
+	return -1, nil //It's a spectator
 }
 
 //GetClientBySteamID returns the client with a matching SteamID
@@ -569,21 +992,91 @@ func (lobby *Lobby) GetIndexesByPlayerIndex(index int) (int, int) {
 	return -1, -1
 }
 
-//KickClientBySteamID kicks all clients from the lobby that have a matching SteamID
-func (lobby *Lobby) KickClientBySteamID(steamID uint64) {
+//KickClientBySteamID kicks all clients and spectators from the lobby that have a matching SteamID, telling them why
+func (lobby *Lobby) KickClientBySteamID(steamID uint64, reason string) {
 	if !lobby.IsRunning() {
 		return
 	}
 
-	if lobby.Clients == nil || len(lobby.Clients) == 0 {
+	//Find them before kicking, as removing a client shifts the client list
+	kicked := make([]*Client, 0)
+	for _, clients := range [][]*Client{lobby.Clients, lobby.Spectators} {
+		for _, client := range clients {
+			if client.SteamID.CompareSteamID(steamID) {
+				kicked = append(kicked, client)
+			}
+		}
+	}
+	for _, client := range kicked {
+		lobby.Disconnect(client, reason)
+	}
+}
+
+//Disconnect removes a client or spectator from the lobby, telling it why and letting everyone else know in chat
+//Kicks, timeouts and lobby closure all end up here or in CloseWithReason, so that no one is ever silently dropped
+func (lobby *Lobby) Disconnect(client *Client, reason string) {
+	if !lobby.IsRunning() || client == nil || client.IsClosed() {
 		return
 	}
 
-	for clientIndex := 0; clientIndex < len(lobby.Clients); clientIndex++ {
-		if lobby.Clients[clientIndex].SteamID.CompareSteamID(steamID) {
-			lobby.ClientRemoveByClientIndex(clientIndex)
+	lobby.Server.ClientKick(client, reason)
+	lobby.Depart(client, reason)
+}
+
+//Depart removes a client or spectator that's already on its way out from the lobby, letting everyone else know in chat why
+func (lobby *Lobby) Depart(client *Client, reason string) {
+	if !lobby.IsRunning() || client == nil || client.IsClosed() {
+		return
+	}
+
+	lobby.SayDeparture(client, reason)
+	lobby.ClientRemove(client)
+}
+
+//MoveClient moves a client or spectator into another lobby, as if it had joined it
+//It waits on both lobbies one after the other, so it must never be called from an event loop, where the other lobby may be waiting on this one
+func (lobby *Lobby) MoveClient(client *Client, dstLobby *Lobby) error {
+	var clientInit *Packet
+	var session []byte
+	lobby.Invoke(func() {
+		if !client.IsClosed() {
+			clientInit, session = client.ClientInit, client.Session
 		}
+	})
+	if clientInit == nil {
+		return fmt.Errorf("client %d left", client.SteamID.ID)
+	}
+
+	err := fmt.Errorf("lobby %s closed", dstLobby.LobbyRoomCode) //Unless the other lobby is still running to say otherwise
+	dstLobby.Invoke(func() {
+		err = dstLobby.ClientInit(clientInit, session)
+	})
+	if err != nil {
+		return err
+	}
+
+	lobby.Invoke(func() {
+		lobby.Depart(client, "moved to lobby "+dstLobby.LobbyRoomCode)
+	})
+	return nil
+}
+
+//SayDeparture tells everyone else in the lobby that a client or spectator is leaving and why, spoken by its first player
+func (lobby *Lobby) SayDeparture(client *Client, reason string) {
+	if lobby.IsSpectator(client) || len(client.Players) == 0 {
+		lobby.Announce("*%s stopped spectating: %s*", client.SteamID.GetNormalizedUsername(), reason)
+		return
+	}
+
+	respMsg := fmt.Sprintf("*%s*", reason)
+	resp, err := NewPacketFromMessage(&protocol.PlayerTalked{Message: respMsg}, client.Players[0].GetChannelEvent(), client.SteamID.ID)
+	if err != nil {
+		log.Error("Unable to chat: ", err)
+		return
 	}
+	lobby.BroadcastPacket(resp, client.Addr) //It may have already moved to another lobby from the same address
+
+	log.Trace("#[CHAT:", client.SteamID.ID, "] ", client.SteamID.GetUsername(), ": ", respMsg)
 }
 
 //IsInvited returns true if the specified SteamID was invited to the server
@@ -617,157 +1110,423 @@ func (lobby *Lobby) IsOwner(steamID CSteamID) bool {
 	return lobby.LobbyOwner.CompareCSteamID(steamID)
 }
 
-//ClientInit initializes a client and returns an error if it fails
-func (lobby *Lobby) ClientInit(packet *Packet) error {
+//ClientInit initializes a client with the session token it was accepted with and returns an error if it fails
+func (lobby *Lobby) ClientInit(packet *Packet, session []byte) error {
 	if !lobby.IsRunning() {
 		return errors.New("lobby not running")
 	}
+	if lobby.Server.IsShuttingDown() {
+		return errors.New("server is shutting down")
+	}
 
-	packet.SeekByte(0, false) //Seek to the start of the packet data
+	request := &protocol.ClientRequestingIndex{}
+	if err := packet.Decode(request); err != nil {
+		return err
+	}
 
-	steamID := packet.ReadU64LENext(1)[0] //Read in the SteamID
-	lobby.KickClientBySteamID(steamID)    //Remove this player from the lobby if they currently exist in it
+	steamID := request.SteamID
+	existing := lobby.GetClientBySteamID(NewCSteamID(steamID))
+	if existing != nil && !bytes.Equal(existing.Session, session) {
+		return fmt.Errorf("already connected from another session") //Don't let a forged SteamID kick the real player
+	}
+	if existing != nil {
+		//Remove this player from the lobby, as it's starting over, but without closing the lobby if it's the only one in it
+		for clientIndex := 0; clientIndex < len(lobby.Clients); clientIndex++ {
+			if lobby.Clients[clientIndex] == existing {
+				lobby.clientDrop(clientIndex)
+				break
+			}
+		}
+		if len(lobby.Clients) > 0 {
+			lobby.ClientLeft(NewCSteamID(steamID)) //Tell the other players that its old players left
+		}
+	}
 
 	//Make sure this player is allowed in the lobby
 	if !lobby.IsInvited(steamID) {
 		return fmt.Errorf("not invited to this lobby")
 	}
 
-	clientPlayerCount := int(packet.ReadByteNext())        //Read in the requested player count
+	clientPlayerCount := int(request.PlayerCount)          //The requested player count
 	//if lobby.GetPlayersTooMany(clientPlayerCount, false) { //Check to see if there's enough open spots in the lobby
 	//	return fmt.Errorf("unable to add %d players to lobby with %d/%d players", clientPlayerCount)
 	//}
 
-	protocolVersion := int(packet.ReadByteNext()) //Read in the client's protocol version
-	if protocolVersion != 25 {                    //We currently only support Stick Fight v25
-		return fmt.Errorf("protocol version %d is unsupported", protocolVersion)
+	dialect, ok := protocol.LookupDialect(request.ProtocolVersion) //The client's protocol version
+	if !ok {
+		return fmt.Errorf("protocol version %d is unsupported", request.ProtocolVersion)
+	}
+	if len(lobby.Clients) == 0 && len(lobby.Spectators) == 0 {
+		lobby.Dialect = dialect //The first client to join decides who can play with it
+	} else if !lobby.Dialect.CompatibleWith(dialect) {
+		return fmt.Errorf("protocol version %d can't play in a lobby on %s", request.ProtocolVersion, lobby.Dialect)
 	}
 
-	newClient := NewClient(lobby, packet.Src, steamID, clientPlayerCount, packet) //Create a new client to host the new players
+	newClient := NewClient(lobby, packet.Src, steamID, clientPlayerCount, packet, session) //Create a new client to host the new players
+	newClient.Dialect = dialect
+	newClient.Extensions = protocol.NegotiateExtensions(request.Extensions)
+	lobby.Capture.Record(CaptureJoined, packet.Src, packet.AsSignedBytes(packet.Sequence, session), session)
+	added := false
 	if lobby.GetPlayersTooMany(clientPlayerCount, false) { //Check to see if there's enough open spots in the lobby
 		if lobby.DisableSpectate {
 			return fmt.Errorf("unable to add %d players to lobby with %d/%d players", clientPlayerCount, len(lobby.GetPlayers()), lobby.MaxPlayers)
 		}
-		lobby.SpectatorAdd(newClient) //Add the new client to the lobby's spectator list
+		added = lobby.SpectatorAdd(newClient) //Add the new client to the lobby's spectator list
 	} else {
-		lobby.ClientAdd(newClient) //Add the new client to the lobby's player list
+		added = lobby.ClientAdd(newClient) //Add the new client to the lobby's player list
+	}
+	if !added {
+		return fmt.Errorf("already connected from another session") //Its SteamID is in another lobby, and a forged one mustn't take it over
+	}
+
+	//Initialize the client
+	packetClientInit, err := lobby.NewClientInitPacket(newClient)
+	if err != nil {
+		return err
+	}
+
+	//Send the clientInit packet!
+	lobby.Server.SendPacketToClient(packetClientInit, newClient)
+	log.Info("Initialized client ", packet.Src, " for ", clientPlayerCount, " players")
+
+	//Send the workshop map cycle to the client
+	lobby.WorkshopMapsLoaded(newClient)
+
+	return nil
+}
+
+//NewClientInitPacket returns a clientInit packet that accepts the specified client into the lobby as it currently stands
+func (lobby *Lobby) NewClientInitPacket(client *Client) (*Packet, error) {
+	clientInit := &protocol.ClientInit{
+		Accepted:        true,                          //Accept the connection
+		PlayerIndex:     byte(client.Players[0].Index), //The first new playerIndex that will be used by this client
+		MapType:         lobby.CurrentLevel.Type(),     //The map type of the current level
+		MapData:         lobby.CurrentLevel.Data(),     //The map data of the current level
+		Players:         make([]protocol.ClientInitPlayer, 0),   //One slot per player, up to the maximum amount of players for this lobby
+		Maps:            0,                             //Still not entirely sure, gets assigned to OptionsHolder.maps on the client and no issues when set to 0
+		Health:          lobby.Health,                  //The starting health of all players
+		Regen:           lobby.Regen,                   //If health regeneration should be enabled
+		WeaponSpawnRate: 2,                             //Set weapon spawn rate to 2 so clients don't request to spawn weapons
+		LocalSteamID:    client.SteamID.ID,             //The client's own players don't get stats
+	}
+
+	for _, player := range lobby.GetPlayers() {
+		if player == nil {
+			clientInit.Players = append(clientInit.Players, protocol.ClientInitPlayer{})
+			continue
+		}
+
+		stats := player.Stats
+		clientInit.Players = append(clientInit.Players, protocol.ClientInitPlayer{SteamID: player.Client.SteamID.ID, Stats: &stats})
+	}
+
+	return NewPacketFromMessage(clientInit, 0, 0)
+}
+
+//ClientAdd adds the specified client to the lobby as one or more players, returning false if there's no room or its SteamID is taken by another session
+func (lobby *Lobby) ClientAdd(client *Client) bool {
+	if lobby.GetPlayersTooMany(client.GetPlayerCount(), false) {
+		return false
+	}
+	if !lobby.Server.Registry.Add(lobby, client) {
+		return false
+	}
+
+	owner := len(lobby.Clients) == 0
+
+	//Add the client to the list of available clients
+	lobby.Clients = append(lobby.Clients, client)
+	defer lobby.updateMembers()
+
+	if owner {
+		lobby.LobbyOwner = client.SteamID
+		lobby.Server.SendPacketToClient(NewPacket(packetTypeRequestingOptions, 0, 0), client)
+	}
+
+	//Initialize each of the players in the client
+	for clientPlayer := 0; clientPlayer < client.GetPlayerCount(); clientPlayer++ {
+		playerIndex := lobby.GetNextPlayerIndex()
+		client.Players[clientPlayer].Index = playerIndex             //Set the next player index for this player
+		lobby.ClientJoined(client.Addr, playerIndex, client.SteamID) //Tell the lobby that this client has joined
+	}
+	return true
+}
+
+//SpectatorAdd adds the specified client to the lobby as a spectator, returning false if its SteamID is taken by another session
+func (lobby *Lobby) SpectatorAdd(client *Client) bool {
+	if !lobby.GetPlayersTooMany(client.GetPlayerCount(), false) {
+		return lobby.ClientAdd(client) //There's enough open spots, try to let the client play instead
+	}
+	if !lobby.Server.Registry.Add(lobby, client) {
+		return false
+	}
+
+	lobby.Spectators = append(lobby.Spectators, client)
+	lobby.updateMembers()
+	return true
+}
+
+//ClientRemoveByClientIndex removes the specified client from the lobby
+func (lobby *Lobby) ClientRemoveByClientIndex(clientIndex int) {
+	if !lobby.IsRunning() {
+		return
+	}
+
+	//Make sure this client actually exists
+	if clientIndex < 0 || clientIndex >= len(lobby.Clients) {
+		return
+	}
+
+	//Get the SteamID of the client
+	steamID := lobby.Clients[clientIndex].SteamID
+
+	//Remove the client from the lobby before anyone's told, so it's never picked as the new owner
+	lobby.clientDrop(clientIndex)
+
+	lobby.ClientLeft(steamID) //Tell the other players that this client left
+	if len(lobby.Clients) == 0 {
+		lobby.Close() //Close the lobby, since there's no more players
+	}
+}
+
+//clientDrop forgets and closes the specified client and takes it out of the client list, without telling anyone
+func (lobby *Lobby) clientDrop(clientIndex int) {
+	//Forget the client, then close it, which forgets its address and SteamID
+	lobby.Server.Registry.Remove(lobby.Clients[clientIndex])
+	lobby.Clients[clientIndex].Close()
+
+	lobby.Clients[clientIndex] = nil                                 //Nullify the client
+	copy(lobby.Clients[clientIndex:], lobby.Clients[clientIndex+1:]) //Shift every client after this client left by one
+	lobby.Clients = lobby.Clients[:len(lobby.Clients)-1]             //Remove the last element
+	lobby.updateMembers()
+}
+
+//SpectatorRemove removes the specified spectator from the lobby
+func (lobby *Lobby) SpectatorRemove(client *Client) {
+	for spectatorIndex := 0; spectatorIndex < len(lobby.Spectators); spectatorIndex++ {
+		if lobby.Spectators[spectatorIndex] != client {
+			continue
+		}
+
+		steamID := client.SteamID
+		lobby.Server.Registry.Remove(client)
+		client.Close()
+
+		lobby.Spectators[spectatorIndex] = nil                                       //Nullify the spectator
+		copy(lobby.Spectators[spectatorIndex:], lobby.Spectators[spectatorIndex+1:]) //Shift every spectator after this spectator left by one
+		lobby.Spectators = lobby.Spectators[:len(lobby.Spectators)-1]                //Remove the last element
+		lobby.updateMembers()
+		log.Info("Spectator ", steamID, " left the lobby!")
+		return
+	}
+}
+
+//IsSpectator returns true if the specified client is spectating this lobby
+func (lobby *Lobby) IsSpectator(client *Client) bool {
+	for _, spectator := range lobby.Spectators {
+		if spectator == client {
+			return true
+		}
+	}
+	return false
+}
+
+//ClientTimedOut handles a client that hasn't sent a packet within the client timeout, holding its slot for it to reconnect if enabled
+func (lobby *Lobby) ClientTimedOut(client *Client) {
+	if !lobby.IsRunning() {
+		return
+	}
+
+	log.Warn("Client ", client.SteamID, " at ", client.Addr, " timed out!")
+
+	if reconnectGrace <= 0 || lobby.IsSpectator(client) {
+		lobby.Disconnect(client, "timed out")
+		return
 	}
 
-	//Initialize the client
-	packetClientInit := NewPacket(packetTypeClientInit, 0, 0) //Create a clientInit packet to initialize this client
-	packetClientInit.Grow(8 + int64(lobby.CurrentLevel.Size()))
-	packetClientInit.WriteByteNext(0x1)                                 //Set to 1 to accept the connection, anything else to refuse the connection
-	packetClientInit.WriteByteNext(byte(newClient.Players[0].Index))    //Set to the first new playerIndex that will be used by this client
-	packetClientInit.WriteByteNext(byte(lobby.MaxPlayers))              //Set to the maximum amount of players for this lobby
-	packetClientInit.WriteByteNext(lobby.CurrentLevel.Type())           //Set the map type of the current level
-	packetClientInit.WriteI32LENext([]int32{lobby.CurrentLevel.Size()}) //Set the map size of the current level
-	packetClientInit.WriteBytesNext(lobby.CurrentLevel.Data())          //Set the map data of the current level
-
-	lobbyPlayers := lobby.GetPlayers()
-	for i := 0; i < len(lobbyPlayers); i++ {
-		packetClientInit.Grow(8)
-		if lobbyPlayers[i] != nil {
-			packetClientInit.WriteU64LENext([]uint64{lobbyPlayers[i].Client.SteamID.ID})
-			if lobbyPlayers[i].Client.SteamID.ID != 0 && lobbyPlayers[i].Client.Addr.String() != packet.Src.String() {
-				packetClientInit.Grow(52)
-				pStats := lobbyPlayers[i].Stats
-				packetClientInit.WriteI32LENext([]int32{
-					pStats.Wins, pStats.Kills, pStats.Deaths, pStats.Suicides, pStats.Falls,
-					pStats.CrownSteals,
-					pStats.BulletsHit, pStats.BulletsMissed, pStats.BulletsShot,
-					pStats.Blocks, pStats.PunchesLanded,
-					pStats.WeaponsPickedUp, pStats.WeaponsThrown,
-				})
-			}
-		} else {
-			packetClientInit.WriteU64LENext([]uint64{0})
+	lobby.ClientDisconnected(client)
+}
+
+//ClientDisconnected holds a client's player slot, stats and ready state for the reconnect grace period
+func (lobby *Lobby) ClientDisconnected(client *Client) {
+	client.Disconnected = true
+	client.DisconnectedAt = time.Now()
+	log.Info("Holding slot for client ", client.SteamID, " for ", reconnectGrace, " seconds")
+
+	//A disconnected player can't keep fighting, so don't hold up the match or the next one for them
+	if lobby.MatchInProgress() {
+		for _, player := range client.Players {
+			player.Health = 0
 		}
+		lobby.CheckWinner()
+	} else if lobby.AllPlayersReady() {
+		lobby.StartMatch()
 	}
+}
 
-	//TODO: Weapons
-	packetClientInit.Grow(2)
-	packetClientInit.WriteU16LENext([]uint16{0}) //How many weapons to spawn
-
-	//Lobby settings
-	packetClientInit.Grow(4)
-	packetClientInit.WriteBytesNext([]byte{
-		0, //Still not entirely sure, gets assigned to OptionsHolder.maps on the client and no issues when set to 0
-		lobby.Health,
-		lobby.Regen,
-		2, //Set weapon spawn rate to 2 so clients don't request to spawn weapons
-	})
+//ClientRemove removes a client or spectator from the lobby, and checks the match again without it
+func (lobby *Lobby) ClientRemove(client *Client) {
+	if !lobby.IsRunning() {
+		return
+	}
 
-	//Send the clientInit packet!
-	lobby.Server.SendPacket(packetClientInit, packet.Src)
-	log.Info("Initialized client ", packet.Src, " for ", clientPlayerCount, " players")
+	if lobby.IsSpectator(client) {
+		lobby.SpectatorRemove(client)
+		return
+	}
 
-	//Send the workshop map cycle to the client
-	lobby.WorkshopMapsLoaded(packet.Src)
+	for clientIndex := 0; clientIndex < len(lobby.Clients); clientIndex++ {
+		if lobby.Clients[clientIndex] == client {
+			lobby.ClientRemoveByClientIndex(clientIndex)
+			break
+		}
+	}
 
-	return nil
+	//The client may have been the last one standing, or the one everyone was waiting on
+	if lobby.MatchInProgress() {
+		lobby.CheckWinner()
+	} else if lobby.AllPlayersReady() {
+		lobby.StartMatch()
+	}
 }
 
-//ClientAdd adds the specified client to the lobby as one or more players
-func (lobby *Lobby) ClientAdd(client *Client) {
-	if lobby.GetPlayersTooMany(client.GetPlayerCount(), false) {
+//ClientRequestingIndex handles a clientRequestingIndex for a SteamID that's already in the lobby, from an address that isn't
+//It's only returning if the packet is signed with its current session, as anyone can claim a new session under any SteamID
+func (lobby *Lobby) ClientRequestingIndex(packet *Packet, session []byte) {
+	request := &protocol.ClientRequestingIndex{}
+	if err := packet.Decode(request); err != nil {
+		log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
 		return
 	}
 
-	if len(lobby.Clients) == 0 {
-		lobby.LobbyOwner = client.SteamID
-		lobby.Server.SendPacket(NewPacket(packetTypeRequestingOptions, 0, 0), client.Addr)
+	client := lobby.GetClientBySteamID(NewCSteamID(request.SteamID))
+	if client != nil && packet.Verify(client.Session) {
+		if packet.Sequence != 0 {
+			lobby.Server.SendAck(packet, packet.Src)
+		}
+		lobby.ClientReattach(client, packet)
+		return
 	}
 
-	//Add the client to the list of available clients
-	lobby.Clients = append(lobby.Clients, client)
+	if session == nil {
+		log.Warn("Rejected clientRequestingIndex from ", packet.Src, " with an invalid session signature")
+		lobby.Server.ClientReject(packet.Src, "invalid session")
+		return
+	}
+	if client != nil && client.Disconnected {
+		//Joining elsewhere under its SteamID would take over the registry, and with it the held slot's only way back
+		log.Warn("Rejected clientRequestingIndex from ", packet.Src, " for client ", client.SteamID, ", whose slot is held for its own session")
+		lobby.Server.ClientReject(packet.Src, "slot is held for another session")
+		return
+	}
+	if client != nil {
+		//The same goes for a client that's still connected, which would stop being reachable by its SteamID
+		log.Warn("Rejected clientRequestingIndex from ", packet.Src, " for client ", client.SteamID, ", which is connected from another session")
+		lobby.Server.ClientReject(packet.Src, "already connected from another session")
+		return
+	}
 
-	//Initialize each of the players in the client
-	for clientPlayer := 0; clientPlayer < client.GetPlayerCount(); clientPlayer++ {
-		playerIndex := lobby.GetNextPlayerIndex()
-		client.Players[clientPlayer].Index = playerIndex             //Set the next player index for this player
-		lobby.ClientJoined(client.Addr, playerIndex, client.SteamID) //Tell the lobby that this client has joined
+	//It isn't playing here, so let it join like anyone else, which the registry only allows once its SteamID has left
+	if packet.Sequence != 0 {
+		lobby.Server.SendAck(packet, packet.Src)
 	}
+	go lobby.Server.ClientJoin(packet, session) //It waits on the new lobby, which mustn't be done from this one's event loop
 }
 
-//SpectatorAdd adds the specified client to the lobby as a spectator
-func (lobby *Lobby) SpectatorAdd(client *Client) {
-	if !lobby.GetPlayersTooMany(client.GetPlayerCount(), false) {
-		lobby.ClientAdd(client) //There's enough open spots, try to let the client play instead
-		return
+//ClientRebind takes a packet from an address that isn't in the lobby as its SteamID's client coming back from a new address, and returns the client
+//It's only that client if it's signed with its current session, which a client that doesn't sign can never prove
+func (lobby *Lobby) ClientRebind(packet *Packet) *Client {
+	client := lobby.GetClientBySteamID(packet.SteamID)
+	if client == nil || client.Extensions < protocol.ExtensionsSigned || !packet.Verify(client.Session) {
+		log.Warn("Dropped packet from ", packet.Src, " with an invalid session signature for client ", packet.SteamID, ": ", packet)
+		return nil
+	}
+	if err := client.Dialect.FromWire(packet); err != nil { //It wasn't known to be the client's yet, so it hasn't been translated
+		log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+		return nil
 	}
 
-	lobby.Spectators = append(lobby.Spectators, client)
+	lobby.ClientReattach(client, packet)
+	return client
 }
 
-//ClientRemoveByClientIndex removes the specified client from the lobby
-func (lobby *Lobby) ClientRemoveByClientIndex(clientIndex int) {
+//ClientReattach reattaches a returning client to its held player slot, possibly from a new address, and resyncs it with the lobby
+func (lobby *Lobby) ClientReattach(client *Client, packet *Packet) {
 	if !lobby.IsRunning() {
 		return
 	}
 
-	//Make sure this client actually exists
-	if clientIndex < 0 || clientIndex >= len(lobby.Clients) {
+	wasDisconnected := client.Disconnected
+	oldAddr := client.Addr
+	client.Addr = packet.Src
+	lobby.Server.Registry.Move(client, oldAddr)
+	client.Disconnected = false
+	client.DisconnectedAt = time.Time{}
+	client.LastTick = time.Now()
+	log.Info("Client ", client.SteamID, " reconnected from ", client.Addr)
+
+	if packet.Type == packetTypeClientRequestingIndex {
+		//The client started over, so start its channels over and initialize it again with its old player index
+		request := &protocol.ClientRequestingIndex{}
+		if err := packet.Decode(request); err == nil {
+			client.Extensions = protocol.NegotiateExtensions(request.Extensions) //It may have come back on another build
+		}
+		client.ClientInit = packet
+		client.Reliability = protocol.NewReliability()
+		lobby.ClientResync(client)
 		return
 	}
 
-	//Get the SteamID of the client
-	steamID := lobby.Clients[clientIndex].SteamID
+	if wasDisconnected {
+		lobby.ClientResync(client)
+	}
+}
 
-	//Close the client
-	lobby.Clients[clientIndex].Close()
+//ClientResync brings a returning client up to date with what it missed: the map, every player's stats, health and whether they're alive, and the game mode
+func (lobby *Lobby) ClientResync(client *Client) {
+	//A clientInit is the only packet that carries stats, and it carries the current map and health options with them
+	packetClientInit, err := lobby.NewClientInitPacket(client)
+	if err != nil {
+		log.Error("Unable to resync client ", client.SteamID, ": ", err)
+		lobby.Disconnect(client, "unable to reinitialize")
+		return
+	}
+	lobby.Server.SendPacketToClient(packetClientInit, client)
+	lobby.WorkshopMapsLoaded(client)
 
-	if len(lobby.Clients) > 0 {
-		lobby.ClientLeft(steamID) //Tell the other players that this client left
+	if lobby.MatchInProgress() {
+		lobby.Server.SendPacketToClient(NewPacket(packetTypeStartMatch, 0, 0), client)
+
+		//Everyone starts the match at full health on the client, so replay what's been lost since as damage
+		maxHealth := lobby.GetMaxHealth()
+		for _, player := range lobby.GetActivePlayers() {
+			damage := maxHealth - player.Health
+			if player.IsDead() {
+				damage = 666.666 //A killing blow
+			}
+			if damage <= 0 {
+				continue
+			}
 
-		//Remove the client from the lobby
-		if len(lobby.Clients) > clientIndex {
-			lobby.Clients[clientIndex] = nil                                 //Nullify the client
-			copy(lobby.Clients[clientIndex:], lobby.Clients[clientIndex+1:]) //Shift every client after this client left by one
-			lobby.Clients = lobby.Clients[:len(lobby.Clients)-1]             //Remove the last element
+			packetTookDamage, err := NewPacketFromMessage(&protocol.PlayerTookDamage{
+				AttackerIndex: byte(player.LastAttackerIndex),
+				Damage:        damage,
+				HasDamageType: true,
+				DamageType:    byte(player.LastDamageType),
+			}, player.GetChannelUpdate(), 0)
+			if err != nil {
+				log.Error("Unable to resync player ", player.Index, "'s health to client ", client.SteamID, ": ", err)
+				continue
+			}
+			lobby.Server.SendPacketToClient(packetTookDamage, client)
 		}
-	} else {
-		lobby.Close() //Close the lobby, since there's no more players
 	}
+
+	//The game has no packet for the game mode, so it's told like /gamemode tells it
+	if name := GameModeName(lobby.GameMode); name != "" && len(client.Players) > 0 {
+		lobby.PlayerThought(client.Players[0].Index, "GameMode: %s", name)
+	}
+	log.Debug("Resynced client ", client.SteamID, " to map: ", lobby.CurrentLevel)
 }
 
 //ClientJoined broadcasts to the lobby that the specified player is now part of this lobby
@@ -776,11 +1535,13 @@ func (lobby *Lobby) ClientJoined(addr *net.UDPAddr, playerIndex int, steamID CSt
 		return
 	}
 
-	packetClientJoined := NewPacket(packetTypeClientJoined, 0, 0)
-	packetClientJoined.Grow(9)
-	packetClientJoined.WriteByteNext(byte(playerIndex))
-	packetClientJoined.WriteU64LENext([]uint64{steamID.ID})
+	packetClientJoined, err := NewPacketFromMessage(&protocol.ClientJoined{PlayerIndex: byte(playerIndex), SteamID: steamID.ID}, 0, 0)
+	if err != nil {
+		log.Error("Unable to tell the lobby that client ", steamID, " joined: ", err)
+		return
+	}
 	lobby.BroadcastPacket(packetClientJoined, addr)
+	lobby.Publish(eventClientJoined, &ClientEvent{SteamID: steamID.ID, PlayerIndex: &playerIndex})
 	log.Info("Client ", steamID, " joined the lobby!")
 }
 
@@ -790,9 +1551,13 @@ func (lobby *Lobby) ClientLeft(steamID CSteamID) {
 		return
 	}
 
-	packetClientLeft := NewPacket(packetTypeClientLeft, 0, 0)
-	packetClientLeft.SteamID = steamID
-	lobby.BroadcastPacket(packetClientLeft, nil)
+	packetClientLeft, err := NewPacketFromMessage(&protocol.Empty{PacketType: packetTypeClientLeft}, 0, steamID.ID)
+	if err != nil {
+		log.Error("Unable to tell the lobby that client ", steamID, " left: ", err)
+	} else {
+		lobby.BroadcastPacket(packetClientLeft, nil)
+	}
+	lobby.Publish(eventClientLeft, &ClientEvent{SteamID: steamID.ID})
 	log.Info("Client ", steamID, " left the lobby!")
 
 	if lobby.LobbyOwner.CompareCSteamID(steamID) {
@@ -807,7 +1572,7 @@ func (lobby *Lobby) ClientLeft(steamID CSteamID) {
 }
 
 //WorkshopMapsLoaded sends the workshop map cycle to the specified client, or broadcasts if nil
-func (lobby *Lobby) WorkshopMapsLoaded(addr *net.UDPAddr) {
+func (lobby *Lobby) WorkshopMapsLoaded(client *Client) {
 	workshopMaps := make([]uint64, 0)
 	for i := 0; i < len(lobby.Levels); i++ {
 		if lobby.Levels[i].Type() == 2 {
@@ -820,13 +1585,14 @@ func (lobby *Lobby) WorkshopMapsLoaded(addr *net.UDPAddr) {
 		}
 	}
 	if len(workshopMaps) > 0 {
-		packetWorkshopMapsLoaded := NewPacket(packetTypeWorkshopMapsLoaded, 1, 0)
-		packetWorkshopMapsLoaded.Grow(2 + int64(len(workshopMaps)*8)) //Grow by 2 bytes for workshop map count, then 8 bytes per map
-		packetWorkshopMapsLoaded.WriteU16LENext([]uint16{uint16(len(workshopMaps))})
-		packetWorkshopMapsLoaded.WriteU64LENext(workshopMaps)
+		packetWorkshopMapsLoaded, err := NewPacketFromMessage(&protocol.WorkshopMapsLoaded{Maps: workshopMaps}, 1, 0)
+		if err != nil {
+			log.Error("Unable to send the workshop map cycle: ", err)
+			return
+		}
 
-		if addr != nil {
-			lobby.Server.SendPacket(packetWorkshopMapsLoaded, addr)
+		if client != nil {
+			lobby.Server.SendPacketToClient(packetWorkshopMapsLoaded, client)
 		} else {
 			lobby.BroadcastPacket(packetWorkshopMapsLoaded, nil)
 		}
@@ -855,14 +1621,18 @@ func (lobby *Lobby) SpawnPlayer(index int, posX, posY, rotX, rotY float32) {
 		flag = 1
 	}
 
-	packetClientSpawned := NewPacket(packetTypeClientSpawned, 0, 0)
-	packetClientSpawned.Grow(26)
-	packetClientSpawned.WriteByteNext(byte(index)) //Write the player index
-	packetClientSpawned.WriteF32LENext([]float32{
-		posX, posY, 0,
-		rotX, rotY, 0,
-	})
-	packetClientSpawned.WriteByteNext(byte(flag))
+	packetClientSpawned, err := NewPacketFromMessage(&protocol.ClientSpawned{
+		PlayerIndex: byte(index),
+		PositionX:   posX,
+		PositionY:   posY,
+		RotationX:   rotX,
+		RotationY:   rotY,
+		Flag:        byte(flag),
+	}, 0, 0)
+	if err != nil {
+		log.Error("Unable to spawn player ", index, ": ", err)
+		return
+	}
 
 	lobby.Clients[clientIndex].Players[playerIndex].Spawned = true
 
@@ -876,9 +1646,14 @@ func (lobby *Lobby) ReadyUp(packet *Packet) {
 		return
 	}
 
-	playerCount := int(packet.ReadByteNext())
-	for i := 0; i < playerCount; i++ {
-		playerIndex := int(packet.ReadByteNext())
+	readyUp := &protocol.ClientReadyUp{}
+	if err := packet.Decode(readyUp); err != nil {
+		log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+		return
+	}
+
+	for _, index := range readyUp.PlayerIndexes {
+		playerIndex := int(index)
 		clientIndex, clientPlayerIndex := lobby.GetIndexesByPlayerIndex(playerIndex)
 		if clientIndex <= -1 || clientPlayerIndex <= -1 {
 			continue
@@ -889,9 +1664,10 @@ func (lobby *Lobby) ReadyUp(packet *Packet) {
 	}
 
 	if lobby.MatchInProgress() {
-		lobby.Server.SendPacket(NewPacket(packetTypeStartMatch, 0, 0), packet.Src)
+		_, client := lobby.GetClientByAddr(packet.Src)
+		lobby.Server.SendPacketToClient(NewPacket(packetTypeStartMatch, 0, 0), client)
 	} else {
-		go lobby.StartMatch()
+		lobby.StartMatch()
 	}
 }
 
@@ -911,10 +1687,16 @@ func (lobby *Lobby) StartMatch() {
 		return
 	}
 
+	if lobby.Server.IsShuttingDown() {
+		log.Warn("Can't start match while the server is shutting down!")
+		lobby.Announce("Server is shutting down,\nno more matches!")
+		return
+	}
+
 	notReady := false
 	players := lobby.GetPlayers()
 	for _, player := range players {
-		if player != nil && !player.Ready {
+		if player != nil && !player.Ready && !player.Client.Disconnected {
 			lobby.PlayerSaid(player.Index, "Either my internet or PC is slow, sorry!")
 			notReady = true
 		}
@@ -938,10 +1720,14 @@ func (lobby *Lobby) StartMatch() {
 		if lobby.Clients[i].GetPlayerCount() > 0 {
 			for j := 0; j < len(lobby.Clients[i].Players); j++ {
 				lobby.Clients[i].Players[j].Health = lobby.GetMaxHealth()
+				if lobby.Clients[i].Disconnected {
+					lobby.Clients[i].Players[j].Health = 0 //Sit out until reconnected
+				}
 			}
 		}
 	}
 
+	previousGameMode := GameModeName(lobby.GameMode)
 	switch lobby.NextGameMode.(type) {
 	case Stock:
 		switch lobby.GameMode.(type) {
@@ -973,11 +1759,16 @@ func (lobby *Lobby) StartMatch() {
 		}
 	}
 
-	lobby.FightStartTime = time.Now()
+	lobby.SetFightStartTime(time.Now())
 	lobby.BroadcastPacket(NewPacket(packetTypeStartMatch, 0, 0), nil)
+	lobby.Server.Metrics.MatchesStarted.Inc()
+	if gameMode := GameModeName(lobby.GameMode); gameMode != previousGameMode {
+		lobby.Publish(eventGameModeChanged, &GameModeEvent{GameMode: gameMode, PreviousGameMode: previousGameMode})
+	}
+	lobby.Publish(eventMatchStarted, &MatchEvent{Level: lobby.CurrentLevel.String(), GameMode: GameModeName(lobby.GameMode)})
 	log.Info("Started match!")
 
-	go lobby.GameMode.StartMatch(lobby)
+	lobby.GameMode.StartMatch(lobby)
 }
 
 //MatchInProgress returns true if the match is in progress
@@ -987,6 +1778,28 @@ func (lobby *Lobby) MatchInProgress() bool {
 	return !lobby.FightStartTime.IsZero()
 }
 
+//AllPlayersReady returns true if there are connected players in the lobby and all of them are ready
+func (lobby *Lobby) AllPlayersReady() bool {
+	connected := 0
+	for _, player := range lobby.GetActivePlayers() {
+		if player.Client.Disconnected {
+			continue
+		}
+		if !player.Ready {
+			return false
+		}
+		connected++
+	}
+	return connected > 0
+}
+
+//SetFightStartTime sets the match's start time, or ends the match if zero
+func (lobby *Lobby) SetFightStartTime(fightStartTime time.Time) {
+	lobby.Lock()         //The match is checked on from outside of the event loop
+	defer lobby.Unlock()
+	lobby.FightStartTime = fightStartTime
+}
+
 //UnReadyAllPlayers unreadies every player
 func (lobby *Lobby) UnReadyAllPlayers() {
 	if !lobby.IsRunning() {
@@ -1066,15 +1879,13 @@ func (lobby *Lobby) ChangeMap(mapIndex, winnerIndex int) {
 		}
 	}
 
-	lobby.FightStartTime = time.Time{}
+	if lobby.MatchInProgress() {
+		lobby.Server.Metrics.MatchesFinished.Inc()
+	}
+	lobby.SetFightStartTime(time.Time{})
 	lobby.UnReadyAllPlayers()
 
-	//Wait for the game mode to finish processing the match
-	for !lobby.GameMode.IsDone() {
-		if lobby.GameMode.IsDone() {
-			break
-		}
-	}
+	//The game mode only touches the lobby from the event loop, which is busy with us, so it's done processing the match
 
 	lobby.CompletedLevelsSinceLastStats++
 
@@ -1089,21 +1900,34 @@ func (lobby *Lobby) ChangeMap(mapIndex, winnerIndex int) {
 			lobby.CompletedLevelsSinceLastStats = 0
 			lobby.CurrentLevel = newLevelLandfall(102)
 		} else {
-			lobby.CurrentLevel = levelPlaylist[randomizer.Intn(len(levelPlaylist)-1)]
+			lobby.CurrentLevel = levelPlaylist[lobby.Random.Intn(len(levelPlaylist))]
 		}
 	} else {
 		lobby.CurrentLevel = levelPlaylist[mapIndex]
 	}
 
-	packetMapChange := NewPacket(packetTypeMapChange, 0, 0)
-	packetMapChange.Grow(2)
-	packetMapChange.WriteByteNext(byte(winnerIndex))
-	packetMapChange.WriteByteNext(lobby.CurrentLevel.Type())
-	packetMapChange.Grow(int64(lobby.CurrentLevel.Size()))
-	packetMapChange.WriteBytesNext(lobby.CurrentLevel.Data())
+	lobby.BroadcastMapChange(winnerIndex)
+	lobby.Publish(eventMapChanged, &MapEvent{Level: lobby.CurrentLevel.String(), WinnerIndex: winnerIndex})
+	log.Info("Changed map: ", lobby.CurrentLevel)
+}
+
+//NewMapChangePacket returns a mapChange packet that declares the winner and loads the current level
+func (lobby *Lobby) NewMapChangePacket(winnerIndex int) (*Packet, error) {
+	return NewPacketFromMessage(&protocol.MapChange{
+		WinnerIndex: byte(winnerIndex),
+		MapType:     lobby.CurrentLevel.Type(),
+		MapData:     lobby.CurrentLevel.Data(),
+	}, 0, 0)
+}
 
+//BroadcastMapChange tells the lobby to load the current level, declaring the winner of the last match
+func (lobby *Lobby) BroadcastMapChange(winnerIndex int) {
+	packetMapChange, err := lobby.NewMapChangePacket(winnerIndex)
+	if err != nil {
+		log.Error("Unable to change map: ", err)
+		return
+	}
 	lobby.BroadcastPacket(packetMapChange, nil)
-	log.Info("Changed map: ", lobby.CurrentLevel)
 }
 
 //TempMap assigns a temporary Landfall map to the fight
@@ -1112,19 +1936,13 @@ func (lobby *Lobby) TempMap(sceneIndex int32, winnerIndex int) {
 		return
 	}
 
-	lobby.FightStartTime = time.Time{}
+	lobby.SetFightStartTime(time.Time{})
 	lobby.UnReadyAllPlayers()
 
 	lobby.CurrentLevel = newLevelLandfall(sceneIndex)
 
-	packetMapChange := NewPacket(packetTypeMapChange, 0, 0)
-	packetMapChange.Grow(2)
-	packetMapChange.WriteByteNext(byte(winnerIndex))
-	packetMapChange.WriteByteNext(lobby.CurrentLevel.Type())
-	packetMapChange.Grow(int64(lobby.CurrentLevel.Size()))
-	packetMapChange.WriteBytesNext(lobby.CurrentLevel.Data())
-
-	lobby.BroadcastPacket(packetMapChange, nil)
+	lobby.BroadcastMapChange(winnerIndex)
+	lobby.Publish(eventMapChanged, &MapEvent{Level: lobby.CurrentLevel.String(), WinnerIndex: winnerIndex})
 	log.Info("Changed map temporarily: ", lobby.CurrentLevel)
 }
 
@@ -1165,13 +1983,21 @@ func (lobby *Lobby) GroundWeaponsInit() {
 
 	placedWeapons := lobby.CurrentLevel.PlacedWeapons
 	if len(placedWeapons) > 0 {
-		packetGroundWeaponsInit := NewPacket(packetTypeGroundWeaponsInit, 0, 0)
-		packetGroundWeaponsInit.Grow(2 + int64(len(placedWeapons)*12)) //Grow by 2 bytes for count, then 12 bytes per weapon
-		packetGroundWeaponsInit.WriteU16LENext([]uint16{uint16(len(placedWeapons))})
+		groundWeaponsInit := &protocol.GroundWeaponsInit{Weapons: make([]protocol.GroundWeapon, len(placedWeapons))}
 		for i := 0; i < len(placedWeapons); i++ {
 			weapon := placedWeapons[i]
-			packetGroundWeaponsInit.WriteF32LENext([]float32{weapon.PositionX, weapon.PositionY})
-			packetGroundWeaponsInit.WriteU16LENext([]uint16{lobby.GetNextWeaponSpawnID(false), lobby.GetNextObjectSpawnID(true)})
+			groundWeaponsInit.Weapons[i] = protocol.GroundWeapon{
+				PositionX:     weapon.PositionX,
+				PositionY:     weapon.PositionY,
+				WeaponSpawnID: lobby.GetNextWeaponSpawnID(false),
+				ObjectSpawnID: lobby.GetNextObjectSpawnID(true),
+			}
+		}
+
+		packetGroundWeaponsInit, err := NewPacketFromMessage(groundWeaponsInit, 0, 0)
+		if err != nil {
+			log.Error("Unable to initialize ground weapons: ", err)
+			return
 		}
 
 		lobby.BroadcastPacket(packetGroundWeaponsInit, nil)
@@ -1212,36 +2038,35 @@ func (lobby *Lobby) PlayerUpdate(packet *Packet) { //420 IQ level strats here, b
 		return
 	}
 
-	//Send the playerUpdate packet out before processing it, rip if it's invalid
-	lobby.BroadcastPacket(packet, packet.Src)
+	update := &protocol.PlayerUpdate{}
+	if err := packet.Decode(update); err != nil {
+		log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+		return
+	}
 
 	netPosition := NetworkPosition{
-		Position:     Vector3{Y: float32(packet.ReadI16LENext(1)[0]) / 100.0, Z: float32(packet.ReadI16LENext(1)[0]) / 100.0}, //Read in the position of the player
-		Rotation:     Vector2{float32(packet.ReadByteNext()) / 100.0, float32(packet.ReadByteNext()) / 100.0},                 //Read in the rotation axis of the player
-		YValue:       float32(packet.ReadByteNext()) / 100.0,                                                                  //Read in the player's YValue (known to be 100 for holding the up key, 156 for holding the down key, unknown for controllers)
-		MovementType: MovementType(packet.ReadByteNext()),                                                                     //Read in the movement type of the player
+		Position:     Vector3{Y: float32(update.PositionY) / 100.0, Z: float32(update.PositionZ) / 100.0}, //The position of the player
+		Rotation:     Vector2{float32(update.RotationX) / 100.0, float32(update.RotationY) / 100.0},      //The rotation axis of the player
+		YValue:       float32(update.YValue) / 100.0,                                                    //The player's YValue (known to be 100 for holding the up key, 156 for holding the down key, unknown for controllers)
+		MovementType: MovementType(update.MovementType),                                                 //The movement type of the player
 	}
 
-	netWeapon := NetworkWeapon{
-		FightState: FightState(packet.ReadByteNext()), //Read in the fight state of the player
+	projectiles := make([]Projectile, len(update.Projectiles))
+	for i, projectile := range update.Projectiles {
+		projectiles[i].ShootPosition = Vector2{float32(projectile.ShootPositionX), float32(projectile.ShootPositionY)}
+		projectiles[i].Shoot = Vector2{float32(projectile.ShootX), float32(projectile.ShootY)}
+		projectiles[i].SyncIndex = projectile.SyncIndex
 	}
 
-	projectileCount := packet.ReadU16LENext(1)[0]           //Read in the amount of projectiles to read
-	projectiles := make([]Projectile, int(projectileCount)) //We max out at 256 projectiles, for now...
-	if len(projectiles) > 0 {                               //If we have projectiles available to read
-		for i := 0; i < len(projectiles); i++ { //Loop over the projectiles that we can store
-			//Read in the data about the projectile
-			projectiles[i].ShootPosition = Vector2{float32(packet.ReadI16LENext(1)[0]), float32(packet.ReadI16LENext(1)[0])}
-			projectiles[i].Shoot = Vector2{float32(packet.ReadByteNext()), float32(packet.ReadByteNext())}
-			projectiles[i].SyncIndex = packet.ReadU16LENext(1)[0]
-		}
-	}
-	netWeapon.Projectiles = projectiles
-	if projectileCount > 256 { //If we maxed out at 256 projectiles and have more to be read
-		packet.SeekByte((int64(projectileCount)*8)-int64(256), true) //Seek ahead so that the weapon type can be correctly read
-		//TODO: Store pages of projectiles or find an alternative indexing that supports uint16 or int16 indexes
+	netWeapon := NetworkWeapon{
+		FightState:  FightState(update.FightState), //The fight state of the player
+		Weapon:      Weapon(update.Weapon),         //The player's current weapon
+		Projectiles: projectiles,
 	}
-	netWeapon.Weapon = Weapon(packet.ReadByteNext()) //Read in the player's current weapon
+
+	//Hold on to the playerUpdate packet until the next tick, replacing any older one that hasn't been sent yet
+	lobby.playerUpdates[playerIndex] = packet
+	lobby.spectatorUpdates[playerIndex] = packet
 
 	//Here's the strat in action
 	lobby.Clients[clientIndex].Players[clientPlayerIndex].Position = netPosition
@@ -1258,14 +2083,22 @@ func (lobby *Lobby) PlayerUpdate(packet *Packet) { //420 IQ level strats here, b
 
 func (lobby *Lobby) DamagePlayer(damagee, attacker int, damage float32, damageType DamageType, particleDirection Vector2) {
 	log.Warn("Player ", damagee, " took ", damage, " damage from player ", attacker, " of type ", damageType)
-	packet := NewPacket(packetTypePlayerTookDamage, (damagee * 2) + 2, 0)
-	packet.Grow(14)
-	packet.WriteByteNext(byte(attacker))
-	packet.WriteF32LENext([]float32{damage, particleDirection.X, particleDirection.Y})
-	packet.WriteByteNext(byte(damageType))
+	packet, err := NewPacketFromMessage(&protocol.PlayerTookDamage{
+		AttackerIndex:      byte(attacker),
+		Damage:             damage,
+		PlayParticles:      particleDirection.X != 0 || particleDirection.Y != 0,
+		ParticleDirectionX: particleDirection.X,
+		ParticleDirectionY: particleDirection.Y,
+		HasDamageType:      true,
+		DamageType:         byte(damageType),
+	}, (damagee * 2) + 2, 0)
+	if err != nil {
+		log.Error("Unable to damage player ", damagee, ": ", err)
+		return
+	}
 
 	damageeClientIndex, _ := lobby.GetIndexesByPlayerIndex(damagee)
-	lobby.Server.SendPacket(packet, lobby.Clients[damageeClientIndex].Addr)
+	lobby.Server.SendPacketToClient(packet, lobby.Clients[damageeClientIndex])
 }
 
 //PlayerTookDamage syncs a player willingly admitting that they took damage
@@ -1299,7 +2132,13 @@ func (lobby *Lobby) PlayerTookDamage(packet *Packet) {
 		return
 	}
 
-	attackerIndex := int(packet.ReadByteNext())
+	tookDamage := &protocol.PlayerTookDamage{}
+	if err := packet.Decode(tookDamage); err != nil {
+		log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+		return
+	}
+
+	attackerIndex := int(tookDamage.AttackerIndex)
 	attackerClientIndex, attackerClientPlayerIndex := lobby.GetIndexesByPlayerIndex(attackerIndex)
 	if attackerClientIndex <= -1 || attackerClientPlayerIndex <= -1 {
 		return
@@ -1309,15 +2148,15 @@ func (lobby *Lobby) PlayerTookDamage(packet *Packet) {
 		return
 	}
 
-	damage := packet.ReadF32LENext(1)[0]
+	damage := tookDamage.Damage
 	particleDirection := Vector2{}
-	if playParticles := packet.ReadByteNext(); playParticles == 1 {
-		particleDirection.X = packet.ReadF32LENext(1)[0]
-		particleDirection.Y = packet.ReadF32LENext(1)[0]
+	if tookDamage.PlayParticles {
+		particleDirection.X = tookDamage.ParticleDirectionX
+		particleDirection.Y = tookDamage.ParticleDirectionY
 	}
 	damageType := damageTypeOther
-	if packet.ByteOffset() < packet.ByteCapacity() {
-		damageType = DamageType(packet.ReadByteNext())
+	if tookDamage.HasDamageType {
+		damageType = DamageType(tookDamage.DamageType)
 	}
 
 	//Make sure this player isn't already dead
@@ -1349,13 +2188,17 @@ func (lobby *Lobby) PlayerTookDamage(packet *Packet) {
 		lobby.Clients[clientIndex].Players[clientPlayerIndex].LastAttackerIndex = attackerIndex
 		lobby.Clients[clientIndex].Players[clientPlayerIndex].LastDamageType = damageType
 
+		lobby.Server.Metrics.Deaths.Inc(damageType.String())
+
 		//Give the attacker a kill
 		if attackerIndex != playerIndex {
 			lobby.Clients[attackerClientIndex].Players[attackerClientPlayerIndex].Stats.Kills++
+			lobby.Server.Metrics.Kills.Inc(damageType.String())
 		}
 
 		//Broadcast the damage
 		lobby.BroadcastPacket(packet, packet.Src)
+		lobby.Publish(eventPlayerKilled, &DamageEvent{PlayerIndex: playerIndex, AttackerIndex: attackerIndex, DamageType: damageType.String()})
 
 		//Check for the winner
 		lobby.CheckWinner()
@@ -1370,6 +2213,7 @@ func (lobby *Lobby) PlayerTookDamage(packet *Packet) {
 	//Broadcast the damage
 	lobby.BroadcastPacket(packet, packet.Src)
 	//lobby.BroadcastPacket(packet, nil)
+	lobby.Publish(eventPlayerDamaged, &DamageEvent{PlayerIndex: playerIndex, AttackerIndex: attackerIndex, Damage: damage, DamageType: damageType.String()})
 
 	if lobby.Clients[clientIndex].Players[clientPlayerIndex].Health <= 0 {
 		lobby.CheckWinner()
@@ -1409,10 +2253,12 @@ func (lobby *Lobby) PlayerFallOut(packet *Packet) {
 
 	lobby.Clients[clientIndex].Players[clientPlayerIndex].Health = 0
 	lobby.Clients[clientIndex].Players[clientPlayerIndex].Stats.Deaths++
+	lobby.Server.Metrics.Deaths.Inc("FallOut")
 
 	//Broadcast the fallout
 	lobby.BroadcastPacket(packet, packet.Src)
 	//lobby.BroadcastPacket(packet, nil)
+	lobby.Publish(eventPlayerFellOut, &PlayerEvent{PlayerIndex: playerIndex})
 
 	lobby.CheckWinner()
 }
@@ -1438,7 +2284,12 @@ func (lobby *Lobby) PlayerTalked(packet *Packet) {
 	}
 
 	//Read in the message
-	msg := string(packet.Bytes())
+	talked := &protocol.PlayerTalked{}
+	if err := packet.Decode(talked); err != nil {
+		log.Warn("Dropped malformed packet from ", packet.Src, ": ", err)
+		return
+	}
+	msg := talked.Message
 	if lobby.Server.HasSwear(msg) {
 		lobby.PlayerThought(playerIndex, "No swearing!")
 		return
@@ -1446,21 +2297,22 @@ func (lobby *Lobby) PlayerTalked(packet *Packet) {
 
 	//Broadcast the message
 	lobby.BroadcastPacket(packet, packet.Src)
+	lobby.Publish(eventChat, &ChatEvent{PlayerIndex: playerIndex, SteamID: lobby.Clients[clientIndex].SteamID.ID, Message: msg})
 
 	//Log it
 	log.Trace("[CHAT:", lobby.Clients[clientIndex].SteamID.ID, "] ", lobby.Clients[clientIndex].SteamID.GetUsername(), ": ", msg)
 
-	if string(msg[0]) == "/" {
+	if strings.HasPrefix(msg, "/") {
 		cmd := strings.Split(string(msg[1:]), " ")
 		switch cmd[0] {
 		case "options":
-			lobby.Server.SendPacket(NewPacket(packetTypeRequestingOptions, 0, 0), packet.Src)
+			lobby.Server.SendPacketToClient(NewPacket(packetTypeRequestingOptions, 0, 0), lobby.Clients[clientIndex])
 		case "pos", "position":
 			position := lobby.Clients[clientIndex].Players[clientPlayerIndex].Position.Position
 			lobby.PlayerSaid(playerIndex, fmt.Sprintf("%s", position))
 		case "weapon":
 			if len(cmd) < 2 {
-				lobby.PlayerSaid(playerIndex, "Current weapon:\n%s", string(lobby.Clients[clientIndex].Players[clientPlayerIndex].Weapon.Weapon))
+				lobby.PlayerSaid(playerIndex, "Current weapon:\n%s", lobby.Clients[clientIndex].Players[clientPlayerIndex].Weapon.Weapon)
 				return
 			}
 
@@ -1552,14 +2404,15 @@ func (lobby *Lobby) PlayerTalked(packet *Packet) {
 				break
 			}
 
-			err := dstLobby.ClientInit(lobby.Clients[clientIndex].ClientInit)
-			if err != nil {
-				lobby.PlayerSaid(playerIndex, "Error joining lobby!")
-				log.Error("Error joining lobby: %v", err)
-				break
-			}
-
-			lobby.KickClientBySteamID(lobby.Clients[clientIndex].SteamID.ID)
+			client := lobby.Clients[clientIndex]
+			go func() {
+				if err := lobby.MoveClient(client, dstLobby); err != nil {
+					log.Error("Error joining lobby: ", err)
+					lobby.Do(func() {
+						lobby.PlayerSaid(playerIndex, "Error joining lobby:\n%s", err)
+					})
+				}
+			}()
 		case "newlobby":
 			roomCode := LobbyRoomCode(6)
 			if len(cmd) > 1 {
@@ -1578,14 +2431,16 @@ func (lobby *Lobby) PlayerTalked(packet *Packet) {
 				break
 			}
 
-			err = dstLobby.ClientInit(lobby.Clients[clientIndex].ClientInit)
-			if err != nil {
-				lobby.PlayerSaid(playerIndex, "Error joining lobby!")
-				break
-			}
-
 			lobby.Server.LobbyAdd(dstLobby)
-			lobby.KickClientBySteamID(lobby.Clients[clientIndex].SteamID.ID)
+			client := lobby.Clients[clientIndex]
+			go func() {
+				if err := lobby.MoveClient(client, dstLobby); err != nil {
+					dstLobby.Invoke(dstLobby.Close)
+					lobby.Do(func() {
+						lobby.PlayerSaid(playerIndex, "Error joining lobby:\n%s", err)
+					})
+				}
+			}()
 
 		case "name", "norm", "normalized", "normal", "username", "steamname", "nickname":
 			lobby.PlayerSaid(playerIndex, lobby.Clients[clientIndex].SteamID.GetNormalizedUsername())
@@ -1645,43 +2500,26 @@ func (lobby *Lobby) PlayerTalked(packet *Packet) {
 
 		case "gamemode", "gm", "game", "mode", "mod":
 			if len(cmd) < 2 {
-				switch lobby.GameMode.(type) {
-				case Stock:
-					lobby.PlayerSaid(playerIndex, "GameMode: Stock")
-				case Tournament:
-					lobby.PlayerSaid(playerIndex, "GameMode: Tournament")
-				case Duel:
-					lobby.PlayerSaid(playerIndex, "GameMode: Duel")
-				case GunGame:
-					lobby.PlayerSaid(playerIndex, "GameMode: GunGame")
-				default:
+				if name := GameModeName(lobby.GameMode); name != "" {
+					lobby.PlayerSaid(playerIndex, "GameMode: %s", name)
+				} else {
 					lobby.PlayerSaid(playerIndex, "Unknown gamemode!")
 				}
 				break
 			}
 
-			if lobby.IsOwner(lobby.Clients[clientIndex].SteamID) {
-				switch cmd[1] {
-				case "stock", "default", "original", "og", "regular", "vanilla", "sf", "stick", "fight", "stickfight", "landfall", "official":
-					lobby.NextGameMode = Stock{}
-					lobby.PlayerSaid(playerIndex, "Set gamemode of next match to Stock!")
-				case "tourney", "tournament", "challenge", "hard", "hardcore", "hardmode":
-					lobby.NextGameMode = Tournament{}
-					lobby.PlayerSaid(playerIndex, "Set gamemode of next match to Tournament!")
-				case "duel", "competitive", "compete", "competition":
-					lobby.NextGameMode = Duel{}
-					lobby.PlayerSaid(playerIndex, "Set gamemode of next match to Duel!")
-				case "gun", "roulette", "gungame":
-					lobby.NextGameMode = GunGame{
-						PlayerData: make([]GunGamePlayerData, lobby.GetPlayerCount(false)),
-					}
-					lobby.PlayerSaid(playerIndex, "Set gamemode of next match to Gun Game!")
-				default:
-					lobby.PlayerSaid(playerIndex, "Unknown gamemode!")
-				}
-			} else {
+			if !lobby.IsOwner(lobby.Clients[clientIndex].SteamID) {
 				lobby.PlayerSaid(playerIndex, "No permissions!")
+				break
+			}
+
+			gameMode := ParseGameMode(cmd[1], lobby.GetPlayerCount(false))
+			if gameMode == nil {
+				lobby.PlayerSaid(playerIndex, "Unknown gamemode!")
+				break
 			}
+			lobby.NextGameMode = gameMode
+			lobby.PlayerSaid(playerIndex, "Set gamemode of next match to %s!", GameModeName(gameMode))
 
 		case "hp":
 			if len(cmd) < 2 {
@@ -1694,15 +2532,72 @@ func (lobby *Lobby) PlayerTalked(packet *Packet) {
 				break
 			}
 
-			healthBytes := []byte(cmd[1])
-			if healthBytes[0] < 0 || healthBytes[0] > 6 {
-				lobby.PlayerSaid(playerIndex, "Invalid HP setting!")
+			health, err := strconv.Atoi(cmd[1])
+			if err != nil || health < 0 || health >= len(lobbyHealths) {
+				lobby.PlayerSaid(playerIndex, "Invalid HP setting, must be 0-%d!", len(lobbyHealths)-1)
 				break
 			}
 
-			lobby.Health = healthBytes[0]
+			lobby.Health = byte(health)
 			lobby.PlayerSaid(playerIndex, "Set max HP: %.2f", lobby.GetMaxHealth())
 
+		case "impair", "network":
+			if !allowImpair {
+				lobby.PlayerSaid(playerIndex, "Network impairment is disabled!")
+				break
+			}
+
+			if len(cmd) < 2 {
+				lobby.PlayerSaid(playerIndex, "Network: %s", lobby.Server.Impairer.Lobby(lobby))
+				break
+			}
+
+			if !lobby.IsOwner(lobby.Clients[clientIndex].SteamID) {
+				lobby.PlayerSaid(playerIndex, "No permissions!")
+				break
+			}
+
+			if cmd[1] != "player" {
+				impairment, err := ParseImpairment(cmd[1:])
+				if err != nil {
+					lobby.PlayerSaid(playerIndex, "Invalid impairment:\n%s", err)
+					break
+				}
+				lobby.Server.Impairer.SetLobby(lobby, impairment)
+				lobby.PlayerSaid(playerIndex, "Network: %s", impairment)
+				break
+			}
+
+			if len(cmd) < 3 {
+				lobby.PlayerSaid(playerIndex, "/impair player playerIndex latency=100ms jitter=20ms loss=5%% dup=1%% reorder=10%%")
+				break
+			}
+
+			impairedIndex, err := strconv.Atoi(cmd[2])
+			if err != nil {
+				lobby.PlayerSaid(playerIndex, "Invalid playerIndex!")
+				break
+			}
+			impairedPlayer := lobby.GetPlayerByIndex(impairedIndex)
+			if impairedPlayer == nil {
+				lobby.PlayerSaid(playerIndex, "Unknown playerIndex!")
+				break
+			}
+			steamID := impairedPlayer.Client.SteamID.ID
+
+			if len(cmd) < 4 {
+				lobby.PlayerSaid(playerIndex, "Player %d network: %s", impairedIndex, lobby.Server.Impairer.Client(steamID))
+				break
+			}
+
+			impairment, err := ParseImpairment(cmd[3:])
+			if err != nil {
+				lobby.PlayerSaid(playerIndex, "Invalid impairment:\n%s", err)
+				break
+			}
+			lobby.Server.Impairer.SetClient(steamID, impairment)
+			lobby.PlayerSaid(playerIndex, "Player %d network: %s", impairedIndex, impairment)
+
 		case "maxplayers":
 			if !lobby.IsOwner(lobby.Clients[clientIndex].SteamID) {
 				lobby.PlayerSaid(playerIndex, "No permissions!")
@@ -1720,10 +2615,10 @@ func (lobby *Lobby) PlayerTalked(packet *Packet) {
 				break
 			}
 
-			/*if maxPlayers < lobby.MaxPlayers {
-				lobby.PlayerSaid(playerIndex, "Cannot lower max players yet!")
+			if err := lobby.CheckMaxPlayers(maxPlayers); err != nil {
+				lobby.PlayerSaid(playerIndex, "Invalid playerCount:\n%s", err)
 				break
-			}*/
+			}
 
 			lobby.MaxPlayers = maxPlayers
 			lobby.PlayerSaid(playerIndex, "Set max players to %d!", maxPlayers)
@@ -1745,52 +2640,7 @@ func (lobby *Lobby) PlayerTalked(packet *Packet) {
 				break
 			}
 
-			timesTried := 0
-			maxTries := 50
-			for {
-				if !lobby.IsRunning() {
-					break
-				}
-				if len(lobby.Clients) <= clientIndex {
-					break
-				}
-				if len(lobby.Clients[clientIndex].Players) <= clientPlayerIndex {
-					break
-				}
-
-				position4 := lobby.Clients[clientIndex].Players[clientPlayerIndex].Position.Position
-				pos4x := int(position4.X)
-				pos4y := int(position4.Y)
-				coordRange := 3
-				minX := posX - coordRange
-				maxX := posX + coordRange
-				minY := posY - coordRange
-				maxY := posY + coordRange
-
-				if pos4x > minX && pos4x < maxX && pos4y > minY && pos4y < maxY {
-					break
-				}
-
-				packetPlayerUpdate := NewPacket(packetTypePlayerUpdate, lobby.Clients[clientIndex].Players[clientPlayerIndex].GetChannelUpdate(), lobby.Clients[clientIndex].SteamID.ID)
-				packetPlayerUpdate.Grow(12)
-				packetPlayerUpdate.WriteI16LENext([]int16{int16(posX), int16(posY)})
-				packetPlayerUpdate.WriteBytesNext(make([]byte, 8))
-
-				lobby.BroadcastPacket(packetPlayerUpdate, nil)
-
-				timesTried++
-				if timesTried > maxTries {
-					break
-				}
-
-				time.Sleep(time.Millisecond * 25)
-			}
-
-			if timesTried > maxTries {
-				lobby.PlayerSaid(playerIndex, "Failed to travel that far!")
-			} else {
-				lobby.PlayerSaid(playerIndex, "Traveled towards\nX:%d Y:%d", posX, posY)
-			}
+			lobby.TravelPlayer(lobby.Clients[clientIndex].Players[clientPlayerIndex], posX, posY, 0)
 
 		case "map":
 			if len(cmd) < 2 {
@@ -1863,6 +2713,48 @@ func (lobby *Lobby) PlayerTalked(packet *Packet) {
 	}
 }
 
+//TravelPlayer nudges a player towards the specified position a step at a time on the event loop, and says how it went
+func (lobby *Lobby) TravelPlayer(player *Player, posX, posY, timesTried int) {
+	maxTries := 50
+	if !lobby.IsRunning() || player.Client.IsClosed() {
+		return
+	}
+
+	position4 := player.Position.Position
+	pos4x := int(position4.X)
+	pos4y := int(position4.Y)
+	coordRange := 3
+	minX := posX - coordRange
+	maxX := posX + coordRange
+	minY := posY - coordRange
+	maxY := posY + coordRange
+
+	if pos4x > minX && pos4x < maxX && pos4y > minY && pos4y < maxY {
+		lobby.PlayerSaid(player.Index, "Traveled towards\nX:%d Y:%d", posX, posY)
+		return
+	}
+
+	playerUpdate := &protocol.PlayerUpdate{PositionY: int16(posX), PositionZ: int16(posY)}
+	packetPlayerUpdate, err := NewPacketFromMessage(playerUpdate, player.GetChannelUpdate(), player.Client.SteamID.ID)
+	if err != nil {
+		log.Error("Unable to travel player ", player.Index, ": ", err)
+		return
+	}
+
+	lobby.BroadcastPacket(packetPlayerUpdate, nil)
+
+	timesTried++
+	if timesTried > maxTries {
+		lobby.PlayerSaid(player.Index, "Failed to travel that far!")
+		return
+	}
+
+	//Wait on the event loop's timer so the player's position updates can be handled in the meantime
+	lobby.After(time.Millisecond*25, func() {
+		lobby.TravelPlayer(player, posX, posY, timesTried)
+	})
+}
+
 //PlayerSaid pretends a player said something out loud
 func (lobby *Lobby) PlayerSaid(playerIndex int, msg string, data ...interface{}) {
 	if !lobby.IsRunning() {
@@ -1874,13 +2766,27 @@ func (lobby *Lobby) PlayerSaid(playerIndex int, msg string, data ...interface{})
 		return
 	}
 
-	resp := NewPacket(packetTypePlayerTalked, lobby.Clients[clientIndex].Players[clientPlayerIndex].GetChannelEvent(), lobby.Clients[clientIndex].SteamID.ID)
-	respBytes := []byte(fmt.Sprintf(msg, data...))
-	resp.Grow(int64(len(respBytes)))
-	resp.WriteBytesNext(respBytes)
+	respMsg := fmt.Sprintf(msg, data...)
+	resp, err := NewPacketFromMessage(&protocol.PlayerTalked{Message: respMsg}, lobby.Clients[clientIndex].Players[clientPlayerIndex].GetChannelEvent(), lobby.Clients[clientIndex].SteamID.ID)
+	if err != nil {
+		log.Error("Unable to chat: ", err)
+		return
+	}
 	lobby.BroadcastPacket(resp, nil)
 
-	log.Trace("#[CHAT:", lobby.Clients[clientIndex].SteamID.ID, "] ", lobby.Clients[clientIndex].SteamID.GetUsername(), ": ", string(respBytes))
+	log.Trace("#[CHAT:", lobby.Clients[clientIndex].SteamID.ID, "] ", lobby.Clients[clientIndex].SteamID.GetUsername(), ": ", respMsg)
+}
+
+//Announce says something to the whole lobby, spoken by the first connected player as the game has no server messages
+//It returns false if there's no connected player to say it, so the lobby didn't hear it
+func (lobby *Lobby) Announce(msg string, data ...interface{}) bool {
+	for _, player := range lobby.GetActivePlayers() {
+		if !player.Client.Disconnected {
+			lobby.PlayerSaid(player.Index, msg, data...)
+			return true
+		}
+	}
+	return false
 }
 
 //PlayerThought pretends a player said something to themselves, where no one else can hear them
@@ -1894,13 +2800,15 @@ func (lobby *Lobby) PlayerThought(playerIndex int, msg string, data ...interface
 		return
 	}
 
-	resp := NewPacket(packetTypePlayerTalked, lobby.Clients[clientIndex].Players[clientPlayerIndex].GetChannelEvent(), lobby.Clients[clientIndex].SteamID.ID)
-	respBytes := []byte(fmt.Sprintf(msg, data...))
-	resp.Grow(int64(len(respBytes)))
-	resp.WriteBytesNext(respBytes)
-	lobby.Server.SendPacket(resp, lobby.Clients[clientIndex].Addr)
+	respMsg := fmt.Sprintf(msg, data...)
+	resp, err := NewPacketFromMessage(&protocol.PlayerTalked{Message: respMsg}, lobby.Clients[clientIndex].Players[clientPlayerIndex].GetChannelEvent(), lobby.Clients[clientIndex].SteamID.ID)
+	if err != nil {
+		log.Error("Unable to chat: ", err)
+		return
+	}
+	lobby.Server.SendPacketToClient(resp, lobby.Clients[clientIndex])
 
-	log.Trace("#[CHAT:", lobby.Clients[clientIndex].SteamID.ID, "] ", lobby.Clients[clientIndex].SteamID.GetUsername(), ": ", string(respBytes))
+	log.Trace("#[CHAT:", lobby.Clients[clientIndex].SteamID.ID, "] ", lobby.Clients[clientIndex].SteamID.GetUsername(), ": ", respMsg)
 }
 
 //SpawnWeapon spawns the specified weapon on the map
@@ -1916,13 +2824,20 @@ func (lobby *Lobby) SpawnWeapon(weaponID Weapon, weaponSpawnPos Vector3) {
 	nextWeaponSpawnID := lobby.GetNextWeaponSpawnID(false)
 	nextObjectSpawnID := lobby.GetNextObjectSpawnID(false)
 
-	packetWeaponSpawned := NewPacket(packetTypeWeaponSpawned, 0, 0)
-	packetWeaponSpawned.Grow(8)
-	packetWeaponSpawned.WriteByteNext(byte(weaponID) - 0x1)
-	packetWeaponSpawned.WriteBytesNext([]byte{byte(weaponSpawnPos.Y), byte(weaponSpawnPos.Z)})
-	packetWeaponSpawned.WriteU16LENext([]uint16{nextWeaponSpawnID, nextObjectSpawnID})
+	weaponSpawned := &protocol.WeaponSpawned{
+		WeaponIndex:   byte(weaponID) - 0x1,
+		PositionY:     byte(weaponSpawnPos.Y),
+		PositionZ:     byte(weaponSpawnPos.Z),
+		WeaponSpawnID: nextWeaponSpawnID,
+		ObjectSpawnID: nextObjectSpawnID,
+	}
 	if lobby.CurrentLevel.IsLobby() && lobby.CurrentLevel.IsStats() && lobby.CurrentLevel.sceneIndex >= 104 && lobby.CurrentLevel.sceneIndex <= 124 {
-		packetWeaponSpawned.WriteByteNext(1)
+		weaponSpawned.Flag = 1
+	}
+	packetWeaponSpawned, err := NewPacketFromMessage(weaponSpawned, 0, 0)
+	if err != nil {
+		log.Error("Unable to spawn weapon ", weaponID, ": ", err)
+		return
 	}
 
 	lobby.BroadcastPacket(packetWeaponSpawned, nil)
@@ -1962,16 +2877,16 @@ func (lobby *Lobby) SpawnWeaponRandom() {
 		return
 	}
 
-	weapons := make([]Weapon, randomizer.Intn(lobby.GetPlayerCount(false))+1)
+	weapons := make([]Weapon, lobby.Random.Intn(lobby.GetPlayerCount(false))+1)
 	log.Trace("Weapons to spawn: ", len(weapons))
 	weaponSpawnPositions := make([]Vector3, len(weapons))
 	for i := 0; i < len(weapons); i++ {
-		weapons[i] = lobby.Weapons[randomizer.Intn(len(lobby.Weapons))]
+		weapons[i] = lobby.Weapons[lobby.Random.Intn(len(lobby.Weapons))]
 
 		height := 11.0 * lobby.LastAppliedScale
-		x := float32(randomizer.Intn(8))
+		x := float32(lobby.Random.Intn(8))
 		if lobby.TourneyRules {
-			x = float32(randomizer.Intn(2))
+			x = float32(lobby.Random.Intn(2))
 		}
 		if lobby.LastSpawnedWeaponOnLeftSide {
 			x *= -1.0
@@ -1993,14 +2908,21 @@ func (lobby *Lobby) UpdateWeapon(playerIndex int, weapon Weapon) {
 
 	player := lobby.Clients[clientIndex].Players[clientPlayerIndex]
 
-	packetPlayerUpdate := NewPacket(packetTypePlayerUpdate, player.GetChannelUpdate(), player.Client.SteamID.ID)
-	packetPlayerUpdate.Grow(12)
-
-	packetPlayerUpdate.WriteI16LENext([]int16{int16(player.Position.Position.Y * 100.0), int16(player.Position.Position.Z * 100.0)})
-	packetPlayerUpdate.WriteBytesNext([]byte{byte(player.Position.Rotation.X * 100.0), byte(player.Position.Rotation.Y * 100.0),
-		byte(player.Position.YValue * 100.0), byte(player.Position.MovementType), byte(player.Weapon.FightState)})
-	packetPlayerUpdate.WriteU16LENext([]uint16{0})
-	packetPlayerUpdate.WriteByteNext(byte(weapon))
+	playerUpdate := &protocol.PlayerUpdate{
+		PositionY:    int16(player.Position.Position.Y * 100.0),
+		PositionZ:    int16(player.Position.Position.Z * 100.0),
+		RotationX:    byte(player.Position.Rotation.X * 100.0),
+		RotationY:    byte(player.Position.Rotation.Y * 100.0),
+		YValue:       byte(player.Position.YValue * 100.0),
+		MovementType: byte(player.Position.MovementType),
+		FightState:   byte(player.Weapon.FightState),
+		Weapon:       byte(weapon),
+	}
+	packetPlayerUpdate, err := NewPacketFromMessage(playerUpdate, player.GetChannelUpdate(), player.Client.SteamID.ID)
+	if err != nil {
+		log.Error("Unable to update weapon of player ", playerIndex, ": ", err)
+		return
+	}
 
 	lobby.BroadcastPacket(packetPlayerUpdate, nil)
 }
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+//joinLobby opens the host's lobby to the public and moves every guest into it
+func joinLobby(t *testing.T, host *testClient, guests ...*testClient) {
+	t.Helper()
+
+	host.Say("/public")
+	host.Say("/code")
+	code := strings.TrimPrefix(host.ExpectChat(host.PlayerIndex, "Room code: "), "Room code: ")
+
+	for _, guest := range guests {
+		guest.Say("/join " + code)
+		guest.ExpectInit()
+
+		joined := &protocol.ClientJoined{}
+		host.ExpectMessage(joined)
+		if joined.SteamID != guest.SteamID || int(joined.PlayerIndex) != guest.PlayerIndex {
+			t.Fatalf("host saw client %d join as player %d, expected client %d as player %d", joined.SteamID, joined.PlayerIndex, guest.SteamID, guest.PlayerIndex)
+		}
+	}
+}
+
+//startMatch readies up every client and waits for all of them to be told the match started
+func startMatch(clients ...*testClient) {
+	for _, client := range clients {
+		client.ReadyUp()
+	}
+	for _, client := range clients {
+		client.Expect(packetTypeStartMatch)
+	}
+}
+
+func TestClientJoinsOwnLobby(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.Join(76561190000000001)
+
+	if client.PlayerIndex != 0 {
+		t.Fatalf("first client in a lobby got player index %d", client.PlayerIndex)
+	}
+
+	lobby := ts.Lobby(client)
+	if !lobby.IsOwner(NewCSteamID(client.SteamID)) {
+		t.Fatalf("client %d doesn't own the lobby it created", client.SteamID)
+	}
+}
+
+func TestClientRejectedWithoutSession(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.Connect(76561190000000001)
+
+	client.Send(&protocol.ClientRequestingIndex{SteamID: client.SteamID, PlayerCount: 1, ProtocolVersion: protocol.Version, Extensions: protocol.Extensions}, 0, client.SteamID)
+
+	init := &protocol.ClientInit{LocalSteamID: client.SteamID}
+	client.ExpectMessage(init)
+	if init.Accepted || init.Reason != "invalid session" {
+		t.Fatalf("unsigned clientRequestingIndex asking to sign got accepted=%t with reason %q", init.Accepted, init.Reason)
+	}
+}
+
+func TestStockClientPlaysUnsigned(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.JoinStock(76561190000000002)
+	joinLobby(t, host, guest)
+
+	//Everything the stock client sends is unsigned, from chat and readying up to its player dying
+	startMatch(host, guest)
+	guest.Die(host.PlayerIndex)
+	host.ExpectMapChange(host.PlayerIndex)
+	guest.ExpectMapChange(host.PlayerIndex)
+
+	lobby := ts.Lobby(host)
+	var guestStats PlayerStats
+	lobby.Invoke(func() {
+		guestStats = lobby.GetPlayerByIndex(guest.PlayerIndex).Stats
+	})
+	if guestStats.Deaths != 1 {
+		t.Fatalf("stock client has %d deaths after dying once", guestStats.Deaths)
+	}
+}
+
+//reversedLayout lays out a packet's data back to front, like a protocol version that changed a layout would
+type reversedLayout struct{}
+
+func (reversedLayout) Marshal(msg protocol.Message) ([]byte, error) {
+	data, err := msg.Marshal()
+	return reversed(data), err
+}
+
+func (reversedLayout) Unmarshal(data []byte, msg protocol.Message) error {
+	return msg.Unmarshal(reversed(data))
+}
+
+func reversed(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := range data {
+		out[len(data)-1-i] = data[i]
+	}
+	return out
+}
+
+func TestProtocolVersions(t *testing.T) {
+	dialect := &protocol.Dialect{
+		Version: 200,
+		Name:    "Stick Fight test",
+		Types:   map[PacketType]PacketType{packetTypePlayerTalked: 150},
+		Layouts: map[PacketType]protocol.Layout{packetTypePlayerTalked: reversedLayout{}},
+	}
+	if err := protocol.RegisterDialect(dialect); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t)
+
+	//Chat only makes it both ways if it's translated both ways
+	host := ts.JoinVersion(76561190000000001, dialect)
+	host.Say("/public")
+	host.Say("/code")
+	code := strings.TrimPrefix(host.ExpectChat(host.PlayerIndex, "Room code: "), "Room code: ")
+
+	guest := ts.Join(76561190000000002)
+	guest.Say("/join " + code)
+	if reason := guest.ExpectChat(guest.PlayerIndex, "Error joining lobby:"); !strings.Contains(reason, "protocol version 25 can't play") {
+		t.Fatalf("incompatible client was turned away with %q", reason)
+	}
+
+	unsupported := ts.Connect(76561190000000003)
+	unsupported.Send(&protocol.Empty{PacketType: packetTypeClientRequestingAccepting}, 0, 0)
+	accepted := &protocol.ClientAccepted{}
+	unsupported.ExpectMessage(accepted)
+	unsupported.setSession(accepted.Token)
+	unsupported.Send(&protocol.ClientRequestingIndex{SteamID: unsupported.SteamID, PlayerCount: 1, ProtocolVersion: 99}, 0, unsupported.SteamID)
+	init := &protocol.ClientInit{LocalSteamID: unsupported.SteamID}
+	unsupported.ExpectMessage(init)
+	if init.Accepted || init.Reason != "protocol version 99 is unsupported" {
+		t.Fatalf("unsupported protocol version got accepted=%t with reason %q", init.Accepted, init.Reason)
+	}
+
+	versions := ts.Status().ProtocolVersions
+	if len(versions) < 2 || versions[0] != protocol.Version || versions[len(versions)-1] != 200 {
+		t.Fatalf("status lists protocol versions %v", versions)
+	}
+}
+
+func TestExtensionsNegotiated(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, extensions := range []byte{protocol.ExtensionsSigned, protocol.ExtensionsReliable} {
+		client := ts.Connect(76561190000000001 + uint64(extensions))
+		client.Send(&protocol.Empty{PacketType: packetTypeClientRequestingAccepting}, 0, 0)
+		accepted := &protocol.ClientAccepted{}
+		client.ExpectMessage(accepted)
+		client.setSession(accepted.Token)
+		client.Send(&protocol.ClientRequestingIndex{SteamID: client.SteamID, PlayerCount: 1, ProtocolVersion: protocol.Version, Extensions: extensions}, 0, client.SteamID)
+
+		//Sequencing its reliable packets would corrupt them for a client that didn't ask for it
+		options := client.Expect(packetTypeRequestingOptions)
+		if sequenced := options.Sequence != 0; sequenced != (extensions >= protocol.ExtensionsReliable) {
+			t.Fatalf("client asking for extensions %d was sent sequenced=%t packets", extensions, sequenced)
+		}
+		client.ExpectInit()
+	}
+}
+
+func TestChangeMapCommand(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+
+	host.Say("/map 3")
+	sceneIndex, ok := host.ExpectMapChange(255).SceneIndex()
+	if !ok || sceneIndex != 4 {
+		t.Fatalf("/map 3 changed to scene %d, expected the fourth default level", sceneIndex)
+	}
+}
+
+func TestFullMatches(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+
+	//The guest takes a hit, then a killing blow, and the host wins
+	startMatch(host, guest)
+	guest.TakeDamage(host.PlayerIndex, 10)
+	tookDamage := &protocol.PlayerTookDamage{}
+	host.ExpectMessage(tookDamage)
+	if int(tookDamage.AttackerIndex) != host.PlayerIndex || tookDamage.Damage != 10 {
+		t.Fatalf("host saw player %d deal %f damage", tookDamage.AttackerIndex, tookDamage.Damage)
+	}
+
+	guest.Die(host.PlayerIndex)
+	host.Expect(packetTypePlayerTookDamage)
+	for _, client := range []*testClient{host, guest} {
+		if sceneIndex, ok := client.ExpectMapChange(host.PlayerIndex).SceneIndex(); ok && sceneIndex == 0 {
+			t.Fatalf("client %d was sent back to the lobby map after a match", client.SteamID)
+		}
+	}
+
+	//The next match starts once everyone readies up on the new map, and this time the guest wins
+	startMatch(host, guest)
+	host.Die(guest.PlayerIndex)
+	guest.ExpectMapChange(guest.PlayerIndex)
+	host.ExpectMapChange(guest.PlayerIndex)
+
+	lobby := ts.Lobby(host)
+	var hostStats, guestStats PlayerStats
+	lobby.Invoke(func() {
+		hostStats = lobby.GetPlayerByIndex(host.PlayerIndex).Stats
+		guestStats = lobby.GetPlayerByIndex(guest.PlayerIndex).Stats
+	})
+	if hostStats.Kills != 1 || hostStats.Deaths != 1 || guestStats.Kills != 1 || guestStats.Deaths != 1 {
+		t.Fatalf("after trading wins, host has %d kills and %d deaths, guest has %d kills and %d deaths",
+			hostStats.Kills, hostStats.Deaths, guestStats.Kills, guestStats.Deaths)
+	}
+	if lobby.MatchInProgress() {
+		t.Fatal("match is still in progress after a winner was declared")
+	}
+}
+
+func TestSoleClientReinitializes(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	lobby := ts.Lobby(host)
+
+	//Starting over with the same session replaces the client, rather than emptying and closing the lobby underneath it
+	var err error
+	var clients int
+	var owner CSteamID
+	lobby.Invoke(func() {
+		client := lobby.GetClientBySteamID(NewCSteamID(host.SteamID))
+		err = lobby.ClientInit(client.ClientInit, client.Session)
+		clients = len(lobby.Clients)
+		owner = lobby.LobbyOwner
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lobby.IsRunning() {
+		t.Fatal("lobby closed when its only client reinitialized")
+	}
+	if clients != 1 || owner.ID != host.SteamID {
+		t.Fatalf("lobby has %d clients and is owned by %d after its only client reinitialized", clients, owner.ID)
+	}
+	if registered, client := ts.Registry.GetBySteamID(host.SteamID); registered != lobby || client.IsClosed() {
+		t.Fatal("reinitialized client isn't registered in its lobby")
+	}
+}
+
+func TestAfterInMatch(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	lobby := ts.Lobby(host)
+
+	startMatch(host, guest)
+	during := make(chan bool, 1)
+	lobby.Invoke(func() {
+		lobby.AfterInMatch(time.Millisecond, func() { during <- lobby.MatchInProgress() })
+	})
+	select {
+	case inMatch := <-during:
+		if !inMatch {
+			t.Fatal("event scheduled during the match ran outside of it")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("event scheduled during the match never ran")
+	}
+
+	//An event that comes due after the match ends mustn't run, not even in the next match
+	after := make(chan struct{}, 1)
+	lobby.Invoke(func() {
+		lobby.AfterInMatch(200*time.Millisecond, func() { after <- struct{}{} })
+	})
+	guest.Die(host.PlayerIndex)
+	host.ExpectMapChange(host.PlayerIndex)
+	guest.ExpectMapChange(host.PlayerIndex)
+	startMatch(host, guest)
+	select {
+	case <-after:
+		t.Fatal("event scheduled during the last match ran in the next one")
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func TestReconnectNeedsOldSession(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	third := ts.Join(76561190000000003)
+	joinLobby(t, host, guest, third)
+	lobby := ts.Lobby(host)
+
+	startMatch(host, guest, third)
+	third.TakeDamage(host.PlayerIndex, 10)
+	host.Expect(packetTypePlayerTookDamage)
+	guest.sock.Close() //Anything it still sent would bring it back, so let the lobby handle what's on its way first
+	host.Say("/code")
+	host.ExpectChat(host.PlayerIndex, "Room code: ")
+	lobby.Invoke(func() {
+		lobby.ClientDisconnected(lobby.GetPlayerByIndex(guest.PlayerIndex).Client)
+	})
+
+	//Anyone can be accepted and claim to be the guest, but only the guest's session gets its slot back
+	impostor := ts.Connect(guest.SteamID)
+	impostor.Send(&protocol.Empty{PacketType: packetTypeClientRequestingAccepting}, 0, 0)
+	accepted := &protocol.ClientAccepted{}
+	impostor.ExpectMessage(accepted)
+	impostor.setSession(accepted.Token)
+	impostor.Send(&protocol.ClientRequestingIndex{SteamID: guest.SteamID, PlayerCount: 1, ProtocolVersion: protocol.Version, Extensions: protocol.Extensions}, 0, guest.SteamID)
+	init := &protocol.ClientInit{LocalSteamID: guest.SteamID}
+	impostor.ExpectMessage(init)
+	if init.Accepted {
+		t.Fatalf("client signed with a new session took over the held slot as player %d", init.PlayerIndex)
+	}
+
+	returning := ts.Connect(guest.SteamID)
+	guest.sessionLock.Lock()
+	returning.setSession(guest.session)
+	guest.sessionLock.Unlock()
+	returning.Send(&protocol.ClientRequestingIndex{SteamID: guest.SteamID, PlayerCount: 1, ProtocolVersion: protocol.Version, Extensions: protocol.Extensions}, 0, guest.SteamID)
+	if returning.ExpectInit(); returning.PlayerIndex != guest.PlayerIndex {
+		t.Fatalf("guest came back as player %d instead of player %d", returning.PlayerIndex, guest.PlayerIndex)
+	}
+
+	//It missed the match starting, the third player getting hurt and its own player being taken out
+	returning.Expect(packetTypeStartMatch)
+	damage := make(map[int]float32)
+	for len(damage) < 2 {
+		tookDamage := &protocol.PlayerTookDamage{}
+		packet := returning.ExpectMessage(tookDamage)
+		damage[(packet.Channel-2)/2] = tookDamage.Damage
+	}
+	if damage[guest.PlayerIndex] != 666.666 || damage[third.PlayerIndex] != 10 {
+		t.Fatalf("guest was resynced with %v damage by player index", damage)
+	}
+	returning.ExpectChat(returning.PlayerIndex, "GameMode: Stock")
+}
+
+func TestReconnectAfterImpostor(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	lobby := ts.Lobby(host)
+
+	//An impostor gets to the server before the guest's new address does, which mustn't cost the guest its slot
+	impostor := ts.Connect(guest.SteamID)
+	if init := requestIndex(impostor); init.Accepted {
+		t.Fatalf("impostor took over the guest's slot as player %d", init.PlayerIndex)
+	}
+
+	guest.Socket().Close()
+	returning := ts.Connect(guest.SteamID)
+	guest.sessionLock.Lock()
+	returning.setSession(guest.session)
+	guest.sessionLock.Unlock()
+	returning.Send(&protocol.ClientRequestingIndex{SteamID: guest.SteamID, PlayerCount: 1, ProtocolVersion: protocol.Version, Extensions: protocol.Extensions}, 0, guest.SteamID)
+	if returning.ExpectInit(); returning.PlayerIndex != guest.PlayerIndex {
+		t.Fatalf("guest came back as player %d instead of player %d", returning.PlayerIndex, guest.PlayerIndex)
+	}
+	if registered, _ := ts.Registry.GetByAddr(returning.Socket().addr); registered != lobby {
+		t.Fatal("guest isn't registered at its new address")
+	}
+
+	returning.Say("back again")
+	host.ExpectChat(guest.PlayerIndex, "back again")
+}
+
+func TestRebindMidMatch(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	startMatch(host, guest)
+
+	//Claiming the guest's SteamID from another address isn't enough without its session
+	impostor := ts.Connect(guest.SteamID)
+	impostor.setSession(make([]byte, protocol.SessionTokenSize))
+	impostor.TakeDamage(host.PlayerIndex, 50)
+
+	//The guest's address changes, and its next ordinary packet carries on from the new one
+	oldAddr := guest.Socket().addr
+	ts.Rebind(guest)
+	guest.TakeDamage(host.PlayerIndex, 10)
+	tookDamage := &protocol.PlayerTookDamage{}
+	host.ExpectMessage(tookDamage)
+	if tookDamage.Damage != 10 {
+		t.Fatalf("host saw the guest take %f damage", tookDamage.Damage)
+	}
+	if _, client := ts.Registry.GetBySteamID(guest.SteamID); client == nil || client.Addr.String() != guest.Socket().addr.String() {
+		t.Fatal("guest isn't registered at its new address")
+	}
+	if lobby, _ := ts.Registry.GetByAddr(oldAddr); lobby != nil {
+		t.Fatal("guest is still registered at its old address")
+	}
+
+	//It's still in the match, and hears about it at its new address
+	guest.Die(host.PlayerIndex)
+	host.ExpectMapChange(host.PlayerIndex)
+	guest.ExpectMapChange(host.PlayerIndex)
+}
+
+func TestRejoinAfterKick(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	lobby := ts.Lobby(host)
+
+	lobby.Invoke(func() {
+		lobby.KickClientBySteamID(guest.SteamID, "misbehaving")
+	})
+	guest.Expect(packetTypeKickPlayer)
+	if kickedLobby, _ := ts.Registry.GetBySteamID(guest.SteamID); kickedLobby != nil {
+		t.Fatal("kicked client is still registered by its SteamID")
+	}
+	if kickedLobby, _ := ts.Registry.GetByAddr(guest.sock.addr); kickedLobby != nil {
+		t.Fatal("kicked client is still registered by its address")
+	}
+
+	//From the same address, it's a stranger that can join like anyone else
+	guest.Send(&protocol.Empty{PacketType: packetTypeClientRequestingAccepting}, 0, 0)
+	accepted := &protocol.ClientAccepted{}
+	guest.ExpectMessage(accepted)
+	guest.setSession(accepted.Token)
+	guest.Send(&protocol.ClientRequestingIndex{SteamID: guest.SteamID, PlayerCount: 1, ProtocolVersion: protocol.Version, Extensions: protocol.Extensions}, 0, guest.SteamID)
+	guest.ExpectInit()
+	if rejoined, client := ts.Registry.GetBySteamID(guest.SteamID); rejoined == nil || rejoined == lobby || client.Addr.String() != guest.sock.addr.String() {
+		t.Fatal("kicked client wasn't registered again when it rejoined")
+	}
+}
+
+func TestShutdownDrainsMatches(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	latecomer := ts.Join(76561190000000003)
+	code := ts.Lobby(host).LobbyRoomCode
+
+	startMatch(host, guest)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		ts.Shutdown(testTimeout * 2) //Only finishing in time if the drain ends with the match
+	}()
+	host.ExpectChat(host.PlayerIndex, "Server is shutting down")
+
+	//Nobody new gets in while the match plays out
+	latecomer.Say("/join " + code)
+	if reason := latecomer.ExpectChat(latecomer.PlayerIndex, "Error joining lobby:"); !strings.Contains(reason, "server is shutting down") {
+		t.Fatalf("client joining mid-drain was turned away with %q", reason)
+	}
+
+	//The match ends, and readying up again mustn't start another one to hold the shutdown up
+	guest.Die(host.PlayerIndex)
+	host.ExpectMapChange(host.PlayerIndex)
+	guest.ExpectMapChange(host.PlayerIndex)
+	host.ReadyUp()
+	guest.ReadyUp()
+	host.ExpectChat(host.PlayerIndex, "Server is shutting down,\nno more matches!")
+
+	select {
+	case <-shutdown:
+	case <-time.After(testTimeout):
+		t.Fatal("server didn't shut down once its only match ended")
+	}
+}
+
+func TestSpoofedKickRefused(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	lobby := ts.Lobby(host)
+
+	//Anyone can send from the guest's address, but without its session it can't make the guest leave
+	packet, err := NewPacketFromMessage(&protocol.Empty{PacketType: packetTypeKickPlayer}, 0, guest.SteamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.network.deliver(packet.AsBytes(), guest.Socket().addr, ts.addr)
+	host.Say("/code")
+	host.ExpectChat(host.PlayerIndex, "Room code: ")
+
+	if registered, _ := ts.Registry.GetBySteamID(guest.SteamID); registered != lobby {
+		t.Fatal("a spoofed kickPlayer took the guest out of its lobby")
+	}
+}
+
+//requestIndex runs a scripted client through the handshake with a new session, returning the clientInit it gets whether it's accepted or not
+func requestIndex(client *testClient) *protocol.ClientInit {
+	client.t.Helper()
+
+	client.Send(&protocol.Empty{PacketType: packetTypeClientRequestingAccepting}, 0, 0)
+	accepted := &protocol.ClientAccepted{}
+	client.ExpectMessage(accepted)
+	client.setSession(accepted.Token)
+	client.Send(&protocol.ClientRequestingIndex{SteamID: client.SteamID, PlayerCount: 1, ProtocolVersion: protocol.Version, Extensions: protocol.Extensions}, 0, client.SteamID)
+
+	init := &protocol.ClientInit{LocalSteamID: client.SteamID}
+	client.ExpectMessage(init)
+	return init
+}
+
+func TestSameSteamIDFromTwoAddresses(t *testing.T) {
+	grace := reconnectGrace
+	t.Cleanup(func() { reconnectGrace = grace })
+
+	for _, reconnectGrace = range []int{grace, 0} { //Checked by the guest's lobby, and without a grace period only by the registry
+		ts := newTestServer(t)
+		host := ts.Join(76561190000000001)
+		guest := ts.Join(76561190000000002)
+		joinLobby(t, host, guest)
+		lobby := ts.Lobby(host)
+
+		//A second address with its own session claims to be the guest
+		impostor := ts.Connect(guest.SteamID)
+		if init := requestIndex(impostor); init.Accepted || init.Reason != "already connected from another session" {
+			t.Fatalf("impostor got accepted=%t with reason %q with a %ds grace period", init.Accepted, init.Reason, reconnectGrace)
+		}
+
+		if registered, _ := ts.Registry.GetBySteamID(guest.SteamID); registered != lobby {
+			t.Fatalf("the impostor took over the guest's registry entry with a %ds grace period", reconnectGrace)
+		}
+		guest.Say("still here")
+		host.ExpectChat(guest.PlayerIndex, "still here")
+	}
+}
+
+func TestRequireSignedRejectsStock(t *testing.T) {
+	requireSigned = true
+	t.Cleanup(func() { requireSigned = false })
+
+	ts := newTestServer(t)
+	client := ts.Connect(76561190000000001)
+	client.Send(&protocol.Empty{PacketType: packetTypeClientRequestingAccepting}, 0, 0)
+	client.Expect(packetTypeClientAccepted)
+	client.Send(&protocol.ClientRequestingIndex{SteamID: client.SteamID, PlayerCount: 1, ProtocolVersion: protocol.Version}, 0, client.SteamID)
+
+	init := &protocol.ClientInit{LocalSteamID: client.SteamID}
+	client.ExpectMessage(init)
+	if init.Accepted || init.Reason != "signed packets required" {
+		t.Fatalf("stock client got accepted=%t with reason %q when signing is required", init.Accepted, init.Reason)
+	}
+	ts.Join(76561190000000002) //Signing clients still get in
+}
+
+//receiveUpdates returns every playerUpdate a scripted client receives until it's waited long enough
+func receiveUpdates(client *testClient, wait time.Duration) []*protocol.PlayerUpdate {
+	updates := make([]*protocol.PlayerUpdate, 0)
+	deadline := time.After(wait)
+	for {
+		select {
+		case packet := <-client.received:
+			update := &protocol.PlayerUpdate{}
+			if packet.Type == packetTypePlayerUpdate && packet.Decode(update) == nil {
+				updates = append(updates, update)
+			}
+		case <-deadline:
+			return updates
+		}
+	}
+}
+
+func TestTickCoalescesUpdates(t *testing.T) {
+	rate := tickRate
+	t.Cleanup(func() { tickRate = rate })
+	tickRate = 2 //Slow enough for a burst of updates to always land between two ticks
+
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	third := ts.Join(76561190000000003)
+	joinLobby(t, host, guest, third)
+
+	//The first update to arrive marks a tick, leaving the whole next one for the burst
+	guest.Send(&protocol.PlayerUpdate{PositionY: 1}, protocol.ChannelUpdate(guest.PlayerIndex), guest.SteamID)
+	host.ExpectMessage(&protocol.PlayerUpdate{})
+	third.ExpectMessage(&protocol.PlayerUpdate{})
+	for positionY := int16(2); positionY <= 6; positionY++ {
+		guest.Send(&protocol.PlayerUpdate{PositionY: positionY}, protocol.ChannelUpdate(guest.PlayerIndex), guest.SteamID)
+	}
+
+	for _, client := range []*testClient{host, third} {
+		updates := receiveUpdates(client, 2*time.Second/time.Duration(tickRate))
+		if len(updates) != 1 || updates[0].PositionY != 6 {
+			t.Fatalf("client %d received %d updates for a burst of 5 within a tick, expected only the latest", client.SteamID, len(updates))
+		}
+	}
+	if updates := receiveUpdates(guest, time.Second/time.Duration(tickRate)); len(updates) != 0 {
+		t.Fatalf("guest was sent %d of its own updates", len(updates))
+	}
+}
+
+func TestSpectatorTickRate(t *testing.T) {
+	rates := []int{tickRate, spectatorTickRate}
+	t.Cleanup(func() { tickRate, spectatorTickRate = rates[0], rates[1] })
+	tickRate, spectatorTickRate = 10, 2
+
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	host.Say("/maxplayers 2")
+	host.Say("/code")
+	code := strings.TrimPrefix(host.ExpectChat(host.PlayerIndex, "Room code: "), "Room code: ")
+	spectator := ts.Join(76561190000000003)
+	spectator.Say("/join " + code)
+	spectator.ExpectInit()
+
+	//The guest keeps moving for a second, far more often than either tick
+	start := time.Now()
+	for positionY := int16(1); time.Since(start) < time.Second; positionY++ {
+		guest.Send(&protocol.PlayerUpdate{PositionY: positionY}, protocol.ChannelUpdate(guest.PlayerIndex), guest.SteamID)
+		time.Sleep(10 * time.Millisecond)
+	}
+	hostUpdates := receiveUpdates(host, time.Second/time.Duration(tickRate))
+	spectatorUpdates := receiveUpdates(spectator, time.Second/time.Duration(spectatorTickRate))
+	spectatorTicks := int(time.Since(start)*time.Duration(spectatorTickRate)/time.Second) + 1
+
+	if len(spectatorUpdates) == 0 || len(spectatorUpdates) > spectatorTicks {
+		t.Fatalf("spectator received %d updates over %d spectator ticks", len(spectatorUpdates), spectatorTicks)
+	}
+	if len(hostUpdates) <= len(spectatorUpdates) {
+		t.Fatalf("host received %d updates, no more than the spectator's %d", len(hostUpdates), len(spectatorUpdates))
+	}
+}
+
+func TestLastClientTimingOutClosesLobby(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	lobby := ts.Lobby(host)
+
+	//The host goes quiet and never comes back, so the lobby passes to the guest
+	host.sock.Close()
+	var owner CSteamID
+	lobby.Invoke(func() {
+		client := lobby.GetClientBySteamID(NewCSteamID(host.SteamID))
+		lobby.ClientTimedOut(client)
+		client.DisconnectedAt = time.Now().Add(-time.Duration(reconnectGrace+1) * time.Second)
+		lobby.Heartbeat(time.Now())
+		owner = lobby.LobbyOwner
+	})
+	if owner.ID != guest.SteamID {
+		t.Fatalf("lobby is owned by %d after the host left", owner.ID)
+	}
+
+	//Then the guest does the same, and there's no one left to keep the lobby open
+	guest.sock.Close()
+	lobby.Invoke(func() {
+		later := time.Now().Add(time.Duration(clientTimeout+1) * time.Second)
+		lobby.Heartbeat(later)
+		lobby.Heartbeat(later.Add(time.Duration(reconnectGrace+1) * time.Second))
+	})
+	if lobby.IsRunning() {
+		t.Fatal("lobby is still running after its last client timed out")
+	}
+
+	deadline := time.Now().Add(testTimeout)
+	for len(ts.GetLobbies()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed lobby is still listed by the server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -5,12 +5,13 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/JoshuaDoes/logger"
 	"github.com/StickFightDev/steamcmd"
-	"github.com/microcosm-cc/bluemonday"
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
 )
 
 //Command-line flags and their defaults
@@ -22,13 +23,27 @@ var (
 	steamCmdDir   = ""
 
 	//Server config
-	address       = "0.0.0.0:1337"
-	maxBufferSize = 8192
-	maxLobbies    = 100
+	address           = ":1337" //Comma-separated, and an unspecified host like ":1337" or "[::]:1337" serves both IPv4 and IPv6
+	httpAddress       = ""      //Comma-separated like address, empty to serve the HTTP API on the same addresses over TCP, or "off" to not serve it
+	adminToken        = ""      //The bearer token the HTTP API's /admin routes require, empty to not serve them
+	adminAuditLog     = ""      //The file to append a JSON line to for every /admin request, empty to only log them
+	maxBufferSize     = 8192
+	maxLobbies        = 100
+	heartbeatInterval = 2  //Seconds between server pings to each client
+	clientTimeout     = 15 //Seconds of silence before a client is disconnected
+	reconnectGrace    = 30 //Seconds a disconnected client's slot is held for it to reconnect
+	shutdownDrain     = 60 //Seconds to wait for running matches to end when shutting down
+	tickRate          = 30 //Lobby ticks per second, each sending the latest playerUpdates to clients
+	spectatorTickRate = 10 //Lobby ticks per second that send the latest playerUpdates to spectators
+	impair            = ""    //The simulated bad network link between the server and every client, like "latency=100ms loss=5%", empty for none
+	allowImpair       = false //If lobby owners may simulate bad network links with /impair
+	requireSigned     = false //If clients must sign every packet with their session token, which turns away the stock game
+	maxStrikes        = 3     //Packets from an address that may crash their handler before the address is ignored, and events that may crash a lobby before it's closed, 0 for neither
 
 	//Logging
 	verbosityLevel  = 0
 	logPlayerUpdate = false
+	captureDir      = "" //The directory to capture every lobby's packets into, empty to not capture
 )
 
 //The server itself
@@ -36,9 +51,7 @@ var (
 	log        *logger.Logger     //Console logger
 	scmd       *steamcmd.SteamCmd //SteamCMD
 	server     *Server            //StickFightDev server
-	randomizer *rand.Rand         //Seed for random numbers
-
-	stripTags *bluemonday.Policy
+	randomizer *rand.Rand         //Random numbers shared by every lobby
 )
 
 func init() {
@@ -46,21 +59,55 @@ func init() {
 	flag.StringVar(&steamUsername, "username", steamUsername, "The username for the Steam account that owns Stick Fight")
 	flag.StringVar(&steamPassword, "password", steamPassword, "The password for the Steam account that owns Stick Fight")
 	flag.StringVar(&steamCmdDir, "steamCmdDir", steamCmdDir, "The directory holding the root of your SteamCmd install")
-	flag.StringVar(&address, "address", address, "The IP and port to serve on")
+	flag.StringVar(&address, "address", address, "The comma-separated IPs and ports to serve on, IPv4 or IPv6")
+	flag.StringVar(&httpAddress, "httpAddress", httpAddress, "The comma-separated IPs and ports to serve the HTTP API on, empty for the same as -address, or off to not serve it")
+	flag.StringVar(&adminToken, "adminToken", adminToken, "The bearer token to require for the HTTP API's /admin routes, empty to not serve them")
+	flag.StringVar(&adminAuditLog, "adminAuditLog", adminAuditLog, "The file to append a JSON line to for every /admin request, on top of logging it")
 	flag.IntVar(&maxBufferSize, "maxBufferSize", maxBufferSize, "The maximum buffer size of expected incoming packets")
 	flag.IntVar(&maxLobbies, "maxLobbies", maxLobbies, "The maximum amount of lobbies to allow")
+	flag.IntVar(&heartbeatInterval, "heartbeatInterval", heartbeatInterval, "The amount of seconds between pings to each client")
+	flag.IntVar(&clientTimeout, "clientTimeout", clientTimeout, "The amount of seconds without any packets before a client is disconnected")
+	flag.IntVar(&reconnectGrace, "reconnectGrace", reconnectGrace, "The amount of seconds to hold a disconnected client's player slot and stats for it to reconnect, 0 to remove it immediately")
+	flag.IntVar(&shutdownDrain, "shutdownDrain", shutdownDrain, "The maximum amount of seconds to wait for running matches to end when shutting down")
+	flag.IntVar(&tickRate, "tickRate", tickRate, "The amount of times per second to send the latest playerUpdates to clients")
+	flag.IntVar(&spectatorTickRate, "spectatorTickRate", spectatorTickRate, "The amount of times per second to send the latest playerUpdates to spectators")
+	flag.StringVar(&impair, "impair", impair, "The simulated bad network link to every client for testing, as space-separated latency=100ms jitter=20ms loss=5% dup=1% reorder=10%")
+	flag.BoolVar(&allowImpair, "allowImpair", allowImpair, "Allows lobby owners to simulate bad network links for testing with /impair")
+	flag.BoolVar(&requireSigned, "requireSigned", requireSigned, "Rejects clients that don't sign every packet with their session token. Without it, the stock game joins unsigned, so its address can be spoofed to send packets like kickPlayer as it or take over its slot")
+	flag.IntVar(&maxStrikes, "maxStrikes", maxStrikes, "The amount of packets from an address that may crash their handler before the address is ignored, and of events that may crash a lobby before it's closed, 0 for neither")
 	flag.IntVar(&verbosityLevel, "verbosity", verbosityLevel, "The verbosity level of debug log output")
 	flag.BoolVar(&logPlayerUpdate, "logPlayerUpdate", logPlayerUpdate, "Enables logging playerUpdate packets")
-	flag.Parse()
-
-	log = logger.NewLogger("sf:srv", verbosityLevel)
-	//stripTags = bluemonday.StripTagsPolicy()
-	stripTags = bluemonday.StrictPolicy()
+	flag.StringVar(&captureDir, "captureDir", captureDir, "The directory to record a capture of every packet each lobby sends and receives into, for the replay command")
 }
 
 func main() {
 	var err error
 
+	//Parsed here rather than in init, so that tests can run without the command line getting in the way
+	flag.Parse()
+
+	log = logger.NewLogger("sf:srv", verbosityLevel)
+	if tickRate <= 0 || spectatorTickRate <= 0 {
+		log.Fatal("tickRate and spectatorTickRate must be above 0")
+	}
+	if heartbeatInterval <= 0 || clientTimeout <= heartbeatInterval {
+		log.Fatal("heartbeatInterval must be above 0, and clientTimeout above heartbeatInterval so clients have a ping to answer before they time out")
+	}
+	defaultImpairment, err := ParseImpairment(strings.Fields(impair))
+	if err != nil {
+		log.Fatal("Invalid impair: ", err)
+	}
+	protocol.LookupUsername = LookupSteamUsername
+
+	switch flag.Arg(0) {
+	case "replay":
+		os.Exit(replayCommand(flag.Args()[1:]))
+	case "dump":
+		os.Exit(dumpCommand(flag.Args()[1:]))
+	case "proxy":
+		os.Exit(proxyCommand(flag.Args()[1:]))
+	}
+
 	//Initialize steamcmd
 	log.Info("Logging into Steam...")
 	scmd = steamcmd.New(steamUsername, steamPassword)
@@ -75,17 +122,12 @@ func main() {
 	}
 
 	log.Trace("Seeding randomizer...")
-	randomizer = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomizer = NewRandomizer(time.Now().UnixNano())
 
 	log.Trace("Loading default levels...")
 	os.Mkdir("maps", 0755)
 
-		for i := int32(1); i <= 124; i++ {
-			if i == 0 || i == 102 {
-				continue
-			}
-			defaultLevels = append(defaultLevels, newLevelLandfall(i))
-		}
+	defaultLevels = newLevelsLandfall()
 
 	lobbyLevels, err = LoadWorkshopMaps(
 		2362135194, 2362150591, 2362151526, 2362151645,
@@ -128,15 +170,44 @@ func main() {
 
 	//Run the server
 	log.Info("Starting the server...")
-	server = NewServer(address)
+	server = NewServer(strings.Split(address, ","))
+	switch httpAddress {
+	case "":
+		server.HTTPAddrs = server.Addrs
+	case "off":
+	default:
+		server.HTTPAddrs = strings.Split(httpAddress, ",")
+	}
+	if adminAuditLog != "" {
+		if err := server.API.Audit.Open(adminAuditLog); err != nil {
+			log.Fatal("Unable to open audit log: ", err)
+		}
+	}
+	server.Impairer.SetDefault(defaultImpairment)
+	if defaultImpairment != nil {
+		log.Warn("Simulating a bad network link to every client: ", defaultImpairment)
+	}
 	go server.Run()
-	defer server.Close()
 
 	log.Trace("Waiting for exit call from system")
 	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT)
-	<-sc
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sc
+	log.Trace(sig, " received!")
+
+	//Drain in the background, so that a second signal can skip the wait
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown(time.Duration(shutdownDrain) * time.Second)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case sig = <-sc:
+		log.Warn(sig, " received again, closing now!")
+		server.Close()
+	}
 
-	log.Trace("SIGINT received!")
 	log.Info("Good-bye!")
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//The buckets of each histogram, in seconds
+var (
+	rttBuckets     = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.15, 0.2, 0.3, 0.5, 1, 2}
+	handlerBuckets = []float64{0.00001, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.05, 0.1}
+)
+
+//Counter is a metric that only goes up, which is safe to use from any goroutine
+type Counter struct {
+	value uint64 //First, so that it's aligned for atomics on 32-bit platforms
+}
+
+//Inc adds one to the counter
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+//Add adds to the counter
+func (counter *Counter) Add(n uint64) {
+	atomic.AddUint64(&counter.value, n)
+}
+
+//Value returns the counter's value
+func (counter *Counter) Value() uint64 {
+	return atomic.LoadUint64(&counter.value)
+}
+
+//Gauge is a metric that goes up and down, which is safe to use from any goroutine
+type Gauge struct {
+	value int64 //First, so that it's aligned for atomics on 32-bit platforms
+}
+
+//Inc adds one to the gauge
+func (gauge *Gauge) Inc() {
+	atomic.AddInt64(&gauge.value, 1)
+}
+
+//Dec takes one from the gauge
+func (gauge *Gauge) Dec() {
+	atomic.AddInt64(&gauge.value, -1)
+}
+
+//Value returns the gauge's value
+func (gauge *Gauge) Value() int64 {
+	return atomic.LoadInt64(&gauge.value)
+}
+
+//CounterVec is a counter for each value of a label, which is safe to use from any goroutine
+type CounterVec struct {
+	sync.Mutex
+	values map[string]uint64
+}
+
+//NewCounterVec returns a counter for each value of a label, none of which are counted yet
+func NewCounterVec() *CounterVec {
+	return &CounterVec{values: make(map[string]uint64)}
+}
+
+//Inc adds one to the counter of the label's value
+func (vec *CounterVec) Inc(label string) {
+	vec.Lock()
+	defer vec.Unlock()
+	vec.values[label]++
+}
+
+//Value returns the counter of the label's value
+func (vec *CounterVec) Value(label string) uint64 {
+	vec.Lock()
+	defer vec.Unlock()
+	return vec.values[label]
+}
+
+//Values returns a copy of the counter of every label value counted so far
+func (vec *CounterVec) Values() map[string]uint64 {
+	vec.Lock()
+	defer vec.Unlock()
+
+	values := make(map[string]uint64, len(vec.values))
+	for label, value := range vec.values {
+		values[label] = value
+	}
+	return values
+}
+
+//Histogram counts observations into buckets by their upper bounds, which is safe to use from any goroutine
+type Histogram struct {
+	sync.Mutex
+	bounds []float64 //The upper bound of each bucket, in ascending order
+	counts []uint64  //The observations that fell in each bucket and none before it, with one more for above every bound
+	sum    float64
+	count  uint64
+}
+
+//NewHistogram returns a histogram with buckets of the ascending upper bounds
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+//Observe counts an observation into its bucket
+func (histogram *Histogram) Observe(value float64) {
+	bucket := sort.SearchFloat64s(histogram.bounds, value) //The first bound that's at least the value
+
+	histogram.Lock()
+	defer histogram.Unlock()
+	histogram.counts[bucket]++
+	histogram.sum += value
+	histogram.count++
+}
+
+//Count returns how many observations were counted
+func (histogram *Histogram) Count() uint64 {
+	histogram.Lock()
+	defer histogram.Unlock()
+	return histogram.count
+}
+
+//Metrics holds the server's counters for Prometheus to scrape, along with what's counted from the lobbies when it does
+type Metrics struct {
+	PacketsReceived *CounterVec //By packet type, as the server knows it after any dialect translation
+	PacketsSent     *CounterVec //By packet type, as the server knows it before any dialect translation
+	BytesReceived   *Counter
+	BytesSent       *Counter
+	ParseErrors     *Counter //Packets that couldn't be read or translated
+	MatchesStarted  *Counter
+	MatchesFinished *Counter
+	Kills           *CounterVec //By damage type of the killing blow
+	Deaths          *CounterVec //By damage type of the killing blow, or FallOut
+	ClientRTT       *Histogram  //Seconds between a ping and its response
+	HandlerLatency  *Histogram  //Seconds a lobby's event loop spent handling a packet
+	PacketReaders   *Gauge      //Goroutines running ReadPackets
+}
+
+//NewMetrics returns metrics that haven't counted anything yet
+func NewMetrics() *Metrics {
+	return &Metrics{
+		PacketsReceived: NewCounterVec(),
+		PacketsSent:     NewCounterVec(),
+		BytesReceived:   &Counter{},
+		BytesSent:       &Counter{},
+		ParseErrors:     &Counter{},
+		MatchesStarted:  &Counter{},
+		MatchesFinished: &Counter{},
+		Kills:           NewCounterVec(),
+		Deaths:          NewCounterVec(),
+		ClientRTT:       NewHistogram(rttBuckets),
+		HandlerLatency:  NewHistogram(handlerBuckets),
+		PacketReaders:   &Gauge{},
+	}
+}
+
+//metricsBuffer writes metrics in the Prometheus text exposition format
+type metricsBuffer struct {
+	bytes.Buffer
+}
+
+//labelEscaper escapes a label value for the Prometheus text exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//formatMetricValue formats a value for the Prometheus text exposition format
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (buf *metricsBuffer) header(name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (buf *metricsBuffer) gauge(name, help string, value float64) {
+	buf.header(name, "gauge", help)
+	fmt.Fprintf(buf, "%s %s\n", name, formatMetricValue(value))
+}
+
+func (buf *metricsBuffer) counter(name, help string, counter *Counter) {
+	buf.header(name, "counter", help)
+	fmt.Fprintf(buf, "%s %d\n", name, counter.Value())
+}
+
+func (buf *metricsBuffer) counterVec(name, help, label string, vec *CounterVec) {
+	buf.header(name, "counter", help)
+
+	values := vec.Values()
+	labels := make([]string, 0, len(values))
+	for value := range values {
+		labels = append(labels, value)
+	}
+	sort.Strings(labels)
+	for _, value := range labels {
+		fmt.Fprintf(buf, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(value), values[value])
+	}
+}
+
+func (buf *metricsBuffer) histogram(name, help string, histogram *Histogram) {
+	buf.header(name, "histogram", help)
+
+	histogram.Lock()
+	counts := append([]uint64{}, histogram.counts...)
+	sum, count := histogram.sum, histogram.count
+	histogram.Unlock()
+
+	cumulative := uint64(0)
+	for bucket := range counts {
+		bound := math.Inf(1) //The last bucket holds everything above the bounds
+		if bucket < len(histogram.bounds) {
+			bound = histogram.bounds[bucket]
+		}
+		cumulative += counts[bucket]
+		fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d\n", name, formatMetricValue(bound), cumulative)
+	}
+	fmt.Fprintf(buf, "%s_sum %s\n%s_count %d\n", name, formatMetricValue(sum), name, count)
+}
+
+//WriteMetrics writes every metric in the Prometheus text exposition format
+func (srv *Server) WriteMetrics(w io.Writer) error {
+	lobbies := srv.GetLobbies()
+	players, spectators := 0, 0
+	for _, lobby := range lobbies {
+		members := lobby.Members()
+		players += len(members.players)
+		spectators += members.spectators
+	}
+
+	metrics := srv.Metrics
+	buf := &metricsBuffer{}
+	buf.gauge("stickfight_lobbies", "Lobbies that are running.", float64(len(lobbies)))
+	buf.gauge("stickfight_players", "Players in every lobby.", float64(players))
+	buf.gauge("stickfight_spectators", "Spectators watching every lobby.", float64(spectators))
+	buf.counterVec("stickfight_packets_received_total", "Packets received, by packet type.", "type", metrics.PacketsReceived)
+	buf.counterVec("stickfight_packets_sent_total", "Packets sent, by packet type, not counting resends.", "type", metrics.PacketsSent)
+	buf.counter("stickfight_received_bytes_total", "Bytes received from every transport.", metrics.BytesReceived)
+	buf.counter("stickfight_sent_bytes_total", "Bytes sent through every transport, counting resends.", metrics.BytesSent)
+	buf.counter("stickfight_packet_parse_errors_total", "Packets that couldn't be read or translated from their client's protocol version.", metrics.ParseErrors)
+	buf.counter("stickfight_matches_started_total", "Matches started.", metrics.MatchesStarted)
+	buf.counter("stickfight_matches_finished_total", "Matches that ended with a map change.", metrics.MatchesFinished)
+	buf.counterVec("stickfight_kills_total", "Players killed by another player, by damage type of the killing blow.", "damage_type", metrics.Kills)
+	buf.counterVec("stickfight_deaths_total", "Players killed, by damage type of the killing blow, or FallOut.", "damage_type", metrics.Deaths)
+	buf.histogram("stickfight_client_rtt_seconds", "Round trip times of pings to clients.", metrics.ClientRTT)
+	buf.histogram("stickfight_handler_duration_seconds", "Time a lobby took to handle a packet from a client.", metrics.HandlerLatency)
+	buf.gauge("stickfight_packet_readers", "Goroutines reading packets from the transports.", float64(metrics.PacketReaders.Value()))
+	buf.gauge("stickfight_goroutines", "Goroutines in the server process.", float64(runtime.NumGoroutine()))
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+//metrics answers with every metric for Prometheus to scrape
+func (api *API) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := api.Server.WriteMetrics(w); err != nil {
+		log.Error("Unable to write metrics: ", err)
+	}
+}
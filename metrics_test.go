@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	histogram := NewHistogram([]float64{0.1, 1})
+	for _, value := range []float64{0.05, 0.1, 0.5, 3} {
+		histogram.Observe(value)
+	}
+
+	buf := &metricsBuffer{}
+	buf.histogram("test_seconds", "Test.", histogram)
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 3.65
+test_seconds_count 4
+`
+	if buf.String() != expected {
+		t.Fatalf("histogram was written as:\n%s\nexpected:\n%s", buf, expected)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+	startMatch(host, guest)
+	guest.Die(host.PlayerIndex)
+	host.ExpectMapChange(host.PlayerIndex)
+
+	w := httptest.NewRecorder()
+	ts.API.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("/metrics answered with %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	metrics := w.Body.String()
+	for _, line := range []string{
+		"stickfight_lobbies 1",
+		"stickfight_players 2",
+		"stickfight_spectators 0",
+		"stickfight_matches_started_total 1",
+		"stickfight_matches_finished_total 1",
+		`stickfight_kills_total{damage_type="Other"} 1`,
+		`stickfight_deaths_total{damage_type="Other"} 1`,
+		`stickfight_packets_received_total{type="clientRequestingAccepting"} 2`,
+		"# TYPE stickfight_client_rtt_seconds histogram",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("/metrics is missing %q", line)
+		}
+	}
+	if ts.Metrics.PacketsSent.Value("startMatch") != 2 || ts.Metrics.BytesReceived.Value() == 0 || ts.Metrics.BytesSent.Value() == 0 {
+		t.Errorf("/metrics didn't count the match's traffic:\n%s", metrics)
+	}
+	if ts.Metrics.PacketReaders.Value() <= 0 || ts.Metrics.HandlerLatency.Count() == 0 {
+		t.Errorf("/metrics didn't count the packet readers or handlers:\n%s", metrics)
+	}
+}
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
 //Player holds a Stick Fight player
 type Player struct {
 	Client *Client //The client that's hosting this player
@@ -18,12 +22,12 @@ type Player struct {
 
 //GetChannelUpdate returns the channel that update packets are expected on
 func (player *Player) GetChannelUpdate() int {
-	return player.Index*2 + 2
+	return protocol.ChannelUpdate(player.Index)
 }
 
 //GetChannelEvent returns the channel that event packets are expected on
 func (player *Player) GetChannelEvent() int {
-	return player.GetChannelUpdate() + 1
+	return protocol.ChannelEvent(player.Index)
 }
 
 //IsDead returns true if the player's health is equal to or below 0
@@ -60,15 +64,6 @@ func (player *Player) SetWeapon(fightState FightState, weapon Weapon, projectile
 	}
 }
 
-//PlayerStats holds the statistics of a player's match session so far
-type PlayerStats struct {
-	Wins, Kills, Deaths, Suicides, Falls   int32 //The death of a player
-	CrownSteals                            int32 //How many times you've stolen the crown from another player
-	BulletsHit, BulletsMissed, BulletsShot int32 //Bullets do a lot of damage
-	Blocks, PunchesLanded                  int32 //Hand to hand combat at its finest
-	WeaponsPickedUp, WeaponsThrown         int32 //Why shoot a gun when you can throw it?
-}
-
 //NetworkPosition holds a player's current position according to the network
 type NetworkPosition struct {
 	Position     Vector3
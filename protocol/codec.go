@@ -0,0 +1,1036 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrShortPacket     = errors.New("packet data is too short") //Returned when a packet ends before its layout does
+	ErrOversizedPacket = errors.New("packet data is too long")  //Returned when a packet has data left over after its layout, or a field can't fit its layout
+)
+
+//Message is the typed data of a packet of a specific PacketType
+type Message interface {
+	Type() PacketType            //The packet type that carries this message
+	Marshal() ([]byte, error)    //Encodes the message as packet data
+	Unmarshal(data []byte) error //Decodes the message from packet data, returning an error if it's too short or too long
+}
+
+//NewPacketFromMessage returns a new packet carrying the specified message
+func NewPacketFromMessage(msg Message, channel int, steamID uint64) (*Packet, error) {
+	data, err := msg.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", msg.Type(), err)
+	}
+
+	packet := NewPacket(msg.Type(), channel, steamID)
+	if len(data) > 0 {
+		packet.Grow(int64(len(data)))
+		packet.WriteBytesNext(data)
+	}
+	return packet, nil
+}
+
+//Decode decodes the packet's data into the specified message, which must be for the packet's type
+func (packet *Packet) Decode(msg Message) error {
+	if msg.Type() != packet.Type {
+		return fmt.Errorf("can't decode %s as %s", packet.Type, msg.Type())
+	}
+	if err := msg.Unmarshal(packet.Bytes()); err != nil {
+		return fmt.Errorf("%s: %w", packet.Type, err)
+	}
+	return nil
+}
+
+//messageReader reads little endian fields from packet data, remembering the first error so it only has to be checked once
+type messageReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *messageReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data)-r.pos < n {
+		r.err = ErrShortPacket
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *messageReader) u8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *messageReader) u16() uint16 {
+	if b := r.next(2); b != nil {
+		return uint16(b[0]) | uint16(b[1])<<8
+	}
+	return 0
+}
+
+func (r *messageReader) u32() uint32 {
+	if b := r.next(4); b != nil {
+		return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	}
+	return 0
+}
+
+func (r *messageReader) u64() uint64 {
+	return uint64(r.u32()) | uint64(r.u32())<<32
+}
+
+func (r *messageReader) i16() int16 {
+	return int16(r.u16())
+}
+
+func (r *messageReader) i32() int32 {
+	return int32(r.u32())
+}
+
+func (r *messageReader) f32() float32 {
+	return math.Float32frombits(r.u32())
+}
+
+//bytes returns a copy of the next n bytes, so the message doesn't hold on to the packet's buffer
+func (r *messageReader) bytes(n int) []byte {
+	b := r.next(n)
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+//rest returns a copy of every byte that's left
+func (r *messageReader) rest() []byte {
+	if r.err != nil {
+		return nil
+	}
+	return r.bytes(len(r.data) - r.pos)
+}
+
+//remaining returns how many bytes are left
+func (r *messageReader) remaining() int {
+	return len(r.data) - r.pos
+}
+
+//done returns the first error, or ErrOversizedPacket if there's data left over
+func (r *messageReader) done() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.pos != len(r.data) {
+		return ErrOversizedPacket
+	}
+	return nil
+}
+
+//messageWriter writes little endian fields as packet data
+type messageWriter struct {
+	data []byte
+}
+
+func (w *messageWriter) u8(v byte) {
+	w.data = append(w.data, v)
+}
+
+func (w *messageWriter) u16(v uint16) {
+	w.data = append(w.data, byte(v), byte(v>>8))
+}
+
+func (w *messageWriter) u32(v uint32) {
+	w.data = append(w.data, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (w *messageWriter) u64(v uint64) {
+	w.u32(uint32(v))
+	w.u32(uint32(v >> 32))
+}
+
+func (w *messageWriter) i16(v int16) {
+	w.u16(uint16(v))
+}
+
+func (w *messageWriter) i32(v int32) {
+	w.u32(uint32(v))
+}
+
+func (w *messageWriter) f32(v float32) {
+	w.u32(math.Float32bits(v))
+}
+
+func (w *messageWriter) bytes(v []byte) {
+	w.data = append(w.data, v...)
+}
+
+//Raw is the data of a packet type whose layout the server doesn't need to know, as it's only ever passed along as-is
+//It's used for playerFallOut, playerForceAdded, playerForceAddedAndBlock, playerLavaForceAdded and the object packets
+type Raw struct {
+	PacketType PacketType //The packet type carrying the data
+	Data       []byte     //The packet data
+}
+
+func (msg *Raw) Type() PacketType { return msg.PacketType }
+
+func (msg *Raw) Marshal() ([]byte, error) {
+	return msg.Data, nil
+}
+
+func (msg *Raw) Unmarshal(data []byte) error {
+	msg.Data = append([]byte{}, data...)
+	return nil
+}
+
+//Empty is the data of a packet type that carries nothing but its type and Steam ID
+//It's used for clientRequestingAccepting, clientLeft, startMatch, requestingOptions and kickPlayer
+type Empty struct {
+	PacketType PacketType //The packet type
+}
+
+func (msg *Empty) Type() PacketType { return msg.PacketType }
+
+func (msg *Empty) Marshal() ([]byte, error) {
+	return nil, nil
+}
+
+func (msg *Empty) Unmarshal(data []byte) error {
+	if len(data) > 0 {
+		return ErrOversizedPacket
+	}
+	return nil
+}
+
+//Ack acknowledges a reliable packet, on the channel of the packet carrying it
+//0x0 (4 bytes, uint32) - The acknowledged sequence number
+type Ack struct {
+	Sequence uint32
+}
+
+func (msg *Ack) Type() PacketType { return PacketTypeAck }
+
+func (msg *Ack) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	w.u32(msg.Sequence)
+	return w.data, nil
+}
+
+func (msg *Ack) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.Sequence = r.u32()
+	return r.done()
+}
+
+//Ping asks for a pingResponse echoing the same data
+//0x0… (x bytes) - Anything, the server sends its UnixNano time as a uint64 to measure the round trip
+type Ping struct {
+	Data []byte
+}
+
+func (msg *Ping) Type() PacketType { return PacketTypePing }
+
+func (msg *Ping) Marshal() ([]byte, error) {
+	return msg.Data, nil
+}
+
+func (msg *Ping) Unmarshal(data []byte) error {
+	msg.Data = append([]byte{}, data...)
+	return nil
+}
+
+//PingResponse echoes the data of a ping
+//0x0… (x bytes) - The data of the ping
+type PingResponse struct {
+	Data []byte
+}
+
+func (msg *PingResponse) Type() PacketType { return PacketTypePingResponse }
+
+func (msg *PingResponse) Marshal() ([]byte, error) {
+	return msg.Data, nil
+}
+
+func (msg *PingResponse) Unmarshal(data []byte) error {
+	msg.Data = append([]byte{}, data...)
+	return nil
+}
+
+//ClientAccepted accepts a clientRequestingAccepting with the session token to sign every following packet with
+//0x0 (16 bytes) - The session token
+type ClientAccepted struct {
+	Token []byte
+}
+
+func (msg *ClientAccepted) Type() PacketType { return PacketTypeClientAccepted }
+
+func (msg *ClientAccepted) Marshal() ([]byte, error) {
+	if len(msg.Token) != SessionTokenSize {
+		return nil, ErrOversizedPacket
+	}
+	return msg.Token, nil
+}
+
+func (msg *ClientAccepted) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.Token = r.bytes(SessionTokenSize)
+	return r.done()
+}
+
+//ClientRequestingIndex asks to join a lobby
+//0x0 (8 bytes, uint64) - The Steam ID of the client
+//0x8 (1 byte,  byte)   - How many local players the client has
+//0x9 (1 byte,  byte)   - The protocol version of the client
+//Then, optionally:
+//  (1 byte, byte)      - The version of the server's protocol extensions the client speaks, left out by the stock game
+type ClientRequestingIndex struct {
+	SteamID         uint64
+	PlayerCount     byte
+	ProtocolVersion byte
+	Extensions      byte //ExtensionsNone if left out
+}
+
+func (msg *ClientRequestingIndex) Type() PacketType { return PacketTypeClientRequestingIndex }
+
+func (msg *ClientRequestingIndex) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	w.u64(msg.SteamID)
+	w.u8(msg.PlayerCount)
+	w.u8(msg.ProtocolVersion)
+	if msg.Extensions != ExtensionsNone {
+		w.u8(msg.Extensions)
+	}
+	return w.data, nil
+}
+
+func (msg *ClientRequestingIndex) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.SteamID = r.u64()
+	msg.PlayerCount = r.u8()
+	msg.ProtocolVersion = r.u8()
+	msg.Extensions = ExtensionsNone
+	if r.err == nil && r.remaining() > 0 {
+		msg.Extensions = r.u8()
+	}
+	return r.done()
+}
+
+//PlayerStats holds the statistics of a player's match session so far
+type PlayerStats struct {
+	Wins, Kills, Deaths, Suicides, Falls   int32 //The death of a player
+	CrownSteals                            int32 //How many times you've stolen the crown from another player
+	BulletsHit, BulletsMissed, BulletsShot int32 //Bullets do a lot of damage
+	Blocks, PunchesLanded                  int32 //Hand to hand combat at its finest
+	WeaponsPickedUp, WeaponsThrown         int32 //Why shoot a gun when you can throw it?
+}
+
+//ClientInitPlayer is a player slot in a clientInit
+type ClientInitPlayer struct {
+	SteamID uint64       //The Steam ID of the client holding the slot, 0 if it's open
+	Stats   *PlayerStats //The stats of the player, only sent for other clients' players
+}
+
+//ClientInit accepts a client into a lobby as it currently stands, or rejects it with a reason
+//0x0 (1 byte, byte) - 1 if accepted, anything else if rejected
+//If rejected:
+//0x1… (x bytes, string) - The reason
+//If accepted:
+//0x1 (1 byte,  byte)    - The first player index of the client
+//0x2 (1 byte,  byte)    - The maximum amount of players, and how many player slots follow the map
+//0x3 (1 byte,  byte)    - The map type
+//0x4 (4 bytes, int32)   - The map data size
+//0x8… (x bytes)         - The map data
+//Each player slot:
+//  (8 bytes, uint64)    - The Steam ID in the slot, 0 if open
+//  (52 bytes, int32×13) - The player's stats, if the slot isn't open and isn't one of the receiving client's
+//Then:
+//  (2 bytes, uint16)    - The amount of weapons to spawn, always 0
+//  (1 byte,  byte)      - The maps option
+//  (1 byte,  byte)      - The health option
+//  (1 byte,  byte)      - The regen option
+//  (1 byte,  byte)      - The weapon spawn rate option
+type ClientInit struct {
+	Accepted        bool
+	Reason          string //Why the client was rejected
+	PlayerIndex     byte
+	MapType         byte
+	MapData         []byte
+	Players         []ClientInitPlayer //One per player slot, so its length is the maximum amount of players
+	Maps            byte
+	Health          byte
+	Regen           byte
+	WeaponSpawnRate byte
+
+	LocalSteamID uint64 //Not sent, the Steam ID of the receiving client, whose own player slots have no stats, found at PlayerIndex if decoded without it
+}
+
+func (msg *ClientInit) Type() PacketType { return PacketTypeClientInit }
+
+func (msg *ClientInit) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	if !msg.Accepted {
+		w.u8(0)
+		w.bytes([]byte(msg.Reason))
+		return w.data, nil
+	}
+
+	if len(msg.Players) > math.MaxUint8 || len(msg.MapData) > math.MaxInt32 {
+		return nil, ErrOversizedPacket
+	}
+
+	w.u8(1)
+	w.u8(msg.PlayerIndex)
+	w.u8(byte(len(msg.Players)))
+	w.u8(msg.MapType)
+	w.i32(int32(len(msg.MapData)))
+	w.bytes(msg.MapData)
+	for _, player := range msg.Players {
+		w.u64(player.SteamID)
+		if player.SteamID == 0 || player.SteamID == msg.LocalSteamID {
+			continue
+		}
+
+		stats := player.Stats
+		if stats == nil {
+			stats = &PlayerStats{}
+		}
+		for _, stat := range []int32{
+			stats.Wins, stats.Kills, stats.Deaths, stats.Suicides, stats.Falls,
+			stats.CrownSteals,
+			stats.BulletsHit, stats.BulletsMissed, stats.BulletsShot,
+			stats.Blocks, stats.PunchesLanded,
+			stats.WeaponsPickedUp, stats.WeaponsThrown,
+		} {
+			w.i32(stat)
+		}
+	}
+	w.u16(0) //TODO: Weapons
+	w.u8(msg.Maps)
+	w.u8(msg.Health)
+	w.u8(msg.Regen)
+	w.u8(msg.WeaponSpawnRate)
+	return w.data, nil
+}
+
+func (msg *ClientInit) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.Accepted = r.u8() == 1
+	if !msg.Accepted {
+		msg.Reason = string(r.rest())
+		return r.done()
+	}
+
+	msg.PlayerIndex = r.u8()
+	maxPlayers := int(r.u8())
+	msg.MapType = r.u8()
+	msg.MapData = r.bytes(int(r.i32()))
+	msg.Players = make([]ClientInitPlayer, 0, maxPlayers)
+	for i := 0; i < maxPlayers && r.err == nil; i++ {
+		player := ClientInitPlayer{SteamID: r.u64()}
+		if i == int(msg.PlayerIndex) && msg.LocalSteamID == 0 {
+			msg.LocalSteamID = player.SteamID //The receiving client's own slots start at its player index, so that's its Steam ID
+		}
+		if player.SteamID != 0 && player.SteamID != msg.LocalSteamID {
+			player.Stats = &PlayerStats{
+				Wins: r.i32(), Kills: r.i32(), Deaths: r.i32(), Suicides: r.i32(), Falls: r.i32(),
+				CrownSteals: r.i32(),
+				BulletsHit: r.i32(), BulletsMissed: r.i32(), BulletsShot: r.i32(),
+				Blocks: r.i32(), PunchesLanded: r.i32(),
+				WeaponsPickedUp: r.i32(), WeaponsThrown: r.i32(),
+			}
+		}
+		msg.Players = append(msg.Players, player)
+	}
+	if weapons := r.u16(); weapons != 0 && r.err == nil {
+		return fmt.Errorf("%d weapons to spawn: %w", weapons, ErrOversizedPacket) //Their layout is unknown, and the server never sends any
+	}
+	msg.Maps = r.u8()
+	msg.Health = r.u8()
+	msg.Regen = r.u8()
+	msg.WeaponSpawnRate = r.u8()
+	return r.done()
+}
+
+//ClientJoined tells a lobby that a player joined
+//0x0 (1 byte,  byte)   - The player index
+//0x1 (8 bytes, uint64) - The Steam ID of the player's client
+type ClientJoined struct {
+	PlayerIndex byte
+	SteamID     uint64
+}
+
+func (msg *ClientJoined) Type() PacketType { return PacketTypeClientJoined }
+
+func (msg *ClientJoined) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	w.u8(msg.PlayerIndex)
+	w.u64(msg.SteamID)
+	return w.data, nil
+}
+
+func (msg *ClientJoined) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.PlayerIndex = r.u8()
+	msg.SteamID = r.u64()
+	return r.done()
+}
+
+//WorkshopMapsLoaded tells a client which workshop maps are in the lobby's map cycle
+//0x0 (2 bytes, uint16)  - The amount of maps
+//0x2… (8 bytes, uint64) - The workshop ID of each map
+type WorkshopMapsLoaded struct {
+	Maps []uint64
+}
+
+func (msg *WorkshopMapsLoaded) Type() PacketType { return PacketTypeWorkshopMapsLoaded }
+
+func (msg *WorkshopMapsLoaded) Marshal() ([]byte, error) {
+	if len(msg.Maps) > math.MaxUint16 {
+		return nil, ErrOversizedPacket
+	}
+
+	w := &messageWriter{}
+	w.u16(uint16(len(msg.Maps)))
+	for _, workshopID := range msg.Maps {
+		w.u64(workshopID)
+	}
+	return w.data, nil
+}
+
+func (msg *WorkshopMapsLoaded) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	count := int(r.u16())
+	if count*8 > r.remaining() {
+		return ErrShortPacket
+	}
+	msg.Maps = make([]uint64, count)
+	for i := 0; i < count; i++ {
+		msg.Maps[i] = r.u64()
+	}
+	return r.done()
+}
+
+//ClientRequestingToSpawn asks to spawn a player
+//0x0 (1 byte,  byte)    - The player index
+//0x1 (8 bytes, float32) - The X and Y position
+//0x9 (8 bytes, float32) - The X and Y rotation
+type ClientRequestingToSpawn struct {
+	PlayerIndex          byte
+	PositionX, PositionY float32
+	RotationX, RotationY float32
+}
+
+func (msg *ClientRequestingToSpawn) Type() PacketType { return PacketTypeClientRequestingToSpawn }
+
+func (msg *ClientRequestingToSpawn) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	w.u8(msg.PlayerIndex)
+	w.f32(msg.PositionX)
+	w.f32(msg.PositionY)
+	w.f32(msg.RotationX)
+	w.f32(msg.RotationY)
+	return w.data, nil
+}
+
+func (msg *ClientRequestingToSpawn) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.PlayerIndex = r.u8()
+	msg.PositionX = r.f32()
+	msg.PositionY = r.f32()
+	msg.RotationX = r.f32()
+	msg.RotationY = r.f32()
+	return r.done()
+}
+
+//ClientSpawned spawns a player
+//0x0  (1 byte,   byte)    - The player index
+//0x1  (12 bytes, float32) - The X, Y and Z position
+//0xD  (12 bytes, float32) - The X, Y and Z rotation
+//0x19 (1 byte,   byte)    - 0 to revive the player for a new map, 1 to spawn it dead in a running match
+type ClientSpawned struct {
+	PlayerIndex                     byte
+	PositionX, PositionY, PositionZ float32
+	RotationX, RotationY, RotationZ float32
+	Flag                            byte
+}
+
+func (msg *ClientSpawned) Type() PacketType { return PacketTypeClientSpawned }
+
+func (msg *ClientSpawned) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	w.u8(msg.PlayerIndex)
+	for _, f := range []float32{msg.PositionX, msg.PositionY, msg.PositionZ, msg.RotationX, msg.RotationY, msg.RotationZ} {
+		w.f32(f)
+	}
+	w.u8(msg.Flag)
+	return w.data, nil
+}
+
+func (msg *ClientSpawned) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.PlayerIndex = r.u8()
+	msg.PositionX, msg.PositionY, msg.PositionZ = r.f32(), r.f32(), r.f32()
+	msg.RotationX, msg.RotationY, msg.RotationZ = r.f32(), r.f32(), r.f32()
+	msg.Flag = r.u8()
+	return r.done()
+}
+
+//ClientReadyUp marks a client's players as ready
+//0x0 (1 byte, byte)   - The amount of players
+//0x1… (1 byte, byte)  - The index of each player
+type ClientReadyUp struct {
+	PlayerIndexes []byte
+}
+
+func (msg *ClientReadyUp) Type() PacketType { return PacketTypeClientReadyUp }
+
+func (msg *ClientReadyUp) Marshal() ([]byte, error) {
+	if len(msg.PlayerIndexes) > math.MaxUint8 {
+		return nil, ErrOversizedPacket
+	}
+
+	w := &messageWriter{}
+	w.u8(byte(len(msg.PlayerIndexes)))
+	w.bytes(msg.PlayerIndexes)
+	return w.data, nil
+}
+
+func (msg *ClientReadyUp) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.PlayerIndexes = r.bytes(int(r.u8()))
+	return r.done()
+}
+
+//ProjectileUpdate is a projectile fired since a player's last playerUpdate
+//0x0 (4 bytes, int16) - The X and Y position it was shot from
+//0x4 (2 bytes, byte)  - The X and Y direction it was shot in
+//0x6 (2 bytes, uint16) - The sync index of the projectile
+type ProjectileUpdate struct {
+	ShootPositionX, ShootPositionY int16
+	ShootX, ShootY                 byte
+	SyncIndex                      uint16
+}
+
+//PlayerUpdate syncs a player's position and weapon, on the player's update channel
+//0x0 (4 bytes, int16)  - The Y and Z position in hundredths
+//0x4 (2 bytes, byte)   - The X and Y rotation in hundredths
+//0x6 (1 byte,  byte)   - The Y value in hundredths, known to be 100 for holding up and 156 for holding down
+//0x7 (1 byte,  byte)   - The movement type
+//0x8 (1 byte,  byte)   - The fight state
+//0x9 (2 bytes, uint16) - The amount of projectiles
+//0xB… (8 bytes)        - Each projectile
+//Then:
+//  (1 byte, byte)      - The weapon
+type PlayerUpdate struct {
+	PositionY, PositionZ int16
+	RotationX, RotationY byte
+	YValue               byte
+	MovementType         byte
+	FightState           byte
+	Projectiles          []ProjectileUpdate
+	Weapon               byte
+}
+
+func (msg *PlayerUpdate) Type() PacketType { return PacketTypePlayerUpdate }
+
+func (msg *PlayerUpdate) Marshal() ([]byte, error) {
+	if len(msg.Projectiles) > math.MaxUint16 {
+		return nil, ErrOversizedPacket
+	}
+
+	w := &messageWriter{}
+	w.i16(msg.PositionY)
+	w.i16(msg.PositionZ)
+	w.bytes([]byte{msg.RotationX, msg.RotationY, msg.YValue, msg.MovementType, msg.FightState})
+	w.u16(uint16(len(msg.Projectiles)))
+	for _, projectile := range msg.Projectiles {
+		w.i16(projectile.ShootPositionX)
+		w.i16(projectile.ShootPositionY)
+		w.u8(projectile.ShootX)
+		w.u8(projectile.ShootY)
+		w.u16(projectile.SyncIndex)
+	}
+	w.u8(msg.Weapon)
+	return w.data, nil
+}
+
+func (msg *PlayerUpdate) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.PositionY = r.i16()
+	msg.PositionZ = r.i16()
+	msg.RotationX = r.u8()
+	msg.RotationY = r.u8()
+	msg.YValue = r.u8()
+	msg.MovementType = r.u8()
+	msg.FightState = r.u8()
+	count := int(r.u16())
+	if count*8 > r.remaining() {
+		return ErrShortPacket //Don't let a bogus count allocate more than the packet could hold
+	}
+	msg.Projectiles = make([]ProjectileUpdate, count)
+	for i := 0; i < count; i++ {
+		msg.Projectiles[i] = ProjectileUpdate{
+			ShootPositionX: r.i16(),
+			ShootPositionY: r.i16(),
+			ShootX:         r.u8(),
+			ShootY:         r.u8(),
+			SyncIndex:      r.u16(),
+		}
+	}
+	msg.Weapon = r.u8()
+	return r.done()
+}
+
+//PlayerTookDamage syncs damage taken by a player, on the damaged player's update channel
+//0x0 (1 byte,  byte)    - The attacker's player index
+//0x1 (4 bytes, float32) - The damage, 666.666 for a killing blow
+//0x5 (1 byte,  byte)    - 1 to play particles
+//If playing particles:
+//  (8 bytes, float32)   - The X and Y direction of the particles
+//Then, optionally:
+//  (1 byte, byte)       - The damage type
+type PlayerTookDamage struct {
+	AttackerIndex                          byte
+	Damage                                 float32
+	PlayParticles                          bool
+	ParticleDirectionX, ParticleDirectionY float32
+	HasDamageType                          bool //Older clients leave out the damage type
+	DamageType                             byte
+}
+
+func (msg *PlayerTookDamage) Type() PacketType { return PacketTypePlayerTookDamage }
+
+func (msg *PlayerTookDamage) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	w.u8(msg.AttackerIndex)
+	w.f32(msg.Damage)
+	if msg.PlayParticles {
+		w.u8(1)
+		w.f32(msg.ParticleDirectionX)
+		w.f32(msg.ParticleDirectionY)
+	} else {
+		w.u8(0)
+	}
+	if msg.HasDamageType {
+		w.u8(msg.DamageType)
+	}
+	return w.data, nil
+}
+
+func (msg *PlayerTookDamage) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.AttackerIndex = r.u8()
+	msg.Damage = r.f32()
+	msg.PlayParticles = r.u8() == 1
+	if msg.PlayParticles {
+		msg.ParticleDirectionX = r.f32()
+		msg.ParticleDirectionY = r.f32()
+	}
+	msg.HasDamageType = r.err == nil && r.remaining() > 0
+	if msg.HasDamageType {
+		msg.DamageType = r.u8()
+	}
+	return r.done()
+}
+
+//PlayerTalked is a chat message, on the player's event channel
+//0x0… (x bytes, string) - The message
+type PlayerTalked struct {
+	Message string
+}
+
+func (msg *PlayerTalked) Type() PacketType { return PacketTypePlayerTalked }
+
+func (msg *PlayerTalked) Marshal() ([]byte, error) {
+	return []byte(msg.Message), nil
+}
+
+func (msg *PlayerTalked) Unmarshal(data []byte) error {
+	if len(data) == 0 {
+		return ErrShortPacket
+	}
+	msg.Message = string(data)
+	return nil
+}
+
+//LobbyType changes whether the lobby is public
+//0x0 (1 byte, byte) - 1 for friends only, 2 for public
+type LobbyType struct {
+	LobbyType byte
+}
+
+func (msg *LobbyType) Type() PacketType { return PacketTypeLobbyType }
+
+func (msg *LobbyType) Marshal() ([]byte, error) {
+	return []byte{msg.LobbyType}, nil
+}
+
+func (msg *LobbyType) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.LobbyType = r.u8()
+	return r.done()
+}
+
+//MapChange ends the match and loads a map
+//0x0 (1 byte, byte) - The winner's player index, 255 for none
+//0x1 (1 byte, byte) - The map type
+//0x2… (x bytes)     - The map data
+type MapChange struct {
+	WinnerIndex byte
+	MapType     byte
+	MapData     []byte
+}
+
+func (msg *MapChange) Type() PacketType { return PacketTypeMapChange }
+
+func (msg *MapChange) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	w.u8(msg.WinnerIndex)
+	w.u8(msg.MapType)
+	w.bytes(msg.MapData)
+	return w.data, nil
+}
+
+func (msg *MapChange) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.WinnerIndex = r.u8()
+	msg.MapType = r.u8()
+	msg.MapData = r.rest()
+	return r.done()
+}
+
+//GroundWeapon is a weapon placed on a map before the match
+type GroundWeapon struct {
+	PositionX, PositionY float32
+	WeaponSpawnID        uint16
+	ObjectSpawnID        uint16
+}
+
+//GroundWeaponsInit spawns the weapons placed on the current map
+//0x0 (2 bytes, uint16) - The amount of weapons
+//Each weapon:
+//  (8 bytes, float32)  - The X and Y position
+//  (2 bytes, uint16)   - The weapon spawn ID
+//  (2 bytes, uint16)   - The object spawn ID
+type GroundWeaponsInit struct {
+	Weapons []GroundWeapon
+}
+
+func (msg *GroundWeaponsInit) Type() PacketType { return PacketTypeGroundWeaponsInit }
+
+func (msg *GroundWeaponsInit) Marshal() ([]byte, error) {
+	if len(msg.Weapons) > math.MaxUint16 {
+		return nil, ErrOversizedPacket
+	}
+
+	w := &messageWriter{}
+	w.u16(uint16(len(msg.Weapons)))
+	for _, weapon := range msg.Weapons {
+		w.f32(weapon.PositionX)
+		w.f32(weapon.PositionY)
+		w.u16(weapon.WeaponSpawnID)
+		w.u16(weapon.ObjectSpawnID)
+	}
+	return w.data, nil
+}
+
+func (msg *GroundWeaponsInit) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	count := int(r.u16())
+	if count*12 > r.remaining() {
+		return ErrShortPacket
+	}
+	msg.Weapons = make([]GroundWeapon, count)
+	for i := 0; i < count; i++ {
+		msg.Weapons[i] = GroundWeapon{
+			PositionX:     r.f32(),
+			PositionY:     r.f32(),
+			WeaponSpawnID: r.u16(),
+			ObjectSpawnID: r.u16(),
+		}
+	}
+	return r.done()
+}
+
+//WeaponSpawned spawns a weapon
+//0x0 (1 byte,  byte)   - The weapon, minus one
+//0x1 (2 bytes, byte)   - The Y and Z position
+//0x3 (2 bytes, uint16) - The weapon spawn ID
+//0x5 (2 bytes, uint16) - The object spawn ID
+//0x7 (1 byte,  byte)   - 1 on the stats maps, 0 otherwise
+type WeaponSpawned struct {
+	WeaponIndex          byte
+	PositionY, PositionZ byte
+	WeaponSpawnID        uint16
+	ObjectSpawnID        uint16
+	Flag                 byte
+}
+
+func (msg *WeaponSpawned) Type() PacketType { return PacketTypeWeaponSpawned }
+
+func (msg *WeaponSpawned) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	w.bytes([]byte{msg.WeaponIndex, msg.PositionY, msg.PositionZ})
+	w.u16(msg.WeaponSpawnID)
+	w.u16(msg.ObjectSpawnID)
+	w.u8(msg.Flag)
+	return w.data, nil
+}
+
+func (msg *WeaponSpawned) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.WeaponIndex = r.u8()
+	msg.PositionY = r.u8()
+	msg.PositionZ = r.u8()
+	msg.WeaponSpawnID = r.u16()
+	msg.ObjectSpawnID = r.u16()
+	msg.Flag = r.u8()
+	return r.done()
+}
+
+//ClientRequestingWeaponDrop asks to drop or throw a weapon, and is also used for clientRequestingWeaponThrow
+//0x0 (1 byte, byte) - The weapon
+//0x1… (x bytes)     - The rest of the request, passed along as-is
+type ClientRequestingWeaponDrop struct {
+	PacketType PacketType //clientRequestingWeaponDrop or clientRequestingWeaponThrow
+	Weapon     byte
+	Data       []byte
+}
+
+func (msg *ClientRequestingWeaponDrop) Type() PacketType { return msg.PacketType }
+
+func (msg *ClientRequestingWeaponDrop) Marshal() ([]byte, error) {
+	return append([]byte{msg.Weapon}, msg.Data...), nil
+}
+
+func (msg *ClientRequestingWeaponDrop) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.Weapon = r.u8()
+	msg.Data = r.rest()
+	return r.done()
+}
+
+//WeaponDropped drops or throws a weapon, and is also used for weaponThrown
+//0x0… (x bytes)        - The request it answers
+//Then:
+//  (2 bytes, uint16)   - The weapon spawn ID
+//  (2 bytes, uint16)   - The object spawn ID
+type WeaponDropped struct {
+	PacketType    PacketType //weaponDropped or weaponThrown
+	Request       ClientRequestingWeaponDrop
+	WeaponSpawnID uint16
+	ObjectSpawnID uint16
+}
+
+func (msg *WeaponDropped) Type() PacketType { return msg.PacketType }
+
+func (msg *WeaponDropped) Marshal() ([]byte, error) {
+	data, err := msg.Request.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &messageWriter{data: data}
+	w.u16(msg.WeaponSpawnID)
+	w.u16(msg.ObjectSpawnID)
+	return w.data, nil
+}
+
+func (msg *WeaponDropped) Unmarshal(data []byte) error {
+	if len(data) < 5 {
+		return ErrShortPacket
+	}
+	if err := msg.Request.Unmarshal(data[:len(data)-4]); err != nil {
+		return err
+	}
+
+	r := &messageReader{data: data[len(data)-4:]}
+	msg.WeaponSpawnID = r.u16()
+	msg.ObjectSpawnID = r.u16()
+	return r.done()
+}
+
+//ClientRequestingWeaponPickUp asks to pick up a weapon, and is passed along as weaponWasPickedUp if it's there
+//0x0 (1 byte,  byte)   - The player index
+//0x1 (2 bytes, uint16) - The weapon spawn ID
+type ClientRequestingWeaponPickUp struct {
+	PacketType    PacketType //clientRequestingWeaponPickUp or weaponWasPickedUp
+	PlayerIndex   byte
+	WeaponSpawnID uint16
+}
+
+func (msg *ClientRequestingWeaponPickUp) Type() PacketType { return msg.PacketType }
+
+func (msg *ClientRequestingWeaponPickUp) Marshal() ([]byte, error) {
+	w := &messageWriter{}
+	w.u8(msg.PlayerIndex)
+	w.u16(msg.WeaponSpawnID)
+	return w.data, nil
+}
+
+func (msg *ClientRequestingWeaponPickUp) Unmarshal(data []byte) error {
+	r := &messageReader{data: data}
+	msg.PlayerIndex = r.u8()
+	msg.WeaponSpawnID = r.u16()
+	return r.done()
+}
+
+//NewMessage returns an empty message for the specified packet type, to decode packet data into
+func NewMessage(packetType PacketType) Message {
+	switch packetType {
+	case PacketTypeAck:
+		return &Ack{}
+	case PacketTypePing:
+		return &Ping{}
+	case PacketTypePingResponse:
+		return &PingResponse{}
+	case PacketTypeClientAccepted:
+		return &ClientAccepted{}
+	case PacketTypeClientRequestingIndex:
+		return &ClientRequestingIndex{}
+	case PacketTypeClientInit:
+		return &ClientInit{}
+	case PacketTypeClientJoined:
+		return &ClientJoined{}
+	case PacketTypeWorkshopMapsLoaded:
+		return &WorkshopMapsLoaded{}
+	case PacketTypeClientRequestingToSpawn:
+		return &ClientRequestingToSpawn{}
+	case PacketTypeClientSpawned:
+		return &ClientSpawned{}
+	case PacketTypeClientReadyUp:
+		return &ClientReadyUp{}
+	case PacketTypePlayerUpdate:
+		return &PlayerUpdate{}
+	case PacketTypePlayerTookDamage:
+		return &PlayerTookDamage{}
+	case PacketTypePlayerTalked:
+		return &PlayerTalked{}
+	case PacketTypeLobbyType:
+		return &LobbyType{}
+	case PacketTypeMapChange:
+		return &MapChange{}
+	case PacketTypeGroundWeaponsInit:
+		return &GroundWeaponsInit{}
+	case PacketTypeWeaponSpawned:
+		return &WeaponSpawned{}
+	case PacketTypeClientRequestingWeaponDrop, PacketTypeClientRequestingWeaponThrow:
+		return &ClientRequestingWeaponDrop{PacketType: packetType}
+	case PacketTypeWeaponDropped:
+		return &WeaponDropped{PacketType: packetType, Request: ClientRequestingWeaponDrop{PacketType: PacketTypeClientRequestingWeaponDrop}}
+	case PacketTypeWeaponThrown:
+		return &WeaponDropped{PacketType: packetType, Request: ClientRequestingWeaponDrop{PacketType: PacketTypeClientRequestingWeaponThrow}}
+	case PacketTypeClientRequestingWeaponPickUp, PacketTypeWeaponWasPickedUp:
+		return &ClientRequestingWeaponPickUp{PacketType: packetType}
+	case PacketTypeClientRequestingAccepting, PacketTypeClientLeft, PacketTypeStartMatch, PacketTypeRequestingOptions, PacketTypeKickPlayer:
+		return &Empty{PacketType: packetType}
+	}
+	return &Raw{PacketType: packetType}
+}
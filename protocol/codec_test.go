@@ -0,0 +1,199 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+//codecCases are well-formed messages and the exact packet data they're sent as
+var codecCases = []struct {
+	name string
+	msg  Message
+	data []byte
+}{
+	{"ack", &Ack{Sequence: 0x01020304}, []byte{0x04, 0x03, 0x02, 0x01}},
+	{"ping", &Ping{Data: []byte{1, 2, 3}}, []byte{1, 2, 3}},
+	{"pingResponse", &PingResponse{Data: []byte{1, 2, 3}}, []byte{1, 2, 3}},
+	{"clientAccepted", &ClientAccepted{Token: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}},
+	{"clientRequestingIndex from the stock game", &ClientRequestingIndex{SteamID: 0x0110000100000001, PlayerCount: 2, ProtocolVersion: 25},
+		[]byte{0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x10, 0x01, 2, 25}},
+	{"clientRequestingIndex with extensions", &ClientRequestingIndex{SteamID: 0x0110000100000001, PlayerCount: 1, ProtocolVersion: 25, Extensions: ExtensionsReliable},
+		[]byte{0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x10, 0x01, 1, 25, ExtensionsReliable}},
+	{"clientInit rejected", &ClientInit{Reason: "lobby full"}, append([]byte{0}, "lobby full"...)},
+	{"clientInit accepted", &ClientInit{
+		Accepted:    true,
+		PlayerIndex: 1,
+		MapType:     2,
+		MapData:     []byte{7, 8},
+		Players: []ClientInitPlayer{
+			{SteamID: 5, Stats: &PlayerStats{
+				Wins: 1, Kills: 2, Deaths: 3, Suicides: 4, Falls: 5,
+				CrownSteals: 6,
+				BulletsHit:  7, BulletsMissed: 8, BulletsShot: 9,
+				Blocks: 10, PunchesLanded: 11,
+				WeaponsPickedUp: 12, WeaponsThrown: -1,
+			}},
+			{SteamID: 6},
+			{},
+		},
+		Maps:            1,
+		Health:          2,
+		Regen:           3,
+		WeaponSpawnRate: 4,
+		LocalSteamID:    6,
+	}, []byte{
+		1, 1, 3, 2,
+		2, 0, 0, 0, 7, 8,
+		5, 0, 0, 0, 0, 0, 0, 0,
+		1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 5, 0, 0, 0,
+		6, 0, 0, 0,
+		7, 0, 0, 0, 8, 0, 0, 0, 9, 0, 0, 0,
+		10, 0, 0, 0, 11, 0, 0, 0,
+		12, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF,
+		6, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0,
+		1, 2, 3, 4,
+	}},
+	{"clientJoined", &ClientJoined{PlayerIndex: 2, SteamID: 0x0102030405060708}, []byte{2, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}},
+	{"workshopMapsLoaded", &WorkshopMapsLoaded{Maps: []uint64{1, 0x0100}},
+		[]byte{2, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+	{"clientRequestingToSpawn", &ClientRequestingToSpawn{PlayerIndex: 1, PositionX: 1.5, PositionY: -2, RotationX: 0.5},
+		[]byte{1, 0x00, 0x00, 0xC0, 0x3F, 0x00, 0x00, 0x00, 0xC0, 0x00, 0x00, 0x00, 0x3F, 0x00, 0x00, 0x00, 0x00}},
+	{"clientSpawned", &ClientSpawned{PlayerIndex: 3, PositionX: 1, PositionY: 2, PositionZ: -1, RotationZ: 10, Flag: 1},
+		[]byte{3,
+			0x00, 0x00, 0x80, 0x3F, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x80, 0xBF,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x41,
+			1}},
+	{"clientReadyUp", &ClientReadyUp{PlayerIndexes: []byte{0, 3}}, []byte{2, 0, 3}},
+	{"playerUpdate", &PlayerUpdate{
+		PositionY: -2, PositionZ: 300,
+		RotationX: 1, RotationY: 2,
+		YValue:       100,
+		MovementType: 3,
+		FightState:   4,
+		Projectiles:  []ProjectileUpdate{{ShootPositionX: -1, ShootPositionY: 2, ShootX: 3, ShootY: 4, SyncIndex: 0x0506}},
+		Weapon:       9,
+	}, []byte{0xFE, 0xFF, 0x2C, 0x01, 1, 2, 100, 3, 4, 1, 0, 0xFF, 0xFF, 0x02, 0x00, 3, 4, 0x06, 0x05, 9}},
+	{"playerTookDamage from an older client", &PlayerTookDamage{AttackerIndex: 1, Damage: 10},
+		[]byte{1, 0x00, 0x00, 0x20, 0x41, 0}},
+	{"playerTookDamage with particles and a damage type", &PlayerTookDamage{
+		AttackerIndex: 2,
+		Damage:        0.5,
+		PlayParticles: true, ParticleDirectionX: 1, ParticleDirectionY: -1,
+		HasDamageType: true, DamageType: 3,
+	}, []byte{2, 0x00, 0x00, 0x00, 0x3F, 1, 0x00, 0x00, 0x80, 0x3F, 0x00, 0x00, 0x80, 0xBF, 3}},
+	{"playerTalked", &PlayerTalked{Message: "gg"}, []byte("gg")},
+	{"lobbyType", &LobbyType{LobbyType: 2}, []byte{2}},
+	{"mapChange", &MapChange{WinnerIndex: 255, MapType: 1, MapData: []byte{1, 2, 3, 4}}, []byte{255, 1, 1, 2, 3, 4}},
+	{"groundWeaponsInit", &GroundWeaponsInit{Weapons: []GroundWeapon{{PositionX: 1.5, PositionY: 2, WeaponSpawnID: 3, ObjectSpawnID: 0x0104}}},
+		[]byte{1, 0, 0x00, 0x00, 0xC0, 0x3F, 0x00, 0x00, 0x00, 0x40, 3, 0, 0x04, 0x01}},
+	{"weaponSpawned", &WeaponSpawned{WeaponIndex: 5, PositionY: 6, PositionZ: 7, WeaponSpawnID: 0x0102, ObjectSpawnID: 0x0304, Flag: 1},
+		[]byte{5, 6, 7, 0x02, 0x01, 0x04, 0x03, 1}},
+	{"clientRequestingWeaponThrow", &ClientRequestingWeaponDrop{PacketType: PacketTypeClientRequestingWeaponThrow, Weapon: 3, Data: []byte{9, 9}},
+		[]byte{3, 9, 9}},
+	{"weaponDropped", &WeaponDropped{
+		PacketType:    PacketTypeWeaponDropped,
+		Request:       ClientRequestingWeaponDrop{PacketType: PacketTypeClientRequestingWeaponDrop, Weapon: 3, Data: []byte{9}},
+		WeaponSpawnID: 1,
+		ObjectSpawnID: 0x0102,
+	}, []byte{3, 9, 1, 0, 0x02, 0x01}},
+	{"weaponWasPickedUp", &ClientRequestingWeaponPickUp{PacketType: PacketTypeWeaponWasPickedUp, PlayerIndex: 1, WeaponSpawnID: 0x0203},
+		[]byte{1, 0x03, 0x02}},
+	{"startMatch", &Empty{PacketType: PacketTypeStartMatch}, nil},
+	{"playerFallOut", &Raw{PacketType: PacketTypePlayerFallOut, Data: []byte{1, 2}}, []byte{1, 2}},
+}
+
+func TestCodecLayout(t *testing.T) {
+	for _, c := range codecCases {
+		data, err := c.msg.Marshal()
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !bytes.Equal(data, c.data) {
+			t.Errorf("%s was encoded as % X, expected % X", c.name, data, c.data)
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range codecCases {
+		decoded := NewMessage(c.msg.Type())
+		if err := decoded.Unmarshal(c.data); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, c.msg) {
+			t.Errorf("%s was decoded as %+v, expected %+v", c.name, decoded, c.msg)
+		}
+	}
+}
+
+func TestCodecShortPacket(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		msg  Message
+		data []byte
+	}{
+		{"truncated ack", &Ack{}, []byte{1, 2, 3}},
+		{"truncated token", &ClientAccepted{}, make([]byte, SessionTokenSize-1)},
+		{"clientRequestingIndex without a protocol version", &ClientRequestingIndex{}, make([]byte, 9)},
+		{"clientInit without a player count", &ClientInit{}, []byte{1, 0}},
+		{"clientInit with a slot missing its stats", &ClientInit{LocalSteamID: 6}, []byte{1, 1, 1, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0}},
+		{"clientJoined without a whole Steam ID", &ClientJoined{}, make([]byte, 8)},
+		{"more workshop maps than sent", &WorkshopMapsLoaded{}, []byte{2, 0, 1, 0, 0, 0, 0, 0, 0, 0}},
+		{"more ready players than sent", &ClientReadyUp{}, []byte{2, 0}},
+		{"bogus projectile count", &PlayerUpdate{}, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0}},
+		{"particles without a direction", &PlayerTookDamage{}, []byte{1, 0, 0, 0, 0, 1}},
+		{"empty chat message", &PlayerTalked{}, nil},
+		{"lobbyType without a type", &LobbyType{}, nil},
+		{"more ground weapons than sent", &GroundWeaponsInit{}, []byte{1, 0, 0, 0, 0, 0}},
+		{"weaponDropped without a request", &WeaponDropped{}, []byte{1, 0, 2, 0}},
+		{"weaponWasPickedUp without a spawn ID", &ClientRequestingWeaponPickUp{}, []byte{1, 2}},
+	} {
+		if err := c.msg.Unmarshal(c.data); !errors.Is(err, ErrShortPacket) {
+			t.Errorf("%s decoded with %v, expected %v", c.name, err, ErrShortPacket)
+		}
+	}
+}
+
+func TestCodecOversizedPacket(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		msg  Message
+		data []byte
+	}{
+		{"ack with a trailing byte", &Ack{}, []byte{1, 2, 3, 4, 5}},
+		{"startMatch with data", &Empty{PacketType: PacketTypeStartMatch}, []byte{0}},
+		{"token with a trailing byte", &ClientAccepted{}, make([]byte, SessionTokenSize+1)},
+		{"clientRequestingIndex past its extensions", &ClientRequestingIndex{}, make([]byte, 12)},
+		{"clientInit with weapons to spawn", &ClientInit{}, []byte{1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0}},
+		{"clientSpawned with a trailing byte", &ClientSpawned{}, make([]byte, 27)},
+		{"lobbyType with a trailing byte", &LobbyType{}, []byte{2, 0}},
+		{"weaponSpawned with a trailing byte", &WeaponSpawned{}, make([]byte, 9)},
+	} {
+		if err := c.msg.Unmarshal(c.data); !errors.Is(err, ErrOversizedPacket) {
+			t.Errorf("%s decoded with %v, expected %v", c.name, err, ErrOversizedPacket)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		msg  Message
+	}{
+		{"short token", &ClientAccepted{Token: make([]byte, SessionTokenSize-1)}},
+		{"more ready players than a byte counts", &ClientReadyUp{PlayerIndexes: make([]byte, 256)}},
+		{"more workshop maps than a uint16 counts", &WorkshopMapsLoaded{Maps: make([]uint64, 65536)}},
+		{"more player slots than a byte counts", &ClientInit{Accepted: true, Players: make([]ClientInitPlayer, 256)}},
+		{"more projectiles than a uint16 counts", &PlayerUpdate{Projectiles: make([]ProjectileUpdate, 65536)}},
+		{"more ground weapons than a uint16 counts", &GroundWeaponsInit{Weapons: make([]GroundWeapon, 65536)}},
+	} {
+		if _, err := c.msg.Marshal(); !errors.Is(err, ErrOversizedPacket) {
+			t.Errorf("%s encoded with %v, expected %v", c.name, err, ErrOversizedPacket)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+//go:build go1.18
+// +build go1.18
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+//fuzzSeeds are well-formed messages to start fuzzing every decoder from
+var fuzzSeeds = []Message{
+	&Ack{Sequence: 1},
+	&Ping{Data: []byte{1, 2, 3, 4}},
+	&PingResponse{Data: []byte{1, 2, 3, 4}},
+	&ClientAccepted{Token: bytes.Repeat([]byte{7}, 16)},
+	&ClientRequestingIndex{SteamID: 76561190000000001, PlayerCount: 1, ProtocolVersion: Version},
+	&ClientRequestingIndex{SteamID: 76561190000000001, PlayerCount: 1, ProtocolVersion: Version, Extensions: Extensions},
+	&ClientInit{Accepted: false, Reason: "lobby full"},
+	&ClientJoined{PlayerIndex: 1, SteamID: 76561190000000002},
+	&WorkshopMapsLoaded{Maps: []uint64{1, 2}},
+	&ClientReadyUp{PlayerIndexes: []byte{0}},
+	&PlayerUpdate{PositionY: 100, Projectiles: []ProjectileUpdate{{ShootX: 1}}},
+	&PlayerTookDamage{AttackerIndex: 1, Damage: 666.666},
+	&PlayerTalked{Message: "/map 3"},
+	&MapChange{WinnerIndex: 255},
+	&GroundWeaponsInit{Weapons: []GroundWeapon{{WeaponSpawnID: 1}}},
+}
+
+//FuzzNewPacketFromBytes makes sure no datagram can crash the packet parser, and that every packet it parses serializes again
+func FuzzNewPacketFromBytes(f *testing.F) {
+	token := bytes.Repeat([]byte{7}, 16)
+	for _, msg := range fuzzSeeds {
+		packet, err := NewPacketFromMessage(msg, 3, 76561190000000001)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(packet.AsBytes())
+		f.Add(packet.AsSignedBytes(1, token))
+	}
+	f.Add([]byte{})
+	f.Add(bytes.Repeat([]byte{0xFF}, sophSize+eophSize))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := NewPacketFromBytes(data)
+		if err != nil {
+			return
+		}
+		packet.Verify(token)
+		if _, err := NewPacketFromBytes(packet.AsSignedBytes(packet.Sequence, token)); err != nil {
+			t.Fatalf("parsed packet %s doesn't parse once serialized again: %v", packet, err)
+		}
+	})
+}
+
+//FuzzDecode makes sure no packet data can crash the decoder of any packet type, and that whatever decodes encodes again
+func FuzzDecode(f *testing.F) {
+	for _, msg := range fuzzSeeds {
+		data, err := msg.Marshal()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(byte(msg.Type()), data)
+	}
+	for packetType := PacketTypePing; packetType <= PacketTypeRequestingOptions; packetType++ {
+		f.Add(byte(packetType), []byte{})
+	}
+
+	f.Fuzz(func(t *testing.T, packetType byte, data []byte) {
+		msg := NewMessage(PacketType(packetType))
+		if msg.Unmarshal(data) != nil {
+			return
+		}
+		if _, err := msg.Marshal(); err != nil {
+			t.Fatalf("decoded %s %+v doesn't encode again: %v", msg.Type(), msg, err)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+//MapType is how a map is identified by its map data in a clientInit or mapChange
+type MapType byte
+
+const (
+	MapTypeLandfall MapType = iota //The map data is the Unity scene index of a built-in map, as an int32
+	MapTypeLocal                   //The map data is the path to a map file on the client
+	MapTypeWorkshop                //The map data is the Steam Workshop ID of the map, as a uint64
+	MapTypeStreamed                //The map data is the map itself
+)
+
+//Map identifies a Stick Fight map as it's sent over the network
+type Map struct {
+	Type MapType //How to interpret the data
+	Data []byte  //The map data
+}
+
+//SceneIndex returns the Unity scene index of a Landfall map, and false if it isn't one
+func (m Map) SceneIndex() (int32, bool) {
+	if m.Type != MapTypeLandfall || len(m.Data) != 4 {
+		return 0, false
+	}
+	return int32(binary.LittleEndian.Uint32(m.Data)), true
+}
+
+//WorkshopID returns the Steam Workshop ID of a Workshop map, and false if it isn't one
+func (m Map) WorkshopID() (uint64, bool) {
+	if m.Type != MapTypeWorkshop || len(m.Data) != 8 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(m.Data), true
+}
+
+func (m Map) String() string {
+	if sceneIndex, ok := m.SceneIndex(); ok {
+		return fmt.Sprintf("Landfall map: %d", sceneIndex)
+	}
+	if workshopID, ok := m.WorkshopID(); ok {
+		return fmt.Sprintf("Steam Workshop map: %d", workshopID)
+	}
+	switch m.Type {
+	case MapTypeLocal:
+		return string(m.Data) + "/Level.bin"
+	case MapTypeStreamed:
+		return fmt.Sprintf("Streamed map: %d bytes", len(m.Data))
+	}
+	return fmt.Sprintf("%d: %v", int(m.Type), m.Data)
+}
+
+//Map returns the map the client is initialized with
+func (msg *ClientInit) Map() Map {
+	return Map{Type: MapType(msg.MapType), Data: msg.MapData}
+}
+
+//Map returns the map being changed to
+func (msg *MapChange) Map() Map {
+	return Map{Type: MapType(msg.MapType), Data: msg.MapData}
+}
@@ -0,0 +1,380 @@
+//Package protocol holds the Stick Fight network protocol shared by the server and its clients: the packet format, the packet types and the typed data each of them carries
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	crunch "github.com/superwhiskers/crunch/v3"
+)
+
+const (
+	sophSize = 5
+	eophSize = 9
+	seqSize  = 4
+	macSize  = 8
+
+	channelFlagSequenced = 0x80 //Set on the channel byte when a reliable sequence number directly precedes it
+	channelFlagSigned    = 0x40 //Set on the channel byte when a session signature follows the Steam ID
+	channelMask          = 0x3F //Masks out the flags on the channel byte
+
+	Version = 25 //The protocol version of Stick Fight v25, which the server speaks internally and translates every other version to and from
+)
+
+//The versions of the server's own extensions to the game's protocol, which a client asks for in its clientRequestingIndex, each adding to the last
+const (
+	ExtensionsNone     = 0 //The stock game, which sends and expects neither flag on the channel byte
+	ExtensionsSigned   = 1 //Signs every packet with its session token, setting channelFlagSigned
+	ExtensionsReliable = 2 //Acknowledges, and handles in order, packets sequenced with channelFlagSequenced
+
+	Extensions = ExtensionsReliable //The latest version, which the server and the client SDK speak
+)
+
+//NegotiateExtensions returns the version of the extensions to speak with a client that asked for the specified version
+func NegotiateExtensions(requested byte) byte {
+	if requested > Extensions {
+		return Extensions
+	}
+	return requested
+}
+
+//ChannelUpdate returns the channel that a player's playerUpdate packets travel through
+func ChannelUpdate(playerIndex int) int {
+	return playerIndex*2 + 2
+}
+
+//ChannelEvent returns the channel that a player's event packets, like playerTalked, travel through
+func ChannelEvent(playerIndex int) int {
+	return ChannelUpdate(playerIndex) + 1
+}
+
+//PeekChannel returns the channel of a serialized packet without deserializing the rest of it, or 0 if it's empty
+func PeekChannel(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	return int(data[len(data)-1] & channelMask)
+}
+
+//Packet holds a Stick Fight network packet
+type Packet struct {
+	*crunch.Buffer //Holds the data buffer, and provides additional methods to directly read and write on this buffer
+
+	Timestamp uint32       //The timestamp of the packet
+	Src       *net.UDPAddr //The source UDP socket where this packet came from, nil if sending a packet
+	Channel   int          //The channel for this packet to travel through
+	SteamID   CSteamID     //The Steam ID of the user who sent or is intended to receive this packet
+	Type      PacketType   //The type of the packet, to allow easy packet creation
+	Sequence  uint32       //The reliable sequence number of this packet on its channel, 0 if sent unreliably
+	MAC       []byte       //The session signature of this packet, nil if unsigned
+
+	pos    int    //io.Reader
+	signed []byte //The serialized packet without its signature, which is what the signature covers
+}
+
+func (packet *Packet) Read(p []byte) (n int, err error) {
+	//packetBytes := packet.AsBytes()
+	packetBytes := packet.Bytes()
+	if packet.Type != PacketTypeHTTP {
+		packetBytes = packet.AsBytes()
+	}
+
+	start := packet.pos
+	for i := 0; i < len(p); i++ {
+		if (start + i) >= len(packetBytes) {
+			return packet.pos - start, io.EOF
+		}
+		p[i] = packetBytes[start + i]
+		packet.pos++
+	}
+	return packet.pos - start, nil
+}
+
+//NewPacket returns a new deserialized Stick Fight network packet
+func NewPacket(packetType PacketType, channel int, steamID uint64) *Packet {
+	return &Packet{crunch.NewBuffer(make([]byte, 0)), uint32(time.Now().Unix()), nil, channel, NewCSteamID(steamID), packetType, 0, nil, 0, nil}
+}
+
+//NewPacketFromBytes returns a Stick Fight network packet deserialized from bytes
+func NewPacketFromBytes(data []byte) (packet *Packet, err error) {
+	if len(data) < sophSize+eophSize {
+		return nil, errors.New("packet size too small")
+	}
+
+	buf := crunch.NewBuffer(data)
+	dataLen := int64(len(data) - sophSize - eophSize)
+	sequenced := data[len(data)-1]&channelFlagSequenced != 0
+	if sequenced {
+		dataLen -= seqSize
+	}
+	signed := data[len(data)-1]&channelFlagSigned != 0
+	if signed {
+		dataLen -= macSize
+	}
+	if dataLen < 0 {
+		return nil, errors.New("packet size too small for its trailer")
+	}
+
+	//Official start of packet header
+	//Size: 5 bytes + data
+	//0x0  (4 bytes, uint32) - Packet timestamp
+	//0x4  (1 byte,  byte)   - Packet type
+	//0x5… (x bytes)         - Packet data, to be interpreted by the packet type's handler
+	packet = NewPacket(PacketTypeNull, 0, 0)
+	packet.Timestamp = buf.ReadU32LENext(1)[0]
+	packet.Type = PacketType(buf.ReadByteNext())
+	if dataLen > 0 {
+		packet.Grow(dataLen)
+		packet.WriteBytesNext(buf.ReadBytesNext(dataLen))
+		packet.SeekByte(0, false) //Seek back to the start of the packet for the next read/write
+	}
+
+	//Custom end of packet header, directly following the packet's data
+	//Size so far: 9 bytes
+	//0x0 (8 bytes, uint64) - The Steam ID of the user who is the intended recipient of the packet
+	//0x8 (8 bytes)         - The session signature, only present if the channel has channelFlagSigned set
+	//0x8 (4 bytes, uint32) - The reliable sequence number, only present if the channel has channelFlagSequenced set
+	//0x8 (1 byte,  int)    - The channel, which was originally handled by Steam's networking library, and is required by the game's packet handling logic
+	packet.SteamID = NewCSteamID(buf.ReadU64LENext(1)[0])
+	if signed {
+		macStart := buf.ByteOffset()
+		packet.MAC = append([]byte{}, buf.ReadBytesNext(macSize)...)
+		packet.signed = append(append([]byte{}, data[:macStart]...), data[macStart+macSize:]...)
+	}
+	if sequenced {
+		packet.Sequence = buf.ReadU32LENext(1)[0]
+	}
+	packet.Channel = int(buf.ReadByteNext() & channelMask)
+
+	return packet, nil
+}
+
+func (packet *Packet) String() string {
+	str := fmt.Sprintf("[%d %d]", packet.Channel, packet.Timestamp)
+	if packet.Sequence != 0 {
+		str = fmt.Sprintf("[%d#%d %d]", packet.Channel, packet.Sequence, packet.Timestamp)
+	}
+	if packet.SteamID.ID != 0 {
+		str += " " + packet.SteamID.GetUsername()
+	}
+	str += fmt.Sprintf(": %d:%s %v", packet.Type, packet.Type.String(), packet.Bytes())
+
+	return str
+}
+
+//AsBytes returns a Stick Fight network packet serialized as bytes
+func (packet *Packet) AsBytes() []byte {
+	return packet.AsSequencedBytes(packet.Sequence)
+}
+
+//AsSequencedBytes returns a Stick Fight network packet serialized as bytes with the specified reliable sequence number, or none if 0
+func (packet *Packet) AsSequencedBytes(sequence uint32) []byte {
+	dataLen := int(packet.ByteCapacity())
+	size := sophSize + dataLen + eophSize
+	if sequence != 0 {
+		size += seqSize
+	}
+	buf := crunch.NewBuffer(make([]byte, size))
+
+	buf.WriteU32LENext([]uint32{packet.Timestamp})
+	buf.WriteByteNext(byte(packet.Type))
+	if dataLen > 0 {
+		buf.WriteBytesNext(packet.Bytes())
+	}
+	buf.WriteU64LENext([]uint64{packet.SteamID.ID})
+	if sequence != 0 {
+		buf.WriteU32LENext([]uint32{sequence})
+		buf.WriteByteNext(byte(packet.Channel&channelMask) | channelFlagSequenced)
+	} else {
+		buf.WriteByteNext(byte(packet.Channel & channelMask))
+	}
+
+	return buf.Bytes()
+}
+
+//ShouldCheckTime returns true if this packet should have its timestamp checked
+func (packet *Packet) ShouldCheckTime() bool {
+	switch packet.Type {
+	case PacketTypePing, PacketTypePingResponse, PacketTypeClientReadyUp, PacketTypePlayerUpdate, PacketTypePlayerTalked, PacketTypePlayerForceAdded, PacketTypePlayerForceAddedAndBlock, PacketTypePlayerLavaForceAdded, PacketTypePlayerFallOut, PacketTypePlayerWonWithRicochet, PacketTypePlayerTookDamage, PacketTypeClientRequestingWeaponThrow:
+		return false
+	}
+
+	return true
+}
+
+//ShouldSendReliably returns true if this packet must reach every client, and in order with the rest of its channel
+func (packet *Packet) ShouldSendReliably() bool {
+	switch packet.Type {
+	case PacketTypeClientInit, PacketTypeClientJoined, PacketTypeClientLeft, PacketTypeClientSpawned,
+		PacketTypeMapChange, PacketTypeStartMatch, PacketTypeGroundWeaponsInit, PacketTypeWorkshopMapsLoaded,
+		PacketTypeWeaponSpawned, PacketTypeWeaponThrown, PacketTypeWeaponDropped, PacketTypeWeaponWasPickedUp,
+		PacketTypePlayerTookDamage, PacketTypePlayerFallOut, PacketTypePlayerTalked,
+		PacketTypeRequestingOptions, PacketTypeKickPlayer:
+		return true
+	}
+
+	return false
+}
+
+//PacketType is the type of a packet, which determines how to interpret the data associated with the packet
+type PacketType byte
+
+func (packetType PacketType) String() string {
+	switch packetType {
+	case PacketTypeHTTP:
+		return "HTTP"
+	case PacketTypeAck:
+		return "ack"
+	case PacketTypePing:
+		return "ping"
+	case PacketTypePingResponse:
+		return "pingResponse"
+	case PacketTypeClientJoined:
+		return "clientJoined"
+	case PacketTypeClientRequestingAccepting:
+		return "clientRequestingAccepting"
+	case PacketTypeClientAccepted:
+		return "clientAccepted"
+	case PacketTypeClientInit:
+		return "clientInit"
+	case PacketTypeClientRequestingIndex:
+		return "clientRequestingIndex"
+	case PacketTypeClientRequestingToSpawn:
+		return "clientRequestingToSpawn"
+	case PacketTypeClientSpawned:
+		return "clientSpawned"
+	case PacketTypeClientReadyUp:
+		return "clientReadyUp"
+	case PacketTypePlayerUpdate:
+		return "playerUpdate"
+	case PacketTypePlayerTookDamage:
+		return "playerTookDamage"
+	case PacketTypePlayerTalked:
+		return "playerTalked"
+	case PacketTypePlayerForceAdded:
+		return "playerForceAdded"
+	case PacketTypePlayerForceAddedAndBlock:
+		return "playerForceAddedAndBlock"
+	case PacketTypePlayerLavaForceAdded:
+		return "playerLavaForceAdded"
+	case PacketTypePlayerFallOut:
+		return "playerFallOut"
+	case PacketTypePlayerWonWithRicochet:
+		return "playerWonWithRicochet"
+	case PacketTypeMapChange:
+		return "mapChange"
+	case PacketTypeWeaponSpawned:
+		return "weaponSpawned"
+	case PacketTypeWeaponThrown:
+		return "weaponThrown"
+	case PacketTypeClientRequestingWeaponThrow:
+		return "clientRequestingWeaponThrow"
+	case PacketTypeClientRequestingWeaponDrop:
+		return "clientRequestingWeaponDrop"
+	case PacketTypeWeaponDropped:
+		return "weaponDropped"
+	case PacketTypeWeaponWasPickedUp:
+		return "weaponWasPickedUp"
+	case PacketTypeClientRequestingWeaponPickUp:
+		return "clientRequestingWeaponPickUp"
+	case PacketTypeObjectUpdate:
+		return "objectUpdate"
+	case PacketTypeObjectSpawned:
+		return "objectSpawned"
+	case PacketTypeObjectSimpleDestruction:
+		return "objectSimpleDestruction"
+	case PacketTypeObjectDestructionCollision:
+		return "objectDestructionCollision"
+	case PacketTypeGroundWeaponsInit:
+		return "groundWeaponsInit"
+	case PacketTypeMapInfo:
+		return "mapInfo"
+	case PacketTypeMapInfoSync:
+		return "mapInfoSync"
+	case PacketTypeWorkshopMapsLoaded:
+		return "workshopMapsLoaded"
+	case PacketTypeStartMatch:
+		return "startMatch"
+	case PacketTypeObjectHello:
+		return "objectHello"
+	case PacketTypeOptionsChanged:
+		return "optionsChanged"
+	case PacketTypeKickPlayer:
+		return "kickPlayer"
+	case PacketTypeClientLeft:
+		return "clientLeft"
+	case PacketTypeLobbyType:
+		return "lobbyType"
+	case PacketTypeRequestingOptions:
+		return "requestingOptions"
+	}
+
+	return fmt.Sprintf("unknown%d", packetType)
+}
+
+//ParsePacketType returns the packet type with the specified name, case-insensitively, or with the specified number
+func ParsePacketType(name string) (PacketType, bool) {
+	if number, err := strconv.ParseUint(name, 10, 8); err == nil {
+		return PacketType(number), true
+	}
+	for i := 0; i <= math.MaxUint8; i++ {
+		if strings.EqualFold(PacketType(i).String(), name) {
+			return PacketType(i), true
+		}
+	}
+	return 0, false
+}
+
+const (
+	PacketTypePing PacketType = iota
+	PacketTypePingResponse
+	PacketTypeClientJoined
+	PacketTypeClientRequestingAccepting
+	PacketTypeClientAccepted
+	PacketTypeClientInit
+	PacketTypeClientRequestingIndex
+	PacketTypeClientRequestingToSpawn
+	PacketTypeClientSpawned
+	PacketTypeClientReadyUp
+	PacketTypePlayerUpdate
+	PacketTypePlayerTookDamage
+	PacketTypePlayerTalked
+	PacketTypePlayerForceAdded
+	PacketTypePlayerForceAddedAndBlock
+	PacketTypePlayerLavaForceAdded
+	PacketTypePlayerFallOut
+	PacketTypePlayerWonWithRicochet
+	PacketTypeMapChange
+	PacketTypeWeaponSpawned
+	PacketTypeWeaponThrown
+	PacketTypeClientRequestingWeaponThrow
+	PacketTypeClientRequestingWeaponDrop
+	PacketTypeWeaponDropped
+	PacketTypeWeaponWasPickedUp
+	PacketTypeClientRequestingWeaponPickUp
+	PacketTypeObjectUpdate
+	PacketTypeObjectSpawned
+	PacketTypeObjectSimpleDestruction
+	PacketTypeObjectInvokeDestructionEvent
+	PacketTypeObjectDestructionCollision
+	PacketTypeGroundWeaponsInit
+	PacketTypeMapInfo
+	PacketTypeMapInfoSync
+	PacketTypeWorkshopMapsLoaded
+	PacketTypeStartMatch
+	PacketTypeObjectHello
+	PacketTypeOptionsChanged
+	PacketTypeKickPlayer
+	PacketTypeClientLeft
+	PacketTypeLobbyType
+	PacketTypeRequestingOptions
+	PacketTypeAck  = 253 //Acknowledges a reliable packet, with its channel and 4 bytes (uint32) of the acknowledged sequence number
+	PacketTypeHTTP = 254
+	PacketTypeNull = 255
+)
@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	reliableInitialTimeout = time.Millisecond * 200  //The first retransmission timeout for a reliable packet
+	reliableMaxTimeout     = time.Millisecond * 3200 //The longest a reliable packet will wait between retransmissions
+	reliableMaxRetries     = 10                      //The amount of retransmissions before a reliable packet is given up on
+	reliableMaxHeld        = 256                     //The maximum amount of out-of-order packets to hold per channel
+	ReliableTickRate       = time.Millisecond * 50   //How often to check for reliable packets that need to be retransmitted
+)
+
+//Reliability holds the reliable delivery state of every channel for a client
+type Reliability struct {
+	sync.Mutex
+
+	channels map[int]*reliableChannel
+}
+
+//reliableChannel holds the reliable delivery state of a single channel
+type reliableChannel struct {
+	nextSend uint32                     //The next sequence number to send on this channel
+	pending  map[uint32]*reliablePacket //The sent packets that haven't been acknowledged yet
+	nextRecv uint32                     //The next sequence number expected from the client on this channel
+	held     map[uint32]*Packet         //The received packets that arrived ahead of nextRecv
+}
+
+//reliablePacket holds a sent reliable packet until it's acknowledged
+type reliablePacket struct {
+	data    []byte        //The serialized packet, ready to resend
+	sentAt  time.Time     //The last time the packet was sent
+	timeout time.Duration //How long to wait after sentAt before resending
+	retries int           //How many times the packet was resent
+}
+
+//NewReliability returns a new reliable delivery state
+func NewReliability() *Reliability {
+	return &Reliability{
+		channels: make(map[int]*reliableChannel),
+	}
+}
+
+func (rel *Reliability) channel(channel int) *reliableChannel {
+	relChannel, ok := rel.channels[channel]
+	if !ok {
+		relChannel = &reliableChannel{
+			nextSend: 1,
+			pending:  make(map[uint32]*reliablePacket),
+			nextRecv: 1,
+			held:     make(map[uint32]*Packet),
+		}
+		rel.channels[channel] = relChannel
+	}
+	return relChannel
+}
+
+//Send assigns the next sequence number on the packet's channel, tracks it for retransmission, and returns the bytes to send
+func (rel *Reliability) Send(packet *Packet) []byte {
+	rel.Lock()
+	defer rel.Unlock()
+
+	relChannel := rel.channel(packet.Channel)
+	sequence := relChannel.nextSend
+	relChannel.nextSend++
+	if relChannel.nextSend == 0 { //0 is reserved for unreliable packets
+		relChannel.nextSend = 1
+	}
+
+	data := packet.AsSequencedBytes(sequence)
+	relChannel.pending[sequence] = &reliablePacket{
+		data:    data,
+		sentAt:  time.Now(),
+		timeout: reliableInitialTimeout,
+	}
+	return data
+}
+
+//Ack marks the specified sequence number on a channel as delivered
+func (rel *Reliability) Ack(channel int, sequence uint32) {
+	rel.Lock()
+	defer rel.Unlock()
+
+	delete(rel.channel(channel).pending, sequence)
+}
+
+//Resend returns every pending packet whose retransmission timeout has passed, and fails once a packet runs out of retries
+//A failed channel can never deliver in order again, as the client would wait forever for the packet it never got
+func (rel *Reliability) Resend(now time.Time) (resend [][]byte, failed bool) {
+	rel.Lock()
+	defer rel.Unlock()
+
+	for _, relChannel := range rel.channels {
+		for _, pending := range relChannel.pending {
+			if now.Sub(pending.sentAt) < pending.timeout {
+				continue
+			}
+
+			if pending.retries >= reliableMaxRetries {
+				failed = true
+				continue
+			}
+
+			pending.retries++
+			pending.sentAt = now
+			pending.timeout *= 2 //Back off exponentially so a struggling link isn't flooded
+			if pending.timeout > reliableMaxTimeout {
+				pending.timeout = reliableMaxTimeout
+			}
+			resend = append(resend, pending.data)
+		}
+	}
+
+	return
+}
+
+//Receive accepts a sequenced packet from the client and returns every packet on its channel that's now ready to handle in order
+//It isn't accepted if it arrived too far ahead to be held, and then mustn't be acknowledged, so that it's sent again
+func (rel *Reliability) Receive(packet *Packet) (ready []*Packet, accepted bool) {
+	rel.Lock()
+	defer rel.Unlock()
+
+	relChannel := rel.channel(packet.Channel)
+	if int32(packet.Sequence-relChannel.nextRecv) < 0 {
+		return nil, true //Already handled, the client must have missed our ack
+	}
+	if packet.Sequence != relChannel.nextRecv {
+		if _, ok := relChannel.held[packet.Sequence]; !ok && len(relChannel.held) >= reliableMaxHeld {
+			return nil, false
+		}
+		relChannel.held[packet.Sequence] = packet //Hold on to it until the gap is filled
+		return nil, true
+	}
+
+	ready = []*Packet{packet}
+	relChannel.advanceRecv()
+	for {
+		next, ok := relChannel.held[relChannel.nextRecv]
+		if !ok {
+			break
+		}
+		delete(relChannel.held, relChannel.nextRecv)
+		ready = append(ready, next)
+		relChannel.advanceRecv()
+	}
+
+	return ready, true
+}
+
+func (relChannel *reliableChannel) advanceRecv() {
+	relChannel.nextRecv++
+	if relChannel.nextRecv == 0 { //0 is reserved for unreliable packets
+		relChannel.nextRecv = 1
+	}
+}
+
+//Pending returns how many sent packets are still waiting to be acknowledged
+func (rel *Reliability) Pending() int {
+	rel.Lock()
+	defer rel.Unlock()
+
+	pending := 0
+	for _, relChannel := range rel.channels {
+		pending += len(relChannel.pending)
+	}
+	return pending
+}
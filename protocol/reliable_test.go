@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+//sequenced returns a packet received on the channel with the sequence number
+func sequenced(channel int, sequence uint32) *Packet {
+	packet := NewPacket(PacketTypePlayerTalked, channel, 0)
+	packet.Sequence = sequence
+	return packet
+}
+
+func TestReliabilityReceiveInOrder(t *testing.T) {
+	rel := NewReliability()
+
+	if ready, accepted := rel.Receive(sequenced(3, 2)); !accepted || len(ready) != 0 {
+		t.Fatalf("packet ahead of the channel was handled or not held: %d ready, accepted=%t", len(ready), accepted)
+	}
+	ready, accepted := rel.Receive(sequenced(3, 1))
+	if !accepted || len(ready) != 2 || ready[0].Sequence != 1 || ready[1].Sequence != 2 {
+		t.Fatalf("filling the gap readied %d packets, accepted=%t", len(ready), accepted)
+	}
+	if ready, accepted := rel.Receive(sequenced(3, 1)); !accepted || len(ready) != 0 {
+		t.Fatalf("duplicate was handled again or not acknowledged: %d ready, accepted=%t", len(ready), accepted)
+	}
+}
+
+func TestReliabilityRefusesWhatItCantHold(t *testing.T) {
+	rel := NewReliability()
+
+	for sequence := uint32(2); sequence < reliableMaxHeld+2; sequence++ {
+		if _, accepted := rel.Receive(sequenced(3, sequence)); !accepted {
+			t.Fatalf("packet %d was refused with room to hold it", sequence)
+		}
+	}
+	if _, accepted := rel.Receive(sequenced(3, reliableMaxHeld+2)); accepted {
+		t.Fatal("packet was accepted with no room to hold it, so it would be acknowledged and never sent again")
+	}
+	if _, accepted := rel.Receive(sequenced(3, 2)); !accepted {
+		t.Fatal("packet that's already held was refused")
+	}
+	if _, accepted := rel.Receive(sequenced(4, 2)); !accepted {
+		t.Fatal("another channel was refused for this channel's held packets")
+	}
+
+	ready, _ := rel.Receive(sequenced(3, 1))
+	if len(ready) != reliableMaxHeld+1 {
+		t.Fatalf("filling the gap readied %d packets, expected %d", len(ready), reliableMaxHeld+1)
+	}
+	if _, accepted := rel.Receive(sequenced(3, reliableMaxHeld+2)); !accepted {
+		t.Fatal("refused packet wasn't accepted when sent again")
+	}
+}
+
+func TestReliabilityFailsAfterRetries(t *testing.T) {
+	rel := NewReliability()
+	rel.Send(NewPacket(PacketTypeMapChange, 1, 0))
+
+	now := time.Now()
+	for retry := 0; retry < reliableMaxRetries; retry++ {
+		now = now.Add(reliableMaxTimeout)
+		resend, failed := rel.Resend(now)
+		if failed || len(resend) != 1 {
+			t.Fatalf("retry %d resent %d packets, failed=%t", retry, len(resend), failed)
+		}
+	}
+
+	now = now.Add(reliableMaxTimeout)
+	if resend, failed := rel.Resend(now); !failed || len(resend) != 0 {
+		t.Fatalf("packet out of retries was resent %d times, failed=%t", len(resend), failed)
+	}
+	if rel.Pending() != 1 {
+		t.Fatal("packet out of retries was forgotten, leaving a gap the client would wait on forever")
+	}
+}
+
+func TestNegotiateExtensions(t *testing.T) {
+	for requested, expected := range map[byte]byte{
+		ExtensionsNone:     ExtensionsNone,
+		ExtensionsSigned:   ExtensionsSigned,
+		ExtensionsReliable: ExtensionsReliable,
+		Extensions + 1:     Extensions,
+	} {
+		if negotiated := NegotiateExtensions(requested); negotiated != expected {
+			t.Errorf("negotiated extensions %d for a client asking for %d, expected %d", negotiated, requested, expected)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+const (
+	SessionTokenSize = 16 //The size of a session token in bytes
+)
+
+//SignPacket returns the session signature of a serialized packet, which is a truncated HMAC-SHA256 keyed by the session token
+func SignPacket(token, signed []byte) []byte {
+	mac := hmac.New(sha256.New, token)
+	mac.Write(signed)
+	return mac.Sum(nil)[:macSize]
+}
+
+//Verify returns true if the packet was signed with the specified session token
+func (packet *Packet) Verify(token []byte) bool {
+	if len(token) == 0 || packet.MAC == nil {
+		return false
+	}
+	return hmac.Equal(packet.MAC, SignPacket(token, packet.signed))
+}
+
+//AsSignedBytes returns a Stick Fight network packet serialized as bytes with the specified reliable sequence number, or none if 0, and signed with the session token
+func (packet *Packet) AsSignedBytes(sequence uint32, token []byte) []byte {
+	unsigned := packet.AsSequencedBytes(sequence)
+	macStart := len(unsigned) - 1 //The signature goes directly after the Steam ID, so before the sequence number and the channel
+	if sequence != 0 {
+		macStart -= seqSize
+	}
+
+	signed := append([]byte{}, unsigned...)
+	signed[len(signed)-1] |= channelFlagSigned
+
+	data := make([]byte, 0, len(signed)+macSize)
+	data = append(data, signed[:macStart]...)
+	data = append(data, SignPacket(token, signed)...)
+	data = append(data, signed[macStart:]...)
+	return data
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"regexp"
+	"sync"
+	"unicode"
+
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	//LookupUsername looks up the username of a Steam ID when it isn't cached yet, or returns an empty string if it can't
+	//It's nil by default, so that nothing reaches out to Steam unless it's asked to
+	LookupUsername func(steamID uint64) string
+
+	steamUsernames     = make(map[uint64]string)
+	steamUsernamesLock sync.RWMutex
+	stripTags          = bluemonday.StrictPolicy()
+)
+
+//CSteamID holds a Steam client ID and its username
+type CSteamID struct {
+	ID           uint64
+	Username     string
+	NormUsername string
+}
+
+//NewCSteamID returns a new Steam client ID
+func NewCSteamID(steamID uint64) CSteamID {
+	clientID := CSteamID{
+		ID: steamID,
+	}
+
+	return clientID
+}
+
+//GetUsername returns the username of the CSteamID and caches it in memory
+func (cSteamID CSteamID) GetUsername() string {
+	if cSteamID.Username != "" {
+		return cSteamID.Username
+	}
+
+	steamUsernamesLock.RLock()
+	steamUsername, ok := steamUsernames[cSteamID.ID]
+	steamUsernamesLock.RUnlock()
+	if ok {
+		cSteamID.Username = steamUsername
+		return steamUsername
+	}
+
+	if LookupUsername == nil {
+		return ""
+	}
+	steamUsername = LookupUsername(cSteamID.ID)
+	if steamUsername == "" {
+		return ""
+	}
+
+	steamUsernamesLock.Lock()
+	steamUsernames[cSteamID.ID] = steamUsername
+	steamUsernamesLock.Unlock()
+	cSteamID.Username = steamUsername
+	return cSteamID.Username
+}
+
+//GetNormalizedUsername returns a normalized version of the username of the CSteamID and caches it in memory
+func (cSteamID CSteamID) GetNormalizedUsername() string {
+	if cSteamID.NormUsername != "" {
+		return cSteamID.NormUsername
+	}
+
+	username := cSteamID.GetUsername()
+	username = regexp.MustCompile(`<.*?>`).ReplaceAllString(username, "")
+	username = regexp.MustCompile(`[^a-zA-Z0-9]+`).ReplaceAllString(username, "")
+	username = stripTags.Sanitize(username)
+
+	bytes := make([]byte, len(username))
+	normalize := transform.Chain(norm.NFD, transform.RemoveFunc(func(r rune) bool {
+		return unicode.Is(unicode.Mn, r)
+	}), norm.NFC)
+	_, _, err := normalize.Transform(bytes, []byte(username), true)
+	if err != nil {
+		return username
+	}
+
+	username = string(bytes)
+	cSteamID.NormUsername = username
+	return cSteamID.NormUsername
+}
+
+//CompareCSteamID evaluates if a CSteamID is the same as another
+func (cSteamID CSteamID) CompareCSteamID(compareSteamID CSteamID) bool {
+	return cSteamID.ID == compareSteamID.ID
+}
+
+//CompareSteamID evaluates if a CSteamID matches a SteamID
+func (cSteamID CSteamID) CompareSteamID(steamID uint64) bool {
+	return cSteamID.ID == steamID
+}
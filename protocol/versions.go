@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	crunch "github.com/superwhiskers/crunch/v3"
+)
+
+//Dialect is how a protocol version of Stick Fight lays out its packets, which is translated to and from the packet types and layouts
+//of Version as packets arrive and leave, so the server only ever has to understand Version
+type Dialect struct {
+	Version    byte                      //The protocol version clients send in their clientRequestingIndex
+	Name       string                    //The game release that speaks it
+	Compatible []byte                    //The other versions whose clients can share a lobby with this version's clients
+	Types      map[PacketType]PacketType //The packet type IDs this version sends in place of Version's, only for those that differ
+	Layouts    map[PacketType]Layout     //The data layouts this version uses in place of Version's, by Version's packet type, only for those that differ
+
+	fromWire map[PacketType]PacketType //Types reversed
+}
+
+//Layout is how a protocol version lays out the data of a packet type differently to Version
+type Layout interface {
+	Marshal(msg Message) ([]byte, error)      //Encodes a message in this version's layout
+	Unmarshal(data []byte, msg Message) error //Decodes a message from this version's layout
+}
+
+//handshakeTypes are the packet types sent before a client's protocol version is known, so every version must keep their type IDs and
+//layouts. A rejecting clientInit may be sent before too, so it's always in Version's layout, but only its type ID has to be kept
+var handshakeTypes = map[PacketType]bool{
+	PacketTypeAck:                       true,
+	PacketTypePing:                      true,
+	PacketTypePingResponse:              true,
+	PacketTypeClientRequestingAccepting: true,
+	PacketTypeClientAccepted:            true,
+	PacketTypeClientRequestingIndex:     true,
+	PacketTypeClientInit:                true,
+}
+
+var (
+	dialects     = make(map[byte]*Dialect) //Every supported protocol version
+	dialectsLock sync.RWMutex
+)
+
+func init() {
+	if err := RegisterDialect(&Dialect{Version: Version, Name: "Stick Fight v25"}); err != nil {
+		panic(err)
+	}
+}
+
+//RegisterDialect adds support for a protocol version, replacing any dialect already registered for it
+func RegisterDialect(dialect *Dialect) error {
+	fromWire := make(map[PacketType]PacketType)
+	for packetType, wireType := range dialect.Types {
+		if handshakeTypes[packetType] || handshakeTypes[wireType] {
+			return fmt.Errorf("protocol version %d can't change the type ID of %s to %d, as it's needed before the version is known", dialect.Version, packetType, wireType)
+		}
+		if _, ok := fromWire[wireType]; ok {
+			return fmt.Errorf("protocol version %d uses type ID %d for more than one packet type", dialect.Version, wireType)
+		}
+		fromWire[wireType] = packetType
+	}
+	for packetType := range dialect.Layouts {
+		if handshakeTypes[packetType] && packetType != PacketTypeClientInit {
+			return fmt.Errorf("protocol version %d can't change the layout of %s, as it's needed before the version is known", dialect.Version, packetType)
+		}
+	}
+	dialect.fromWire = fromWire
+
+	dialectsLock.Lock()
+	defer dialectsLock.Unlock()
+	dialects[dialect.Version] = dialect
+	return nil
+}
+
+//LookupDialect returns the dialect of a protocol version, and false if it isn't supported
+func LookupDialect(version byte) (*Dialect, bool) {
+	dialectsLock.RLock()
+	defer dialectsLock.RUnlock()
+	dialect, ok := dialects[version]
+	return dialect, ok
+}
+
+//Versions returns every supported protocol version in ascending order
+func Versions() []int {
+	dialectsLock.RLock()
+	defer dialectsLock.RUnlock()
+
+	versions := make([]int, 0, len(dialects))
+	for version := range dialects {
+		versions = append(versions, int(version))
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+func (dialect *Dialect) String() string {
+	if dialect == nil {
+		return fmt.Sprintf("protocol version %d", Version)
+	}
+	return fmt.Sprintf("protocol version %d (%s)", dialect.Version, dialect.Name)
+}
+
+//CompatibleWith returns true if clients of both dialects can share a lobby, where a nil dialect is Version's
+func (dialect *Dialect) CompatibleWith(other *Dialect) bool {
+	if dialect.version() == other.version() {
+		return true
+	}
+	if dialect != nil {
+		for _, version := range dialect.Compatible {
+			if version == other.version() {
+				return true
+			}
+		}
+	}
+	if other != nil {
+		for _, version := range other.Compatible {
+			if version == dialect.version() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (dialect *Dialect) version() byte {
+	if dialect == nil {
+		return Version
+	}
+	return dialect.Version
+}
+
+//ToWire returns a packet as this dialect sends it, which is the packet itself if the dialect doesn't change it
+func (dialect *Dialect) ToWire(packet *Packet) (*Packet, error) {
+	if dialect == nil {
+		return packet, nil
+	}
+
+	wireType, retyped := dialect.Types[packet.Type]
+	if !retyped {
+		wireType = packet.Type
+	}
+	layout, relaid := dialect.Layouts[packet.Type]
+	if !relaid || (packet.Type == PacketTypeClientInit && !isAccepted(packet)) {
+		if !retyped {
+			return packet, nil
+		}
+		return packet.retyped(wireType, packet.Bytes()), nil
+	}
+
+	msg := NewMessage(packet.Type)
+	if err := packet.Decode(msg); err != nil {
+		return nil, err
+	}
+	data, err := layout.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%s for protocol version %d: %w", packet.Type, dialect.Version, err)
+	}
+	return packet.retyped(wireType, data), nil
+}
+
+//FromWire translates a packet as this dialect sent it into Version's packet type and layout
+func (dialect *Dialect) FromWire(packet *Packet) error {
+	if dialect == nil {
+		return nil
+	}
+
+	if packetType, ok := dialect.fromWire[packet.Type]; ok {
+		packet.Type = packetType
+	} else if _, ok := dialect.Types[packet.Type]; ok {
+		return fmt.Errorf("protocol version %d doesn't use type ID %d for %s", dialect.Version, packet.Type, packet.Type)
+	}
+
+	layout, ok := dialect.Layouts[packet.Type]
+	if !ok {
+		return nil
+	}
+	msg := NewMessage(packet.Type)
+	if err := layout.Unmarshal(packet.Bytes(), msg); err != nil {
+		return fmt.Errorf("%s from protocol version %d: %w", packet.Type, dialect.Version, err)
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		return fmt.Errorf("%s from protocol version %d: %w", packet.Type, dialect.Version, err)
+	}
+	packet.Buffer = crunch.NewBuffer(data) //The signature is still checked against the packet as it was sent
+	return nil
+}
+
+//retyped returns a copy of the packet with a different type and data
+func (packet *Packet) retyped(packetType PacketType, data []byte) *Packet {
+	clone := NewPacket(packetType, packet.Channel, packet.SteamID.ID)
+	clone.Timestamp = packet.Timestamp
+	clone.Src = packet.Src
+	clone.Sequence = packet.Sequence
+	if len(data) > 0 {
+		clone.Grow(int64(len(data)))
+		clone.WriteBytesNext(data)
+	}
+	return clone
+}
+
+//isAccepted returns true if a clientInit packet accepts its client, rather than rejecting it in Version's layout
+func isAccepted(packet *Packet) bool {
+	data := packet.Bytes()
+	return len(data) > 0 && data[0] == 1
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+var (
+	errProxyClosed = errors.New("proxy closed")
+)
+
+//proxyCommand forwards clients to an upstream server until interrupted, and returns the exit code
+func proxyCommand(args []string) int {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := flags.String("listen", ":1338", "The IP and port for clients to connect to")
+	upstream := flags.String("upstream", "", "The IP and port of the server to forward clients to")
+	rules := make(proxyRules, 0)
+	flags.Var(&rules, "rule", "A rule for packets on the way, as \"in|out|both type drop\" or \"in|out|both type set Field=value\", where in is from clients (repeatable)")
+	quiet := flags.Bool("quiet", false, "Don't write the packets passing through")
+	types := flags.String("type", "", "The comma-separated packet types to write, by name or number")
+	channels := flags.String("channel", "", "The comma-separated channels to write")
+	steamID := flags.Uint64("steamID", 0, "Only write packets carrying this Steam ID, or sent to or received from its client")
+	raw := flags.Bool("raw", false, "Also write the raw data of every packet")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: proxy -upstream host:port [-listen :1338] [-rule \"out clientInit set Maps=1\"]... [-quiet] [-type types] [-channel channels] [-steamID id] [-raw]")
+		fmt.Fprintln(flags.Output(), "Forwards clients to an upstream server, decoding both directions, applying rules to them and capturing them into -captureDir if it's set.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *upstream == "" || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	filter, err := newDumpFilter(*types, *channels, *steamID)
+	if err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		return 2
+	}
+	upstreamAddr, err := net.ResolveUDPAddr("udp", *upstream)
+	if err != nil {
+		log.Error("Unable to resolve upstream server ", *upstream, ": ", err)
+		return 2
+	}
+	listenAddr, err := net.ResolveUDPAddr("udp", *listen)
+	if err != nil {
+		log.Error("Unable to resolve listening address ", *listen, ": ", err)
+		return 2
+	}
+	sock, err := ListenUDP(listenAddr)
+	if err != nil {
+		log.Error("Unable to listen on ", listenAddr, ": ", err)
+		return 2
+	}
+
+	proxy := NewProxy(sock, upstreamAddr, func() (Transport, error) {
+		return ListenUDP(&net.UDPAddr{})
+	})
+	proxy.Rules = rules
+	if !*quiet {
+		proxy.Dump = &dumper{w: os.Stdout, filter: filter, raw: *raw}
+	}
+	if captureDir != "" {
+		capture, err := NewCapture(captureDir, &CaptureHeader{Start: time.Now(), RoomCode: "proxy"})
+		if err != nil {
+			log.Error("Unable to capture the proxy: ", err)
+			return 2
+		}
+		log.Info("Capturing into ", capture.Path)
+		proxy.Capture = capture
+		defer capture.Close()
+	}
+
+	go func() {
+		sc := make(chan os.Signal, 1)
+		signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sc
+		log.Trace(sig, " received!")
+		proxy.Close()
+	}()
+
+	log.Info("Proxying ", sock.LocalAddr(), " to ", upstreamAddr, " with ", len(rules), " rules")
+	if err := proxy.Run(); err != nil {
+		log.Error(err)
+		return 1
+	}
+	log.Info("Good-bye!")
+	return 0
+}
+
+//ProxyRule drops or rewrites every packet of a type travelling in a direction through a proxy
+type ProxyRule struct {
+	Inbound  bool //Applies to packets from clients to the upstream server
+	Outbound bool //Applies to packets from the upstream server to clients
+	Type     PacketType
+	Drop     bool
+	Field    string //The field of the packet type's message to set, if not dropping
+	Value    string //The value to set the field to, parsed by the field's type
+
+	text string
+}
+
+//ParseProxyRule parses a rule written as "in|out|both type drop" or "in|out|both type set Field=value"
+func ParseProxyRule(text string) (*ProxyRule, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("rule %q isn't \"in|out|both type drop\" or \"in|out|both type set Field=value\"", text)
+	}
+
+	rule := &ProxyRule{text: strings.Join(fields, " ")}
+	switch fields[0] {
+	case "in":
+		rule.Inbound = true
+	case "out":
+		rule.Outbound = true
+	case "both":
+		rule.Inbound, rule.Outbound = true, true
+	default:
+		return nil, fmt.Errorf("rule %q has unknown direction %q", text, fields[0])
+	}
+
+	packetType, ok := protocol.ParsePacketType(fields[1])
+	if !ok {
+		return nil, fmt.Errorf("rule %q has unknown packet type %q", text, fields[1])
+	}
+	rule.Type = packetType
+
+	switch {
+	case fields[2] == "drop" && len(fields) == 3:
+		rule.Drop = true
+	case fields[2] == "set" && len(fields) >= 4 && strings.Contains(fields[3], "="):
+		assignment := strings.SplitN(strings.Join(fields[3:], " "), "=", 2) //A string value may have spaces in it
+		rule.Field, rule.Value = assignment[0], assignment[1]
+		if err := rule.Apply(protocol.NewMessage(packetType)); err != nil { //Catch a bad field or value now rather than on the first packet
+			return nil, fmt.Errorf("rule %q: %v", text, err)
+		}
+	default:
+		return nil, fmt.Errorf("rule %q has unknown action %q", text, strings.Join(fields[2:], " "))
+	}
+
+	return rule, nil
+}
+
+func (rule *ProxyRule) String() string {
+	return rule.text
+}
+
+//Matches returns true if the rule applies to a packet travelling in a direction
+func (rule *ProxyRule) Matches(packet *Packet, direction CaptureDirection) bool {
+	if packet.Type != rule.Type {
+		return false
+	}
+	return (direction == CaptureInbound && rule.Inbound) || (direction == CaptureOutbound && rule.Outbound)
+}
+
+//Apply sets the rule's field on a decoded message
+func (rule *ProxyRule) Apply(msg protocol.Message) error {
+	v := reflect.ValueOf(msg).Elem()
+	field := v.FieldByNameFunc(func(name string) bool {
+		return strings.EqualFold(name, rule.Field)
+	})
+	if !field.IsValid() || strings.EqualFold(rule.Field, "PacketType") {
+		return fmt.Errorf("%s has no field %s", msg.Type(), rule.Field)
+	}
+
+	var value interface{}
+	var err error
+	switch field.Kind() {
+	case reflect.Bool:
+		value, err = strconv.ParseBool(rule.Value)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value, err = strconv.ParseInt(rule.Value, 0, field.Type().Bits())
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		value, err = strconv.ParseUint(rule.Value, 0, field.Type().Bits())
+	case reflect.Float32, reflect.Float64:
+		value, err = strconv.ParseFloat(rule.Value, field.Type().Bits())
+	case reflect.String:
+		value = rule.Value
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("%s.%s can't be set by a rule", msg.Type(), rule.Field)
+		}
+		value, err = parseHexDump(rule.Value)
+	default:
+		return fmt.Errorf("%s.%s can't be set by a rule", msg.Type(), rule.Field)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for %s.%s: %v", msg.Type(), rule.Field, err)
+	}
+
+	field.Set(reflect.ValueOf(value).Convert(field.Type()))
+	return nil
+}
+
+//proxyRules is a repeatable command-line flag of proxy rules
+type proxyRules []*ProxyRule
+
+func (rules *proxyRules) String() string {
+	texts := make([]string, len(*rules))
+	for i, rule := range *rules {
+		texts[i] = rule.String()
+	}
+	return strings.Join(texts, ", ")
+}
+
+func (rules *proxyRules) Set(text string) error {
+	rule, err := ParseProxyRule(text)
+	if err != nil {
+		return err
+	}
+	*rules = append(*rules, rule)
+	return nil
+}
+
+//Proxy forwards the packets of game clients to an upstream server and back, writing, capturing and applying rules to them on the way
+type Proxy struct {
+	Listen   Transport    //Where clients send their packets
+	Upstream *net.UDPAddr //The server to forward them to
+	Rules    []*ProxyRule //Applied in order to every packet, until one drops it
+	Dump     *dumper      //Writes every packet, nil to not write them
+	Capture  *Capture     //Records every packet as it arrived, before any rules, nil to not capture them
+
+	dial      func() (Transport, error) //Opens a socket to talk to the upstream server from, one per client so the server can tell them apart
+	lock      sync.Mutex
+	sessions  map[addrKey]*proxySession
+	dumpLock  sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+//proxySession is a client being forwarded through its own socket to the upstream server
+type proxySession struct {
+	sync.Mutex
+
+	Client   *net.UDPAddr
+	Upstream Transport
+
+	steamID  uint64    //Learned from the client's clientRequestingIndex
+	token    []byte    //Learned from the server's clientAccepted, to sign the client's rewritten packets with
+	lastSeen time.Time //When a packet last passed through in either direction
+}
+
+//NewProxy returns a proxy that forwards the clients of a transport to an upstream server, through sockets opened by dial
+func NewProxy(listen Transport, upstream *net.UDPAddr, dial func() (Transport, error)) *Proxy {
+	return &Proxy{
+		Listen:   listen,
+		Upstream: upstream,
+		Rules:    make([]*ProxyRule, 0),
+		dial:     dial,
+		sessions: make(map[addrKey]*proxySession),
+		closed:   make(chan struct{}),
+	}
+}
+
+//Run forwards packets until the proxy is closed
+func (proxy *Proxy) Run() error {
+	go proxy.expireSessions()
+
+	buffer := make([]byte, maxBufferSize)
+	for {
+		n, addr, err := proxy.Listen.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-proxy.closed:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		session, err := proxy.session(addr)
+		if err == errProxyClosed {
+			return nil
+		}
+		if err != nil {
+			log.Error("Unable to forward ", addr, ": ", err)
+			continue
+		}
+		if data := proxy.Forward(session, CaptureInbound, buffer[:n]); data != nil {
+			session.Upstream.WriteToUDP(data, proxy.Upstream)
+		}
+	}
+}
+
+//session returns the session of a client, opening a new one if it's the client's first packet
+func (proxy *Proxy) session(addr *net.UDPAddr) (*proxySession, error) {
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+
+	if session, ok := proxy.sessions[newAddrKey(addr)]; ok {
+		return session, nil
+	}
+	select {
+	case <-proxy.closed:
+		return nil, errProxyClosed //Don't open a socket that nothing will close
+	default:
+	}
+
+	upstream, err := proxy.dial()
+	if err != nil {
+		return nil, err
+	}
+	session := &proxySession{Client: addr, Upstream: upstream, lastSeen: time.Now()}
+	proxy.sessions[newAddrKey(addr)] = session
+	log.Info("Forwarding ", addr, " through ", upstream.LocalAddr())
+
+	go proxy.readUpstream(session)
+	return session, nil
+}
+
+//readUpstream forwards the upstream server's packets to a client until its session is closed
+func (proxy *Proxy) readUpstream(session *proxySession) {
+	buffer := make([]byte, maxBufferSize)
+	for {
+		n, addr, err := session.Upstream.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(proxy.Upstream.IP) || addr.Port != proxy.Upstream.Port {
+			continue //Only the upstream server gets to talk to the client
+		}
+
+		if data := proxy.Forward(session, CaptureOutbound, buffer[:n]); data != nil {
+			proxy.Listen.WriteToUDP(data, session.Client)
+		}
+	}
+}
+
+//expireSessions closes the sessions of clients that went silent for longer than the client timeout, until the proxy is closed
+func (proxy *Proxy) expireSessions() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-proxy.closed:
+			return
+		case now := <-ticker.C:
+			proxy.lock.Lock()
+			for key, session := range proxy.sessions {
+				session.Lock()
+				idle := now.Sub(session.lastSeen)
+				session.Unlock()
+				if idle > time.Duration(clientTimeout)*time.Second {
+					log.Info("Stopped forwarding ", session.Client, " after ", idle.Round(time.Second), " of silence")
+					session.Upstream.Close()
+					delete(proxy.sessions, key)
+				}
+			}
+			proxy.lock.Unlock()
+		}
+	}
+}
+
+//Forward captures, writes and applies the rules to a packet travelling in a direction, and returns what to pass on, or nil to drop it
+func (proxy *Proxy) Forward(session *proxySession, direction CaptureDirection, data []byte) []byte {
+	proxy.Capture.Record(direction, session.Client, data, nil)
+
+	session.Lock()
+	session.lastSeen = time.Now()
+	session.Unlock()
+
+	prefix := fmt.Sprintf("%s %-3s %-21s", time.Now().Format("15:04:05.000"), direction, session.Client)
+	packet, err := protocol.NewPacketFromBytes(data)
+	if err != nil {
+		proxy.write(func(dump *dumper) {
+			dump.Malformed(prefix, data, err)
+		})
+		return data //It's not up to the proxy to decide what's malformed
+	}
+	session.learn(packet, direction)
+
+	forward, notes := proxy.applyRules(session, direction, packet, data)
+	proxy.write(func(dump *dumper) {
+		if dump.Packet(prefix, packet, session.SteamID()) {
+			for _, note := range notes {
+				fmt.Fprintf(dump.w, "    Proxy: %s\n", note)
+			}
+		}
+	})
+	return forward
+}
+
+//write writes to the proxy's dumper one packet at a time, if it has one
+func (proxy *Proxy) write(f func(dump *dumper)) {
+	if proxy.Dump == nil {
+		return
+	}
+
+	proxy.dumpLock.Lock()
+	defer proxy.dumpLock.Unlock()
+	f(proxy.Dump)
+}
+
+//applyRules applies every matching rule to a packet, and returns what to pass on, or nil to drop it, with a note for each rule applied
+func (proxy *Proxy) applyRules(session *proxySession, direction CaptureDirection, packet *Packet, data []byte) ([]byte, []string) {
+	notes := make([]string, 0)
+	var msg protocol.Message
+	for _, rule := range proxy.Rules {
+		if !rule.Matches(packet, direction) {
+			continue
+		}
+		if rule.Drop {
+			return nil, append(notes, fmt.Sprintf("dropped by %q", rule))
+		}
+
+		if msg == nil {
+			msg = protocol.NewMessage(packet.Type)
+			if err := packet.Decode(msg); err != nil {
+				return data, append(notes, fmt.Sprintf("not rewritten by %q, as it's malformed: %v", rule, err))
+			}
+		}
+		if err := rule.Apply(msg); err != nil {
+			notes = append(notes, fmt.Sprintf("not rewritten by %q: %v", rule, err))
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("rewritten by %q", rule))
+	}
+	if msg == nil {
+		return data, notes
+	}
+
+	rewritten, err := NewPacketFromMessage(msg, packet.Channel, packet.SteamID.ID)
+	if err != nil {
+		return data, append(notes, fmt.Sprintf("passed on as it was, as the rewrite doesn't fit: %v", err))
+	}
+	rewritten.Timestamp = packet.Timestamp
+	if packet.MAC == nil {
+		return rewritten.AsSequencedBytes(packet.Sequence), notes
+	}
+
+	//The client signed the packet, so the rewrite needs signing too, which can only be done if the proxy saw its session token
+	token := session.Token()
+	if token == nil {
+		return data, append(notes, "passed on as it was, as the client's session token is unknown to sign the rewrite with")
+	}
+	return rewritten.AsSignedBytes(packet.Sequence, token), notes
+}
+
+//learn picks up the client's Steam ID and session token as they pass through
+func (session *proxySession) learn(packet *Packet, direction CaptureDirection) {
+	switch {
+	case direction == CaptureInbound && packet.Type == packetTypeClientRequestingIndex:
+		request := &protocol.ClientRequestingIndex{}
+		if packet.Decode(request) == nil {
+			session.Lock()
+			session.steamID = request.SteamID
+			session.Unlock()
+		}
+	case direction == CaptureOutbound && packet.Type == packetTypeClientAccepted:
+		accepted := &protocol.ClientAccepted{}
+		if packet.Decode(accepted) == nil {
+			session.Lock()
+			session.token = accepted.Token
+			session.Unlock()
+		}
+	}
+}
+
+//SteamID returns the client's Steam ID, or 0 if it hasn't asked to join yet
+func (session *proxySession) SteamID() uint64 {
+	session.Lock()
+	defer session.Unlock()
+	return session.steamID
+}
+
+//Token returns the client's session token, or nil if it hasn't been accepted yet
+func (session *proxySession) Token() []byte {
+	session.Lock()
+	defer session.Unlock()
+	return session.token
+}
+
+//Close stops forwarding packets and closes every socket
+func (proxy *Proxy) Close() {
+	proxy.closeOnce.Do(func() {
+		close(proxy.closed)
+		proxy.Listen.Close()
+
+		proxy.lock.Lock()
+		defer proxy.lock.Unlock()
+		for key, session := range proxy.sessions {
+			session.Upstream.Close()
+			delete(proxy.sessions, key)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyRewritesSignedPackets(t *testing.T) {
+	ts := newTestServer(t)
+	sock, err := ts.network.Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1338})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewProxy(sock, ts.addr, func() (Transport, error) {
+		return ts.network.Listen(nil)
+	})
+	for _, text := range []string{"in playerTalked set Message=/code", "out clientJoined drop"} {
+		rule, err := ParseProxyRule(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.Rules = append(proxy.Rules, rule)
+	}
+	out := &bytes.Buffer{}
+	proxy.Dump = &dumper{w: out, filter: &dumpFilter{Types: map[PacketType]bool{packetTypePlayerTalked: true}}}
+	go proxy.Run()
+	defer proxy.Close()
+
+	//Clients of the proxy are clients of the server behind it, and what they say gets rewritten and signed again on the way
+	viaProxy := &testServer{Server: ts.Server, t: t, network: ts.network, addr: sock.addr}
+	host := viaProxy.Join(76561190000000001)
+	host.Say("hello")
+	host.ExpectChat(host.PlayerIndex, "Room code: ")
+
+	proxy.Close()
+	proxy.dumpLock.Lock()
+	defer proxy.dumpLock.Unlock()
+	if !strings.Contains(out.String(), "Message: \"hello\"\n    Proxy: rewritten by \"in playerTalked set Message=/code\"") {
+		t.Fatalf("proxy didn't write the rewritten packet:\n%s", out)
+	}
+}
+
+func TestParseProxyRule(t *testing.T) {
+	for _, text := range []string{
+		"in playerUpdate set YValue=156",
+		"out clientInit set Maps=1",
+		"both 20 drop",
+		"in playerTalked set Message=hello there",
+	} {
+		if _, err := ParseProxyRule(text); err != nil {
+			t.Errorf("rule %q didn't parse: %v", text, err)
+		}
+	}
+
+	for _, text := range []string{
+		"sideways playerUpdate drop",
+		"in notAPacket drop",
+		"in playerUpdate set NotAField=1",
+		"in playerUpdate set YValue=256",
+		"in playerUpdate set PacketType=1",
+		"in playerUpdate explode",
+	} {
+		if _, err := ParseProxyRule(text); err == nil {
+			t.Errorf("rule %q parsed", text)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+//lockedSource is a source of random numbers that's safe to share between goroutines, as every lobby's event loop and packet handler does
+type lockedSource struct {
+	sync.Mutex
+	source rand.Source64
+}
+
+//NewRandomizer returns random numbers from the seed that are safe to share between goroutines
+func NewRandomizer(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{source: rand.NewSource(seed).(rand.Source64)})
+}
+
+func (src *lockedSource) Int63() int64 {
+	src.Lock()
+	defer src.Unlock()
+	return src.source.Int63()
+}
+
+func (src *lockedSource) Uint64() uint64 {
+	src.Lock()
+	defer src.Unlock()
+	return src.source.Uint64()
+}
+
+func (src *lockedSource) Seed(seed int64) {
+	src.Lock()
+	defer src.Unlock()
+	src.source.Seed(seed)
+}
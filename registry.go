@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+)
+
+//addrKey is a comparable form of a UDP address, so that looking one up doesn't need to format it as a string
+type addrKey struct {
+	IP   [16]byte //The IP address, with IPv4 addresses in their IPv4-in-IPv6 form
+	Port int      //The port
+	Zone string   //The IPv6 zone, if any
+}
+
+//newAddrKey returns the comparable form of a UDP address
+func newAddrKey(addr *net.UDPAddr) addrKey {
+	key := addrKey{Port: addr.Port, Zone: addr.Zone}
+	copy(key.IP[:], addr.IP.To16())
+	return key
+}
+
+//registryEntry is a client or spectator and the lobby it's in
+type registryEntry struct {
+	Lobby   *Lobby  //The lobby the client is in
+	Client  *Client //The client
+	Session []byte  //The client's session, which stays the same across lobbies when it's moved
+}
+
+//Registry is a server-wide index of every client and spectator by address and by SteamID, safe to use from any goroutine
+type Registry struct {
+	sync.RWMutex
+
+	byAddr    map[addrKey]*registryEntry //Every client and spectator by address
+	bySteamID map[uint64]*registryEntry  //Every client and spectator by SteamID
+}
+
+//NewRegistry returns a new, empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		byAddr:    make(map[addrKey]*registryEntry),
+		bySteamID: make(map[uint64]*registryEntry),
+	}
+}
+
+//Add indexes a client that was added to a lobby, replacing a client with the same address or SteamID only if it's from the same session
+//It returns false without indexing anything if either one belongs to another session, which a forged SteamID must never take over
+func (reg *Registry) Add(lobby *Lobby, client *Client) bool {
+	reg.Lock()
+	defer reg.Unlock()
+
+	if client.Addr != nil {
+		if entry, ok := reg.byAddr[newAddrKey(client.Addr)]; ok && entry.Client != client && !bytes.Equal(entry.Session, client.Session) {
+			return false
+		}
+	}
+	if entry, ok := reg.bySteamID[client.SteamID.ID]; ok && entry.Client != client && !bytes.Equal(entry.Session, client.Session) {
+		return false
+	}
+
+	entry := &registryEntry{Lobby: lobby, Client: client, Session: client.Session}
+	if client.Addr != nil {
+		reg.byAddr[newAddrKey(client.Addr)] = entry
+	}
+	reg.bySteamID[client.SteamID.ID] = entry
+	return true
+}
+
+//Remove forgets a client that was removed from its lobby, leaving alone any newer client that replaced it
+//It must be called before the client is closed, which forgets the address and SteamID it's indexed by
+func (reg *Registry) Remove(client *Client) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	if client.Addr != nil {
+		key := newAddrKey(client.Addr)
+		if entry, ok := reg.byAddr[key]; ok && entry.Client == client {
+			delete(reg.byAddr, key)
+		}
+	}
+	if entry, ok := reg.bySteamID[client.SteamID.ID]; ok && entry.Client == client {
+		delete(reg.bySteamID, client.SteamID.ID)
+	}
+}
+
+//Move reindexes a client that's now using a new address
+func (reg *Registry) Move(client *Client, oldAddr *net.UDPAddr) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	entry, ok := reg.bySteamID[client.SteamID.ID]
+	if !ok || entry.Client != client {
+		return
+	}
+
+	if oldAddr != nil {
+		key := newAddrKey(oldAddr)
+		if old, ok := reg.byAddr[key]; ok && old.Client == client {
+			delete(reg.byAddr, key)
+		}
+	}
+	reg.byAddr[newAddrKey(client.Addr)] = entry
+}
+
+//GetByAddr returns the lobby and client using the specified address
+func (reg *Registry) GetByAddr(addr *net.UDPAddr) (*Lobby, *Client) {
+	reg.RLock()
+	defer reg.RUnlock()
+
+	if entry, ok := reg.byAddr[newAddrKey(addr)]; ok {
+		return entry.Lobby, entry.Client
+	}
+	return nil, nil
+}
+
+//GetBySteamID returns the lobby and client with the specified SteamID
+func (reg *Registry) GetBySteamID(steamID uint64) (*Lobby, *Client) {
+	reg.RLock()
+	defer reg.RUnlock()
+
+	if entry, ok := reg.bySteamID[steamID]; ok {
+		return entry.Lobby, entry.Client
+	}
+	return nil, nil
+}
+
+//Clients returns every indexed client and spectator
+func (reg *Registry) Clients() []*Client {
+	reg.RLock()
+	defer reg.RUnlock()
+
+	clients := make([]*Client, 0, len(reg.bySteamID))
+	for _, entry := range reg.bySteamID {
+		clients = append(clients, entry.Client)
+	}
+	return clients
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+const (
+	replayDrain  = 2 * time.Second        //How long to keep listening for the server's responses after the last captured packet is replayed
+	replaySettle = 100 * time.Millisecond //How long to let the server's last packets arrive after it closes
+)
+
+//replayCommand replays every capture file named in its arguments, and returns the exit code: 1 if any diverged, 2 if any couldn't be replayed
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "How many times faster than it was captured to replay a capture")
+	updates := flags.Bool("updates", false, "Also compare playerUpdate packets, which depend on tick timing and rarely match exactly")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: replay [-speed 1] [-updates] capture.sfcap...")
+		fmt.Fprintln(flags.Output(), "Replays the packets each client sent a captured lobby into a fresh server, and shows where its responses diverge from the captured ones.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || *speed <= 0 {
+		flags.Usage()
+		return 2
+	}
+
+	captureDir = "" //Don't capture the replay itself
+	randomizer = NewRandomizer(time.Now().UnixNano())
+	defaultLevels = newLevelsLandfall()
+
+	code := 0
+	for _, path := range flags.Args() {
+		diverged, err := Replay(path, *speed, *updates, os.Stdout)
+		if err != nil {
+			log.Error("Unable to replay ", path, ": ", err)
+			code = 2
+			continue
+		}
+		if diverged && code == 0 {
+			code = 1
+		}
+	}
+	return code
+}
+
+//replayStream is every packet the server sent to a client, as captured or as replayed
+type replayStream struct {
+	Packets []*Packet
+	updates bool            //If playerUpdates are kept
+	seen    map[string]bool //The reliable packets already kept, so resends don't count twice
+}
+
+func newReplayStream(updates bool) *replayStream {
+	return &replayStream{
+		Packets: make([]*Packet, 0),
+		updates: updates,
+		seen:    make(map[string]bool),
+	}
+}
+
+//Add keeps a packet the server sent, unless it's a resend or only depends on timing
+func (stream *replayStream) Add(data []byte) {
+	packet, err := protocol.NewPacketFromBytes(data)
+	if err != nil {
+		return
+	}
+
+	switch packet.Type {
+	case packetTypePing, packetTypePingResponse, packetTypeAck:
+		return //These carry times and sequence numbers, not lobby state
+	case packetTypePlayerUpdate:
+		if !stream.updates {
+			return
+		}
+	}
+
+	if packet.Sequence != 0 {
+		if stream.seen[string(data)] {
+			return
+		}
+		stream.seen[string(data)] = true
+	}
+	stream.Packets = append(stream.Packets, packet)
+}
+
+//replayKey returns what a replayed packet must share with the captured one to be the same, which leaves out when it was sent
+func replayKey(packet *Packet) string {
+	return fmt.Sprintf("%d/%d/%d/%x", packet.Type, packet.Channel, packet.SteamID.ID, packet.Bytes())
+}
+
+//replayClient is a captured client's address on the replay's network, which keeps everything the replayed server sends it
+type replayClient struct {
+	sync.Mutex
+
+	Addr     *net.UDPAddr
+	SteamID  uint64
+	Captured *replayStream
+	Replayed *replayStream
+
+	sock *MemoryTransport
+}
+
+func (client *replayClient) read() {
+	buffer := make([]byte, maxBufferSize)
+	for {
+		n, _, err := client.sock.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		client.Lock()
+		client.Replayed.Add(buffer[:n])
+		client.Unlock()
+	}
+}
+
+//Replay plays the packets each client sent a captured lobby into a fresh lobby at the captured pace, then writes where the packets
+//the fresh lobby sent back diverge from the captured ones, and returns true if they did
+func Replay(path string, speed float64, updates bool, w io.Writer) (bool, error) {
+	reader, err := OpenCapture(path)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	header := reader.Header
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+
+	//The fresh server lives on its own network, where it can talk to the captured addresses
+	network := NewMemoryNetwork()
+	sock, err := network.Listen(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1337}) //A documentation address, so it can't be a captured client's
+	if err != nil {
+		return false, err
+	}
+	srv := NewServer(nil)
+	srv.Transports = []Transport{sock}
+	if err := srv.Start(); err != nil {
+		return false, err
+	}
+	defer srv.Close()
+
+	//Start the lobby like the captured one started, so its choices play out the same
+	startLevel := newLevelFromMap(header.Map)
+	lobbyLevels = []*Level{startLevel}
+	lobby, err := NewLobby(srv, header.RoomCode)
+	if err != nil {
+		return false, err
+	}
+	lobby.Invoke(func() {
+		lobby.Seed = header.Seed
+		lobby.Random = rand.New(rand.NewSource(header.Seed))
+		lobby.CurrentLevel = startLevel
+	})
+	srv.LobbyAdd(lobby)
+
+	clients := make([]*replayClient, 0)
+	clientsByAddr := make(map[addrKey]*replayClient)
+	clientFor := func(addr *net.UDPAddr) (*replayClient, error) {
+		if client, ok := clientsByAddr[newAddrKey(addr)]; ok {
+			return client, nil
+		}
+		clientSock, err := network.Listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		client := &replayClient{
+			Addr:     addr,
+			Captured: newReplayStream(updates),
+			Replayed: newReplayStream(updates),
+			sock:     clientSock,
+		}
+		go client.read()
+		clientsByAddr[newAddrKey(addr)] = client
+		clients = append(clients, client)
+		return client, nil
+	}
+
+	var last time.Duration
+	start := time.Now()
+	for _, record := range records {
+		client, err := clientFor(record.Addr)
+		if err != nil {
+			return false, err
+		}
+		last = record.Time
+
+		if record.Direction == CaptureOutbound {
+			client.Captured.Add(record.Data) //Only the replay goroutine adds to the captured stream
+			continue
+		}
+
+		if wait := time.Duration(float64(record.Time)/speed) - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		packet, err := protocol.NewPacketFromBytes(record.Data)
+		if err != nil {
+			log.Warn("Skipped malformed captured packet from ", record.Addr, ": ", err)
+			continue
+		}
+		packet.Src = record.Addr
+
+		//Run it on the event loop directly rather than through the server's readers, so it's handled in the captured order
+		switch record.Direction {
+		case CaptureJoined:
+			request := &protocol.ClientRequestingIndex{}
+			if packet.Decode(request) == nil {
+				client.SteamID = request.SteamID
+			}
+			lobby.Invoke(func() {
+				if err := lobby.ClientInit(packet, record.Session); err != nil {
+					log.Warn("Captured client ", record.Addr, " couldn't join the replay: ", err)
+				}
+			})
+		case CaptureInbound:
+			lobby.Invoke(func() {
+				if _, joined := lobby.GetClientByAddr(packet.Src); joined != nil {
+					if err := joined.Dialect.FromWire(packet); err != nil { //Captured as the client sent it
+						log.Warn("Skipped malformed captured packet from ", record.Addr, ": ", err)
+						return
+					}
+				}
+				lobby.HandleInbound(packet)
+			})
+		}
+	}
+	time.Sleep(replayDrain)
+
+	//Close the server like the captured one was closed, so a capture that ends with everyone being kicked still matches
+	srv.Close()
+	time.Sleep(replaySettle)
+
+	fmt.Fprintf(w, "Replayed lobby %s captured at %s: %d clients, %d records over %s at %gx speed\n",
+		header.RoomCode, header.Start.Format(time.RFC3339), len(clients), len(records), last.Round(time.Millisecond), speed)
+	diverged := false
+	for _, client := range clients {
+		client.Lock()
+		if replayCompare(w, client) {
+			diverged = true
+		}
+		client.Unlock()
+		client.sock.Close()
+	}
+
+	return diverged, nil
+}
+
+//replayCompare writes how the packets a replayed client received compare to the captured ones, and returns true if they diverged
+func replayCompare(w io.Writer, client *replayClient) bool {
+	name := client.Addr.String()
+	if client.SteamID != 0 {
+		name = fmt.Sprintf("%s (%d)", name, client.SteamID)
+	}
+	captured, replayed := client.Captured.Packets, client.Replayed.Packets
+
+	for i := 0; i < len(captured) && i < len(replayed); i++ {
+		if replayKey(captured[i]) == replayKey(replayed[i]) {
+			continue
+		}
+		fmt.Fprintf(w, "%s: %d captured, %d replayed, diverged at packet %d:\n", name, len(captured), len(replayed), i+1)
+		fmt.Fprintf(w, "  captured: %s\n", captured[i])
+		fmt.Fprintf(w, "  replayed: %s\n", replayed[i])
+		return true
+	}
+
+	switch {
+	case len(captured) > len(replayed):
+		fmt.Fprintf(w, "%s: %d captured, %d replayed, the replay stopped short before:\n", name, len(captured), len(replayed))
+		fmt.Fprintf(w, "  captured: %s\n", captured[len(replayed)])
+		return true
+	case len(replayed) > len(captured):
+		fmt.Fprintf(w, "%s: %d captured, %d replayed, the replay went on with:\n", name, len(captured), len(replayed))
+		fmt.Fprintf(w, "  replayed: %s\n", replayed[len(captured)])
+		return true
+	}
+
+	fmt.Fprintf(w, "%s: %d packets, identical\n", name, len(captured))
+	return false
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
 	"runtime"
+	"sync"
 	"time"
 
 	swearfilter "github.com/JoshuaDoes/gofuckyourself"
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
 )
 
 var (
@@ -18,57 +19,105 @@ var (
 
 //Server holds a Stick Fight dedicated server
 type Server struct {
-	Addr string
+	Addrs     []string //The addresses to serve on
+	HTTPAddrs []string //The addresses to serve the HTTP API on, none to not serve it
 
 	//Session
-	Running bool
-	Sock    *net.UDPConn
-	HTTP    *net.TCPListener
+	Running      bool         //Guarded by RunningLock, as every reader checks it between packets
+	RunningLock  sync.RWMutex
+	ShuttingDown bool //Guarded by RunningLock, if the server is draining its lobbies to shut down, and won't start or join anything new
+	Transports []Transport         //A UDP socket for each address, or whatever else the server was given to send and receive through
+	API        *API               //The HTTP API, served on HTTPAddrs
+	Routes  sync.Map           //The *udpRoute each address last reached us on, by addrKey, when there's more than one socket
 	Lobbies []*Lobby
 	Filter  *swearfilter.SwearFilter
+
+	LobbiesLock sync.RWMutex //Guards Lobbies, which is changed by every lobby's event loop
+	Registry    *Registry    //Every client and spectator in every lobby, by address and by SteamID
+	Impairer    *Impairer    //Simulates bad network links to and from clients, for testing
+	Strikes     *Strikes     //The packets from each address that crashed their handler
+	Metrics     *Metrics     //Counters for Prometheus to scrape
+	Events      *Events      //What happens in every lobby, for anyone watching
+
+	//Session tokens issued by clientAccepted that haven't been claimed yet, by address
+	Sessions     map[addrKey]*pendingSession
+	SessionsLock sync.Mutex
 }
 
 //Status holds server statistics
 type Status struct {
 	Address string `json:"address"`
+	Addresses []string `json:"addresses"`
 	Online bool `json:"online"`
 	Lobbies int `json:"lobbies"`
 	MaxLobbies int `json:"maxLobbies"`
 	Players int `json:"playersOnline"`
+	ProtocolVersions []int `json:"protocolVersions"` //The protocol versions clients can join with
 }
 
-//NewServer returns a new server running on the specified UDP address
-func NewServer(addr string) *Server {
+//NewServer returns a new server that will listen on the specified addresses, unless it's given transports before it starts
+func NewServer(addrs []string) *Server {
 	srv := &Server{
-		Addr:    addr,
-		Lobbies: make([]*Lobby, 0),
-		Filter:  swearfilter.NewSwearFilter(true, swears...),
+		Addrs:    addrs,
+		Lobbies:  make([]*Lobby, 0),
+		Filter:   swearfilter.NewSwearFilter(true, swears...),
+		Sessions: make(map[addrKey]*pendingSession),
+		Registry: NewRegistry(),
+		Impairer: NewImpairer(),
+		Strikes:  NewStrikes(maxStrikes),
+		Metrics:  NewMetrics(),
+		Events:   NewEvents(),
 	}
+	srv.API = NewAPI(srv)
 
 	return srv
 }
 
 //Status returns the current server statistics
 func (srv *Server) Status() *Status {
+	lobbies := srv.GetLobbies()
 	players := 0
-	for i := 0; i < len(srv.Lobbies); i++ {
-		players += srv.Lobbies[i].GetPlayerCount(false)
+	for i := 0; i < len(lobbies); i++ {
+		players += len(lobbies[i].Members().players)
+	}
+
+	address := ""
+	if len(srv.Addrs) > 0 {
+		address = srv.Addrs[0]
 	}
 
 	return &Status{
-		Address: srv.Addr,
-		Online: srv.Running,
-		Lobbies: len(srv.Lobbies),
+		Address: address,
+		Addresses: srv.BoundAddrs(),
+		Online: srv.IsRunning(),
+		Lobbies: len(lobbies),
 		MaxLobbies: maxLobbies,
 		Players: players,
+		ProtocolVersions: protocol.Versions(),
 	}
 }
 
 //IsRunning returns true if the server is currently running
 func (srv *Server) IsRunning() bool {
+	srv.RunningLock.RLock()
+	defer srv.RunningLock.RUnlock()
 	return srv.Running
 }
 
+//SetRunning marks the server as running or not
+func (srv *Server) SetRunning(running bool) {
+	srv.RunningLock.Lock()
+	defer srv.RunningLock.Unlock()
+	srv.Running = running
+}
+
+//IsShuttingDown returns true if the server is draining its lobbies to shut down
+func (srv *Server) IsShuttingDown() bool {
+	srv.RunningLock.RLock()
+	defer srv.RunningLock.RUnlock()
+	return srv.ShuttingDown
+}
+
 //Close closes the server
 func (srv *Server) Close() {
 	if !srv.IsRunning() {
@@ -77,57 +126,69 @@ func (srv *Server) Close() {
 
 	log.Info("Closing server!")
 
-	for _, lobby := range srv.Lobbies {
-		lobby.Close()
+	for _, lobby := range srv.GetLobbies() {
+		lobby.Invoke(func() {
+			lobby.CloseWithReason("server is shutting down")
+		})
 	}
 
-	srv.Sock.Close()
-	srv.HTTP.Close()
-	srv.Running = false
+	srv.SetRunning(false)
+	srv.Impairer.Close() //Anything still held back is dropped, rather than sent after the server's gone
+	for _, sock := range srv.Transports {
+		sock.Close()
+	}
+	srv.Events.Close()
+	srv.API.Close()
 }
 
-//Run starts the server and ticks it until it's closed
-func (srv *Server) Run() {
-	if srv.Running {
-		srv.Close()
+//Shutdown announces the shutdown to every lobby, waits for running matches to end or the drain period to pass, then closes the server
+func (srv *Server) Shutdown(drain time.Duration) {
+	if !srv.IsRunning() {
+		return
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp4", srv.Addr)
-	if err != nil {
-		log.Fatal("Unable to resolve UDP address for udp4 address ", srv.Addr)
-	}
-	log.Trace("Resolved UDP address for udp4 address ", srv.Addr)
+	srv.RunningLock.Lock()
+	srv.ShuttingDown = true
+	srv.RunningLock.Unlock()
+	log.Info("Shutting down once every match ends, or in ", drain, " at most")
 
-	sock, err := net.ListenUDP("udp4", udpAddr)
-	if err != nil {
-		log.Fatal("Unable to listen on UDP address ", udpAddr)
+	for _, lobby := range srv.GetLobbies() {
+		lobby := lobby
+		lobby.Do(func() {
+			lobby.Announce("Server is shutting down\nafter this match, %d seconds max!", int(drain.Seconds()))
+		})
 	}
-	log.Trace("Listening on UDP address ", udpAddr)
-	srv.Sock = sock
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", srv.Addr)
-	if err != nil {
-		log.Fatal("Unable to resolve TCP address for tcp address ", srv.Addr)
+	deadline := time.Now().Add(drain)
+	for time.Now().Before(deadline) && srv.MatchesInProgress() {
+		time.Sleep(time.Second)
 	}
-	log.Trace("Resolved TCP address for tcp address ", srv.Addr)
 
-	httpSock, err := net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		log.Fatal("Unable to listen on TCP address ", tcpAddr)
+	srv.Close()
+}
+
+//MatchesInProgress returns true if any lobby has a match in progress
+func (srv *Server) MatchesInProgress() bool {
+	for _, lobby := range srv.GetLobbies() {
+		if lobby.IsRunning() && lobby.MatchInProgress() {
+			return true
+		}
 	}
-	log.Trace("Listening on TCP address ", tcpAddr)
-	srv.HTTP = httpSock
+	return false
+}
 
-	srv.Running = true
-	log.Info("Server is running!")
+//Run starts the server and ticks it until it's closed
+func (srv *Server) Run() {
+	if srv.IsRunning() {
+		srv.Close()
+	}
 
-	for i := 0; i < runtime.NumCPU(); i++ {
-		go srv.ReadPackets()
+	if err := srv.Start(); err != nil {
+		log.Fatal("Unable to listen on ", srv.Addrs, ": ", err)
 	}
-	go srv.ReadHTTP()
 
-	for srv.Running {
-		if !srv.Running {
+	for srv.IsRunning() {
+		if !srv.IsRunning() {
 			break
 		}
 
@@ -135,12 +196,39 @@ func (srv *Server) Run() {
 	}
 }
 
-//ReadPackets starts reading packets and handles them
-func (srv *Server) ReadPackets() {
+//Start starts serving on the server's transports, listening on its addresses first if it wasn't given any, and returns once it's running
+func (srv *Server) Start() error {
+	if len(srv.Transports) == 0 {
+		if err := srv.Listen(); err != nil {
+			return err
+		}
+	}
+	if err := srv.API.Listen(srv.HTTPAddrs); err != nil {
+		return err
+	}
+
+	srv.SetRunning(true)
+	log.Info("Server is running on ", srv.BoundAddrs(), "!")
+
+	for _, sock := range srv.Transports {
+		for i := 0; i < runtime.NumCPU(); i++ {
+			go srv.ReadPackets(sock)
+		}
+	}
+	srv.API.Serve()
+	go srv.ExpireSessions()
+
+	return nil
+}
+
+//ReadPackets starts reading packets from a transport and handles them
+func (srv *Server) ReadPackets(sock Transport) {
+	srv.Metrics.PacketReaders.Inc()
+	defer srv.Metrics.PacketReaders.Dec()
 	buffer := make([]byte, maxBufferSize)
 
-	for srv.Running {
-		if !srv.Running {
+	for srv.IsRunning() {
+		if !srv.IsRunning() {
 			break
 		}
 
@@ -148,130 +236,132 @@ func (srv *Server) ReadPackets() {
 		buffer = make([]byte, maxBufferSize)
 
 		//Block until a packet is read into the buffer
-		n, addr, err := srv.Sock.ReadFromUDP(buffer)
+		n, addr, err := sock.ReadFromUDP(buffer)
 		if err != nil {
+			if !srv.IsRunning() {
+				break
+			}
 			log.Error(addr, ": ", err)
 			continue
 		}
+		srv.RouteSeen(sock, addr)
+		srv.Metrics.BytesReceived.Add(uint64(n))
 
 		//Trim the buffer
 		buffer = buffer[:n]
 
-		//Handle the packet
-		go srv.Handle(buffer, addr)
+		//Handle the packet, which hands it off to its lobby's event loop if it has one, once it makes it through any simulated bad network link
+		srv.Impair(addr, buffer, func(data []byte) {
+			srv.Handle(data, addr)
+		})
 	}
 }
 
-//ReadHTTP starts reading HTTP packets and handles them
-func (srv *Server) ReadHTTP() {
-	buffer := make([]byte, maxBufferSize)
-
-	for srv.Running {
-		if !srv.Running {
+//ExpireSessions periodically forgets session tokens that were never claimed
+func (srv *Server) ExpireSessions() {
+	for srv.IsRunning() {
+		if !srv.IsRunning() {
 			break
 		}
 
-		//Reset the buffer
-		buffer = make([]byte, maxBufferSize)
+		now := time.Now()
+		srv.SessionsExpire(now)
+		srv.RoutesExpire(now)
 
-		//Block until a client is encountered
-		tcpConn, err := srv.HTTP.AcceptTCP()
-		if err != nil {
-			log.Error(srv.HTTP.Addr(), ": ", err)
-			continue
-		}
-		log.Trace("Accepted TCP client: ", tcpConn.RemoteAddr())
-		//defer tcpConn.Close()
+		time.Sleep(time.Duration(heartbeatInterval) * time.Second)
+	}
+}
 
-		//Block until a packet is read into the buffer
-		n, err := tcpConn.Read(buffer)
-		if err != nil {
-			log.Error(tcpConn.RemoteAddr(), ": ", err)
-			continue
-		}
+//SendPacket sends a packet to a destination address
+func (srv *Server) SendPacket(packet *Packet, addr *net.UDPAddr) {
+	srv.Metrics.PacketsSent.Inc(packet.Type.String())
+	srv.WriteTo(packet.AsBytes(), addr)
 
-		//Trim the buffer
-		buffer = buffer[:n]
+	if shouldLog(packet) {
+		log.Trace("Sent to ", addr, ": ", packet)
+	}
+}
 
-		packet, err := NewPacketFromBytes(buffer)
-		if err != nil {
-			log.Error("unable to create packet from bytes: ", err)
-			continue
-		}
+//SendPacketToClient sends a packet to a client, reliably and in order if the packet type requires it
+func (srv *Server) SendPacketToClient(packet *Packet, client *Client) {
+	if client == nil || client.IsClosed() || client.Disconnected {
+		return //A reconnecting client is resynced instead
+	}
 
-		if packet.Type != packetTypeHTTP {
-			log.Error("expected packet type HTTP over TCP")
-			continue
-		}
+	reliable := packet.ShouldSendReliably() //Decided by the packet type before it's translated to a type ID the server doesn't know
+	packetType := packet.Type
+	packet, err := client.Dialect.ToWire(packet)
+	if err != nil {
+		log.Error("unable to send packet to ", client.Addr, ": ", err)
+		return
+	}
+	srv.Metrics.PacketsSent.Inc(packetType.String())
 
-		/*resp, err := http.ReadResponse(bufio.NewReader(packet), nil)
-		if err != nil {
-			log.Error("unable to convert HTTP response: ", err)
-			continue
-		}*/
-		resp := &http.Response{
-			Status: "200 OK",
-			StatusCode: 200,
-			Proto: "HTTP/1.1",
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Body: io.NopCloser(bufio.NewReader(packet)),
-			ContentLength: int64(len(packet.Bytes())),
+	if !reliable || client.Extensions < protocol.ExtensionsReliable { //The stock game doesn't know what to do with a sequence number
+		srv.WriteTo(packet.AsBytes(), client.Addr)
+		if shouldLog(packet) {
+			log.Trace("Sent to ", client.Addr, ": ", packet)
 		}
+		return
+	}
 
-		/*n, err = tcpConn.Write(packet.Bytes())
-		if err != nil {
-			log.Error(tcpConn.RemoteAddr(), ": ", err)
-			continue
-		}*/
-
-		err = resp.Write(tcpConn)
-		if err != nil {
-			log.Error(tcpConn.RemoteAddr(), ": ", err)
-			continue
-		}
+	srv.WriteTo(client.Reliability.Send(packet), client.Addr)
 
-		//tcpConn.CloseWrite()
-		err = tcpConn.Close()
-		log.Trace("Closed TCP client: ", err)
+	if shouldLog(packet) {
+		log.Trace("Sent reliably to ", client.Addr, ": ", packet)
 	}
 }
 
-//SendPacket sends a packet to a destination address
-func (srv *Server) SendPacket(packet *Packet, addr *net.UDPAddr) {
-	srv.Sock.WriteToUDP(packet.AsBytes(), addr)
-
-	if packet.ShouldLog() {
-		log.Trace("Sent to ", addr, ": ", packet)
+//SendAck acknowledges a reliable packet received from an address
+func (srv *Server) SendAck(packet *Packet, addr *net.UDPAddr) {
+	packetAck, err := NewPacketFromMessage(&protocol.Ack{Sequence: packet.Sequence}, packet.Channel, 0)
+	if err != nil {
+		log.Error("unable to acknowledge packet: ", err)
+		return
 	}
+	srv.SendPacket(packetAck, addr)
 }
 
-//Handle handles a packet for the server
+//Handle handles a packet for the server, unless its address struck out, recovering from any panic it causes
 func (srv *Server) Handle(buffer []byte, addr *net.UDPAddr) {
+	if srv.Strikes.Out(addr) {
+		return
+	}
+	srv.Recover(addr, func() {
+		srv.handle(buffer, addr)
+	})
+}
+
+func (srv *Server) handle(buffer []byte, addr *net.UDPAddr) {
 	//Read the buffer into a packet
-	packet, err := NewPacketFromBytes(buffer)
+	packet, err := protocol.NewPacketFromBytes(buffer)
 	if err != nil {
+		srv.Metrics.ParseErrors.Inc()
 		log.Error("unable to create packet from bytes to handle: ", err)
 		return //Goodbye false packet!
 	}
 
-	if packet.Type == packetTypeHTTP {
-		return
-	}
-
 	//Set the source address of the packet
 	packet.Src = addr
 
 	//Log the packet
-	if packet.ShouldLog() {
+	if shouldLog(packet) {
 		log.Trace("Received from ", addr, ": ", packet)
 	}
 
-	if lobby := srv.GetLobbyByAddr(packet.Src); lobby != nil {
-		lobby.Handle(packet)
+	if lobby, client := srv.GetLobbyClientByAddr(packet.Src); lobby != nil {
+		lobby.Capture.Record(CaptureInbound, addr, buffer, nil)
+		if err := client.Dialect.FromWire(packet); err != nil {
+			srv.Metrics.ParseErrors.Inc()
+			log.Warn("Dropped malformed packet from ", addr, ": ", err)
+			return
+		}
+		srv.Metrics.PacketsReceived.Inc(packet.Type.String())
+		lobby.Enqueue(packet) //Let the lobby's event loop handle it in order with everything else in the lobby
 		return
 	}
 
+	srv.Metrics.PacketsReceived.Inc(packet.Type.String()) //Only the handshake, which every protocol version agrees on
 	switch packet.Type {
 	case packetTypePing:
 		srv.ClientPong(packet.Src, packet.Bytes())
@@ -280,62 +370,171 @@ func (srv *Server) Handle(buffer []byte, addr *net.UDPAddr) {
 		srv.ClientAccept(packet.Src)
 
 	case packetTypeClientRequestingIndex:
-		/* TODO: Move to srv.FindLobby(packet)
-		for _, lobby := range srv.Lobbies {
-			//Try to initialize this client with the lobby
-			err := lobby.ClientInit(packet)
-			if err == nil {
-				return
-			}
-		}*/
-
-		lobby, err := NewLobby(srv, "") //Create a new lobby with a random room code
-		if err != nil {
-			log.Error("unable to create new lobby: ", err)
-			srv.ClientReject(addr, err.Error())
+		request := &protocol.ClientRequestingIndex{}
+		if err := packet.Decode(request); err != nil {
+			log.Warn("Dropped malformed packet from ", addr, ": ", err)
 			return
 		}
-		err = lobby.ClientInit(packet)
-		if err != nil {
-			log.Error("unable to init client into new lobby: ", err)
-			srv.ClientReject(addr, err.Error())
+		if requireSigned && request.Extensions < protocol.ExtensionsSigned {
+			log.Warn("Rejected clientRequestingIndex from ", addr, " that won't sign its packets")
+			srv.ClientReject(addr, "signed packets required")
 			return
 		}
-		srv.LobbyAdd(lobby)
+		session := srv.SessionClaim(packet, request.Extensions) //Make sure this client was accepted and signed with the session it was given, if it signs at all
+
+		//A client returning to a lobby it's still in, to be checked against its old session by the lobby's event loop
+		if lobby := srv.GetLobbyBySteamID(packet); lobby != nil {
+			lobby.Do(func() {
+				srv.Recover(addr, func() {
+					lobby.ClientRequestingIndex(packet, session)
+				})
+			})
+			return
+		}
+
+		if session == nil {
+			log.Warn("Rejected clientRequestingIndex from ", addr, " with an invalid session signature")
+			srv.ClientReject(addr, "invalid session")
+			return
+		}
+		if packet.Sequence != 0 {
+			srv.SendAck(packet, packet.Src)
+		}
+
+		srv.ClientJoin(packet, session)
 
-	case packetTypeKickPlayer:
+	case packetTypeKickPlayer, packetTypeAck:
 		//Just so we handle this if the client isn't in a lobby yet
 
 	default:
+		//A client that's come back from another address, to be checked against its session by its lobby's event loop
+		if lobby, _ := srv.Registry.GetBySteamID(packet.SteamID.ID); lobby != nil && packet.SteamID.ID != 0 && packet.MAC != nil {
+			lobby.Capture.Record(CaptureInbound, addr, buffer, nil)
+			lobby.Enqueue(packet)
+			return
+		}
+
 		log.Error(fmt.Sprintf("Unhandled packet from %s: %s", packet.Src, packet))
 	}
 }
 
+//ClientJoin creates a new lobby for a client that was accepted with the specified session
+func (srv *Server) ClientJoin(packet *Packet, session []byte) {
+	/* TODO: Move to srv.FindLobby(packet)
+	for _, lobby := range srv.Lobbies {
+		//Try to initialize this client with the lobby
+		err := lobby.ClientInit(packet)
+		if err == nil {
+			return
+		}
+	}*/
+
+	lobby, err := NewLobby(srv, "") //Create a new lobby with a random room code
+	if err != nil {
+		log.Error("unable to create new lobby: ", err)
+		srv.ClientReject(packet.Src, err.Error())
+		return
+	}
+	srv.LobbyAdd(lobby) //Before the client hears it's in, so that it's never in a lobby the server doesn't know about
+	lobby.Invoke(func() {
+		if srv.Recover(packet.Src, func() { err = lobby.ClientInit(packet, session) }) {
+			err = errors.New("malformed clientRequestingIndex")
+		}
+	})
+	if err != nil {
+		log.Error("unable to init client into new lobby: ", err)
+		srv.ClientReject(packet.Src, err.Error())
+		lobby.Invoke(lobby.Close)
+	}
+}
+
 //ClientPong responds to a ping with a pong
 func (srv *Server) ClientPong(addr *net.UDPAddr, data []byte) {
-	packetPingResponse := NewPacket(packetTypePingResponse, 0, 0)
-	if dataLen := int64(len(data)); dataLen > 0 {
-		packetPingResponse.Grow(dataLen)
-		packetPingResponse.WriteBytesNext(data)
+	packetPingResponse, err := NewPacketFromMessage(&protocol.PingResponse{Data: data}, 0, 0)
+	if err != nil {
+		log.Error("unable to respond to ping: ", err)
+		return
 	}
 	srv.SendPacket(packetPingResponse, addr)
 }
 
-//ClientAccept accepts a client
+//ClientPing pings a client with the current time, so the round trip can be measured when it responds
+func (srv *Server) ClientPing(client *Client) {
+	now := time.Now()
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(now.UnixNano()))
+	packetPing, err := NewPacketFromMessage(&protocol.Ping{Data: data}, 0, 0)
+	if err != nil {
+		log.Error("unable to ping client: ", err)
+		return
+	}
+	client.LastPing = now
+	srv.SendPacket(packetPing, client.Addr)
+}
+
+//ClientPingResponse measures a client's round trip time from its response to a server ping
+func (srv *Server) ClientPingResponse(client *Client, packet *Packet) {
+	pingResponse := &protocol.PingResponse{}
+	if err := packet.Decode(pingResponse); err != nil || len(pingResponse.Data) < 8 {
+		return
+	}
+
+	sentAt := time.Unix(0, int64(binary.LittleEndian.Uint64(pingResponse.Data)))
+	if sentAt.After(client.LastPing) { //Don't trust a time we haven't sent yet
+		return
+	}
+
+	rtt := time.Since(sentAt)
+	client.PingInMs = float64(rtt) / float64(time.Millisecond)
+	srv.Metrics.ClientRTT.Observe(rtt.Seconds())
+	log.Trace("Client ", client.Addr, " has a ping of ", client.PingInMs, "ms")
+}
+
+//ClientAccept accepts a client and issues it the session token it must sign every following packet with
 func (srv *Server) ClientAccept(addr *net.UDPAddr) {
-	packetClientAccepted := NewPacket(packetTypeClientAccepted, 1, 0)
+	token, err := srv.SessionIssue(addr)
+	if err != nil {
+		log.Error("unable to issue session token: ", err)
+		srv.ClientReject(addr, "unable to start session")
+		return
+	}
+
+	packetClientAccepted, err := NewPacketFromMessage(&protocol.ClientAccepted{Token: token}, 1, 0)
+	if err != nil {
+		log.Error("unable to accept client: ", err)
+		return
+	}
 	srv.SendPacket(packetClientAccepted, addr)
 	log.Debug("Accepted client ", addr)
 }
 
+//ClientKick tells a client it was kicked and why, but leaves removing it from its lobby to the caller
+func (srv *Server) ClientKick(client *Client, reason string) {
+	if client == nil || client.IsClosed() || client.Disconnected {
+		return
+	}
+
+	//Sent unreliably, as the client is about to be forgotten and won't be around to be resent to
+	packetKickPlayer, err := NewPacketFromMessage(&protocol.Empty{PacketType: packetTypeKickPlayer}, 0, client.SteamID.ID)
+	if err != nil {
+		log.Error("unable to kick client: ", err)
+		return
+	}
+	if packetKickPlayer, err = client.Dialect.ToWire(packetKickPlayer); err != nil {
+		log.Error("unable to kick client: ", err)
+		return
+	}
+	srv.SendPacket(packetKickPlayer, client.Addr)
+	srv.ClientReject(client.Addr, reason) //The reason is only shown by a rejected clientInit
+	log.Info("Kicked client ", client.SteamID, " at ", client.Addr, ": ", reason)
+}
+
 //ClientReject rejects a client
 func (srv *Server) ClientReject(addr *net.UDPAddr, reason string) {
-	packetClientInit := NewPacket(packetTypeClientInit, 0, 0)
-	packetClientInit.Grow(1)
-	if reason != "" {
-		reasonBytes := []byte(reason)
-		packetClientInit.Grow(int64(len(reasonBytes)))
-		packetClientInit.WriteBytes(0x1, reasonBytes)
+	packetClientInit, err := NewPacketFromMessage(&protocol.ClientInit{Accepted: false, Reason: reason}, 0, 0)
+	if err != nil {
+		log.Error("unable to reject client: ", err)
+		return
 	}
 	srv.SendPacket(packetClientInit, addr)
 	if reason != "" {
@@ -345,32 +544,54 @@ func (srv *Server) ClientReject(addr *net.UDPAddr, reason string) {
 	}
 }
 
+//GetLobbies returns a copy of the list of lobbies, safe to loop over while lobbies come and go
+func (srv *Server) GetLobbies() []*Lobby {
+	srv.LobbiesLock.RLock()
+	defer srv.LobbiesLock.RUnlock()
+
+	lobbies := make([]*Lobby, len(srv.Lobbies))
+	copy(lobbies, srv.Lobbies)
+	return lobbies
+}
+
 //GetLobbyByAddr returns the lobby that the address is found in
 func (srv *Server) GetLobbyByAddr(addr *net.UDPAddr) *Lobby {
-	if len(srv.Lobbies) > 0 {
-		for i := 0; i < len(srv.Lobbies); i++ {
-			if srv.Lobbies[i] != nil && srv.Lobbies[i].IsRunning() && len(srv.Lobbies[i].Clients) > 0 {
-				for clientIndex := 0; clientIndex < len(srv.Lobbies[i].Clients); clientIndex++ {
-					if srv.Lobbies[i].Clients[clientIndex].Addr.String() == addr.String() {
-						//We found the lobby that this client is in!
-						return srv.Lobbies[i]
-					}
-				}
-			}
-		}
+	lobby, _ := srv.GetLobbyClientByAddr(addr)
+	return lobby
+}
+
+//GetLobbyClientByAddr returns the lobby that the address is found in, and the client or spectator with that address
+func (srv *Server) GetLobbyClientByAddr(addr *net.UDPAddr) (*Lobby, *Client) {
+	lobby, client := srv.Registry.GetByAddr(addr)
+	if lobby == nil || !lobby.IsRunning() {
+		return nil, nil //We didn't find the lobby, they must be new!
 	}
+	return lobby, client
+}
 
-	//We didn't find the lobby, they must be new!
-	return nil
+//GetLobbyBySteamID returns the lobby that already has a client with the SteamID requested by a clientRequestingIndex packet
+func (srv *Server) GetLobbyBySteamID(packet *Packet) *Lobby {
+	if reconnectGrace <= 0 {
+		return nil
+	}
+
+	request := &protocol.ClientRequestingIndex{}
+	if err := packet.Decode(request); err != nil {
+		return nil
+	}
+
+	lobby, _ := srv.Registry.GetBySteamID(request.SteamID)
+	if lobby == nil || !lobby.IsRunning() {
+		return nil
+	}
+	return lobby
 }
 
 //GetLobbyByCode returns the lobby matching the room code
 func (srv *Server) GetLobbyByCode(code string) *Lobby {
-	if len(srv.Lobbies) > 0 {
-		for i := 0; i < len(srv.Lobbies); i++ {
-			if srv.Lobbies[i] != nil && srv.Lobbies[i].IsRunning() && srv.Lobbies[i].LobbyRoomCode == code {
-				return srv.Lobbies[i]
-			}
+	for _, lobby := range srv.GetLobbies() {
+		if lobby.IsRunning() && lobby.LobbyRoomCode == code {
+			return lobby
 		}
 	}
 
@@ -379,56 +600,62 @@ func (srv *Server) GetLobbyByCode(code string) *Lobby {
 
 //LobbyAdd adds the specified lobby to the server
 func (srv *Server) LobbyAdd(lobby *Lobby) {
+	srv.LobbiesLock.Lock()
+	defer srv.LobbiesLock.Unlock()
 	srv.Lobbies = append(srv.Lobbies, lobby)
 }
 
-//GetClientByAddr returns the client with a matching address
-func (srv *Server) GetClientByAddr(addr *net.UDPAddr) (int, *Client) {
-	for _, lobby := range srv.Lobbies {
-		if lobby.Clients == nil || len(lobby.Clients) == 0 {
-			continue
-		}
+//LobbyAddIfAbsent adds the specified lobby to the server unless a running lobby already has its room code, returning false if one does
+func (srv *Server) LobbyAddIfAbsent(lobby *Lobby) bool {
+	srv.LobbiesLock.Lock()
+	defer srv.LobbiesLock.Unlock()
 
-		for clientIndex, client := range lobby.Clients {
-			if client.Addr.String() == addr.String() {
-				return clientIndex, client
-			}
+	for _, other := range srv.Lobbies {
+		if other.IsRunning() && other.LobbyRoomCode == lobby.LobbyRoomCode {
+			return false
 		}
 	}
-	return -1, nil
+	srv.Lobbies = append(srv.Lobbies, lobby)
+	return true
 }
 
-//GetClientBySteamID returns the client with a matching SteamID
-func (srv *Server) GetClientBySteamID(steamID CSteamID) *Client {
-	for _, lobby := range srv.Lobbies {
-		if lobby.Clients == nil || len(lobby.Clients) == 0 {
-			continue
-		}
+//LobbyRemove removes the specified lobby from the server
+func (srv *Server) LobbyRemove(lobby *Lobby) {
+	srv.LobbiesLock.Lock()
+	defer srv.LobbiesLock.Unlock()
 
-		for _, client := range lobby.Clients {
-			if client.SteamID.CompareCSteamID(steamID) {
-				return client
-			}
+	for i := 0; i < len(srv.Lobbies); i++ {
+		if srv.Lobbies[i] == lobby {
+			srv.Lobbies[i] = nil                      //Nullify the lobby
+			copy(srv.Lobbies[i:], srv.Lobbies[i+1:]) //Shift every lobby after this lobby left by one
+			srv.Lobbies = srv.Lobbies[:len(srv.Lobbies)-1]
+			break
 		}
 	}
-	return nil
+	srv.Impairer.SetLobby(lobby, nil) //Its impairment would otherwise keep it from ever being freed
+}
+
+//GetClientByAddr returns the client with a matching address
+func (srv *Server) GetClientByAddr(addr *net.UDPAddr) *Client {
+	_, client := srv.GetLobbyClientByAddr(addr)
+	return client
+}
+
+//GetClientBySteamID returns the client with a matching SteamID
+func (srv *Server) GetClientBySteamID(steamID CSteamID) *Client {
+	_, client := srv.Registry.GetBySteamID(steamID.ID)
+	return client
 }
 
 //GetClientBySteamUsername returns the client with a matching Steam username
 func (srv *Server) GetClientBySteamUsername(steamUsername string) *Client {
-	for _, lobby := range srv.Lobbies {
-		if lobby.Clients == nil || len(lobby.Clients) == 0 {
-			continue
+	for _, client := range srv.Registry.Clients() {
+		if client.SteamID.GetUsername() == steamUsername {
+			return client
 		}
 
-		for _, client := range lobby.Clients {
-			if client.SteamID.GetUsername() == steamUsername {
-				return client
-			}
-
-			if client.SteamID.GetNormalizedUsername() == steamUsername {
-				return client
-			}
+		if client.SteamID.GetNormalizedUsername() == steamUsername {
+			return client
 		}
 	}
 	return nil
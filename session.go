@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+//pendingSession holds a session token that was issued to an address, but not yet claimed by a clientRequestingIndex
+type pendingSession struct {
+	Token  []byte    //The session token
+	Issued time.Time //When the session token was issued
+}
+
+//NewSessionToken returns a new random session token
+func NewSessionToken() ([]byte, error) {
+	token := make([]byte, protocol.SessionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+//SessionIssue issues a new session token to an address, replacing any it was issued before
+func (srv *Server) SessionIssue(addr *net.UDPAddr) ([]byte, error) {
+	token, err := NewSessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	srv.SessionsLock.Lock()
+	defer srv.SessionsLock.Unlock()
+	srv.Sessions[newAddrKey(addr)] = &pendingSession{
+		Token:  token,
+		Issued: time.Now(),
+	}
+	return token, nil
+}
+
+//SessionClaim returns the session token issued to the packet's source address if the packet was signed with it, or nil if not
+//A client that didn't ask for ExtensionsSigned never signs anything, so like the stock game it's let in unsigned with a session of its own
+func (srv *Server) SessionClaim(packet *Packet, extensions byte) []byte {
+	srv.SessionsLock.Lock()
+	defer srv.SessionsLock.Unlock()
+
+	session, ok := srv.Sessions[newAddrKey(packet.Src)]
+	if extensions < protocol.ExtensionsSigned {
+		delete(srv.Sessions, newAddrKey(packet.Src))
+		if ok {
+			return session.Token
+		}
+
+		token, err := NewSessionToken()
+		if err != nil {
+			log.Error("unable to issue session token: ", err)
+			return nil
+		}
+		return token
+	}
+	if !ok || !packet.Verify(session.Token) {
+		return nil
+	}
+
+	delete(srv.Sessions, newAddrKey(packet.Src))
+	return session.Token
+}
+
+//SessionsExpire forgets every session token that wasn't claimed within the client timeout
+func (srv *Server) SessionsExpire(now time.Time) {
+	srv.SessionsLock.Lock()
+	defer srv.SessionsLock.Unlock()
+
+	for addr, session := range srv.Sessions {
+		if now.Sub(session.Issued) > time.Duration(clientTimeout)*time.Second {
+			delete(srv.Sessions, addr)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//udpRoute remembers which of the server's transports an address last reached us on, so replies come from the same socket
+type udpRoute struct {
+	seen int64     //The UnixNano time the address last sent a packet to this transport, first so it's aligned for atomic access
+	Sock Transport //The transport the address last sent a packet to
+}
+
+//Listen opens a UDP socket for every configured address, which may be IPv4, IPv6 or dual-stack
+func (srv *Server) Listen() error {
+	for _, addr := range srv.Addrs {
+		addr = strings.TrimSpace(addr)
+		//Listening on "udp" rather than "udp4" or "udp6" lets the address pick the family, and an unspecified host like ":1337" or "[::]:1337" serves both
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+		log.Trace("Resolved UDP address ", udpAddr, " for ", addr)
+
+		sock, err := ListenUDP(udpAddr)
+		if err != nil {
+			return err
+		}
+		log.Trace("Listening on UDP address ", sock.LocalAddr())
+		srv.Transports = append(srv.Transports, sock)
+	}
+	return nil
+}
+
+//BoundAddrs returns every address the server's transports are bound to
+func (srv *Server) BoundAddrs() []string {
+	addrs := make([]string, 0, len(srv.Transports))
+	for _, sock := range srv.Transports {
+		addrs = append(addrs, sock.LocalAddr().String())
+	}
+	return addrs
+}
+
+//RouteSeen remembers that an address reached us on the specified transport
+func (srv *Server) RouteSeen(sock Transport, addr *net.UDPAddr) {
+	if len(srv.Transports) < 2 {
+		return //There's only one way to reply
+	}
+
+	now := time.Now().UnixNano()
+	key := newAddrKey(addr)
+	if value, ok := srv.Routes.Load(key); ok {
+		if route := value.(*udpRoute); route.Sock == sock {
+			atomic.StoreInt64(&route.seen, now)
+			return
+		}
+	}
+	srv.Routes.Store(key, &udpRoute{Sock: sock, seen: now})
+}
+
+//SockFor returns the transport to send to an address from, preferring the one it last reached us on
+func (srv *Server) SockFor(addr *net.UDPAddr) Transport {
+	if len(srv.Transports) == 1 {
+		return srv.Transports[0]
+	}
+
+	if value, ok := srv.Routes.Load(newAddrKey(addr)); ok {
+		return value.(*udpRoute).Sock
+	}
+
+	//We haven't heard from it, so pick the first transport of a family that can reach it
+	isIPv4 := addr.IP.To4() != nil
+	for _, sock := range srv.Transports {
+		localIP := sock.LocalAddr().(*net.UDPAddr).IP
+		if localIP.To4() != nil {
+			if isIPv4 {
+				return sock
+			}
+			continue
+		}
+		if !isIPv4 || localIP.IsUnspecified() { //An unspecified IPv6 socket is dual-stack
+			return sock
+		}
+	}
+	return nil
+}
+
+//WriteTo sends raw bytes to an address from the transport that can reach it
+func (srv *Server) WriteTo(data []byte, addr *net.UDPAddr) {
+	srv.Impair(addr, data, func(data []byte) {
+		srv.writeTo(data, addr)
+	})
+}
+
+//writeTo sends serialized data to an address through the socket it last reached us on, past any simulated bad network link
+func (srv *Server) writeTo(data []byte, addr *net.UDPAddr) {
+	sock := srv.SockFor(addr)
+	if sock == nil {
+		log.Error("No socket can reach ", addr)
+		return
+	}
+	sock.WriteToUDP(data, addr)
+	srv.Metrics.BytesSent.Add(uint64(len(data)))
+
+	if captureDir != "" {
+		srv.CaptureOf(addr).Record(CaptureOutbound, addr, data, nil)
+	}
+}
+
+//RoutesExpire forgets the routes of addresses that haven't sent a packet within the client timeout
+func (srv *Server) RoutesExpire(now time.Time) {
+	expiry := now.Add(-time.Duration(clientTimeout) * time.Second).UnixNano()
+	srv.Routes.Range(func(key, value interface{}) bool {
+		if atomic.LoadInt64(&value.(*udpRoute).seen) < expiry {
+			srv.Routes.Delete(key)
+		}
+		return true
+	})
+}
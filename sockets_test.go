@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestDualStack(t *testing.T) {
+	ipv4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1337}
+	ipv6 := &net.UDPAddr{IP: net.IPv6loopback, Port: 1337}
+	ts := newTestServerOn(t, ipv4, ipv6)
+
+	//One client on each family, playing in the same lobby
+	host := ts.Join(76561190000000001)
+	guest := ts.JoinFrom(76561190000000002, &net.UDPAddr{IP: net.IPv6loopback, Port: 40000}, ipv6)
+	joinLobby(t, host, guest)
+	guest.Say("hello from ::1")
+	host.ExpectChat(guest.PlayerIndex, "hello from ::1")
+	host.Say("hello from 127.0.0.1")
+	guest.ExpectChat(host.PlayerIndex, "hello from 127.0.0.1")
+
+	//Replies go out on the socket each client reached us on, and on one of its family for a client we haven't heard from
+	for _, route := range []struct {
+		addr *net.UDPAddr
+		sock *net.UDPAddr
+	}{
+		{host.Socket().addr, ipv4},
+		{guest.Socket().addr, ipv6},
+		{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}, ipv4},
+		{&net.UDPAddr{IP: net.IPv6loopback, Port: 50000}, ipv6},
+	} {
+		if sock := ts.SockFor(route.addr); sock == nil || sock.LocalAddr().String() != route.sock.String() {
+			t.Fatalf("replies to %s don't go out on %s", route.addr, route.sock)
+		}
+	}
+
+	status := &Status{}
+	if w := apiRequest(t, ts, http.MethodGet, "/status", "", status); w.Code != http.StatusOK {
+		t.Fatalf("/status answered with %d", w.Code)
+	}
+	if len(status.Addresses) != 2 || status.Addresses[0] != ipv4.String() || status.Addresses[1] != ipv6.String() {
+		t.Fatalf("/status listed %v as the bound addresses", status.Addresses)
+	}
+}
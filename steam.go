@@ -5,47 +5,18 @@ import (
 	"os"
 	"os/exec"
 	"io/ioutil"
-	"regexp"
-	"unicode"
 
-	"golang.org/x/text/transform"
-	"golang.org/x/text/unicode/norm"
 	"github.com/JoshuaDoes/json"
 	"github.com/Philipp15b/go-steamapi"
 )
 
-var (
-	steamUsernames = make(map[uint64]string)
-)
-
-//CSteamID holds a Steam client ID and its username
-type CSteamID struct {
-	ID           uint64
-	Username     string
-	NormUsername string
-}
-
-//NewCSteamID returns a new Steam client ID
-func NewCSteamID(steamID uint64) CSteamID {
-	clientID := CSteamID{
-		ID: steamID,
+//LookupSteamUsername asks Steam for the username of a Steam ID, or returns an empty string if it can't
+func LookupSteamUsername(steamID uint64) string {
+	if steamKey == "" {
+		return "" //Steam won't answer without a key, so don't hold up the caller asking
 	}
 
-	return clientID
-}
-
-//GetUsername returns the username of the CSteamID and caches it in memory
-func (cSteamID CSteamID) GetUsername() string {
-	if cSteamID.Username != "" {
-		return cSteamID.Username
-	}
-
-	if steamUsername, ok := steamUsernames[cSteamID.ID]; ok {
-		cSteamID.Username = steamUsername
-		return steamUsername
-	}
-
-	summaries, err := steamapi.GetPlayerSummaries([]uint64{cSteamID.ID}, steamKey)
+	summaries, err := steamapi.GetPlayerSummaries([]uint64{steamID}, steamKey)
 	if err != nil {
 		return ""
 	}
@@ -54,44 +25,7 @@ func (cSteamID CSteamID) GetUsername() string {
 		return ""
 	}
 
-	steamUsernames[cSteamID.ID] = summaries[0].PersonaName
-	cSteamID.Username = steamUsernames[cSteamID.ID]
-	return cSteamID.Username
-}
-
-//GetNormalizedUsername returns a normalized version of the username of the CSteamID and caches it in memory
-func (cSteamID CSteamID) GetNormalizedUsername() string {
-	if cSteamID.NormUsername != "" {
-		return cSteamID.NormUsername
-	}
-
-	username := cSteamID.GetUsername()
-	username = regexp.MustCompile(`<.*?>`).ReplaceAllString(username, "")
-	username = regexp.MustCompile(`[^a-zA-Z0-9]+`).ReplaceAllString(username, "")
-	username = stripTags.Sanitize(username)
-
-	bytes := make([]byte, len(username))
-	normalize := transform.Chain(norm.NFD, transform.RemoveFunc(func(r rune) bool {
-		return unicode.Is(unicode.Mn, r)
-	}), norm.NFC)
-	_, _, err := normalize.Transform(bytes, []byte(username), true)
-	if err != nil {
-		return username
-	}
-
-	username = string(bytes)
-	cSteamID.NormUsername = username
-	return cSteamID.NormUsername
-}
-
-//CompareCSteamID evaluates if a CSteamID is the same as another
-func (cSteamID CSteamID) CompareCSteamID(compareSteamID CSteamID) bool {
-	return cSteamID.ID == compareSteamID.ID
-}
-
-//CompareSteamID evaluates if a CSteamID matches a SteamID
-func (cSteamID CSteamID) CompareSteamID(steamID uint64) bool {
-	return cSteamID.ID == steamID
+	return summaries[0].PersonaName
 }
 
 //LoadWorkshopMaps updates and preloads a given list of Workshop maps in a batch command
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	strikeExpiry = 10 * time.Minute //How long an address goes without a strike before its strikes are forgotten
+)
+
+//Strikes counts the packets from each address that crashed their handler, so an address that keeps sending them can be ignored
+type Strikes struct {
+	sync.Mutex
+
+	Max     int //How many strikes an address gets before it's ignored, 0 to never ignore it
+	strikes map[addrKey]*strike
+}
+
+//strike is the strikes against an address
+type strike struct {
+	count int
+	last  time.Time //When the address was last struck
+}
+
+//NewStrikes returns a strike counter that ignores an address after the specified amount of strikes, or never if 0
+func NewStrikes(max int) *Strikes {
+	return &Strikes{
+		Max:     max,
+		strikes: make(map[addrKey]*strike),
+	}
+}
+
+//Add strikes an address, and returns how many strikes it has now
+func (strikes *Strikes) Add(addr *net.UDPAddr) int {
+	strikes.Lock()
+	defer strikes.Unlock()
+
+	now := time.Now()
+	key := newAddrKey(addr)
+	s, ok := strikes.strikes[key]
+	if !ok || now.Sub(s.last) > strikeExpiry {
+		s = &strike{}
+		strikes.strikes[key] = s
+	}
+	s.count++
+	s.last = now
+	return s.count
+}
+
+//Count returns how many strikes an address has
+func (strikes *Strikes) Count(addr *net.UDPAddr) int {
+	strikes.Lock()
+	defer strikes.Unlock()
+
+	s, ok := strikes.strikes[newAddrKey(addr)]
+	if !ok || time.Since(s.last) > strikeExpiry {
+		return 0
+	}
+	return s.count
+}
+
+//Out returns true if an address has struck out, and its packets should be ignored
+func (strikes *Strikes) Out(addr *net.UDPAddr) bool {
+	return strikes.Max > 0 && strikes.Count(addr) >= strikes.Max
+}
+
+//Recover runs the handler of a packet from an address, and turns a panic into a logged error and a strike against the address,
+//returning true if it panicked. A client that strikes out is kicked from its lobby
+func (srv *Server) Recover(addr *net.UDPAddr, handle func()) (panicked bool) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		panicked = true
+
+		count := srv.Strikes.Add(addr)
+		log.Error(fmt.Sprintf("Recovered from a panic handling a packet from %s (strike %d): %v\n%s", addr, count, r, debug.Stack()))
+		if srv.Strikes.Max <= 0 || count != srv.Strikes.Max {
+			return
+		}
+
+		log.Warn("Ignoring ", addr, " after ", count, " packets crashed their handler")
+		if lobby, client := srv.GetLobbyClientByAddr(addr); lobby != nil {
+			go lobby.Do(func() { //Not waited on, as this may be the lobby's own event loop
+				lobby.Disconnect(client, "too many malformed packets")
+			})
+		}
+	}()
+
+	handle()
+	return false
+}
+
+//Recover runs an event or timer on the lobby's event loop, and turns a panic into a logged error and a strike against the lobby,
+//returning true if it panicked. A lobby that strikes out is closed, as its state can't be trusted anymore
+func (lobby *Lobby) Recover(what string, handle func()) (panicked bool) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		panicked = true
+
+		lobby.strikes++
+		log.Error(fmt.Sprintf("Recovered from a panic running %s in lobby %s (strike %d): %v\n%s", what, lobby.LobbyRoomCode, lobby.strikes, r, debug.Stack()))
+		if lobby.Server.Strikes.Max <= 0 || lobby.strikes != lobby.Server.Strikes.Max {
+			return
+		}
+
+		log.Warn("Closing lobby ", lobby.LobbyRoomCode, " after ", lobby.strikes, " events crashed it")
+		go lobby.Do(func() { //Not waited on, as this is the lobby's own event loop
+			lobby.Recover("lobby closure", func() {
+				lobby.CloseWithReason("lobby crashed")
+			})
+		})
+	}()
+
+	handle()
+	return false
+}
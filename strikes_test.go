@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/StickFightDev/StickFightDedicatedSrv/protocol"
+)
+
+func TestEmptyChatMessage(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+
+	host.Say("")
+	host.Say("/code")
+	host.ExpectChat(host.PlayerIndex, "Room code: ")
+	if strikes := ts.Strikes.Count(host.sock.addr); strikes != 0 {
+		t.Fatalf("empty chat message crashed its handler %d times", strikes)
+	}
+}
+
+func TestRecoverStrikesOut(t *testing.T) {
+	defaultStrikes := maxStrikes
+	maxStrikes = 2
+	t.Cleanup(func() { maxStrikes = defaultStrikes })
+
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	lobby := ts.Lobby(host)
+
+	for strike := 1; strike <= ts.Strikes.Max; strike++ {
+		if !ts.Recover(host.sock.addr, func() { panic("malformed") }) {
+			t.Fatalf("strike %d didn't panic", strike)
+		}
+		if count := ts.Strikes.Count(host.sock.addr); count != strike {
+			t.Fatalf("address has %d strikes after %d panics", count, strike)
+		}
+	}
+	if !ts.Strikes.Out(host.sock.addr) {
+		t.Fatal("address didn't strike out")
+	}
+
+	//Striking out kicks the client, and nothing it sends is handled after that
+	host.Expect(packetTypeKickPlayer)
+	host.Say("/code")
+	if ts.Recover(host.sock.addr, func() {}) {
+		t.Fatal("a handler that didn't panic was counted as a strike")
+	}
+	lobby.Invoke(func() {}) //Wait for the kick to finish
+	if ts.GetLobbyByAddr(host.sock.addr) != nil {
+		t.Fatal("client that struck out is still in its lobby")
+	}
+}
+
+func TestEventPanicClosesLobby(t *testing.T) {
+	defaultStrikes := maxStrikes
+	maxStrikes = 2
+	t.Cleanup(func() { maxStrikes = defaultStrikes })
+
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	lobby := ts.Lobby(host)
+
+	//A crashed timer only takes a strike, and the lobby carries on
+	lobby.After(time.Millisecond, func() { panic("broken game mode") })
+	host.Say("/code")
+	host.ExpectChat(host.PlayerIndex, "Room code: ")
+	if !lobby.IsRunning() {
+		t.Fatal("lobby closed after its first crashed event")
+	}
+	if strikes := ts.Strikes.Count(host.sock.addr); strikes != 0 {
+		t.Fatalf("client was struck %d times for its lobby's event crashing", strikes)
+	}
+
+	//Striking out closes the lobby, telling everyone why, and only that lobby
+	other := ts.Join(76561190000000002)
+	lobby.After(time.Millisecond, func() { panic("broken game mode") })
+	host.Expect(packetTypeKickPlayer)
+	reject := &protocol.ClientInit{LocalSteamID: host.SteamID}
+	host.ExpectMessage(reject)
+	if reject.Accepted || reject.Reason != "lobby crashed" {
+		t.Fatalf("client was kicked from its crashed lobby with %q", reject.Reason)
+	}
+	other.Say("/code")
+	other.ExpectChat(other.PlayerIndex, "Room code: ")
+}
+
+func TestOwnerCommandsRejectInvalidValues(t *testing.T) {
+	ts := newTestServer(t)
+	host := ts.Join(76561190000000001)
+	guest := ts.Join(76561190000000002)
+	joinLobby(t, host, guest)
+
+	for _, command := range []string{"/hp ", "/hp x", "/hp 7", "/maxplayers -1", "/maxplayers 0", "/maxplayers 256", "/maxplayers 1"} {
+		host.Say(command)
+		host.ExpectChat(host.PlayerIndex, "Invalid ")
+	}
+	host.Say("/hp 1")
+	if said := host.ExpectChat(host.PlayerIndex, "Set max HP: "); said != "Set max HP: 200.00" {
+		t.Fatalf("/hp 1 answered %q", said)
+	}
+	host.Say("/maxplayers 2")
+	host.ExpectChat(host.PlayerIndex, "Set max players to 2!")
+
+	if strikes := ts.Strikes.Count(host.sock.addr); strikes != 0 {
+		t.Fatalf("owner commands crashed their handler %d times", strikes)
+	}
+}
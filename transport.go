@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	memoryInboxSize = 1024 //The amount of packets an in-memory transport holds before dropping new ones, like a full socket buffer would
+)
+
+var (
+	errTransportClosed = errors.New("use of closed transport")
+)
+
+//Transport sends and receives the server's UDP packets, which a *net.UDPConn already does
+type Transport interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error) //Blocks until a packet arrives, or errors once the transport is closed
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+//ListenUDP opens a UDP socket on the specified address as a transport
+func ListenUDP(udpAddr *net.UDPAddr) (Transport, error) {
+	return net.ListenUDP("udp", udpAddr)
+}
+
+//MemoryNetwork connects in-memory transports to each other by address, so a server and its clients can talk without sockets
+type MemoryNetwork struct {
+	sync.Mutex
+
+	transports map[addrKey]*MemoryTransport //Every open transport by its address
+	nextPort   int                          //The next port to hand out to a transport that didn't ask for one
+}
+
+//NewMemoryNetwork returns a new, empty in-memory network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[addrKey]*MemoryTransport),
+		nextPort:   40000,
+	}
+}
+
+//Listen opens an in-memory transport on the specified address, or on the next free localhost port if it's nil
+func (network *MemoryNetwork) Listen(udpAddr *net.UDPAddr) (*MemoryTransport, error) {
+	network.Lock()
+	defer network.Unlock()
+
+	if udpAddr == nil {
+		for {
+			udpAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: network.nextPort}
+			network.nextPort++
+			if _, taken := network.transports[newAddrKey(udpAddr)]; !taken {
+				break
+			}
+		}
+	}
+
+	key := newAddrKey(udpAddr)
+	if _, taken := network.transports[key]; taken {
+		return nil, errors.New("address already in use: " + udpAddr.String())
+	}
+
+	transport := &MemoryTransport{
+		network: network,
+		addr:    udpAddr,
+		inbox:   make(chan memoryPacket, memoryInboxSize),
+		closed:  make(chan struct{}),
+	}
+	network.transports[key] = transport
+	return transport, nil
+}
+
+//deliver hands a copy of a packet to the transport on the destination address, dropping it if there's none or it's full
+func (network *MemoryNetwork) deliver(data []byte, src, dst *net.UDPAddr) {
+	network.Lock()
+	transport := network.transports[newAddrKey(dst)]
+	network.Unlock()
+	if transport == nil {
+		return //Nobody's listening, so it's lost like it would be over UDP
+	}
+
+	packet := memoryPacket{Data: make([]byte, len(data)), Src: src}
+	copy(packet.Data, data)
+	select {
+	case transport.inbox <- packet:
+	case <-transport.closed:
+	default: //The reader fell behind
+	}
+}
+
+//MemoryTransport is a transport on an in-memory network
+type MemoryTransport struct {
+	network *MemoryNetwork
+	addr    *net.UDPAddr
+	inbox   chan memoryPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+//memoryPacket is a packet waiting to be read from an in-memory transport
+type memoryPacket struct {
+	Data []byte
+	Src  *net.UDPAddr
+}
+
+//ReadFromUDP blocks until a packet arrives, or errors once the transport is closed
+func (transport *MemoryTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case packet := <-transport.inbox:
+		return copy(b, packet.Data), packet.Src, nil
+	case <-transport.closed:
+		return 0, nil, errTransportClosed
+	}
+}
+
+//WriteToUDP sends a packet to the transport on the specified address
+func (transport *MemoryTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-transport.closed:
+		return 0, errTransportClosed
+	default:
+	}
+
+	transport.network.deliver(b, transport.addr, addr)
+	return len(b), nil
+}
+
+//LocalAddr returns the address of the transport
+func (transport *MemoryTransport) LocalAddr() net.Addr {
+	return transport.addr
+}
+
+//Close closes the transport and frees up its address
+func (transport *MemoryTransport) Close() error {
+	transport.once.Do(func() {
+		close(transport.closed)
+
+		transport.network.Lock()
+		delete(transport.network.transports, newAddrKey(transport.addr))
+		transport.network.Unlock()
+	})
+	return nil
+}